@@ -0,0 +1,56 @@
+package khronos
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Accounting counts the items which entered and left a queue.
+// Every item pushed is either still pending or left the queue one way, so that
+//
+//	Pushed == Popped + Pending + Inflight + Expired + DeadLettered + Dropped
+//
+// holds at any time: an item can not be silently lost.
+// On a follower, the items removed by the leader count as popped.
+type Accounting struct {
+	Pushed       uint64 // items enqueued.
+	Popped       uint64 // items dequeued by consumers.
+	Pending      uint64 // items in the queue.
+	Inflight     uint64 // items delivered and not acknowledged yet.
+	Expired      uint64 // items removed because they expired.
+	DeadLettered uint64 // items moved to a dead letter route.
+	Dropped      uint64 // items discarded, by remove, a reset or a rename replacing a route.
+}
+
+// Check returns an error describing the difference if the identity of the counters does not hold.
+func (a Accounting) Check() error {
+	out := a.Popped + a.Pending + a.Inflight + a.Expired + a.DeadLettered + a.Dropped
+	if a.Pushed != out {
+		return fmt.Errorf("ERR accounting mismatch: pushed=%d but popped+pending+inflight+expired+dlq+dropped=%d", a.Pushed, out)
+	}
+	return nil
+}
+
+func (a Accounting) fields() []string {
+	return []string{
+		"pushed:" + strconv.FormatUint(a.Pushed, 10),
+		"popped:" + strconv.FormatUint(a.Popped, 10),
+		"pending:" + strconv.FormatUint(a.Pending, 10),
+		"inflight:" + strconv.FormatUint(a.Inflight, 10),
+		"expired:" + strconv.FormatUint(a.Expired, 10),
+		"dlq:" + strconv.FormatUint(a.DeadLettered, 10),
+		"dropped:" + strconv.FormatUint(a.Dropped, 10),
+	}
+}
+
+// Accounting returns a consistent snapshot of the counters of the queue.
+func (pq *PriorityQueueWithRouting) Accounting() Accounting {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	a := pq.accounting
+	for _, r := range pq.routes {
+		a.Pending += uint64(r.size())
+	}
+	return a
+}
@@ -0,0 +1,399 @@
+package khronos
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	errInvalidUserPass = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	errReservedUser    = errors.New("ERR the user name token is reserved")
+	errRoutePerm       = errors.New("NOPERM this user has no permissions to access one of the routes used as arguments")
+)
+
+type invalidRuleError struct {
+	rule string
+}
+
+func (e *invalidRuleError) Error() string {
+	return "ERR error in ACL SETUSER modifier '" + e.rule + "'"
+}
+
+type commandPermError struct {
+	command string
+}
+
+func (e *commandPermError) Error() string {
+	return "NOPERM this user has no permissions to run the '" + e.command + "' command"
+}
+
+// aclUser is a user of the access control list of a server, see AclCommand.
+type aclUser struct {
+	enabled   bool
+	nopass    bool
+	passwords map[[sha256.Size]byte]struct{}
+
+	allCommands bool            // whether every command is allowed, but the ones denied in commands.
+	commands    map[string]bool // commands allowed or denied one by one.
+
+	allRoutes bool     // whether every route is allowed.
+	patterns  []string // patterns of the routes allowed, see path.Match.
+}
+
+// acl is the access control list of a server.
+type acl struct {
+	mu    sync.RWMutex
+	users map[string]*aclUser
+}
+
+// enabled reports whether users are defined, in which case the clients must authenticate.
+func (a *acl) enabled() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.users) > 0
+}
+
+// SetUser creates or changes a user of the access control list of the server, applying the rules in order.
+// The rules are the ones of "acl setuser", for instance:
+//
+//	srv.SetUser("worker", "on", ">secret", "~jobs:*", "+pop", "+xack")
+//
+// Once a user is defined, the clients must authenticate, either with "auth <user> <password>"
+// or with Server.Password which grants every permission.
+func (srv *Server) SetUser(name string, rules ...string) error {
+	if strings.EqualFold(name, "token") {
+		return errReservedUser
+	}
+	a := &srv.acl
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u := &aclUser{}
+	if current, ok := a.users[name]; ok {
+		u = current.clone()
+	}
+	for _, rule := range rules {
+		if err := u.apply(rule); err != nil {
+			return err
+		}
+	}
+	if a.users == nil {
+		a.users = make(map[string]*aclUser)
+	}
+	a.users[name] = u
+	return nil
+}
+
+// clone returns a copy of the user which can be changed independently.
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = make(map[[sha256.Size]byte]struct{}, len(u.passwords))
+	for p := range u.passwords {
+		c.passwords[p] = struct{}{}
+	}
+	c.commands = make(map[string]bool, len(u.commands))
+	for name, allowed := range u.commands {
+		c.commands[name] = allowed
+	}
+	c.patterns = append([]string(nil), u.patterns...)
+	return &c
+}
+
+// apply changes the user with a rule of "acl setuser".
+func (u *aclUser) apply(rule string) error {
+	switch lower := strings.ToLower(rule); {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass = true
+		u.passwords = nil
+	case lower == "resetpass":
+		u.nopass = false
+		u.passwords = nil
+	case lower == "allroutes" || rule == "~*":
+		u.allRoutes = true
+		u.patterns = nil
+	case lower == "resetroutes":
+		u.allRoutes = false
+		u.patterns = nil
+	case lower == "allcommands" || lower == "+@all":
+		u.allCommands = true
+		u.commands = nil
+	case lower == "nocommands" || lower == "-@all":
+		u.allCommands = false
+		u.commands = nil
+	case lower == "reset":
+		*u = aclUser{}
+	case strings.HasPrefix(rule, ">"):
+		if u.passwords == nil {
+			u.passwords = make(map[[sha256.Size]byte]struct{})
+		}
+		u.passwords[sha256.Sum256([]byte(rule[1:]))] = struct{}{}
+		u.nopass = false
+	case strings.HasPrefix(rule, "<"):
+		delete(u.passwords, sha256.Sum256([]byte(rule[1:])))
+	case strings.HasPrefix(rule, "~"):
+		if _, err := path.Match(rule[1:], ""); err != nil {
+			return &invalidRuleError{rule}
+		}
+		if !u.allRoutes {
+			u.patterns = append(u.patterns, rule[1:])
+		}
+	case strings.HasPrefix(lower, "+@") || strings.HasPrefix(lower, "-@"):
+		flag, ok := commandFlagByName(lower[2:])
+		if !ok {
+			return &invalidRuleError{rule}
+		}
+		for name, info := range commandInfos {
+			if info.Flags&flag != 0 {
+				u.allow(name, lower[0] == '+')
+			}
+		}
+	case strings.HasPrefix(lower, "+") || strings.HasPrefix(lower, "-"):
+		if _, ok := commandLibraries[lower[1:]]; !ok {
+			return &invalidRuleError{rule}
+		}
+		u.allow(lower[1:], lower[0] == '+')
+	default:
+		return &invalidRuleError{rule}
+	}
+	return nil
+}
+
+func (u *aclUser) allow(name string, allowed bool) {
+	if u.commands == nil {
+		u.commands = make(map[string]bool)
+	}
+	u.commands[name] = allowed
+}
+
+func commandFlagByName(name string) (CommandFlags, bool) {
+	for _, fn := range commandFlagNames {
+		if fn.name == name {
+			return fn.flag, true
+		}
+	}
+	return 0, false
+}
+
+// authenticate reports whether password is a password of the enabled user.
+func (u *aclUser) authenticate(password string) bool {
+	if !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	sum := sha256.Sum256([]byte(password))
+	ok := 0
+	for p := range u.passwords {
+		ok |= subtle.ConstantTimeCompare(sum[:], p[:])
+	}
+	return ok == 1
+}
+
+// canRun reports whether the user may run the command.
+func (u *aclUser) canRun(name string) bool {
+	if allowed, ok := u.commands[name]; ok {
+		return allowed
+	}
+	return u.allCommands
+}
+
+// canAccess reports whether the user may access the route.
+func (u *aclUser) canAccess(route string) bool {
+	if u.allRoutes {
+		return true
+	}
+	for _, pattern := range u.patterns {
+		if ok, _ := path.Match(pattern, route); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// rules describes the user as the rules of "acl setuser" creating it, passwords being hashed.
+func (u *aclUser) rules() []string {
+	rules := []string{"off"}
+	if u.enabled {
+		rules[0] = "on"
+	}
+	if u.nopass {
+		rules = append(rules, "nopass")
+	}
+	var passwords []string
+	for p := range u.passwords {
+		passwords = append(passwords, "#"+hex.EncodeToString(p[:]))
+	}
+	sort.Strings(passwords)
+	rules = append(rules, passwords...)
+	if u.allRoutes {
+		rules = append(rules, "~*")
+	}
+	for _, pattern := range u.patterns {
+		rules = append(rules, "~"+pattern)
+	}
+	if u.allCommands {
+		rules = append(rules, "+@all")
+	} else {
+		rules = append(rules, "-@all")
+	}
+	for _, name := range sortedKeys(u.commands) {
+		if u.commands[name] {
+			rules = append(rules, "+"+name)
+		} else {
+			rules = append(rules, "-"+name)
+		}
+	}
+	return rules
+}
+
+// user returns the named user, or nil.
+func (a *acl) user(name string) *aclUser {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.users[name]
+}
+
+// check returns an error unless the user may run the command with args on their routes.
+func (a *acl) check(user, name string, args []string) error {
+	u := a.user(user)
+	if u == nil || !u.enabled {
+		return ErrNoAuth
+	}
+	if !u.canRun(name) {
+		return &commandPermError{name}
+	}
+	for _, route := range commandRoutes(name, args) {
+		if !u.canAccess(route) {
+			return errRoutePerm
+		}
+	}
+	return nil
+}
+
+// commandRoutes returns the routes among the arguments of a command, as described by its CommandInfo.
+func commandRoutes(name string, args []string) []string {
+	if name == "pop" {
+		routes, _ := parsePopArgs(args)
+		return routes
+	}
+	info := commandInfos[name]
+	if info.FirstKey <= 0 {
+		return nil
+	}
+	last := info.LastKey
+	if last < 0 {
+		last += len(args) + 1
+	}
+	step := info.Step
+	if step <= 0 {
+		step = 1
+	}
+	var routes []string
+	for i := info.FirstKey; i <= last && i <= len(args); i += step {
+		routes = append(routes, args[i-1])
+	}
+	return routes
+}
+
+// AclCommand is the command "acl".
+// "acl setuser <user> <rule>..." creates or changes a user, applying the rules in order:
+//
+//	on, off             enable or disable the user
+//	><password>         add a password, <<password> removes it
+//	nopass, resetpass   accept any password, or none until one is added
+//	~<pattern>          allow the routes matching the pattern, as path.Match, ~* or allroutes for all of them
+//	resetroutes         allow no route
+//	+<command>          allow a command, -<command> denies it
+//	+@<flag>            allow the commands with a flag of CommandInfo: write, readonly, blocking or admin,
+//	                    +@all or allcommands for all of them, -@<flag> denies them
+//	reset               remove every password and permission, and disable the user
+//
+// "acl deluser <user>..." deletes users and replies with the number of users deleted,
+// "acl users" replies with the names of the users, "acl list" with the rules describing each user,
+// and "acl whoami" with the user of the connection, "default" for Server.Password.
+// Once a user is defined, the clients must authenticate with "auth <user> <password>".
+type AclCommand struct {
+	ArgsCommand
+}
+
+func (c *AclCommand) Name() string {
+	return "acl"
+}
+
+func (c *AclCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		return errNoServer
+	}
+	args := c.Args()
+	a := &srv.acl
+	switch sub := strings.ToLower(args[0]); {
+	case sub == "setuser" && len(args) >= 2:
+		if err := srv.SetUser(args[1], args[2:]...); err != nil {
+			return err
+		}
+		return writer.WriteStatus(OK)
+	case sub == "deluser" && len(args) >= 2:
+		a.mu.Lock()
+		n := 0
+		for _, name := range args[1:] {
+			if _, ok := a.users[name]; ok {
+				delete(a.users, name)
+				n++
+			}
+		}
+		a.mu.Unlock()
+		return writer.WriteInt64(int64(n))
+	case sub == "users" && len(args) == 1:
+		a.mu.RLock()
+		names := sortedKeys(a.users)
+		a.mu.RUnlock()
+		return writer.WriteArray(names)
+	case sub == "list" && len(args) == 1:
+		a.mu.RLock()
+		list := make([]string, 0, len(a.users))
+		for _, name := range sortedKeys(a.users) {
+			list = append(list, "user "+name+" "+strings.Join(a.users[name].rules(), " "))
+		}
+		a.mu.RUnlock()
+		return writer.WriteArray(list)
+	case sub == "whoami" && len(args) == 1:
+		conn := connFromContext(ctx)
+		if conn == nil {
+			return errNoServer
+		}
+		conn.mu.Lock()
+		user := conn.user
+		conn.mu.Unlock()
+		if user == "" {
+			user = "default"
+		}
+		return writer.WriteString(user)
+	default:
+		return &wrongCommandError{command: c.Name() + "|" + sub, args: args[1:]}
+	}
+}
+
+func NewAclCommand(args []string) (Command, error) {
+	if len(args) == 0 {
+		return nil, &WrongArityError{"acl"}
+	}
+	cmd := &AclCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["acl"] = NewAclCommand
+}
@@ -0,0 +1,392 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// aofBacklog is the number of operations waiting to be appended before the file is rewritten instead.
+	aofBacklog = 1 << 16
+	// aofSyncInterval is how often the appended operations are synced to disk.
+	aofSyncInterval = time.Second
+	// aofAutoRewriteMin is the size under which the file is not rewritten automatically.
+	aofAutoRewriteMin = 64 << 20
+)
+
+var (
+	errAOFDisabled       = errors.New("ERR the append only file is disabled, set Server.AppendOnlyFile or Server.Storage")
+	errRewriteInProgress = errors.New("BUSY background append only file rewriting already in progress")
+)
+
+// appendOnly is the state of the persistence of a server, see Server.Storage and Server.AppendOnlyFile.
+type appendOnly struct {
+	once sync.Once
+	err  error // error loading the storage at startup.
+
+	mu        sync.Mutex
+	enabled   bool
+	storage   Storage
+	rewrite   chan struct{} // requests a rewrite, see "bgrewriteaof".
+	stop      chan aofStop  // stops the writer.
+	rewriting bool          // whether a rewrite is in progress.
+	baseSize  int64         // size of the storage after the last rewrite.
+	lastErr   error         // error of the last rewrite or write, nil if it succeeded.
+	failedAt  time.Time     // time of the last failure to write the storage.
+	rewrites  int           // number of rewrites done.
+}
+
+// persisted reports whether the operations of the queue are persisted, see Server.Storage.
+func (srv *Server) persisted() bool {
+	return srv.Storage != nil || srv.AppendOnlyFile != ""
+}
+
+// startAppendOnly rebuilds the queue from Server.Storage, or Server.AppendOnlyFile, and starts logging
+// its operations, once.
+func (srv *Server) startAppendOnly() error {
+	if !srv.persisted() {
+		return nil
+	}
+	a := &srv.aof
+	a.once.Do(func() {
+		storage := srv.Storage
+		if storage == nil {
+			storage = NewFileStorage(srv.AppendOnlyFile)
+		}
+		n, err := srv.Queue.load(storage)
+		switch {
+		case errors.Is(err, ErrAppendOnlyTruncated) || errors.Is(err, ErrAppendOnlyCorrupt):
+			// the damaged operations are dropped by the rewrite below.
+			srv.logger().Warn("khronos: append only file recovered to its last valid operation", "path", srv.AppendOnlyFile,
+				"error", err, "operations", n)
+		case err != nil:
+			a.err = err
+			return
+		default:
+			srv.logger().Info("khronos: append only file loaded", "path", srv.AppendOnlyFile, "operations", n)
+		}
+		w := &aofWriter{srv: srv, storage: storage}
+		// the storage is compacted at startup, and the writer starts from the snapshot.
+		if a.err = w.rewrite(); a.err != nil {
+			return
+		}
+		rewrite, stop := make(chan struct{}, 1), make(chan aofStop)
+		a.mu.Lock()
+		a.enabled, a.storage, a.rewrite, a.stop = true, storage, rewrite, stop
+		a.mu.Unlock()
+		go w.run(rewrite, stop)
+	})
+	return a.err
+}
+
+// aofStop stops the writer of the append-only file, which replies to done with the number of items persisted.
+type aofStop struct {
+	save bool // rewrite the file before closing it.
+	done chan int
+}
+
+// closeAppendOnly flushes and closes the append-only file, rewriting it first if save,
+// and returns the number of items of the queue persisted by the file, 0 if it could not be written.
+func (srv *Server) closeAppendOnly(save bool) int {
+	a := &srv.aof
+	a.mu.Lock()
+	stop := a.stop
+	a.stop = nil
+	a.enabled = false
+	a.mu.Unlock()
+	if stop == nil {
+		return 0
+	}
+	done := make(chan int)
+	stop <- aofStop{save: save, done: done}
+	return <-done
+}
+
+// load applies the operations of the storage to the queue, and returns the number of operations applied.
+// The error of the storage is returned after the valid operations of damaged storage were applied.
+func (pq *PriorityQueueWithRouting) load(storage Storage) (int, error) {
+	var (
+		n      int
+		failed error
+	)
+	err := storage.Load(func(args []string) {
+		if failed != nil {
+			return
+		}
+		var op queueOp
+		if len(args) > 0 {
+			op, failed = parseQueueOp(args[0], args[1:])
+		} else {
+			failed = errSyntax
+		}
+		if failed != nil {
+			failed = fmt.Errorf("khronos: operation %d: %w", n+1, failed)
+			return
+		}
+		pq.apply(op)
+		n++
+	})
+	if failed != nil {
+		return n, failed
+	}
+	return n, err
+}
+
+// aofWriter appends the operations of the queue to the storage.
+// It is only used by the goroutine running it.
+type aofWriter struct {
+	srv     *Server
+	storage Storage
+	feed    *opFeed
+	// ops receives the operations of feed, it is nil once the feed fell behind
+	// and until the storage is rewritten.
+	ops    <-chan queueOp
+	batch  [][]string // operations received and not appended yet.
+	dirty  bool       // whether operations were appended since the last sync.
+	broken bool       // whether a write failed, the storage is rewritten to recover.
+}
+
+// run appends the operations until stop receives, rewriting the storage when rewrite receives.
+func (w *aofWriter) run(rewrite <-chan struct{}, stop <-chan aofStop) {
+	a := &w.srv.aof
+	ticker := time.NewTicker(aofSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case op, ok := <-w.ops:
+			if !ok {
+				// the writer fell behind, the operations missed are in the next snapshot.
+				w.ops = nil
+				w.logRewrite(w.rewrite())
+				continue
+			}
+			w.append(op)
+			if len(w.ops) == 0 {
+				w.flush(false)
+				size := w.storage.Size()
+				a.mu.Lock()
+				auto := size >= aofAutoRewriteMin && size >= 2*a.baseSize
+				a.mu.Unlock()
+				if auto {
+					w.logRewrite(w.rewrite())
+				}
+			}
+		case <-rewrite:
+			w.logRewrite(w.rewrite())
+		case <-ticker.C:
+			if w.ops == nil || w.broken {
+				w.logRewrite(w.rewrite())
+			}
+			w.flush(true)
+		case req := <-stop:
+		drain:
+			for w.ops != nil {
+				select {
+				case op, ok := <-w.ops:
+					if !ok {
+						w.ops = nil
+						break drain
+					}
+					w.append(op)
+				default:
+					break drain
+				}
+			}
+			w.flush(true)
+			if req.save {
+				w.logRewrite(w.rewrite())
+			}
+			n := 0
+			if w.ops != nil && !w.broken {
+				// the file holds every operation, so the items left in the queue are persisted.
+				acc := w.srv.Queue.Accounting()
+				n = int(acc.Pending + acc.Inflight)
+			}
+			// the storage is snapshotted until the uploads are done.
+			w.srv.uploads.wait()
+			w.srv.Queue.unsubscribe(w.feed)
+			if err := w.storage.Close(); err != nil {
+				a.wrote(err)
+			}
+			req.done <- n
+			return
+		}
+	}
+}
+
+// append adds op to the operations to append.
+func (w *aofWriter) append(op queueOp) {
+	w.batch = append(w.batch, op.args())
+}
+
+// flush appends the operations received to the storage, and syncs it if fsync.
+func (w *aofWriter) flush(fsync bool) {
+	if w.broken {
+		return
+	}
+	var err error
+	if len(w.batch) > 0 {
+		err = w.storage.Append(w.batch)
+		w.batch, w.dirty = nil, true
+	}
+	if err == nil && fsync && w.dirty {
+		start := time.Now()
+		err = w.storage.Sync()
+		w.srv.observeLatency(latencyAOFFsync, time.Since(start))
+		w.dirty = false
+	}
+	w.broken = err != nil
+	w.srv.aof.wrote(err)
+}
+
+// rewrite replaces the operations of the storage with a snapshot of the queue, the smallest list
+// of operations rebuilding its state, and continues appending the operations following the snapshot.
+func (w *aofWriter) rewrite() error {
+	a := &w.srv.aof
+	a.mu.Lock()
+	a.rewriting = true
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.rewriting = false
+		a.mu.Unlock()
+	}()
+
+	snapshot, feed, err := w.srv.Queue.subscribe(aofBacklog)
+	if err != nil {
+		// the file keeps the operations of the items the snapshot misses.
+		w.srv.Queue.unsubscribe(feed)
+		return err
+	}
+	ops := make([][]string, len(snapshot))
+	for i, op := range snapshot {
+		ops[i] = op.args()
+	}
+	if err := w.storage.Compact(ops); err != nil {
+		w.srv.Queue.unsubscribe(feed)
+		return err
+	}
+
+	if w.feed != nil {
+		w.srv.Queue.unsubscribe(w.feed)
+	}
+	w.feed, w.ops, w.batch = feed, feed.ops, nil
+	w.dirty, w.broken = false, false
+	size := w.storage.Size()
+	a.mu.Lock()
+	a.baseSize = size
+	a.rewrites++
+	a.mu.Unlock()
+	w.srv.uploadSnapshot(w.storage)
+	return nil
+}
+
+// logRewrite records the outcome of a rewrite.
+func (w *aofWriter) logRewrite(err error) {
+	a := &w.srv.aof
+	if err != nil {
+		a.wrote(err)
+		w.srv.logger().Error("khronos: append only file rewrite failed", "path", w.srv.AppendOnlyFile, "error", err)
+		return
+	}
+	a.wrote(nil)
+	w.srv.logger().Info("khronos: append only file rewritten", "path", w.srv.AppendOnlyFile, "size", w.storage.Size())
+}
+
+// wrote records the outcome of a write to the storage.
+func (a *appendOnly) wrote(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastErr = err
+	if err != nil {
+		a.failedAt = time.Now()
+	}
+}
+
+// failedSince reports whether writing the file failed within the last d.
+func (a *appendOnly) failedSince(d time.Duration) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return !a.failedAt.IsZero() && time.Since(a.failedAt) < d
+}
+
+// fields returns the "info persistence" lines.
+func (a *appendOnly) fields() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status := "ok"
+	if a.lastErr != nil {
+		status = "err"
+	}
+	var size int64
+	if a.storage != nil {
+		size = a.storage.Size()
+	}
+	return []string{
+		"aof_enabled:" + strconv.Itoa(btoi(a.enabled)),
+		"aof_rewrite_in_progress:" + strconv.Itoa(btoi(a.rewriting)),
+		"aof_rewrites:" + strconv.Itoa(a.rewrites),
+		"aof_last_write_status:" + status,
+		"aof_current_size:" + strconv.FormatInt(size, 10),
+		"aof_base_size:" + strconv.FormatInt(a.baseSize, 10),
+	}
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// BgRewriteAOFCommand is the command "bgrewriteaof".
+// It starts rewriting the append-only file in the background as the smallest list of pushes
+// rebuilding the current state of the queue, see Server.AppendOnlyFile, and replies OK.
+// The progress is reported by "info persistence".
+type BgRewriteAOFCommand struct {
+	ArgsCommand
+}
+
+func (c *BgRewriteAOFCommand) Name() string {
+	return "bgrewriteaof"
+}
+
+func (c *BgRewriteAOFCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		return errNoServer
+	}
+	a := &srv.aof
+	a.mu.Lock()
+	enabled, rewriting, rewrite := a.enabled, a.rewriting, a.rewrite
+	a.mu.Unlock()
+	if !enabled {
+		return errAOFDisabled
+	}
+	if rewriting {
+		return errRewriteInProgress
+	}
+	select {
+	case rewrite <- struct{}{}:
+		return writer.WriteStatus(OK)
+	default:
+		return errRewriteInProgress
+	}
+}
+
+func NewBgRewriteAOFCommand(args []string) (Command, error) {
+	if len(args) != 0 {
+		return nil, &WrongArityError{"bgrewriteaof"}
+	}
+	cmd := &BgRewriteAOFCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["bgrewriteaof"] = NewBgRewriteAOFCommand
+}
@@ -0,0 +1,191 @@
+package khronos
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// aofMagic starts the append-only files, it changes with their format.
+// It is followed by the records, each one an operation encoded as a command
+// framed by its length and its CRC-32 checksum as two big-endian uint32.
+// The files without it are read as the commands alone, as written by the first version.
+const aofMagic = "khronos-aof-1\n"
+
+// aofRecordHeader is the size of the frame of a record.
+const aofRecordHeader = 8
+
+var (
+	// ErrAppendOnlyTruncated is reported by CheckAppendOnlyFile for a file ending in the middle of a record,
+	// as left by a crash during a write.
+	ErrAppendOnlyTruncated = errors.New("khronos: append only file truncated")
+	// ErrAppendOnlyCorrupt is reported by CheckAppendOnlyFile for a record whose checksum is wrong,
+	// or which is not a valid operation.
+	ErrAppendOnlyCorrupt = errors.New("khronos: append only file corrupt")
+)
+
+// AppendOnlyCheck describes an append-only file, see CheckAppendOnlyFile.
+type AppendOnlyCheck struct {
+	Version    int   // Version of the format, 0 for a file without checksums.
+	Operations int   // Number of valid operations, from the start of the file.
+	Size       int64 // Size of the file.
+	ValidSize  int64 // Size of the start of the file holding the valid operations.
+
+	// Err is ErrAppendOnlyTruncated or ErrAppendOnlyCorrupt, wrapped with the position of the first
+	// invalid record, if the file is damaged, nil otherwise. The loading of a damaged file recovers
+	// the valid operations and discards the rest of the file.
+	Err error
+}
+
+// CheckAppendOnlyFile reads the append-only file at path and verifies the checksums of its records,
+// without loading it, see Server.AppendOnlyFile. The error is about reading the file, the damages
+// are reported by AppendOnlyCheck.Err.
+func CheckAppendOnlyFile(path string) (AppendOnlyCheck, error) {
+	return openAppendOnly(path, func(queueOp) {})
+}
+
+// ReadAppendOnlyFile is like CheckAppendOnlyFile, and calls fn with each valid operation of the file,
+// encoded as the arguments of a command, such as ["push", route, value, priority, id].
+func ReadAppendOnlyFile(path string, fn func(args []string)) (AppendOnlyCheck, error) {
+	return openAppendOnly(path, func(op queueOp) { fn(op.args()) })
+}
+
+// LoadAppendOnlyFile rebuilds the queue from the append-only file at path, up to its first damaged record,
+// as a server does at startup, see CheckAppendOnlyFile. The queue is expected to be empty.
+// It lets a file be inspected with the methods of the queue, without starting a server.
+func (pq *PriorityQueueWithRouting) LoadAppendOnlyFile(path string) (AppendOnlyCheck, error) {
+	return openAppendOnly(path, pq.apply)
+}
+
+// RepairAppendOnlyFile truncates the damaged append-only file at path after its last valid record,
+// and returns its check before the repair. The file is left as it is unless it is damaged.
+// A server loading the file discards the damaged records all the same, the repair lets the file be
+// used as a backup or by another tool. It cannot repair a file without checksums.
+func RepairAppendOnlyFile(path string) (AppendOnlyCheck, error) {
+	check, err := CheckAppendOnlyFile(path)
+	if err != nil || check.Err == nil {
+		return check, err
+	}
+	return check, os.Truncate(path, check.ValidSize)
+}
+
+// openAppendOnly calls apply with the operations of the append-only file at path, see readAppendOnly.
+func openAppendOnly(path string, apply func(queueOp)) (AppendOnlyCheck, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return AppendOnlyCheck{}, err
+	}
+	defer f.Close()
+
+	check, err := readAppendOnly(f, apply)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = f.Stat(); err == nil {
+			check.Size = info.Size()
+		}
+		if check.Version == 0 {
+			check.ValidSize = check.Size
+		}
+	}
+	return check, err
+}
+
+// readAppendOnly calls apply with the operations of an append-only file, up to the first damaged record.
+// The error is about reading r, or parsing a file without checksums.
+func readAppendOnly(r io.Reader, apply func(queueOp)) (AppendOnlyCheck, error) {
+	in := bufio.NewReader(r)
+	magic, err := in.Peek(len(aofMagic))
+	if err != nil && err != io.EOF {
+		return AppendOnlyCheck{}, err
+	}
+	if !bytes.Equal(magic, []byte(aofMagic)) {
+		return readLegacyAppendOnly(in, apply)
+	}
+	in.Discard(len(aofMagic))
+	check := AppendOnlyCheck{Version: 1, ValidSize: int64(len(aofMagic))}
+	damaged := func(err error) (AppendOnlyCheck, error) {
+		check.Err = fmt.Errorf("%w: operation %d at offset %d", err, check.Operations+1, check.ValidSize)
+		return check, nil
+	}
+	var header [aofRecordHeader]byte
+	for {
+		if _, err = io.ReadFull(in, header[:]); err == io.EOF {
+			return check, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return damaged(ErrAppendOnlyTruncated)
+		}
+		if err != nil {
+			return check, err
+		}
+		size, sum := binary.BigEndian.Uint32(header[:4]), binary.BigEndian.Uint32(header[4:])
+		if size > DefaultMaxBulkLen+DefaultMaxArrayLen {
+			return damaged(ErrAppendOnlyCorrupt)
+		}
+		payload := make([]byte, size)
+		if _, err = io.ReadFull(in, payload); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return damaged(ErrAppendOnlyTruncated)
+		}
+		if err != nil {
+			return check, err
+		}
+		if crc32.ChecksumIEEE(payload) != sum {
+			return damaged(ErrAppendOnlyCorrupt)
+		}
+		name, args, err := NewRespProtocolParser(bytes.NewReader(payload)).Parse()
+		if err != nil {
+			return damaged(ErrAppendOnlyCorrupt)
+		}
+		op, err := parseQueueOp(name, args)
+		if err != nil {
+			return damaged(ErrAppendOnlyCorrupt)
+		}
+		apply(op)
+		check.Operations++
+		check.ValidSize += aofRecordHeader + int64(size)
+	}
+}
+
+// readLegacyAppendOnly calls apply with the operations of an append-only file without checksums.
+// It fails on the first invalid operation, its damages cannot be told apart from a bug.
+func readLegacyAppendOnly(r io.Reader, apply func(queueOp)) (AppendOnlyCheck, error) {
+	var check AppendOnlyCheck
+	parser := NewRespProtocolParser(r)
+	for {
+		name, args, err := parser.Parse()
+		if err == io.EOF {
+			return check, nil
+		}
+		if err != nil {
+			return check, fmt.Errorf("operation %d: %w", check.Operations+1, err)
+		}
+		op, err := parseQueueOp(name, args)
+		if err != nil {
+			return check, fmt.Errorf("operation %d: %w", check.Operations+1, err)
+		}
+		apply(op)
+		check.Operations++
+	}
+}
+
+// writeRecord writes the operation op, encoded as a command, as a record of the append-only file,
+// and returns the number of bytes written.
+func writeRecord(w io.Writer, op []string) (int, error) {
+	builder := getprotocolBuilder()
+	defer putProtocolBuilder(builder)
+	builder.WriteArray(op)
+	var header [aofRecordHeader]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(builder.buf)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(builder.buf))
+	n, err := w.Write(header[:])
+	if err != nil {
+		return n, err
+	}
+	m, err := w.Write(builder.buf)
+	return n + m, err
+}
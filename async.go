@@ -0,0 +1,198 @@
+package khronos
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// asyncBacklog is the number of async commands waiting for a worker before new ones are refused.
+	asyncBacklog = 1024
+	// asyncResultTTL is how long the result of an async command is kept when nobody fetches it.
+	asyncResultTTL = 10 * time.Minute
+)
+
+var (
+	errAsyncBusy   = errors.New("BUSY too many async commands in progress")
+	errNoSuchTask  = errors.New("ERR no such task")
+	errTaskPending = errors.New("PENDING task is still running")
+)
+
+// asyncStartedError is the reply of an async command, carrying the token to pass to "taskstatus".
+type asyncStartedError struct {
+	token string
+}
+
+func (e *asyncStartedError) Error() string {
+	return "ASYNC " + e.token
+}
+
+// asyncTask is an async command, running or finished.
+type asyncTask struct {
+	cmd      Command
+	ctx      context.Context
+	done     bool
+	finished time.Time
+	reply    []byte // raw reply written by the command.
+	err      error
+}
+
+// asyncTasks runs the async commands of a server on a pool of workers.
+type asyncTasks struct {
+	once  sync.Once
+	queue chan *asyncTask
+	mu    sync.Mutex
+	tasks map[string]*asyncTask
+}
+
+// RegisterAsyncCommand registers a command which runs in the background, for long-running commands
+// which would otherwise hold the connection, such as exports of a whole route.
+// The command immediately replies "-ASYNC <token>", and its reply is later fetched with "taskstatus <token>".
+// The command keeps running if the connection which sent it is closed, until the server shuts down.
+func RegisterAsyncCommand(name string, constructor CommandConstructor) {
+	RegisterCommand(name, func(args []string) (Command, error) {
+		cmd, err := constructor(args)
+		if err != nil {
+			return nil, err
+		}
+		return &asyncCommand{Command: cmd}, nil
+	})
+}
+
+// asyncCommand starts the wrapped command on the server's async workers.
+type asyncCommand struct {
+	Command
+}
+
+func (c *asyncCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		// without a server there is no one to poll the task, run it in place.
+		return c.Command.Execute(ctx, writer)
+	}
+	token, err := srv.startTask(context.WithoutCancel(ctx), c.Command)
+	if err != nil {
+		return err
+	}
+	return writer.WriteError(&asyncStartedError{token})
+}
+
+// startTask queues cmd for the async workers and returns its token.
+func (srv *Server) startTask(ctx context.Context, cmd Command) (string, error) {
+	t := &srv.tasks
+	t.once.Do(func() {
+		workers := srv.AsyncWorkers
+		if workers <= 0 {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		t.queue = make(chan *asyncTask, asyncBacklog)
+		t.tasks = make(map[string]*asyncTask)
+		for i := 0; i < workers; i++ {
+			go srv.asyncWorker()
+		}
+	})
+
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b[:])
+	task := &asyncTask{cmd: cmd, ctx: ctx}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := srv.clock().Now()
+	for token, task := range t.tasks {
+		if task.done && now.Sub(task.finished) > asyncResultTTL {
+			delete(t.tasks, token)
+		}
+	}
+	select {
+	case t.queue <- task:
+	default:
+		return "", errAsyncBusy
+	}
+	t.tasks[token] = task
+	return token, nil
+}
+
+func (srv *Server) asyncWorker() {
+	t := &srv.tasks
+	for task := range t.queue {
+		ctx, cancel := context.WithCancel(task.ctx)
+		go func() {
+			select {
+			case <-srv.getDoneChan():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		var buf bytes.Buffer
+		err := task.cmd.Execute(ctx, &responseWriter{&buf})
+		cancel()
+		if err != nil {
+			srv.logger().Warn("khronos: async command error", "cmd", task.cmd.Name(), "error", err)
+		}
+
+		t.mu.Lock()
+		task.done, task.finished = true, srv.clock().Now()
+		task.reply, task.err = buf.Bytes(), err
+		t.mu.Unlock()
+	}
+}
+
+// TaskStatusCommand is the command "taskstatus".
+// "taskstatus <token>" replies "-PENDING" while the async command with this token is running,
+// and then its reply, once: the result is forgotten after it is fetched.
+type TaskStatusCommand struct {
+	ArgsCommand
+}
+
+func (c *TaskStatusCommand) Name() string {
+	return "taskstatus"
+}
+
+func (c *TaskStatusCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		return errNoServer
+	}
+	token := c.Args()[0]
+	t := &srv.tasks
+	t.mu.Lock()
+	task, ok := t.tasks[token]
+	if ok && task.done {
+		delete(t.tasks, token)
+	}
+	t.mu.Unlock()
+	switch {
+	case !ok:
+		return errNoSuchTask
+	case !task.done:
+		// polling is expected, do not report it as a command error.
+		return writer.WriteError(errTaskPending)
+	case task.err != nil:
+		return task.err
+	}
+	_, err := writer.Write(task.reply)
+	return err
+}
+
+func NewTaskStatusCommand(args []string) (Command, error) {
+	if len(args) != 1 {
+		return nil, &WrongArityError{"taskstatus"}
+	}
+	cmd := &TaskStatusCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["taskstatus"] = NewTaskStatusCommand
+}
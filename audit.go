@@ -0,0 +1,61 @@
+package khronos
+
+import (
+	"strings"
+	"time"
+)
+
+// redacted replaces the arguments hidden from the audit events.
+const redacted = "(redacted)"
+
+// AuditEvent describes a command sent by a client, see Server.Audit.
+type AuditEvent struct {
+	Time       time.Time // when the command started.
+	ClientID   int64
+	Addr       string
+	ClientName string   // the name set with "client setname".
+	User       string   // the user of the access control list the client authenticated as, if any.
+	Command    string   // the name of the command, in lower case.
+	Args       []string // the arguments of the command, without the credentials.
+	Err        error    // the error replied to the client, nil if the command succeeded.
+	Duration   time.Duration
+}
+
+// audit sends the event of cmd to Server.Audit, if set.
+func (srv *Server) audit(c *connContext, cmd Command, start time.Time, err error) {
+	if srv.Audit == nil {
+		return
+	}
+	c.mu.Lock()
+	name, user := c.name, c.user
+	c.mu.Unlock()
+	srv.Audit(AuditEvent{
+		Time:       start,
+		ClientID:   c.id,
+		Addr:       c.conn.RemoteAddr().String(),
+		ClientName: name,
+		User:       user,
+		Command:    cmd.Name(),
+		Args:       auditArgs(cmd.Name(), cmd.Args(), srv.AuditRedactArgs),
+		Err:        err,
+		Duration:   srv.clock().Now().Sub(start),
+	})
+}
+
+// auditArgs returns a copy of the arguments of a command, with the passwords and the tokens redacted,
+// or all of them if redactAll.
+func auditArgs(name string, args []string, redactAll bool) []string {
+	audited := make([]string, len(args))
+	for i, arg := range args {
+		switch {
+		case redactAll, name == "auth":
+			arg = redacted
+		case name == "acl" && strings.HasPrefix(arg, ">"):
+			arg = ">" + redacted
+		case i > 0 && i == len(args)-1 && strings.EqualFold(args[i-1], "token"):
+			arg = redacted
+		}
+		audited[i] = arg
+	}
+	return audited
+}
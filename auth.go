@@ -0,0 +1,241 @@
+package khronos
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoAuth is returned when a client runs a command before authenticating, or as a disabled user.
+	ErrNoAuth          = errors.New("NOAUTH Authentication required.")
+	errInvalidPassword = errors.New("WRONGPASS invalid password")
+	errInvalidToken    = errors.New("NOAUTH invalid or expired token")
+	errTokenScope      = errors.New("NOPERM this token does not grant access to this command or route")
+)
+
+// tokenCommands are the commands a route-scoped token grants access to, on its route only.
+var tokenCommands = map[string]bool{
+	"push":    true,
+	"pop":     true,
+	"popn":    true,
+	"popdue":  true,
+	"length":  true,
+	"xack":    true,
+	"claim":   true,
+	"retry":   true,
+	"confirm": true,
+	"touch":   true,
+}
+
+// NewRouteToken returns a token granting access to the push, pop and length commands
+// on route until expiry, without holding the server password.
+// The token is signed with secret, which must be the Server.TokenSecret of the servers accepting it.
+func NewRouteToken(secret []byte, route string, expiry time.Time) string {
+	exp := strconv.FormatInt(expiry.Unix(), 10)
+	encodedRoute := base64.RawURLEncoding.EncodeToString([]byte(route))
+	return encodedRoute + "." + exp + "." + signRouteToken(secret, route, exp)
+}
+
+func signRouteToken(secret []byte, route, exp string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(route + "\n" + exp))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyRouteToken checks the signature and the expiry of token and returns the route it grants access to,
+// and its expiry.
+func verifyRouteToken(secret []byte, token string, now time.Time) (string, time.Time, error) {
+	if len(secret) == 0 {
+		return "", time.Time{}, errInvalidToken
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", time.Time{}, errInvalidToken
+	}
+	route, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", time.Time{}, errInvalidToken
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.Unix() >= exp {
+		return "", time.Time{}, errInvalidToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(signRouteToken(secret, string(route), parts[1]))) {
+		return "", time.Time{}, errInvalidToken
+	}
+	return string(route), time.Unix(exp, 0), nil
+}
+
+// authRequired reports whether the clients must authenticate before running commands.
+func (srv *Server) authRequired() bool {
+	return srv.Password != "" || len(srv.TokenSecret) > 0 || srv.acl.enabled()
+}
+
+// splitToken splits the trailing "token <t>" arguments from args.
+// It is only applied to the tokenCommands of the servers with a Server.TokenSecret, see CommandParser,
+// so that "token" remains a valid route or value elsewhere.
+func splitToken(args []string) ([]string, string, bool) {
+	if n := len(args); n >= 2 && strings.EqualFold(args[n-2], "token") {
+		return args[:n-2], args[n-1], true
+	}
+	return args, "", false
+}
+
+// authorize checks that the connection is allowed to execute cmd.
+func (c *connContext) authorize(cmd Command) error {
+	if !c.srv.authRequired() {
+		return nil
+	}
+	name := cmd.Name()
+	if name == "auth" || name == "quit" {
+		return nil
+	}
+	c.mu.Lock()
+	authenticated, scope, expiry, user := c.authenticated, c.tokenRoute, c.tokenExpiry, c.user
+	c.mu.Unlock()
+	if authenticated {
+		return nil
+	}
+	if user != "" {
+		return c.srv.acl.check(user, name, cmd.Args())
+	}
+	args := cmd.Args()
+	now := c.srv.clock().Now()
+	if token, ok := c.parser.token(); ok {
+		route, _, err := verifyRouteToken(c.srv.TokenSecret, token, now)
+		if err != nil {
+			return err
+		}
+		scope = route
+	} else if scope != "" && !now.Before(expiry) {
+		// the token of "auth token" is only valid until its expiry.
+		return errInvalidToken
+	}
+	if scope == "" {
+		return ErrNoAuth
+	}
+	if !tokenCommands[name] || len(args) == 0 || args[0] != scope {
+		return errTokenScope
+	}
+	if name == "pop" {
+		// pop may wait on several routes, all of them must be in the scope.
+		routes, _ := parsePopArgs(args)
+		for _, route := range routes {
+			if route != scope {
+				return errTokenScope
+			}
+		}
+	}
+	return nil
+}
+
+// AuthCommand is the command "auth".
+// "auth <password>" authenticates the connection with Server.Password,
+// "auth <user> <password>" authenticates the connection as a user of the access control list, see AclCommand,
+// "auth token <token>" restricts the connection to the route of a token created by NewRouteToken, until it expires.
+type AuthCommand struct {
+	ArgsCommand
+}
+
+func (c *AuthCommand) Name() string {
+	return "auth"
+}
+
+func (c *AuthCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	srv := ServerFromContext(ctx)
+	conn := connFromContext(ctx)
+	if srv == nil || conn == nil {
+		return errNoServer
+	}
+	if len(args) == 2 && strings.EqualFold(args[0], "token") {
+		route, expiry, err := verifyRouteToken(srv.TokenSecret, args[1], srv.clock().Now())
+		if err != nil {
+			return err
+		}
+		conn.mu.Lock()
+		conn.authenticated, conn.tokenRoute, conn.tokenExpiry, conn.user = false, route, expiry, ""
+		conn.mu.Unlock()
+		return writer.WriteStatus(OK)
+	}
+	if len(args) == 2 {
+		u := srv.acl.user(args[0])
+		if u == nil || !u.authenticate(args[1]) {
+			return errInvalidUserPass
+		}
+		conn.mu.Lock()
+		conn.authenticated, conn.tokenRoute, conn.user = false, "", args[0]
+		conn.mu.Unlock()
+		return writer.WriteStatus(OK)
+	}
+	if len(args) != 1 {
+		return &WrongArityError{c.Name()}
+	}
+	if srv.Password == "" || subtle.ConstantTimeCompare([]byte(args[0]), []byte(srv.Password)) != 1 {
+		return errInvalidPassword
+	}
+	conn.mu.Lock()
+	conn.authenticated, conn.tokenRoute, conn.user = true, "", ""
+	conn.mu.Unlock()
+	return writer.WriteStatus(OK)
+}
+
+func NewAuthCommand(args []string) (Command, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, &WrongArityError{"auth"}
+	}
+	cmd := &AuthCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+// TokenCommand is the command "token".
+// "token <route> <seconds>" creates a token granting access to route for the given number of seconds.
+type TokenCommand struct {
+	ArgsCommand
+}
+
+func (c *TokenCommand) Name() string {
+	return "token"
+}
+
+func (c *TokenCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	if len(args) != 2 {
+		return &WrongArityError{c.Name()}
+	}
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		return errNoServer
+	}
+	if len(srv.TokenSecret) == 0 {
+		return errTokensDisabled
+	}
+	seconds, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || seconds <= 0 {
+		return errNotInteger
+	}
+	expiry := srv.clock().Now().Add(time.Duration(seconds) * time.Second)
+	return writer.WriteString(NewRouteToken(srv.TokenSecret, args[0], expiry))
+}
+
+func NewTokenCommand(args []string) (Command, error) {
+	if len(args) != 2 {
+		return nil, &WrongArityError{"token"}
+	}
+	cmd := &TokenCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["auth"] = NewAuthCommand
+	commandLibraries["token"] = NewTokenCommand
+}
@@ -0,0 +1,104 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrRouteFull is returned when an item is enqueued to a route holding RouteConfig.MaxLength items.
+var ErrRouteFull = errors.New("FULL route reached its maximum length")
+
+// FullPolicy is what EnqueueContext does when the route holds RouteConfig.MaxLength items.
+type FullPolicy int
+
+const (
+	// FullReject fails the enqueue with ErrRouteFull, it is the default.
+	FullReject FullPolicy = iota
+	// FullBlock blocks the producer until an item leaves the route.
+	FullBlock
+)
+
+func (p FullPolicy) String() string {
+	if p == FullBlock {
+		return "block"
+	}
+	return "reject"
+}
+
+// full reports whether the route holds RouteConfig.MaxLength items.
+// It must be called with queueLock held.
+func (r *route) full() bool {
+	return r.config.MaxLength > 0 && r.size() >= r.config.MaxLength
+}
+
+// EnqueueContext is like Enqueue, but applies RouteConfig.OnFull when the route holds RouteConfig.MaxLength items:
+// it returns ErrRouteFull, or blocks until an item leaves the route, giving up when ctx is done,
+// in which case it returns ctx.Err().
+// It lets a producer slow down to the pace of the consumers instead of growing the route without bound.
+func (pq *PriorityQueueWithRouting) EnqueueContext(ctx context.Context, route string, item *Item) error {
+	_, err := pq.enqueue(ctx, route, item)
+	return err
+}
+
+// enqueue is EnqueueContext, returning the identifier assigned to the item.
+func (pq *PriorityQueueWithRouting) enqueue(ctx context.Context, route string, item *Item) (uint64, error) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r := pq.route(route)
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				// wake up the producer below so that it can observe ctx.Err()
+				pq.queueLock.Lock()
+				r.resolve().notFull.Broadcast()
+				pq.queueLock.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	for {
+		r = r.resolve()
+		if !r.full() {
+			pq.push(r, item)
+			return item.id, nil
+		}
+		if r.config.OnFull != FullBlock {
+			pq.drop(r, item, DropRejected)
+			return 0, ErrRouteFull
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		r.producers++
+		r.notFull.Wait()
+		r.producers--
+	}
+}
+
+// TryEnqueue adds an item to the route unless it holds RouteConfig.MaxLength items, without blocking,
+// and reports whether the item was added.
+func (pq *PriorityQueueWithRouting) TryEnqueue(route string, item *Item) bool {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r := pq.route(route)
+	if r.full() {
+		pq.drop(r, item, DropRejected)
+		return false
+	}
+	pq.push(r, item)
+	return true
+}
+
+// wakeProducers wakes up the producers waiting for room in the route.
+// It must be called with queueLock held.
+func (r *route) wakeProducers() {
+	if r.producers > 0 {
+		r.notFull.Broadcast()
+	}
+}
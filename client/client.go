@@ -0,0 +1,391 @@
+// Package client is a client of khronos servers, speaking RESP over TCP.
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error is an error reply of the server, such as "ERR no such item".
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// Code returns the first word of the error, such as "ERR" or "THROTTLED".
+func (e Error) Code() string {
+	code, _, _ := strings.Cut(string(e), " ")
+	return code
+}
+
+// errNoSuchItem is the error of the server for an item which does not exist.
+const errNoSuchItem = Error("ERR no such item")
+
+// errProtocol is returned when the server replies with something which is not RESP.
+var errProtocol = errors.New("khronos: invalid reply")
+
+// maxIdleConns is the number of idle connections kept by a client.
+const maxIdleConns = 8
+
+// Client is a client of a khronos server. It keeps a few connections open,
+// and is safe for concurrent use.
+type Client struct {
+	// Addr is the address of the server, in the form "host:port".
+	Addr string
+
+	// Addrs are more servers of the same replication topology, tried in order after Addr
+	// when the server in use can not be reached. With Addrs, the client also connects to the leader
+	// of a follower, and follows the redirections of the servers after a failover.
+	Addrs []string
+
+	// Username and Password, if set, are sent with "auth" on each new connection,
+	// Password alone for Server.Password.
+	Username string
+	Password string
+
+	// DialTimeout bounds the time to connect to the server, 5 seconds if zero.
+	DialTimeout time.Duration
+
+	mu         sync.Mutex
+	idle       []*conn
+	closed     bool
+	current    string   // address of the server in use, Addr if empty.
+	discovered []string // leaders learned from the servers, see discover.
+}
+
+// New returns a client of the server at addr.
+func New(addr string) *Client {
+	return &Client{Addr: addr}
+}
+
+// Close closes the idle connections of the client.
+// The commands running keep their connection until they return, and then close it.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle, c.closed = nil, true
+	c.mu.Unlock()
+	for _, cn := range idle {
+		_ = cn.Close()
+	}
+	return nil
+}
+
+// conn is a connection to the server.
+type conn struct {
+	net.Conn
+	addr string
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// get returns an idle connection to the server in use, or a new one.
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	for n := len(c.idle); n > 0; n = len(c.idle) {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		if cn.addr == c.serverLocked() {
+			c.mu.Unlock()
+			return cn, nil
+		}
+		// a connection to a server the client moved away from.
+		_ = cn.Close()
+	}
+	c.mu.Unlock()
+	return c.dial(ctx)
+}
+
+// put gives back a connection which can be used again.
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	if c.closed || len(c.idle) >= maxIdleConns {
+		c.mu.Unlock()
+		_ = cn.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+	c.mu.Unlock()
+}
+
+// dialAddr connects to the server at addr and authenticates.
+func (c *Client) dialAddr(ctx context.Context, addr string) (*conn, error) {
+	timeout := c.DialTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	d := net.Dialer{Timeout: timeout}
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, addr: addr, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	if c.Password != "" {
+		args := []string{"auth", c.Password}
+		if c.Username != "" {
+			args = []string{"auth", c.Username, c.Password}
+		}
+		if _, err = cn.do(ctx, args); err != nil {
+			_ = cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// Do sends a command and returns its reply: a string for a status or a bulk string,
+// an int64 for an integer, a []any for an array, nil for a nil reply, and an Error for an error.
+// The command is abandoned, and its connection closed, when ctx is done.
+func (c *Client) Do(ctx context.Context, args ...string) (any, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := cn.do(ctx, args)
+	var serverErr Error
+	if (err != nil && !errors.As(err, &serverErr)) || ctx.Err() != nil {
+		// the connection is broken, or its deadline was set to abandon the command.
+		_ = cn.Close()
+		if ctx.Err() == nil {
+			c.failed(cn.addr)
+		}
+		return reply, err
+	}
+	c.put(cn)
+	if addr, ok := moved(err); ok {
+		// the server handed its role over, the command was refused and can be sent again.
+		c.moveTo(cn.addr, addr)
+		if cn, err = c.get(ctx); err != nil {
+			return nil, err
+		}
+		if reply, err = cn.do(ctx, args); (err != nil && !errors.As(err, &serverErr)) || ctx.Err() != nil {
+			_ = cn.Close()
+			return reply, err
+		}
+		c.put(cn)
+	}
+	return reply, err
+}
+
+// do sends a command and reads its reply.
+func (cn *conn) do(ctx context.Context, args []string) (any, error) {
+	defer cn.watch(ctx)()
+	writeCommand(cn.w, args)
+	if err := cn.w.Flush(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	reply, err := readReply(cn.r)
+	return reply, contextError(ctx, err)
+}
+
+// watch unblocks the reads and writes of the connection when ctx is done,
+// until the returned function is called.
+func (cn *conn) watch(ctx context.Context) func() {
+	done := ctx.Done()
+	if done == nil {
+		return func() {}
+	}
+	stop, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-done:
+			_ = cn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-exited
+	}
+}
+
+// contextError returns the error of ctx if it caused err.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func writeCommand(w *bufio.Writer, args []string) {
+	w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+		w.WriteString(arg)
+		w.WriteString("\r\n")
+	}
+}
+
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errProtocol
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, errProtocol
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		elems := make([]any, n)
+		for i := range elems {
+			if elems[i], err = readReply(r); err != nil {
+				var serverErr Error
+				if !errors.As(err, &serverErr) {
+					return nil, err
+				}
+				elems[i] = serverErr
+			}
+		}
+		return elems, nil
+	}
+	return nil, errProtocol
+}
+
+// Push adds a value to the route with the given priority and returns the identifier of the item.
+func (c *Client) Push(ctx context.Context, route, value string, priority int64) (uint64, error) {
+	reply, err := c.Do(ctx, "push", route, value, strconv.FormatInt(priority, 10))
+	if err != nil {
+		return 0, err
+	}
+	id, ok := reply.(int64)
+	if !ok {
+		return 0, errProtocol
+	}
+	return uint64(id), nil
+}
+
+// Message is an item popped from a route.
+type Message struct {
+	// Route is the route the item was popped from.
+	Route string
+
+	// ID is the identifier of the item, zero unless the route reserves its items
+	// until they are confirmed, see "configure <route> delivery atleastonce".
+	ID uint64
+
+	// Value is the value of the item.
+	Value string
+
+	// Priority is the priority the item was pushed with.
+	Priority int64
+}
+
+// Pop removes and returns the next item of the route, waiting for one until ctx is done.
+func (c *Client) Pop(ctx context.Context, route string) (*Message, error) {
+	reply, err := c.Do(ctx, "pop", route, "withscore")
+	if err != nil {
+		return nil, err
+	}
+	// the value and the priority, preceded by the id of an item reserved until confirmed.
+	fields, _ := reply.([]any)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, errProtocol
+	}
+	n := len(fields)
+	value, ok := fields[n-2].(string)
+	priority, isInt := fields[n-1].(int64)
+	if !ok || !isInt {
+		return nil, errProtocol
+	}
+	msg := &Message{Route: route, Value: value, Priority: priority}
+	if n == 3 {
+		s, _ := fields[0].(string)
+		if msg.ID, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return nil, errProtocol
+		}
+	}
+	return msg, nil
+}
+
+// Confirm confirms the processing of a message reserved by its route.
+func (c *Client) Confirm(ctx context.Context, msg *Message) error {
+	_, err := c.Do(ctx, "confirm", msg.Route, strconv.FormatUint(msg.ID, 10))
+	return err
+}
+
+// Touch extends the reservation of a message, which is enqueued again if not confirmed within d.
+// It returns an Error with the code "ERR" if the message is no longer reserved.
+func (c *Client) Touch(ctx context.Context, msg *Message, d time.Duration) error {
+	n, err := c.Do(ctx, "touch", msg.Route, strconv.FormatUint(msg.ID, 10), strconv.FormatInt(d.Milliseconds(), 10))
+	if err == nil && n == int64(0) {
+		return errNoSuchItem
+	}
+	return err
+}
+
+// Retry gives up the processing of a message reserved by its route, which enqueues it again
+// after the backoff of its retry policy.
+func (c *Client) Retry(ctx context.Context, msg *Message) error {
+	_, err := c.Do(ctx, "retry", msg.Route, strconv.FormatUint(msg.ID, 10))
+	return err
+}
+
+// Dump returns the items of the route as a blob for Restore, without removing them.
+// It lets a route be backed up, or copied to another server.
+func (c *Client) Dump(ctx context.Context, route string) ([]byte, error) {
+	reply, err := c.Do(ctx, "dump", route)
+	if err != nil {
+		return nil, err
+	}
+	blob, ok := reply.(string)
+	if !ok {
+		return nil, errProtocol
+	}
+	return []byte(blob), nil
+}
+
+// Restore pushes to the route the items of a blob returned by Dump, and returns the number
+// of items restored. It fails if the route has items, unless replace, in which case they are dropped first.
+func (c *Client) Restore(ctx context.Context, route string, blob []byte, replace bool) (int, error) {
+	args := []string{"restore", route, string(blob)}
+	if replace {
+		args = append(args, "replace")
+	}
+	reply, err := c.Do(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, errProtocol
+	}
+	return int(n), nil
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"khronos"
+)
+
+// startServer serves a new queue on a random local port and returns the server and its address.
+func startServer(t *testing.T) (*khronos.Server, string) {
+	t.Helper()
+	return serve(t, &khronos.Server{})
+}
+
+// serve serves srv on a random local port and returns it with its address.
+func serve(t *testing.T, srv *khronos.Server) (*khronos.Server, string) {
+	t.Helper()
+	if srv.Queue == nil {
+		srv.Queue = khronos.NewPriorityQueueWithRouting()
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() { _ = srv.Serve(ln) }()
+	return srv, ln.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	_, addr := startServer(t)
+	c := New(addr)
+	defer c.Close()
+	ctx := context.Background()
+
+	if reply, err := c.Do(ctx, "ping"); err != nil || reply != "PONG" {
+		t.Errorf("ping: got %v, %v", reply, err)
+	}
+	if id, err := c.Push(ctx, "jobs", "a", 1); err != nil || id != 1 {
+		t.Errorf("push: got %d, %v", id, err)
+	}
+	if msg, err := c.Pop(ctx, "jobs"); err != nil || msg.Value != "a" || msg.ID != 0 || msg.Priority != 1 {
+		t.Errorf("pop: got %+v, %v", msg, err)
+	}
+	if _, err := c.Do(ctx, "nosuch"); !errors.As(err, new(Error)) {
+		t.Errorf("unknown command: got %v", err)
+	}
+	if _, err := c.Push(ctx, "jobs", "b", 2); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := c.Dump(ctx, "jobs")
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if n, err := c.Restore(ctx, "copy", blob, false); err != nil || n != 1 {
+		t.Errorf("restore: got %d, %v", n, err)
+	}
+	if msg, err := c.Pop(ctx, "copy"); err != nil || msg.Value != "b" || msg.Priority != 2 {
+		t.Errorf("pop restored: got %+v, %v", msg, err)
+	}
+
+	// a blocking pop is abandoned when ctx is done.
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.Pop(ctx, "empty"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("pop on an empty route: got %v", err)
+	}
+}
+
+func TestConsume(t *testing.T) {
+	srv, addr := startServer(t)
+	c := New(addr)
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := c.Do(ctx, "configure", "jobs", "delivery", "atleastonce"); err != nil {
+		t.Fatal(err)
+	}
+	c.Push(ctx, "jobs", "a", 1)
+	c.Push(ctx, "jobs", "b", 1)
+
+	var (
+		mu     sync.Mutex
+		values []string
+	)
+	err := c.Consume(ctx, "jobs", func(ctx context.Context, msg *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		values = append(values, msg.Value)
+		switch len(values) {
+		case 1:
+			return errors.New("failed")
+		case 3:
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("consume: got %v", err)
+	}
+	// the failed item is retried after the others.
+	if len(values) != 3 || values[0] != "a" || values[1] != "b" || values[2] != "a" {
+		t.Errorf("consumed %v", values)
+	}
+	if a := srv.Queue.Accounting(); a.Inflight != 0 || a.Pending != 0 {
+		t.Errorf("accounting: got %+v", a)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	leader, leaderAddr := startServer(t)
+	follower, followerAddr := serve(t, &khronos.Server{ReplicaOf: leaderAddr})
+	ctx := context.Background()
+	t.Cleanup(func() {
+		_, _ = New(leaderAddr).Do(ctx, "replicaof", "no", "one")
+		_, _ = New(followerAddr).Do(ctx, "replicaof", "no", "one")
+	})
+
+	// the client discovers the leader from the follower.
+	c := &Client{Addr: followerAddr, Addrs: []string{"127.0.0.1:1"}}
+	defer c.Close()
+	if _, err := c.Push(ctx, "jobs", "a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if n := leader.Queue.Length("jobs"); n != 1 {
+		t.Errorf("Expected the item on the leader, got %d items", n)
+	}
+
+	// after a failover, the former leader redirects the client to the promoted follower.
+	if reply, err := New(followerAddr).Do(ctx, "failover", "timeout", "2000"); err != nil || reply != "OK" {
+		t.Fatalf("failover: got %v, %v", reply, err)
+	}
+	if _, err := c.Push(ctx, "jobs", "b", 1); err != nil {
+		t.Fatal(err)
+	}
+	if n := follower.Queue.Length("jobs"); n != 2 {
+		t.Errorf("Expected the items on the promoted follower, got %d items", n)
+	}
+
+	// an unreachable server is skipped.
+	c = &Client{Addr: "127.0.0.1:1", Addrs: []string{followerAddr}}
+	defer c.Close()
+	if reply, err := c.Do(ctx, "ping"); err != nil || reply != "PONG" {
+		t.Errorf("ping: got %v, %v", reply, err)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	_, addr := startServer(t)
+	c := New(addr)
+	defer c.Close()
+	ctx := context.Background()
+
+	p := c.Pipeline()
+	var pushes []*Result
+	for i := 0; i < 100; i++ {
+		pushes = append(pushes, p.Push("jobs", "v", int64(i)))
+	}
+	length := p.Length("jobs")
+	failed := p.Do("nosuch")
+	last := p.Length("jobs")
+	if id, err := pushes[0].Int(); err != errNotExecuted {
+		t.Errorf("result before Exec: got %d, %v", id, err)
+	}
+	if n := p.Len(); n != 103 {
+		t.Errorf("Len: got %d, want 103", n)
+	}
+
+	if err := p.Exec(ctx); !errors.As(err, new(Error)) {
+		t.Errorf("Exec: got %v, want the error of the unknown command", err)
+	}
+	for i, r := range pushes {
+		if id, err := r.Int(); err != nil || id != int64(i+1) {
+			t.Errorf("push %d: got %d, %v", i, id, err)
+		}
+	}
+	if n, err := length.Int(); err != nil || n != 100 {
+		t.Errorf("length: got %d, %v", n, err)
+	}
+	if _, err := failed.Reply(); !errors.As(err, new(Error)) {
+		t.Errorf("unknown command: got %v", err)
+	}
+	if n, err := last.Int(); err != nil || n != 100 {
+		t.Errorf("length after an error: got %d, %v", n, err)
+	}
+	if err := p.Exec(ctx); err != nil || p.Len() != 0 {
+		t.Errorf("Exec of an empty pipeline: got %v, %d commands", err, p.Len())
+	}
+}
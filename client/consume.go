@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// minReconnectBackoff and maxReconnectBackoff bound the delay of Consume before reconnecting,
+	// doubled at each consecutive failure.
+	minReconnectBackoff = 100 * time.Millisecond
+	maxReconnectBackoff = 5 * time.Second
+	// settleTimeout bounds the time to confirm or retry a message.
+	settleTimeout = 5 * time.Second
+)
+
+// Handler processes a message of Consume.
+// Returning nil confirms the message, returning an error gives it up so that it is retried.
+type Handler func(ctx context.Context, msg *Message) error
+
+// Consume pops the items of the route one at a time, in order, and calls handle with each of them,
+// until ctx is done, and then returns ctx.Err().
+//
+// For a route reserving its items until confirmed, see "configure <route> delivery atleastonce",
+// a message is confirmed when handle returns nil, and retried after the backoff of the route when
+// it returns an error. The items of the other routes are removed as they are popped, whatever handle returns.
+//
+// Consume reconnects when the connection fails or the server throttles the route,
+// waiting between attempts with an exponential backoff. It returns the other errors of the server.
+func (c *Client) Consume(ctx context.Context, route string, handle Handler) error {
+	backoff := minReconnectBackoff
+	for {
+		msg, err := c.Pop(ctx, route)
+		if err == nil {
+			backoff = minReconnectBackoff
+			err = c.settle(ctx, msg, handle(ctx, msg))
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			continue
+		}
+		if !retryable(err) {
+			return err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, maxReconnectBackoff)
+	}
+}
+
+// settle confirms or retries the message according to the result of its handler.
+func (c *Client) settle(ctx context.Context, msg *Message, result error) error {
+	if msg.ID == 0 {
+		return nil
+	}
+	// the message is settled even if ctx is done meanwhile, so that it is not redelivered for nothing.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), settleTimeout)
+	defer cancel()
+	if result == nil {
+		return c.Confirm(ctx, msg)
+	}
+	err := c.Retry(ctx, msg)
+	if err == errNoSuchItem {
+		// the reservation expired while handling the message, which was already enqueued again.
+		return nil
+	}
+	return err
+}
+
+// retryable reports whether Consume retries after err, rather than returning it.
+func retryable(err error) bool {
+	var serverErr Error
+	if errors.As(err, &serverErr) {
+		return serverErr.Code() == "THROTTLED"
+	}
+	return true
+}
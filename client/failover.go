@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"strings"
+)
+
+// A client given several addresses, see Client.Addrs, uses a single server at a time:
+// the first one it can connect to, starting with Addr. It moves to the next one when
+// the connection to the server in use fails, and to the new leader when a server replies
+// "MOVED <addr>" after a failover. When connecting to a follower, the client asks it for
+// its leader with "role" and connects to the leader instead, which the client discovers
+// this way without being given its address.
+//
+// A command whose connection fails is not sent again, since the server may have run it:
+// the next commands go to the next server.
+
+// serverLocked returns the address of the server in use.
+// It must be called with mu held.
+func (c *Client) serverLocked() string {
+	if c.current != "" {
+		return c.current
+	}
+	return c.Addr
+}
+
+// servers returns the addresses of the known servers, the one in use first.
+func (c *Client) servers() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current := c.serverLocked()
+	all := append(append([]string{c.Addr}, c.Addrs...), c.discovered...)
+	// rotate the list so that it starts with the server in use, and keeps its order after it.
+	for i, addr := range all {
+		if addr == current {
+			all = append(all[i:], all[:i]...)
+			break
+		}
+	}
+	servers := make([]string, 0, len(all)+1)
+	seen := make(map[string]bool, len(all)+1)
+	for _, addr := range append([]string{current}, all...) {
+		if !seen[addr] {
+			seen[addr] = true
+			servers = append(servers, addr)
+		}
+	}
+	return servers
+}
+
+// dial connects to the first server which can be reached, starting with the one in use,
+// and makes it the server in use.
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	var firstErr error
+	for _, addr := range c.servers() {
+		cn, err := c.dialAddr(ctx, addr)
+		if err == nil {
+			cn = c.discover(ctx, cn)
+			c.mu.Lock()
+			c.current = cn.addr
+			c.mu.Unlock()
+			return cn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// discover asks the server of cn for its leader, if the client knows several servers,
+// and returns a connection to the leader if the server is a follower.
+// It returns cn if the server is a leader or the leader can not be reached.
+func (c *Client) discover(ctx context.Context, cn *conn) *conn {
+	if len(c.Addrs) == 0 {
+		return cn
+	}
+	reply, err := cn.do(ctx, []string{"role"})
+	role, _ := reply.([]any)
+	if err != nil || len(role) < 2 || role[0] != "follower" {
+		return cn
+	}
+	leader, _ := role[1].(string)
+	if leader == "" || leader == cn.addr {
+		return cn
+	}
+	lcn, err := c.dialAddr(ctx, leader)
+	if err != nil {
+		return cn
+	}
+	_ = cn.Close()
+	c.learn(leader)
+	return lcn
+}
+
+// learn adds addr to the known servers.
+func (c *Client) learn(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if addr == c.Addr {
+		return
+	}
+	for _, known := range append(c.Addrs, c.discovered...) {
+		if known == addr {
+			return
+		}
+	}
+	c.discovered = append(c.discovered, addr)
+}
+
+// failed moves the client away from the server at addr after a connection failure,
+// to the next known server.
+func (c *Client) failed(addr string) {
+	servers := c.servers()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.serverLocked() != addr || len(servers) < 2 {
+		return
+	}
+	c.current = servers[1]
+}
+
+// moveTo makes the server at to the server in use, after the server at from redirected the client.
+func (c *Client) moveTo(from, to string) {
+	c.learn(to)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.serverLocked() == from {
+		c.current = to
+	}
+}
+
+// moved returns the address of the server a "MOVED <addr>" error redirects to.
+func moved(err error) (string, bool) {
+	serverErr, ok := err.(Error)
+	if !ok || serverErr.Code() != "MOVED" {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(string(serverErr), "MOVED")), true
+}
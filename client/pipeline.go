@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strconv"
+)
+
+// Pipeline queues commands and sends them to the server in a single write when executed,
+// reading their replies in order, which saves a round trip per command when submitting
+// many items. A Pipeline is not safe for concurrent use.
+type Pipeline struct {
+	c       *Client
+	cmds    [][]string
+	results []*Result
+}
+
+// Result is the reply of a command queued in a pipeline, set when the pipeline is executed.
+type Result struct {
+	reply any
+	err   error
+}
+
+// Reply returns the reply of the command, as returned by Client.Do.
+func (r *Result) Reply() (any, error) {
+	return r.reply, r.err
+}
+
+// Int returns the integer reply of the command, such as the identifier returned by push
+// or the number of items returned by length.
+func (r *Result) Int() (int64, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, ok := r.reply.(int64)
+	if !ok {
+		return 0, errProtocol
+	}
+	return n, nil
+}
+
+// errNotExecuted is the error of the results of a pipeline which was not executed.
+var errNotExecuted = errors.New("khronos: pipeline not executed")
+
+// Pipeline returns an empty pipeline sending its commands over a connection of the client.
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Do queues a command, see Client.Do.
+func (p *Pipeline) Do(args ...string) *Result {
+	r := &Result{err: errNotExecuted}
+	p.cmds = append(p.cmds, args)
+	p.results = append(p.results, r)
+	return r
+}
+
+// Push queues the push of a value to the route with the given priority,
+// the result is the identifier of the item, see Client.Push.
+func (p *Pipeline) Push(route, value string, priority int64) *Result {
+	return p.Do("push", route, value, strconv.FormatInt(priority, 10))
+}
+
+// Length queues a request for the number of items of the route.
+func (p *Pipeline) Length(route string) *Result {
+	return p.Do("length", route)
+}
+
+// Len returns the number of commands queued.
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+// Exec sends the queued commands and sets their results, and empties the pipeline.
+// It returns the first error of the results, either an Error of the server for one of the
+// commands, the others being executed anyway, or the error which broke the connection,
+// also set on the results of the commands whose reply was not read.
+// The commands refused by a server which handed its role over with a failover are not sent again,
+// but the next commands of the client go to the new leader.
+func (p *Pipeline) Exec(ctx context.Context) error {
+	cmds, results := p.cmds, p.results
+	p.cmds, p.results = nil, nil
+	if len(cmds) == 0 {
+		return nil
+	}
+	cn, err := p.c.get(ctx)
+	if err != nil {
+		for _, r := range results {
+			r.err = err
+		}
+		return err
+	}
+
+	err = cn.pipeline(ctx, cmds, results)
+	var serverErr Error
+	if (err != nil && !errors.As(err, &serverErr)) || ctx.Err() != nil {
+		_ = cn.Close()
+		if ctx.Err() == nil {
+			p.c.failed(cn.addr)
+		}
+		return err
+	}
+	p.c.put(cn)
+	for _, r := range results {
+		if addr, ok := moved(r.err); ok {
+			p.c.moveTo(cn.addr, addr)
+			break
+		}
+	}
+	return err
+}
+
+// pipeline sends the commands in a single write and sets their results from the replies read in order.
+// It returns the first error of the results.
+func (cn *conn) pipeline(ctx context.Context, cmds [][]string, results []*Result) error {
+	defer cn.watch(ctx)()
+	for _, args := range cmds {
+		writeCommand(cn.w, args)
+	}
+	if err := cn.w.Flush(); err != nil {
+		err = contextError(ctx, err)
+		for _, r := range results {
+			r.err = err
+		}
+		return err
+	}
+	var first error
+	for i, r := range results {
+		r.reply, r.err = readReply(cn.r)
+		var serverErr Error
+		if r.err != nil && !errors.As(r.err, &serverErr) {
+			err := contextError(ctx, r.err)
+			for _, r := range results[i:] {
+				r.reply, r.err = nil, err
+			}
+			return err
+		}
+		if first == nil {
+			first = r.err
+		}
+	}
+	return first
+}
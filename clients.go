@@ -0,0 +1,233 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errNoSuchClient = errors.New("ERR No such client")
+
+// clientRegistry keeps track of the connections served by a server.
+// The zero value is ready to use.
+type clientRegistry struct {
+	mu    sync.Mutex
+	conns map[int64]*connContext
+}
+
+func (r *clientRegistry) add(c *connContext) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns == nil {
+		r.conns = make(map[int64]*connContext)
+	}
+	r.conns[c.id] = c
+}
+
+func (r *clientRegistry) remove(c *connContext) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, c.id)
+}
+
+// list returns the registered connections ordered by id.
+func (r *clientRegistry) list() []*connContext {
+	r.mu.Lock()
+	conns := make([]*connContext, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+	return conns
+}
+
+// markBlocked records that the connection of ctx is blocked on route.
+// The connection is watched while it waits for an item of the route, see watch.
+// The returned function must be called once the connection is no longer blocked.
+func markBlocked(ctx context.Context, route string) func() {
+	c := connFromContext(ctx)
+	if c == nil {
+		return func() {}
+	}
+	// the client is not waiting for the replies of the commands before this one.
+	_ = c.flush()
+	c.mu.Lock()
+	c.state = stateBlocked
+	c.blockedRoute = route
+	c.mu.Unlock()
+	unwatch := func() {}
+	if route != "" {
+		unwatch = c.watch()
+	}
+	return func() {
+		unwatch()
+		c.mu.Lock()
+		c.state = stateActive
+		c.blockedRoute = ""
+		c.mu.Unlock()
+	}
+}
+
+// info formats the connection like a line of the "client list" reply.
+func (c *connContext) info(now time.Time) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var b strings.Builder
+	b.WriteString("id=" + strconv.FormatInt(c.id, 10))
+	b.WriteString(" addr=" + c.conn.RemoteAddr().String())
+	b.WriteString(" name=" + c.name)
+	b.WriteString(" age=" + strconv.FormatInt(int64(now.Sub(c.createdAt)/time.Second), 10))
+	b.WriteString(" cmd=" + c.lastCommand)
+	b.WriteString(" blocked=" + c.blockedRoute)
+	if c.space != "" {
+		b.WriteString(" space=" + c.space)
+	} else {
+		b.WriteString(" space=" + defaultSpace)
+	}
+	b.WriteString(" idle=" + strconv.FormatInt(int64(now.Sub(c.lastActive)/time.Second), 10))
+	b.WriteString(" cmds=" + strconv.FormatInt(c.commands, 10))
+	b.WriteString(" in=" + strconv.FormatInt(atomic.LoadInt64(&c.counted.read), 10))
+	b.WriteString(" out=" + strconv.FormatInt(atomic.LoadInt64(&c.counted.written), 10))
+	b.WriteString(" mode=" + c.mode())
+	b.WriteString(" resp=2")
+	return b.String()
+}
+
+// mode describes how the connection consumes the server.
+// It must be called with c.mu held.
+func (c *connContext) mode() string {
+	switch {
+	case c.state == stateBlocked && c.lastCommand == "sync":
+		return "replica"
+	case c.state == stateBlocked:
+		return "blocked"
+	}
+	return "normal"
+}
+
+// countingConn counts the bytes read from and written to a connection.
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// ClientCommand is the command "client".
+// It inspects and manages the connections of the server with the following subcommands:
+//
+//	client list                    list the connections, one per line
+//	client info                    describe the current connection, in the format of client list
+//	client kill id <id>            close the connection with the given id
+//	client kill addr <ip:port>     close the connection with the given address
+//	client setname <name>          name the current connection
+//	client getname                 return the name of the current connection
+//	client id                      return the id of the current connection
+type ClientCommand struct {
+	ArgsCommand
+}
+
+func (c *ClientCommand) Name() string {
+	return "client"
+}
+
+func (c *ClientCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	if len(args) == 0 {
+		return &WrongArityError{c.Name()}
+	}
+	srv := ServerFromContext(ctx)
+	conn := connFromContext(ctx)
+	if srv == nil || conn == nil {
+		return errNoSuchClient
+	}
+	switch sub := strings.ToLower(args[0]); sub {
+	case "list":
+		now := clockFromContext(ctx).Now()
+		var b strings.Builder
+		for _, client := range srv.clients.list() {
+			b.WriteString(client.info(now))
+			b.WriteString("\n")
+		}
+		return writer.WriteString(b.String())
+	case "info":
+		return writer.WriteString(conn.info(clockFromContext(ctx).Now()) + "\n")
+	case "kill":
+		if len(args) != 3 {
+			return &WrongArityError{c.Name() + "|" + sub}
+		}
+		filter, value := strings.ToLower(args[1]), args[2]
+		var match func(*connContext) bool
+		switch filter {
+		case "id":
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errNoSuchClient
+			}
+			match = func(client *connContext) bool { return client.id == id }
+		case "addr":
+			match = func(client *connContext) bool { return client.conn.RemoteAddr().String() == value }
+		default:
+			return &wrongCommandError{command: c.Name() + "|" + sub, args: args[1:]}
+		}
+		var killed int64
+		for _, client := range srv.clients.list() {
+			if match(client) {
+				client.kill()
+				killed++
+			}
+		}
+		return writer.WriteInt64(killed)
+	case "setname":
+		if len(args) != 2 {
+			return &WrongArityError{c.Name() + "|" + sub}
+		}
+		conn.mu.Lock()
+		conn.name = args[1]
+		conn.mu.Unlock()
+		return writer.WriteStatus(OK)
+	case "getname":
+		conn.mu.Lock()
+		name := conn.name
+		conn.mu.Unlock()
+		if name == "" {
+			return writer.WriteNil()
+		}
+		return writer.WriteString(name)
+	case "id":
+		return writer.WriteInt64(conn.id)
+	default:
+		return &wrongCommandError{command: c.Name() + "|" + sub, args: args[1:]}
+	}
+}
+
+func NewClientCommand(args []string) (Command, error) {
+	if len(args) == 0 {
+		return nil, &WrongArityError{"client"}
+	}
+	cmd := &ClientCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["client"] = NewClientCommand
+}
@@ -0,0 +1,99 @@
+package khronos
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is the source of time of a server.
+// Every time-based feature reads the time and waits for durations through it,
+// so that replacing it, for example with khronostest.Clock, runs the server under a controlled time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// AfterFunc calls f in its own goroutine once d has elapsed.
+	// The returned function stops the timer, it reports false if f has already been called.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// SystemClock is the Clock measuring the real time, used when Server.Clock is nil.
+var SystemClock Clock = systemClock{}
+
+// clock returns the clock of the server.
+func (srv *Server) clock() Clock {
+	if srv.Clock != nil {
+		return srv.Clock
+	}
+	return SystemClock
+}
+
+// clockFromContext returns the clock of the server serving ctx,
+// or SystemClock if ctx does not come from a server.
+func clockFromContext(ctx context.Context) Clock {
+	if srv := ServerFromContext(ctx); srv != nil {
+		return srv.clock()
+	}
+	return SystemClock
+}
+
+// withTimeout is like context.WithTimeout, but measures d with clock.
+// Once the timeout expires, context.Cause of the returned context is context.DeadlineExceeded.
+func withTimeout(ctx context.Context, clock Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := clock.AfterFunc(d, func() { cancel(context.DeadlineExceeded) })
+	return ctx, func() {
+		stop()
+		cancel(context.Canceled)
+	}
+}
+
+// SetClock sets the source of time of the queue: the enqueue times, the visibility timeouts,
+// the retry backoffs, the deduplication windows and the idle times of the routes are measured with it.
+// The queue uses SystemClock while it is nil. A Server with a Clock sets it on its queue,
+// unless the queue already has one.
+func (pq *PriorityQueueWithRouting) SetClock(clock Clock) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	pq.clock = clock
+}
+
+// useClock sets clock on the queue if it has none, see SetClock.
+func (pq *PriorityQueueWithRouting) useClock(clock Clock) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	if pq.clock == nil {
+		pq.clock = clock
+	}
+}
+
+// getClock returns the clock of the queue.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) getClock() Clock {
+	if pq.clock != nil {
+		return pq.clock
+	}
+	return SystemClock
+}
+
+// now returns the current time of the queue.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) now() time.Time {
+	return pq.getClock().Now()
+}
+
+// afterFunc calls f once d has elapsed on the clock of the queue, see Clock.AfterFunc.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) afterFunc(d time.Duration, f func()) func() bool {
+	return pq.getClock().AfterFunc(d, f)
+}
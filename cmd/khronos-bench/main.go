@@ -0,0 +1,244 @@
+// Command khronos-bench measures the throughput and the latency of a khronos server,
+// like redis-benchmark, for capacity planning.
+//
+// It runs each workload of -t in turn: a number of clients send the requests concurrently,
+// in batches of -P pipelined requests, spread over -r routes, and the requests per second
+// and the latency percentiles are reported. A request's latency is the round trip of its batch.
+// With -contention, the waits for the lock of the queue of the server are measured during each workload,
+// to compare the contention of a workload spread over 1 and over several routes with -r.
+//
+//	khronos-bench -h 127.0.0.1:7464 -c 50 -n 100000 -P 16 -d 64 -r 10 -t push,pop
+//
+// The workloads are:
+//
+//	push    pushes a value of -d bytes with a random priority
+//	pop     pops an item without waiting, "popn <route> 1", run it after push to pop actual items
+//	length  asks for the number of items of the route
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"khronos/client"
+)
+
+// workloads returns the arguments of a request to the route, for each workload.
+var workloads = map[string]func(route, value string) []string{
+	"push": func(route, value string) []string {
+		return []string{"push", route, value, strconv.Itoa(rand.Intn(1 << 20))}
+	},
+	"pop": func(route, value string) []string {
+		return []string{"popn", route, "1"}
+	},
+	"length": func(route, value string) []string {
+		return []string{"length", route}
+	},
+}
+
+type options struct {
+	addr       string
+	password   string
+	clients    int
+	requests   int
+	pipeline   int
+	size       int
+	routes     int
+	prefix     string
+	contention bool
+}
+
+// result is the outcome of a workload.
+type result struct {
+	elapsed    time.Duration
+	latencies  []time.Duration // one per request, sorted.
+	errors     int64
+	lastErr    error
+	contention []string // "lock_" lines of "info contention", with -contention.
+}
+
+func main() {
+	var opts options
+	var tests string
+	flag.StringVar(&opts.addr, "h", "127.0.0.1:7464", "address of the server")
+	flag.StringVar(&opts.password, "a", "", "password of the server")
+	flag.IntVar(&opts.clients, "c", 50, "number of parallel connections")
+	flag.IntVar(&opts.requests, "n", 100000, "total number of requests of each workload")
+	flag.IntVar(&opts.pipeline, "P", 1, "number of requests pipelined in a batch")
+	flag.IntVar(&opts.size, "d", 16, "size of the pushed values in bytes")
+	flag.IntVar(&opts.routes, "r", 1, "number of routes the requests are spread over")
+	flag.StringVar(&opts.prefix, "route", "bench", "prefix of the routes, followed by their number")
+	flag.StringVar(&tests, "t", "push,pop", "comma separated workloads to run: push, pop, length")
+	flag.BoolVar(&opts.contention, "contention", false, "measure the waits for the lock of the server during each workload")
+	flag.Parse()
+	if opts.clients < 1 || opts.requests < 1 || opts.pipeline < 1 || opts.size < 0 || opts.routes < 1 {
+		fmt.Fprintln(os.Stderr, "khronos-bench: -c, -n, -P and -r must be positive, -d not negative")
+		os.Exit(2)
+	}
+
+	for _, name := range strings.Split(tests, ",") {
+		name = strings.TrimSpace(name)
+		request, ok := workloads[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "khronos-bench: unknown workload %q\n", name)
+			os.Exit(2)
+		}
+		if opts.contention {
+			if err := profileLock(opts); err != nil {
+				fmt.Fprintln(os.Stderr, "khronos-bench: lock profiling:", err)
+				os.Exit(1)
+			}
+		}
+		res := run(opts, request)
+		if opts.contention {
+			res.contention = lockContention(opts)
+		}
+		report(os.Stdout, name, opts, res)
+		if res.errors == int64(opts.requests) {
+			os.Exit(1)
+		}
+	}
+}
+
+// run sends the requests of a workload and measures them.
+func run(opts options, request func(route, value string) []string) *result {
+	value := strings.Repeat("x", opts.size)
+	var (
+		next    atomic.Int64 // number of requests handed out.
+		errs    atomic.Int64
+		mu      sync.Mutex
+		lastErr error
+		wg      sync.WaitGroup
+	)
+	latencies := make([][]time.Duration, opts.clients)
+	start := time.Now()
+	for i := 0; i < opts.clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// a client per connection, so that the connections are not shared between the workers.
+			c := client.New(opts.addr)
+			c.Password = opts.password
+			defer c.Close()
+			ctx := context.Background()
+			for {
+				n := int(next.Add(int64(opts.pipeline)))
+				batch := opts.pipeline - max(0, n-opts.requests)
+				if batch <= 0 {
+					return
+				}
+				p := c.Pipeline()
+				for j := 0; j < batch; j++ {
+					route := opts.prefix + strconv.Itoa((n-batch+j)%opts.routes)
+					p.Do(request(route, value)...)
+				}
+				sent := time.Now()
+				err := p.Exec(ctx)
+				rtt := time.Since(sent)
+				for j := 0; j < batch; j++ {
+					latencies[i] = append(latencies[i], rtt)
+				}
+				var serverErr client.Error
+				if err != nil {
+					if errors.As(err, &serverErr) {
+						errs.Add(1)
+					} else {
+						errs.Add(int64(batch))
+					}
+					mu.Lock()
+					lastErr = err
+					mu.Unlock()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	res := &result{elapsed: time.Since(start), errors: errs.Load(), lastErr: lastErr}
+	for _, l := range latencies {
+		res.latencies = append(res.latencies, l...)
+	}
+	slices.Sort(res.latencies)
+	return res
+}
+
+// profileLock enables the lock profiling of the server and resets its measures.
+func profileLock(opts options) error {
+	c := client.New(opts.addr)
+	c.Password = opts.password
+	defer c.Close()
+	ctx := context.Background()
+	if _, err := c.Do(ctx, "config", "set", "lockprofiling", "yes"); err != nil {
+		return err
+	}
+	_, err := c.Do(ctx, "config", "resetstat")
+	return err
+}
+
+// lockContention returns the "lock_" lines of "info contention".
+func lockContention(opts options) []string {
+	c := client.New(opts.addr)
+	c.Password = opts.password
+	defer c.Close()
+	reply, err := c.Do(context.Background(), "info", "contention")
+	if err != nil {
+		return []string{"error: " + err.Error()}
+	}
+	info, _ := reply.(string)
+	var lines []string
+	for _, line := range strings.Split(info, "\r\n") {
+		if strings.HasPrefix(line, "lock_") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// percentile returns the latency under which p percent of the requests completed.
+func (r *result) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.latencies))*p/100+0.5) - 1
+	return r.latencies[min(max(i, 0), len(r.latencies)-1)]
+}
+
+func report(w *os.File, name string, opts options, res *result) {
+	fmt.Fprintf(w, "====== %s ======\n", name)
+	fmt.Fprintf(w, "  %d requests completed in %.2f seconds\n", opts.requests, res.elapsed.Seconds())
+	fmt.Fprintf(w, "  %d parallel clients, pipeline %d, %d bytes payload, %d routes\n", opts.clients, opts.pipeline, opts.size, opts.routes)
+	if res.errors > 0 {
+		fmt.Fprintf(w, "  %d errors, last: %v\n", res.errors, res.lastErr)
+	}
+	fmt.Fprintf(w, "  throughput: %.2f requests per second\n", float64(opts.requests)/res.elapsed.Seconds())
+	fmt.Fprintf(w, "  latency (msec): avg=%.3f p50=%.3f p95=%.3f p99=%.3f max=%.3f\n",
+		ms(res.average()), ms(res.percentile(50)), ms(res.percentile(95)), ms(res.percentile(99)), ms(res.percentile(100)))
+	if len(res.contention) > 0 {
+		fmt.Fprintf(w, "  lock contention: %s\n", strings.Join(res.contention, " "))
+	}
+	fmt.Fprintln(w)
+}
+
+func (r *result) average() time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, l := range r.latencies {
+		total += l
+	}
+	return total / time.Duration(len(r.latencies))
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,113 @@
+// Command khronos-check verifies, inspects and repairs an append-only file of a khronos server offline,
+// like redis-check-aof, so that an operator can recover after a crash, see Server.AppendOnlyFile.
+//
+// It reads the checksums of the records of the file, and reports the number of valid operations
+// and the first damaged record, if any. It exits with status 1 if the file is damaged and not repaired.
+//
+//	khronos-check [-dump] [-routes] [-fix] khronos.aof
+//
+// The flags are:
+//
+//	-dump    prints the valid operations, one command per line
+//	-routes  rebuilds the queue from the file, and prints its routes with their number of items
+//	-fix     truncates a damaged file after its last valid operation, discarding the damaged ones
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"khronos"
+)
+
+func main() {
+	var dump, routes, fix bool
+	flag.BoolVar(&dump, "dump", false, "print the valid operations, one command per line")
+	flag.BoolVar(&routes, "routes", false, "print the routes of the file with their number of items")
+	flag.BoolVar(&fix, "fix", false, "truncate a damaged file after its last valid operation")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: khronos-check [-dump] [-routes] [-fix] <file>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+
+	check, err := khronos.ReadAppendOnlyFile(path, func(args []string) {
+		if dump {
+			fmt.Println(commandLine(args))
+		}
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "khronos-check:", err)
+		os.Exit(1)
+	}
+	if routes {
+		if err = printRoutes(path); err != nil {
+			fmt.Fprintln(os.Stderr, "khronos-check:", err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Printf("%s: format version %d, %d operations, %d bytes\n", path, check.Version, check.Operations, check.Size)
+	if check.Version == 0 {
+		fmt.Println("the file has no checksums, it is rewritten with them by the next server loading it")
+	}
+	if check.Err == nil {
+		fmt.Println("ok")
+		return
+	}
+	fmt.Printf("damaged: %v\n", check.Err)
+	discarded := check.Size - check.ValidSize
+	if !fix {
+		fmt.Printf("%d bytes after the last valid operation, at offset %d, are discarded when the file is loaded,\n", discarded, check.ValidSize)
+		fmt.Println("run with -fix to truncate the file")
+		os.Exit(1)
+	}
+	if _, err = khronos.RepairAppendOnlyFile(path); err != nil {
+		fmt.Fprintln(os.Stderr, "khronos-check:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("repaired: truncated to %d bytes, %d bytes discarded\n", check.ValidSize, discarded)
+}
+
+// printRoutes prints the routes of the queue rebuilt from the file, with their number of items.
+func printRoutes(path string) error {
+	pq := khronos.NewPriorityQueueWithRouting()
+	if _, err := pq.LoadAppendOnlyFile(path); err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	pq.ForEach(func(route string, item khronos.Item) bool {
+		counts[route]++
+		return true
+	})
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s\t%d\n", name, counts[name])
+	}
+	return nil
+}
+
+// commandLine returns the arguments of a command as a line, quoting the ones which need it.
+func commandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = arg
+		if arg == "" || strings.ContainsAny(arg, " \t\r\n\"'\\") || !strconv.CanBackquote(arg) {
+			quoted[i] = strconv.Quote(arg)
+		}
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,167 @@
+package khronos
+
+import (
+	"strings"
+)
+
+// CommandFlags describe the behavior of a command to the clients, see CommandInfo.
+type CommandFlags int
+
+const (
+	// FlagWrite marks the commands which change the queue.
+	FlagWrite CommandFlags = 1 << iota
+	// FlagReadOnly marks the commands which only read the queue.
+	FlagReadOnly
+	// FlagBlocking marks the commands which may wait for an item.
+	FlagBlocking
+	// FlagAdmin marks the commands which administer the server.
+	FlagAdmin
+)
+
+var commandFlagNames = []struct {
+	flag CommandFlags
+	name string
+}{
+	{FlagWrite, "write"},
+	{FlagReadOnly, "readonly"},
+	{FlagBlocking, "blocking"},
+	{FlagAdmin, "admin"},
+}
+
+// names returns the names of the flags, as replied by the command "command".
+func (f CommandFlags) names() []string {
+	var names []string
+	for _, fn := range commandFlagNames {
+		if f&fn.flag != 0 {
+			names = append(names, fn.name)
+		}
+	}
+	return names
+}
+
+// CommandInfo describes the arguments of a command, like the COMMAND INFO of Redis.
+type CommandInfo struct {
+	// Arity is the number of arguments, counting the name of the command.
+	// A negative arity -n means at least n arguments, zero means unchecked.
+	// The trailing "token <t>" arguments of the commands accepting route tokens are not counted.
+	Arity int
+
+	// Flags describe the behavior of the command.
+	Flags CommandFlags
+
+	// FirstKey, LastKey and Step locate the routes among the arguments, counting the name of the command:
+	// the routes are at FirstKey, FirstKey+Step, ... up to LastKey, negative counting from the end.
+	// FirstKey is zero for the commands without a route.
+	FirstKey, LastKey, Step int
+}
+
+// accepts reports whether args, not counting the name of the command, match the arity.
+func (info CommandInfo) accepts(n int) bool {
+	switch {
+	case info.Arity > 0:
+		return n+1 == info.Arity
+	case info.Arity < 0:
+		return n+1 >= -info.Arity
+	}
+	return true
+}
+
+var commandInfos = map[string]CommandInfo{
+	"acl":          {Arity: -2, Flags: FlagAdmin},
+	"auth":         {Arity: -2},
+	"bgrewriteaof": {Arity: 1, Flags: FlagAdmin},
+	"bind":         {Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"bindings":     {Arity: -1, Flags: FlagReadOnly},
+	"claim":        {Arity: -6, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"client":       {Arity: -2, Flags: FlagAdmin},
+	"command":      {Arity: -1},
+	"config":       {Arity: -2, Flags: FlagAdmin},
+	"confirm":      {Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"configure":    {Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"copy":         {Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 2, Step: 1},
+	"cron":         {Arity: -2, Flags: FlagWrite},
+	"debug":        {Arity: -2, Flags: FlagAdmin},
+	"drain":        {Arity: -1, Flags: FlagAdmin},
+	"dump":         {Arity: -2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	"echo":         {Arity: 2},
+	"gc":           {Arity: -1, Flags: FlagAdmin},
+	"group":        {Arity: 4, Flags: FlagWrite, FirstKey: 2, LastKey: 2, Step: 1},
+	"failover":     {Arity: -1, Flags: FlagAdmin},
+	"fanout":       {Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"flushall":     {Arity: -1, Flags: FlagWrite | FlagAdmin},
+	"flushspace":   {Arity: -1, Flags: FlagWrite | FlagAdmin},
+	"health":       {Arity: -1, Flags: FlagReadOnly},
+	"info":         {Arity: -1, Flags: FlagReadOnly},
+	"latency":      {Arity: -2, Flags: FlagAdmin},
+	"length":       {Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	"memory":       {Arity: -2, Flags: FlagReadOnly},
+	"migrate":      {Arity: -4, Flags: FlagWrite, FirstKey: 3, LastKey: 3, Step: 1},
+	"namespace":    {Arity: -2, Flags: FlagAdmin},
+	"pause":        {Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"ping":         {Arity: -1},
+	"pop":          {Arity: -2, Flags: FlagWrite | FlagBlocking, FirstKey: 1, LastKey: -1, Step: 1},
+	"popdue":       {Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"popn":         {Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"push":         {Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"queueconfig":  {Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"quit":         {Arity: 1},
+	"range":        {Arity: -4, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	"remove":       {Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"removevalue":  {Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"rename":       {Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 2, Step: 1},
+	"renameroute":  {Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 2, Step: 1},
+	"replicaof":    {Arity: 3, Flags: FlagAdmin},
+	"restore":      {Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"resume":       {Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"retry":        {Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"role":         {Arity: 1, Flags: FlagReadOnly},
+	"select":       {Arity: 2},
+	"shutdown":     {Arity: -1, Flags: FlagAdmin},
+	"slowlog":      {Arity: -2, Flags: FlagAdmin},
+	"stat":         {Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	"sync":         {Arity: 1, Flags: FlagAdmin},
+	"taskstatus":   {Arity: 2, Flags: FlagReadOnly},
+	"token":        {Arity: 3, Flags: FlagAdmin},
+	"touch":        {Arity: -4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"unbind":       {Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	"update":       {Arity: 3, Flags: FlagWrite},
+	"use":          {Arity: 2},
+	"wait":         {Arity: 3, Flags: FlagBlocking},
+	"xack":         {Arity: -4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+}
+
+// RegisterCommandInfo sets the description of a command registered with RegisterCommand,
+// so that the server checks its arity before constructing it and reports it to the clients.
+// It is not safe to call RegisterCommandInfo while a server is running.
+func RegisterCommandInfo(name string, info CommandInfo) {
+	commandInfos[strings.ToLower(name)] = info
+}
+
+// checkArity returns an error if the arguments of the command do not match its arity.
+func checkArity(name string, args []string) error {
+	info, ok := commandInfos[name]
+	if !ok {
+		return nil
+	}
+	if !info.accepts(len(args)) {
+		return &WrongArityError{name}
+	}
+	return nil
+}
+
+// writeCommandInfo writes the description of the command as replied by "command",
+// [name, arity, [flags...], first key, last key, step] like Redis.
+func writeCommandInfo(b *protocolBuilder, name string) {
+	info := commandInfos[name]
+	b.WriteArrayHeader(6)
+	b.WriteString(name)
+	b.WriteInt64(int64(info.Arity))
+	flags := info.Flags.names()
+	b.WriteArrayHeader(len(flags))
+	for _, flag := range flags {
+		b.WriteStatus(flag)
+	}
+	b.WriteInt64(int64(info.FirstKey))
+	b.WriteInt64(int64(info.LastKey))
+	b.WriteInt64(int64(info.Step))
+}
@@ -3,6 +3,8 @@ package khronos
 import (
 	"context"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Command is an interface that represents a command that can be executed.
@@ -22,9 +24,15 @@ type Command interface {
 // CommandConstructor is a function that constructs a command.
 type CommandConstructor func(args []string) (Command, error)
 
-// RegisterCommand registers a command constructor.
 var commandLibraries = make(map[string]CommandConstructor)
 
+// RegisterCommand registers a command constructor under the given name.
+// Registering a name twice replaces the previous constructor.
+// It is not safe to call RegisterCommand while a server is running.
+func RegisterCommand(name string, constructor CommandConstructor) {
+	commandLibraries[strings.ToLower(name)] = constructor
+}
+
 // ArgsCommand is a command that has arguments.
 type ArgsCommand struct {
 	args []string
@@ -35,6 +43,11 @@ func (a ArgsCommand) Args() []string {
 	return a.args
 }
 
+// CommandCommand is the command "command".
+// "command" replies with the description of every command, see CommandInfo,
+// each as an array [name, arity, [flags...], first key, last key, step] like the COMMAND of Redis.
+// "command info <name>..." replies with the description of the given commands, nil for the unknown ones,
+// and "command count" with the number of commands.
 type CommandCommand struct {
 	ArgsCommand
 }
@@ -45,14 +58,36 @@ func (c *CommandCommand) Name() string {
 
 func (c *CommandCommand) Execute(_ context.Context, writer ResponseWriter) error {
 	args := c.Args()
-	if len(args) != 0 {
-		return writer.WriteError(&wrongNumberOfArgsError{c.Name()})
+	names := sortedKeys(commandLibraries)
+	if len(args) > 0 {
+		switch sub := strings.ToLower(args[0]); {
+		case sub == "count" && len(args) == 1:
+			return writer.WriteInt64(int64(len(commandLibraries)))
+		case sub == "info":
+			names = args[1:]
+		default:
+			return &wrongCommandError{command: c.Name() + "|" + sub, args: args[1:]}
+		}
 	}
-	commands := make([]string, 0, len(commandLibraries))
-	for name := range commandLibraries {
-		commands = append(commands, name)
+	builder := getprotocolBuilder()
+	defer putProtocolBuilder(builder)
+	builder.WriteArrayHeader(len(names))
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if _, ok := commandLibraries[name]; !ok {
+			builder.WriteNil()
+			continue
+		}
+		writeCommandInfo(builder, name)
 	}
-	return writer.WriteArray(commands)
+	_, err := writer.Write(builder.Bytes())
+	return err
+}
+
+func NewCommandCommand(args []string) (Command, error) {
+	cmd := &CommandCommand{}
+	cmd.args = args
+	return cmd, nil
 }
 
 // PingCommand is the command "ping".
@@ -76,12 +111,12 @@ func (c *PingCommand) Execute(_ context.Context, writer ResponseWriter) error {
 	if len(args) == 1 {
 		return writer.WriteString(args[0])
 	}
-	return writer.WriteError(&wrongNumberOfArgsError{c.Name()})
+	return writer.WriteError(&WrongArityError{c.Name()})
 }
 
 func NewPingCommand(args []string) (Command, error) {
 	if len(args) > 1 {
-		return nil, &wrongNumberOfArgsError{"ping"}
+		return nil, &WrongArityError{"ping"}
 	}
 	cmd := &PingCommand{}
 	cmd.args = args
@@ -105,20 +140,31 @@ func (c *EchoCommand) Name() string {
 func (c *EchoCommand) Execute(_ context.Context, writer ResponseWriter) error {
 	args := c.Args()
 	if len(args) != 1 {
-		return writer.WriteError(&wrongNumberOfArgsError{c.Name()})
+		return writer.WriteError(&WrongArityError{c.Name()})
 	}
 	return writer.WriteString(args[0])
 }
 
 func NewEchoCommand(args []string) (Command, error) {
 	if len(args) != 1 {
-		return nil, &wrongNumberOfArgsError{"echo"}
+		return nil, &WrongArityError{"echo"}
 	}
 	cmd := &EchoCommand{}
 	cmd.args = args
 	return cmd, nil
 }
 
+// PushCommand is the command "push".
+// "push <route> <value> [<priority>] [dedup <id> <ttl-ms>] [header <key> <value> [<key> <value>...]]" pushes an item
+// with optional headers, and replies with its id.
+// The priority "now" is the current Unix time in milliseconds, which makes a route with "order asc" a time-ordered queue.
+// Without a priority, the item gets the default priority of the route, see RouteConfig.DefaultPriority.
+// With "dedup", the item is not pushed if an item with the same id was pushed to the route
+// in the last ttl-ms milliseconds, and the reply is 0, see EnqueueOnce.
+// A route holding its maximum length, see "configure <route> maxlength <n>", fails the push with ErrRouteFull,
+// or blocks it until an item leaves the route with "configure <route> onfull block", see EnqueueContext.
+// Without "dedup", a route matching the topic patterns bound with "bind" is a topic: the item is pushed
+// to the bound routes instead, without blocking, and the reply is its id in the first of them, see Publish.
 type PushCommand struct {
 	ArgsCommand
 }
@@ -129,57 +175,375 @@ func (c *PushCommand) Name() string {
 
 func (c *PushCommand) Execute(ctx context.Context, writer ResponseWriter) error {
 	args := c.Args()
-	if len(args) != 3 {
-		return &wrongNumberOfArgsError{"push"}
+	if !validPushArgs(args) {
+		return &WrongArityError{"push"}
 	}
-	key, value, score := args[0], args[1], args[2]
-	priority, err := strconv.ParseInt(score, 10, 64)
-	if err != nil {
+	key, value := args[0], args[1]
+	score, options := splitPushArgs(args)
+	pq := PqFromContext(ctx)
+	var (
+		priority int64
+		err      error
+	)
+	switch {
+	case score == "":
+		config := pq.RouteConfig(key)
+		priority = config.DefaultPriority
+		if config.TimestampPriority {
+			priority = clockFromContext(ctx).Now().UnixMilli()
+		}
+	case strings.EqualFold(score, "now"):
+		priority = clockFromContext(ctx).Now().UnixMilli()
+	default:
+		if priority, err = strconv.ParseInt(score, 10, 64); err != nil {
+			return errNotInteger
+		}
+	}
+	item := getItem(value, priority)
+	// the item is back in the pool unless it was queued, and it may be popped and reused
+	// by another connection as soon as it is: its identifier is returned by the queue.
+	var id uint64
+	defer func() {
+		if id == 0 {
+			putItem(item)
+		}
+	}()
+	var (
+		dedupID  string
+		dedupTTL int64
+	)
+	if isDedup(options) {
+		dedupID = options[1]
+		if dedupTTL, err = strconv.ParseInt(options[2], 10, 64); err != nil || dedupTTL <= 0 {
+			return errNotInteger
+		}
+		options = options[3:]
+	}
+	if len(options) > 0 {
+		if !strings.EqualFold(options[0], "header") {
+			return errSyntax
+		}
+		for i := 1; i < len(options); i += 2 {
+			item.SetHeader(options[i], options[i+1])
+		}
+	}
+	srv := ServerFromContext(ctx)
+	// a key matching the patterns of bound routes is a topic, the item is pushed to the routes,
+	// each of them counting it against its quotas.
+	var routes []string
+	if dedupID == "" {
+		routes = pq.topicRoutes(key)
+	}
+	if len(routes) > 0 {
+		if err = pq.throttle(routes...); err != nil {
+			return err
+		}
+		for _, route := range routes {
+			if err = srv.reserveMemory(pq, route, item); err != nil {
+				return err
+			}
+		}
+		if id, err = pq.publish(routes, item); err != nil {
+			return err
+		}
+		return writer.WriteInt64(int64(id))
+	}
+	if err = pq.Throttle(key); err != nil {
 		return err
 	}
-	pq := PqFromContext(ctx)
-	item := &Item{value: value, priority: priority}
-	pq.Enqueue(key, item)
-	return writer.WriteStatus(OK)
+	if dedupID != "" && pq.Duplicate(key, dedupID) {
+		return writer.WriteInt64(0)
+	}
+	if err = srv.reserveMemory(pq, key, item); err != nil {
+		return err
+	}
+	if dedupID == "" {
+		unblock := func() {}
+		if pq.RouteConfig(key).OnFull == FullBlock {
+			unblock = markBlocked(ctx, key)
+		}
+		id, err = pq.enqueue(ctx, key, item)
+		unblock()
+		if err != nil {
+			return err
+		}
+	} else if id = pq.enqueueOnce(key, item, dedupID, time.Duration(dedupTTL)*time.Millisecond); id == 0 {
+		return writer.WriteInt64(0)
+	}
+	return writer.WriteInt64(int64(id))
+}
+
+// isDedup reports whether the options of push start with "dedup <id> <ttl-ms>".
+func isDedup(options []string) bool {
+	return len(options) >= 3 && strings.EqualFold(options[0], "dedup")
+}
+
+// splitPushArgs returns the priority of push, "" if it is omitted, and the options following it.
+func splitPushArgs(args []string) (string, []string) {
+	options := args[2:]
+	if len(options) == 0 || strings.EqualFold(options[0], "dedup") || strings.EqualFold(options[0], "header") {
+		return "", options
+	}
+	return options[0], options[1:]
+}
+
+// validPushArgs reports whether push has a route, a value, complete dedup options and complete headers.
+func validPushArgs(args []string) bool {
+	if len(args) < 2 {
+		return false
+	}
+	_, options := splitPushArgs(args)
+	if isDedup(options) {
+		options = options[3:]
+	}
+	return len(options) == 0 || (len(options) >= 3 && len(options)%2 == 1)
 }
 
 func NewPushCommand(args []string) (Command, error) {
-	if len(args) != 3 {
-		return nil, &wrongNumberOfArgsError{"push"}
+	if !validPushArgs(args) {
+		return nil, &WrongArityError{"push"}
 	}
 	cmd := &PushCommand{}
 	cmd.args = args
 	return cmd, nil
 }
 
+// PopCommand is the command "pop".
+// "pop <route>" removes the item with the highest priority of the route and replies with its value,
+// waiting for an item if the route is empty.
+// "pop <route> <route>..." waits on several routes and replies with the route and the value of the
+// first available item, the routes being checked in order.
+// "pop <route> group=<group> consumer=<consumer>" pops from a consumer group, see GroupCommand,
+// and replies with the id and the value of the item.
+// "pop <route> filter <expr>" only pops the items matching the expression, see compileFilter,
+// leaving the others in the route.
+// From a route with at-least-once delivery, see "configure <route> delivery atleastonce",
+// the id of the item precedes its value, to be given to "confirm" once the item is processed.
+// With the option "withscore", the reply is an array followed by the priority of the item, as an integer,
+// and with the option "withheaders", followed by the headers of the item as key, value pairs.
 type PopCommand struct {
 	ArgsCommand
 }
 
+// popOptions are the options of pop, given among its routes.
+type popOptions struct {
+	group       string // "group=<group>"
+	consumer    string // "consumer=<consumer>"
+	withHeaders bool   // "withheaders"
+	withScore   bool   // "withscore"
+	filtered    bool   // "filter <expr>"
+	filter      string
+}
+
+// parsePopArgs splits the routes and the options of pop.
+func parsePopArgs(args []string) ([]string, popOptions) {
+	var routes []string
+	var opts popOptions
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if v, ok := strings.CutPrefix(arg, "group="); ok {
+			opts.group = v
+		} else if v, ok := strings.CutPrefix(arg, "consumer="); ok {
+			opts.consumer = v
+		} else if strings.EqualFold(arg, "withheaders") {
+			opts.withHeaders = true
+		} else if strings.EqualFold(arg, "withscore") {
+			opts.withScore = true
+		} else if strings.EqualFold(arg, "filter") {
+			opts.filtered = true
+			if i+1 < len(args) {
+				i++
+				opts.filter = args[i]
+			}
+		} else {
+			routes = append(routes, arg)
+		}
+	}
+	return routes, opts
+}
+
+// writeSingle replies with the item popped from a single route: its value,
+// preceded by its id if the item is reserved until confirmed.
+func (opts popOptions) writeSingle(writer ResponseWriter, pq *PriorityQueueWithRouting, route string, item *Item) error {
+	if pq.isReserved(route, item) {
+		return opts.writeItem(writer, item, strconv.FormatUint(item.id, 10), item.value)
+	}
+	return opts.writeItem(writer, item, item.value)
+}
+
+// writeItem replies with fields describing the popped item, followed by its priority and its headers if requested.
+func (opts popOptions) writeItem(writer ResponseWriter, item *Item, fields ...string) error {
+	if !opts.withHeaders && !opts.withScore {
+		if len(fields) == 1 {
+			return writer.WriteString(fields[0])
+		}
+		return writer.WriteArray(fields)
+	}
+	return WriteValue(writer, opts.reply(item, fields...))
+}
+
+// reply returns fields describing the popped item, followed by its priority and its headers if requested.
+func (opts popOptions) reply(item *Item, fields ...string) []any {
+	reply := make([]any, 0, len(fields)+1+2*len(item.headers))
+	for _, field := range fields {
+		reply = append(reply, field)
+	}
+	if opts.withScore {
+		reply = append(reply, item.priority)
+	}
+	if opts.withHeaders {
+		for _, key := range sortedKeys(item.headers) {
+			reply = append(reply, key, item.headers[key])
+		}
+	}
+	return reply
+}
+
 func (c *PopCommand) Name() string {
 	return "pop"
 }
 
 func (c *PopCommand) Execute(ctx context.Context, writer ResponseWriter) error {
 	args := c.Args()
-	if len(args) != 1 {
-		return &wrongNumberOfArgsError{"pop"}
+	args, opts := parsePopArgs(args)
+	if len(args) == 0 {
+		return &WrongArityError{"pop"}
 	}
-	key := args[0]
 	pq := PqFromContext(ctx)
-	item := pq.Dequeue(key)
-	return writer.WriteString(item.value)
+	for _, key := range args {
+		if err := pq.Throttle(key); err != nil {
+			return err
+		}
+	}
+	if opts.group != "" || opts.consumer != "" {
+		if len(args) != 1 || opts.group == "" || opts.consumer == "" || opts.filtered {
+			return errSyntax
+		}
+		unblock := markBlocked(ctx, args[0])
+		item, err := pq.DequeueGroup(ctx, args[0], opts.group, opts.consumer)
+		unblock()
+		if err != nil {
+			return err
+		}
+		return opts.writeItem(writer, item, strconv.FormatUint(item.id, 10), item.value)
+	}
+	for _, key := range args {
+		// the items of a route with consumer groups only reach its groups.
+		if pq.hasGroups(key) {
+			return ErrWrongType
+		}
+	}
+	if opts.filtered && len(args) > 1 {
+		return errSyntax
+	}
+	if len(args) > 1 {
+		unblock := markBlocked(ctx, strings.Join(args, ","))
+		route, item, err := pq.DequeueAny(ctx, args...)
+		unblock()
+		if err != nil {
+			return err
+		}
+		defer pq.release(route, item)
+		if pq.isReserved(route, item) {
+			return opts.writeItem(writer, item, route, strconv.FormatUint(item.id, 10), item.value)
+		}
+		return opts.writeItem(writer, item, route, item.value)
+	}
+	key := args[0]
+	if opts.filtered {
+		match, err := compileFilter(opts.filter)
+		if err != nil {
+			return err
+		}
+		unblock := markBlocked(ctx, key)
+		item, err := pq.DequeueFunc(ctx, key, match)
+		unblock()
+		if err != nil {
+			return err
+		}
+		defer pq.release(key, item)
+		return opts.writeSingle(writer, pq, key, item)
+	}
+	unblock := markBlocked(ctx, key)
+	item, err := pq.DequeueContext(ctx, key)
+	unblock()
+	if err != nil {
+		return err
+	}
+	defer pq.release(key, item)
+	return opts.writeSingle(writer, pq, key, item)
 }
 
 func NewPopCommand(args []string) (Command, error) {
-	if len(args) != 1 {
-		return nil, &wrongNumberOfArgsError{"pop"}
+	if len(args) == 0 {
+		return nil, &WrongArityError{"pop"}
 	}
 	cmd := &PopCommand{}
 	cmd.args = args
 	return cmd, nil
 }
 
+// PopNCommand is the command "popn".
+// "popn <route> <count>" removes up to count items with the highest priorities of the route without waiting,
+// and replies with an array of their values, empty if the route is empty.
+// The options "withscore" and "withheaders" are those of "pop": with an option, or from a route with
+// at-least-once delivery, each item is replied as an array.
+type PopNCommand struct {
+	ArgsCommand
+}
+
+func (c *PopNCommand) Name() string {
+	return "popn"
+}
+
+func (c *PopNCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	routes, opts := parsePopArgs(args[2:])
+	if len(routes) > 0 || opts.group != "" || opts.consumer != "" || opts.filtered {
+		return errSyntax
+	}
+	key := args[0]
+	count, err := strconv.Atoi(args[1])
+	if err != nil || count < 0 {
+		return errNotInteger
+	}
+	pq := PqFromContext(ctx)
+	if err = pq.Throttle(key); err != nil {
+		return err
+	}
+	if pq.hasGroups(key) {
+		return ErrWrongType
+	}
+	items := pq.TryDequeueN(key, count)
+	reply := getReply(len(items))
+	defer putReply(reply)
+	for i, item := range items {
+		switch {
+		case pq.isReserved(key, item):
+			(*reply)[i] = opts.reply(item, strconv.FormatUint(item.id, 10), item.value)
+		case opts.withScore || opts.withHeaders:
+			(*reply)[i] = opts.reply(item, item.value)
+		default:
+			(*reply)[i] = item.value
+		}
+	}
+	defer func() {
+		for _, item := range items {
+			pq.release(key, item)
+		}
+	}()
+	return WriteValue(writer, *reply)
+}
+
+func NewPopNCommand(args []string) (Command, error) {
+	if len(args) < 2 {
+		return nil, &WrongArityError{"popn"}
+	}
+	cmd := &PopNCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
 type LengthCommand struct {
 	ArgsCommand
 }
@@ -191,17 +555,20 @@ func (c *LengthCommand) Name() string {
 func (c *LengthCommand) Execute(ctx context.Context, writer ResponseWriter) error {
 	args := c.Args()
 	if len(args) != 1 {
-		return &wrongNumberOfArgsError{"length"}
+		return &WrongArityError{"length"}
 	}
 	key := args[0]
 	pq := PqFromContext(ctx)
+	if err := pq.Throttle(key); err != nil {
+		return err
+	}
 	length := pq.Length(key)
 	return writer.WriteInt64(int64(length))
 }
 
 func NewLengthCommand(args []string) (Command, error) {
 	if len(args) != 1 {
-		return nil, &wrongNumberOfArgsError{"length"}
+		return nil, &WrongArityError{"length"}
 	}
 	cmd := &LengthCommand{}
 	cmd.args = args
@@ -221,7 +588,7 @@ func (c *QuitCommand) Name() string {
 func (c *QuitCommand) Execute(_ context.Context, writer ResponseWriter) error {
 	args := c.Args()
 	if len(args) != 0 {
-		return &wrongNumberOfArgsError{"quit"}
+		return &WrongArityError{"quit"}
 	}
 	_, _ = writer.Write([]byte("\r\n"))
 	return ErrQuit
@@ -229,17 +596,19 @@ func (c *QuitCommand) Execute(_ context.Context, writer ResponseWriter) error {
 
 func NewQuitCommand(args []string) (Command, error) {
 	if len(args) != 0 {
-		return nil, &wrongNumberOfArgsError{"quit"}
+		return nil, &WrongArityError{"quit"}
 	}
 	cmd := &QuitCommand{}
 	return cmd, nil
 }
 
 func init() {
+	commandLibraries["command"] = NewCommandCommand
 	commandLibraries["ping"] = NewPingCommand
 	commandLibraries["echo"] = NewEchoCommand
 	commandLibraries["push"] = NewPushCommand
 	commandLibraries["pop"] = NewPopCommand
+	commandLibraries["popn"] = NewPopNCommand
 	commandLibraries["length"] = NewLengthCommand
 	commandLibraries["quit"] = NewQuitCommand
 }
@@ -0,0 +1,1020 @@
+package khronos
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"khronos/khronostest"
+)
+
+// execute runs a command against pq and returns the raw RESP reply.
+func execute(t *testing.T, pq *PriorityQueueWithRouting, name string, args ...string) string {
+	t.Helper()
+	constructor, ok := commandLibraries[name]
+	if !ok {
+		t.Fatalf("unknown command %s", name)
+	}
+	cmd, err := constructor(args)
+	if err != nil {
+		return "-" + err.Error() + "\r\n"
+	}
+	var buf bytes.Buffer
+	writer := &responseWriter{&buf}
+	ctx := PqWithContext(context.Background(), pq)
+	if err = cmd.Execute(ctx, writer); err != nil {
+		return "-" + err.Error() + "\r\n"
+	}
+	return buf.String()
+}
+
+// benchmarkCommands runs the commands in a loop on a queue, as a connection would.
+func benchmarkCommands(b *testing.B, commands ...[]string) {
+	pq := NewPriorityQueueWithRouting()
+	ctx := PqWithContext(context.Background(), pq)
+	writer := &responseWriter{io.Discard}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, command := range commands {
+			cmd, err := commandLibraries[command[0]](command[1:])
+			if err == nil {
+				err = cmd.Execute(ctx, writer)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkPushPop(b *testing.B) {
+	benchmarkCommands(b, []string{"push", "route", "value", "1"}, []string{"pop", "route"})
+	// BenchmarkPushPop-8   	 1000000	      1116 ns/op	      96 B/op	       6 allocs/op
+}
+
+func BenchmarkPushPopN(b *testing.B) {
+	benchmarkCommands(b,
+		[]string{"push", "route", "value1", "1"},
+		[]string{"push", "route", "value2", "2"},
+		[]string{"push", "route", "value3", "3"},
+		[]string{"popn", "route", "3"},
+	)
+	// BenchmarkPushPopN-8   	  404974	      2668 ns/op	     216 B/op	      12 allocs/op
+}
+
+func TestErrorClasses(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want error
+	}{
+		{&WrongArityError{Command: "push"}, ErrWrongArity},
+		{&wrongCommandError{command: "nosuch"}, ErrUnknownCommand},
+		{&wrongCommandError{command: "cron|nosuch", args: []string{"a"}}, ErrUnknownCommand},
+	} {
+		if !errors.Is(tt.err, tt.want) {
+			t.Errorf("Expected %q to be %q", tt.err, tt.want)
+		}
+	}
+	if _, err := NewPushCommand([]string{"jobs"}); !errors.Is(err, ErrWrongArity) {
+		t.Errorf("push with a missing argument: got %v", err)
+	}
+	if errors.Is(&WrongArityError{Command: "push"}, ErrUnknownCommand) {
+		t.Error("Expected a wrong arity not to be an unknown command")
+	}
+}
+
+func TestListCommands(t *testing.T) {
+	RegisterListCommands()
+	pq := NewPriorityQueueWithRouting()
+
+	if got := execute(t, pq, "lpush", "jobs", "a", "b"); got != ":2\r\n" {
+		t.Errorf("lpush: got %q", got)
+	}
+	if got := execute(t, pq, "rpush", "jobs", "c"); got != ":3\r\n" {
+		t.Errorf("rpush: got %q", got)
+	}
+	if got := execute(t, pq, "llen", "jobs"); got != ":3\r\n" {
+		t.Errorf("llen: got %q", got)
+	}
+	if got := execute(t, pq, "rpop", "jobs"); got != "$1\r\na\r\n" {
+		t.Errorf("rpop: got %q", got)
+	}
+	if got := execute(t, pq, "blpop", "jobs", "0"); got != "*2\r\n$4\r\njobs\r\n$1\r\nb\r\n" {
+		t.Errorf("blpop: got %q", got)
+	}
+	if got := execute(t, pq, "lpop", "jobs"); got != "$1\r\nc\r\n" {
+		t.Errorf("lpop: got %q", got)
+	}
+	if got := execute(t, pq, "lpop", "jobs"); got != "$-1\r\n" {
+		t.Errorf("lpop on empty route: got %q", got)
+	}
+	if got := execute(t, pq, "brpop", "jobs", "0.01"); got != "*-1\r\n" {
+		t.Errorf("brpop timeout: got %q", got)
+	}
+
+	// the order of the items is kept by a replica, and by the items pushed to it.
+	execute(t, pq, "rpush", "jobs", "a", "b")
+	snapshot, feed, _ := pq.subscribe(1)
+	pq.unsubscribe(feed)
+	replica := NewPriorityQueueWithRouting()
+	for _, op := range snapshot {
+		replica.apply(op)
+	}
+	execute(t, replica, "rpush", "jobs", "c")
+	for _, want := range []string{"a", "b", "c"} {
+		if got := execute(t, replica, "lpop", "jobs"); got != "$1\r\n"+want+"\r\n" {
+			t.Errorf("lpop on the replica: got %q, want %q", got, want)
+		}
+	}
+
+	execute(t, pq, "configure", "reserved", "delivery", "atleastonce")
+	execute(t, pq, "rpush", "reserved", "a")
+	if got := execute(t, pq, "lpop", "reserved"); got != "-"+ErrWrongType.Error()+"\r\n" {
+		t.Errorf("lpop with at-least-once delivery: got %q", got)
+	}
+	if got := execute(t, pq, "blpop", "reserved", "0"); got != "-"+ErrWrongType.Error()+"\r\n" {
+		t.Errorf("blpop with at-least-once delivery: got %q", got)
+	}
+}
+
+func TestSortedSetCommands(t *testing.T) {
+	RegisterSortedSetCommands()
+	pq := NewPriorityQueueWithRouting()
+
+	if got := execute(t, pq, "zadd", "jobs", "1", "a", "3", "b", "2e0", "c"); got != ":3\r\n" {
+		t.Errorf("zadd: got %q", got)
+	}
+	if got := execute(t, pq, "zadd", "jobs", "1.5", "d"); got != "-"+errNotInteger.Error()+"\r\n" {
+		t.Errorf("zadd with a fractional score: got %q", got)
+	}
+	if got := execute(t, pq, "zcard", "jobs"); got != ":3\r\n" {
+		t.Errorf("zcard: got %q", got)
+	}
+	if got := execute(t, pq, "zpopmax", "jobs"); got != "*2\r\n$1\r\nb\r\n$1\r\n3\r\n" {
+		t.Errorf("zpopmax: got %q", got)
+	}
+	if got := execute(t, pq, "bzpopmax", "other", "jobs", "0"); got != "*3\r\n$4\r\njobs\r\n$1\r\nc\r\n$1\r\n2\r\n" {
+		t.Errorf("bzpopmax: got %q", got)
+	}
+	if got := execute(t, pq, "zpopmax", "jobs", "5"); got != "*2\r\n$1\r\na\r\n$1\r\n1\r\n" {
+		t.Errorf("zpopmax with count: got %q", got)
+	}
+	if got := execute(t, pq, "zpopmax", "jobs"); got != "*0\r\n" {
+		t.Errorf("zpopmax on empty route: got %q", got)
+	}
+	if got := execute(t, pq, "bzpopmax", "jobs", "0.01"); got != "*-1\r\n" {
+		t.Errorf("bzpopmax timeout: got %q", got)
+	}
+	execute(t, pq, "configure", "reserved", "delivery", "atleastonce")
+	execute(t, pq, "zadd", "reserved", "1", "a")
+	if got := execute(t, pq, "zpopmax", "reserved"); got != "-"+ErrWrongType.Error()+"\r\n" {
+		t.Errorf("zpopmax with at-least-once delivery: got %q", got)
+	}
+	if got := execute(t, pq, "bzpopmax", "reserved", "0"); got != "-"+ErrWrongType.Error()+"\r\n" {
+		t.Errorf("bzpopmax with at-least-once delivery: got %q", got)
+	}
+}
+
+func TestPopLeavesCallerItems(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	item := NewItem("a", 1)
+	id := pq.EnqueueID("jobs", item)
+
+	if got := execute(t, pq, "pop", "jobs"); got != "$1\r\na\r\n" {
+		t.Fatalf("pop: got %q", got)
+	}
+	execute(t, pq, "push", "jobs", "z", "1")
+	if item.Value() != "a" || item.ID() != id {
+		t.Errorf("Expected the item of the caller to be left as it was, got %q with id %d", item.Value(), item.ID())
+	}
+}
+
+func TestRouteMaxOps(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+
+	if got := execute(t, pq, "queueconfig", "jobs", "maxops", "2"); got != "+OK\r\n" {
+		t.Fatalf("queueconfig: got %q", got)
+	}
+	execute(t, pq, "push", "jobs", "a", "1")
+	execute(t, pq, "push", "jobs", "b", "1")
+	if got := execute(t, pq, "push", "jobs", "c", "1"); got != "-"+ErrThrottled.Error()+"\r\n" {
+		t.Errorf("push over quota: got %q", got)
+	}
+	if got := execute(t, pq, "push", "other", "c", "1"); got != ":3\r\n" {
+		t.Errorf("push to another route: got %q", got)
+	}
+	if got := execute(t, pq, "configure", "jobs", "get"); !strings.Contains(got, "$6\r\nmaxops\r\n$1\r\n2\r\n") {
+		t.Errorf("configure get: got %q", got)
+	}
+	// the alias is a command of its own, for the arity errors, the statistics and the access control.
+	if cmd, _ := commandLibraries["queueconfig"]([]string{"jobs", "get"}); cmd.Name() != "queueconfig" {
+		t.Errorf("queueconfig: got the name %q", cmd.Name())
+	}
+	if got := execute(t, pq, "queueconfig", "jobs"); got != "-"+(&WrongArityError{"queueconfig"}).Error()+"\r\n" {
+		t.Errorf("queueconfig with a wrong arity: got %q", got)
+	}
+}
+
+func TestAccounting(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+
+	execute(t, pq, "push", "a", "x", "1")
+	execute(t, pq, "push", "a", "y", "1")
+	execute(t, pq, "push", "b", "z", "1")
+	execute(t, pq, "pop", "a")
+	if err := pq.RenameRoute("a", "b", true); err != nil {
+		t.Fatal(err)
+	}
+	want := Accounting{Pushed: 3, Popped: 1, Pending: 1, Dropped: 1}
+	if got := pq.Accounting(); got != want {
+		t.Errorf("accounting: got %+v, want %+v", got, want)
+	}
+	if got := execute(t, pq, "debug", "accounting"); got != "+OK\r\n" {
+		t.Errorf("debug accounting: got %q", got)
+	}
+	pq.accounting.Popped++
+	if got := execute(t, pq, "debug", "accounting"); !strings.HasPrefix(got, "-ERR accounting mismatch") {
+		t.Errorf("debug accounting after a lost item: got %q", got)
+	}
+}
+
+func TestRenameCommand(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	pq.SetRouteConfig("acme:jobs", RouteConfig{Order: OrderAsc})
+	execute(t, pq, "push", "acme:jobs", "x", "2")
+	execute(t, pq, "push", "acme:jobs", "y", "1")
+	execute(t, pq, "push", "jobs", "z", "1")
+
+	// the items of the target are discarded, like the Redis RENAME.
+	if got := execute(t, pq, "rename", "acme:jobs", "jobs"); got != "+OK\r\n" {
+		t.Fatalf("rename: got %q", got)
+	}
+	if got := execute(t, pq, "length", "jobs"); got != ":2\r\n" {
+		t.Errorf("length after rename: got %q", got)
+	}
+	if got := execute(t, pq, "pop", "jobs"); got != "$1\r\ny\r\n" {
+		t.Errorf("pop after rename: got %q, want the order of the renamed route", got)
+	}
+	if got := execute(t, pq, "rename", "acme:jobs", "jobs"); got != "-"+ErrNoSuchRoute.Error()+"\r\n" {
+		t.Errorf("rename of a missing route: got %q", got)
+	}
+	if got := execute(t, pq, "rename", "jobs"); !strings.HasPrefix(got, "-ERR wrong number of arguments") {
+		t.Errorf("rename with one route: got %q", got)
+	}
+}
+
+func TestCopyCommand(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	execute(t, pq, "push", "jobs", "x", "1", "header", "trace", "42")
+	execute(t, pq, "push", "jobs", "y", "2")
+
+	if got := execute(t, pq, "copy", "jobs", "audit"); got != ":2\r\n" {
+		t.Fatalf("copy: got %q", got)
+	}
+	if got := execute(t, pq, "length", "jobs"); got != ":2\r\n" {
+		t.Errorf("length of the source: got %q", got)
+	}
+	if got := execute(t, pq, "dump", "audit", "items"); got != execute(t, pq, "dump", "jobs", "items") {
+		t.Errorf("dump of the copy: got %q, want the items of the source", got)
+	}
+	if got := execute(t, pq, "copy", "jobs", "audit"); got != "-"+ErrRouteExists.Error()+"\r\n" {
+		t.Errorf("copy to a route with items: got %q", got)
+	}
+	execute(t, pq, "pop", "jobs")
+	if got := execute(t, pq, "copy", "jobs", "audit", "replace"); got != ":1\r\n" {
+		t.Errorf("copy replace: got %q", got)
+	}
+	if got := execute(t, pq, "length", "audit"); got != ":1\r\n" {
+		t.Errorf("length of the replaced copy: got %q", got)
+	}
+	if got := execute(t, pq, "copy", "missing", "audit", "replace"); got != "-"+ErrNoSuchRoute.Error()+"\r\n" {
+		t.Errorf("copy of a missing route: got %q", got)
+	}
+	if got := execute(t, pq, "copy", "jobs", "jobs"); got != "-"+errSameRoute.Error()+"\r\n" {
+		t.Errorf("copy to itself: got %q", got)
+	}
+	want := Accounting{Pushed: 5, Popped: 1, Pending: 2, Dropped: 2}
+	if got := pq.Accounting(); got != want {
+		t.Errorf("accounting: got %+v, want %+v", got, want)
+	}
+}
+
+func TestFanoutCommand(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	execute(t, pq, "push", "workers:a", "x", "1")
+	execute(t, pq, "configure", "workers:b", "maxlength", "1")
+	execute(t, pq, "push", "jobs", "y", "1")
+
+	if got := execute(t, pq, "fanout", "workers:*", "reload", "5"); got != ":2\r\n" {
+		t.Fatalf("fanout: got %q", got)
+	}
+	for _, route := range []string{"workers:a", "workers:b"} {
+		if got := execute(t, pq, "range", route, "0", "0"); !strings.Contains(got, "reload") {
+			t.Errorf("range %s: got %q, want the item pushed by fanout", route, got)
+		}
+	}
+	if got := execute(t, pq, "length", "jobs"); got != ":1\r\n" {
+		t.Errorf("length of a route not matching: got %q", got)
+	}
+	if got := execute(t, pq, "fanout", "workers:*", "again", "5"); got != "-"+ErrRouteFull.Error()+"\r\n" {
+		t.Errorf("fanout to a full route: got %q", got)
+	}
+	if got := execute(t, pq, "length", "workers:a"); got != ":2\r\n" {
+		t.Errorf("length after a failed fanout: got %q, want nothing pushed", got)
+	}
+	if got := execute(t, pq, "fanout", "nobody:*", "x", "1"); got != ":0\r\n" {
+		t.Errorf("fanout matching no route: got %q", got)
+	}
+	if got := execute(t, pq, "fanout", "[", "x", "1"); got != "-"+errSyntax.Error()+"\r\n" {
+		t.Errorf("fanout with a malformed pattern: got %q", got)
+	}
+}
+
+func TestTopicBindings(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	_, feed, _ := pq.subscribe(100)
+	defer pq.unsubscribe(feed)
+	for _, b := range [][2]string{{"db", "logs.*.db"}, {"all", "logs.#"}, {"errors", "logs.error.*"}, {"errors", "#.db"}, {"db", "logs.*.db"}} {
+		if got := execute(t, pq, "bind", b[0], b[1]); got != "+OK\r\n" {
+			t.Fatalf("bind %s %s: got %q", b[0], b[1], got)
+		}
+	}
+	if n := len(feed.ops); n != 4 {
+		t.Errorf("operations of the bindings: got %d, want 4 without the binding made twice", n)
+	}
+
+	execute(t, pq, "push", "logs.error.db", "disk full", "1")
+	execute(t, pq, "push", "logs.info.web", "started", "1")
+	execute(t, pq, "push", "metrics.cpu", "90", "1")
+	for route, want := range map[string]string{"db": ":1\r\n", "all": ":2\r\n", "errors": ":1\r\n", "logs.error.db": ":0\r\n", "metrics.cpu": ":1\r\n"} {
+		if got := execute(t, pq, "length", route); got != want {
+			t.Errorf("length %s: got %q, want %q", route, got, want)
+		}
+	}
+
+	if got := execute(t, pq, "bindings", "errors"); got != "*2\r\n$11\r\nerrors #.db\r\n$19\r\nerrors logs.error.*\r\n" {
+		t.Errorf("bindings: got %q", got)
+	}
+	if got := execute(t, pq, "unbind", "all", "logs.#"); got != "+OK\r\n" {
+		t.Errorf("unbind: got %q", got)
+	}
+	if got := execute(t, pq, "unbind", "all", "logs.#"); got != "-"+ErrNoSuchBinding.Error()+"\r\n" {
+		t.Errorf("unbind twice: got %q", got)
+	}
+	execute(t, pq, "push", "logs.info.web", "stopped", "1")
+	if got := execute(t, pq, "length", "logs.info.web"); got != ":1\r\n" {
+		t.Errorf("length of a key no longer bound: got %q", got)
+	}
+
+	execute(t, pq, "configure", "db", "maxlength", "1")
+	if got := execute(t, pq, "push", "logs.warn.db", "slow", "1"); got != "-"+ErrRouteFull.Error()+"\r\n" {
+		t.Errorf("push to a full bound route: got %q", got)
+	}
+	if got := execute(t, pq, "length", "errors"); got != ":1\r\n" {
+		t.Errorf("length after a failed push: got %q, want nothing pushed", got)
+	}
+
+	// the quotas of the bound routes apply, not those of the key.
+	execute(t, pq, "configure", "errors", "maxops", "1")
+	execute(t, pq, "push", "logs.error.web", "timeout", "1")
+	if got := execute(t, pq, "push", "logs.error.web", "timeout", "1"); got != "-"+ErrThrottled.Error()+"\r\n" {
+		t.Errorf("push over the quota of a bound route: got %q", got)
+	}
+	// a push throttled by one of the routes takes no token from the others.
+	execute(t, pq, "configure", "audit", "maxops", "2")
+	execute(t, pq, "bind", "audit", "logs.error.*")
+	if got := execute(t, pq, "push", "logs.error.web", "timeout", "1"); got != "-"+ErrThrottled.Error()+"\r\n" {
+		t.Errorf("push over the quota of one of the bound routes: got %q", got)
+	}
+	for i := 0; i < 2; i++ {
+		if got := execute(t, pq, "push", "audit", "login", "1"); strings.HasPrefix(got, "-") {
+			t.Errorf("push within the quota of the route: got %q", got)
+		}
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"logs.error.db", "logs.error.db", true},
+		{"logs.*.db", "logs.error.db", true},
+		{"logs.*", "logs.error.db", false},
+		{"logs.#", "logs.error.db", true},
+		{"logs.#", "logs", true},
+		{"#", "logs.error.db", true},
+		{"#.db", "logs.error.db", true},
+		{"logs.#.db", "logs.db", true},
+		{"logs.#.web", "logs.error.db", false},
+		{"*.*", "logs", false},
+		{"#.*.#", "logs", true},
+		{strings.Repeat("#.", 40) + "db", strings.Repeat("logs.", 40) + "web", false},
+	} {
+		if got := matchTopic(strings.Split(tt.pattern, "."), strings.Split(tt.topic, ".")); got != tt.want {
+			t.Errorf("matchTopic(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestPopDueCommand(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	execute(t, pq, "configure", "timers", "order", "asc")
+	for _, at := range []string{"3000", "1000", "2000", "9000"} {
+		execute(t, pq, "push", "timers", "t"+at, at)
+	}
+
+	if got := execute(t, pq, "popdue", "timers", "2500", "10"); got != "*2\r\n$5\r\nt1000\r\n$5\r\nt2000\r\n" {
+		t.Errorf("popdue: got %q", got)
+	}
+	if got := execute(t, pq, "popdue", "timers", "2500"); got != "*0\r\n" {
+		t.Errorf("popdue with nothing due: got %q", got)
+	}
+	if got := execute(t, pq, "popdue", "timers", "9000", "withscore"); got != "*1\r\n*2\r\n$5\r\nt3000\r\n:3000\r\n" {
+		t.Errorf("popdue withscore: got %q", got)
+	}
+
+	// on a route dequeuing the highest priority first, the due items are the last ones.
+	for _, priority := range []string{"1", "5", "2", "8"} {
+		execute(t, pq, "push", "jobs", "p"+priority, priority)
+	}
+	if got := execute(t, pq, "popdue", "jobs", "4", "10"); got != "*2\r\n$2\r\np2\r\n$2\r\np1\r\n" {
+		t.Errorf("popdue in descending order: got %q", got)
+	}
+	if got := execute(t, pq, "length", "jobs"); got != ":2\r\n" {
+		t.Errorf("length after popdue: got %q", got)
+	}
+	if got := execute(t, pq, "popdue", "jobs", "soon"); got != "-"+errNotInteger.Error()+"\r\n" {
+		t.Errorf("popdue with a bad bound: got %q", got)
+	}
+}
+
+func TestPushMaxLength(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+
+	execute(t, pq, "configure", "jobs", "maxlength", "1")
+	execute(t, pq, "push", "jobs", "a", "1")
+	if got := execute(t, pq, "push", "jobs", "b", "1"); got != "-"+ErrRouteFull.Error()+"\r\n" {
+		t.Errorf("push to a full route: got %q", got)
+	}
+	if got := execute(t, pq, "configure", "jobs", "onfull", "wait"); got != "-"+errSyntax.Error()+"\r\n" {
+		t.Errorf("configure onfull: got %q", got)
+	}
+}
+
+func TestPopWithScore(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+
+	execute(t, pq, "push", "jobs", "a", "1")
+	execute(t, pq, "push", "jobs", "b", "-2", "header", "k", "v")
+	execute(t, pq, "push", "jobs", "c", "3")
+	if got := execute(t, pq, "pop", "jobs", "withscore"); got != "*2\r\n$1\r\nc\r\n:3\r\n" {
+		t.Errorf("pop withscore: got %q", got)
+	}
+	if got := execute(t, pq, "popn", "jobs", "5", "withscore", "withheaders"); got != "*2\r\n*2\r\n$1\r\na\r\n:1\r\n*4\r\n$1\r\nb\r\n:-2\r\n$1\r\nk\r\n$1\r\nv\r\n" {
+		t.Errorf("popn withscore withheaders: got %q", got)
+	}
+	if got := execute(t, pq, "popn", "jobs", "5"); got != "*0\r\n" {
+		t.Errorf("popn from an empty route: got %q", got)
+	}
+
+	execute(t, pq, "configure", "jobs", "delivery", "atleastonce")
+	execute(t, pq, "push", "jobs", "d", "4")
+	execute(t, pq, "push", "jobs", "e", "5")
+	if got := execute(t, pq, "popn", "jobs", "1"); got != "*1\r\n*2\r\n$1\r\n5\r\n$1\r\ne\r\n" {
+		t.Errorf("popn reserved: got %q", got)
+	}
+	if got := execute(t, pq, "pop", "jobs", "withscore"); got != "*3\r\n$1\r\n4\r\n$1\r\nd\r\n:4\r\n" {
+		t.Errorf("pop reserved withscore: got %q", got)
+	}
+	if got := execute(t, pq, "popn", "jobs", "x"); got != "-"+errNotInteger.Error()+"\r\n" {
+		t.Errorf("popn with an invalid count: got %q", got)
+	}
+}
+
+func TestPushDefaultPriority(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	ctx := context.WithValue(context.Background(), ServerContextKey, &Server{Clock: khronostest.NewClock(time.UnixMilli(1000))})
+	push := func(args ...string) string {
+		t.Helper()
+		cmd, err := NewPushCommand(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err = cmd.Execute(PqWithContext(ctx, pq), &responseWriter{&buf}); err != nil {
+			return err.Error()
+		}
+		return buf.String()
+	}
+
+	push("jobs", "a")
+	push("jobs", "b", "header", "k", "v")
+	execute(t, pq, "configure", "jobs", "defaultpriority", "7")
+	push("jobs", "c", "dedup", "c", "1000")
+	push("jobs", "d", "now")
+	execute(t, pq, "configure", "jobs", "defaultpriority", "now")
+	execute(t, pq, "configure", "jobs", "order", "asc")
+	push("jobs", "e")
+	if got := push("jobs", "f", "soon"); got != errNotInteger.Error() {
+		t.Errorf("push with an invalid priority: got %q", got)
+	}
+
+	var got []string
+	for pq.Length("jobs") > 0 {
+		item := pq.Dequeue("jobs")
+		got = append(got, fmt.Sprintf("%s:%d:%s", item.Value(), item.Priority(), item.Header("k")))
+	}
+	if want := "a:0: b:0:v c:7: d:1000: e:1000:"; strings.Join(got, " ") != want {
+		t.Errorf("got %q, want %q", strings.Join(got, " "), want)
+	}
+}
+
+func TestRemoveCommands(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+
+	execute(t, pq, "push", "jobs", "a", "3")
+	execute(t, pq, "push", "jobs", "b", "2")
+	execute(t, pq, "push", "jobs", "a", "1")
+	execute(t, pq, "push", "other", "c", "1")
+	if got := execute(t, pq, "remove", "other", "2"); got != ":0\r\n" {
+		t.Errorf("remove from another route: got %q", got)
+	}
+	if got := execute(t, pq, "remove", "jobs", "2"); got != ":1\r\n" {
+		t.Errorf("remove: got %q", got)
+	}
+	if got := execute(t, pq, "remove", "jobs", "2"); got != ":0\r\n" {
+		t.Errorf("remove twice: got %q", got)
+	}
+	if got := execute(t, pq, "removevalue", "jobs", "a"); got != ":2\r\n" {
+		t.Errorf("removevalue: got %q", got)
+	}
+	if n := pq.Length("jobs"); n != 0 {
+		t.Errorf("length: got %d", n)
+	}
+	if err := pq.Accounting().Check(); err != nil {
+		t.Error(err)
+	}
+
+	// the paged items are removed as well.
+	pq.SetOverflowDir(t.TempDir())
+	pq.SetRouteConfig("paged", RouteConfig{MaxInMemory: 2})
+	for i := 0; i < 10; i++ {
+		execute(t, pq, "push", "paged", []string{"a", "b"}[i%2], fmt.Sprint(i))
+	}
+	if got := execute(t, pq, "removevalue", "paged", "a"); got != ":5\r\n" {
+		t.Errorf("removevalue paged: got %q", got)
+	}
+	for pq.Length("paged") > 0 {
+		if item := pq.Dequeue("paged"); item.Value() != "b" {
+			t.Errorf("Expected only b to remain, got %v", item)
+		}
+	}
+	if err := pq.Accounting().Check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConsumerGroups(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+
+	execute(t, pq, "group", "create", "jobs", "billing")
+	execute(t, pq, "group", "create", "jobs", "audit")
+	if got := execute(t, pq, "group", "create", "jobs", "audit"); got != "-ERR consumer group already exists\r\n" {
+		t.Errorf("create twice: got %q", got)
+	}
+	execute(t, pq, "push", "jobs", "a", "1")
+	execute(t, pq, "push", "jobs", "b", "2")
+
+	// every group sees every item, each delivered to a single consumer of the group.
+	if got := execute(t, pq, "pop", "jobs", "group=billing", "consumer=w1"); got != "*2\r\n$1\r\n4\r\n$1\r\nb\r\n" {
+		t.Errorf("pop billing: got %q", got)
+	}
+	if got := execute(t, pq, "pop", "jobs", "group=billing", "consumer=w2"); got != "*2\r\n$1\r\n2\r\n$1\r\na\r\n" {
+		t.Errorf("pop billing again: got %q", got)
+	}
+	if got := execute(t, pq, "pop", "jobs", "group=audit", "consumer=w1"); got != "*2\r\n$1\r\n3\r\n$1\r\nb\r\n" {
+		t.Errorf("pop audit: got %q", got)
+	}
+	if got := execute(t, pq, "pop", "jobs"); got != "-"+ErrWrongType.Error()+"\r\n" {
+		t.Errorf("pop without a group: got %q", got)
+	}
+	if got := execute(t, pq, "group", "pending", "jobs", "billing"); !strings.HasPrefix(got, "*8\r\n$1\r\n2\r\n$2\r\nw2\r\n") {
+		t.Errorf("pending: got %q", got)
+	}
+	if a := pq.Accounting(); a.Inflight != 3 || a.Pending != 1 {
+		t.Errorf("accounting: got %+v", a)
+	}
+
+	if got := execute(t, pq, "xack", "jobs", "billing", "4", "42"); got != ":1\r\n" {
+		t.Errorf("xack: got %q", got)
+	}
+	if got := execute(t, pq, "claim", "jobs", "billing", "w3", "0", "2", "4"); got != "*2\r\n$1\r\n2\r\n$1\r\na\r\n" {
+		t.Errorf("claim: got %q", got)
+	}
+	if got := execute(t, pq, "claim", "jobs", "billing", "w1", "60000", "2"); got != "*0\r\n" {
+		t.Errorf("claim of a recent delivery: got %q", got)
+	}
+	entries, _ := pq.Pending("jobs", "billing")
+	if len(entries) != 1 || entries[0].Consumer != "w3" || entries[0].Deliveries != 2 {
+		t.Errorf("pending after claim: got %+v", entries)
+	}
+
+	if got := execute(t, pq, "group", "destroy", "jobs", "audit"); got != "+OK\r\n" {
+		t.Errorf("destroy: got %q", got)
+	}
+	if got := execute(t, pq, "xack", "jobs", "audit", "3"); got != "-ERR no such consumer group\r\n" {
+		t.Errorf("xack on a destroyed group: got %q", got)
+	}
+	if err := pq.Accounting().Check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	_, feed, _ := pq.subscribe(100)
+	defer pq.unsubscribe(feed)
+
+	execute(t, pq, "group", "create", "jobs", "workers")
+	execute(t, pq, "configure", "jobs", "retrybackoff", "10ms")
+	execute(t, pq, "push", "jobs", "a", "1")
+	execute(t, pq, "pop", "jobs", "group=workers", "consumer=w1")
+
+	if got := execute(t, pq, "retry", "jobs", "1", "0"); got != ":0\r\n" {
+		t.Errorf("retry: got %q", got)
+	}
+	if got := execute(t, pq, "retry", "jobs", "1"); got != "-ERR no such item\r\n" {
+		t.Errorf("retry of an item not pending: got %q", got)
+	}
+	want := "*4\r\n$1\r\n2\r\n$1\r\na\r\n$7\r\nattempt\r\n$1\r\n2\r\n"
+	if got := execute(t, pq, "pop", "jobs", "group=workers", "consumer=w1", "withheaders"); got != want {
+		t.Errorf("pop retried item: got %q", got)
+	}
+
+	// without delay, the backoff of the route applies: 10ms doubled before the third attempt.
+	if got := execute(t, pq, "retry", "jobs", "2"); got != ":20\r\n" {
+		t.Errorf("retry with backoff: got %q", got)
+	}
+	if a := pq.Accounting(); a.Inflight != 1 || a.Pending != 0 || a.Check() != nil {
+		t.Errorf("accounting during the backoff: got %+v", a)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	item, err := pq.DequeueGroup(ctx, "jobs", "workers", "w2")
+	if err != nil || item.Attempt() != 3 {
+		t.Fatalf("dequeue after the backoff: got %v, %v", item, err)
+	}
+	if err := pq.Accounting().Check(); err != nil {
+		t.Error(err)
+	}
+
+	// the retries are replicated: the given up deliveries are no longer pending.
+	replica := NewPriorityQueueWithRouting()
+	for len(feed.ops) > 0 {
+		replica.apply(<-feed.ops)
+	}
+	if entries, _ := replica.Pending("jobs", "workers"); len(entries) != 1 || entries[0].Consumer != "w2" {
+		t.Errorf("replicated pending entries: got %+v", entries)
+	}
+
+	config := RouteConfig{RetryBackoff: time.Second, RetryMaxBackoff: 5 * time.Second}
+	for attempt, want := range map[int]time.Duration{2: time.Second, 3: 2 * time.Second, 4: 4 * time.Second, 5: 5 * time.Second, 100: 5 * time.Second} {
+		if got := config.backoff(attempt); got != want {
+			t.Errorf("backoff(%d): got %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestAtLeastOnceDelivery(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+
+	execute(t, pq, "configure", "jobs", "delivery", "atleastonce")
+	execute(t, pq, "configure", "jobs", "visibility", "20ms")
+	execute(t, pq, "push", "jobs", "a", "1")
+	execute(t, pq, "push", "jobs", "b", "1")
+
+	if got := execute(t, pq, "pop", "jobs"); got != "*2\r\n$1\r\n1\r\n$1\r\na\r\n" {
+		t.Errorf("pop: got %q", got)
+	}
+	if got := execute(t, pq, "confirm", "jobs", "1", "1"); got != ":1\r\n" {
+		t.Errorf("confirm: got %q", got)
+	}
+
+	// b is not confirmed, and comes back after the visibility timeout.
+	execute(t, pq, "pop", "jobs")
+	if a := pq.Accounting(); a.Inflight != 1 || a.Check() != nil {
+		t.Errorf("accounting while reserved: got %+v", a)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	item, err := pq.DequeueContext(ctx, "jobs")
+	if err != nil || item.Value() != "b" || item.Attempt() != 2 {
+		t.Fatalf("dequeue after the visibility timeout: got %v, %v", item, err)
+	}
+	if n := pq.Confirm("jobs", 2); n != 0 {
+		t.Errorf("confirm after the visibility timeout: got %d", n)
+	}
+	pq.Confirm("jobs", item.ID())
+	if a := pq.Accounting(); a.Inflight != 0 || a.Check() != nil {
+		t.Errorf("accounting: got %+v", a)
+	}
+
+	execute(t, pq, "configure", "jobs", "delivery", "atmostonce")
+	execute(t, pq, "push", "jobs", "c", "1")
+	if got := execute(t, pq, "pop", "jobs"); got != "$1\r\nc\r\n" {
+		t.Errorf("pop at most once: got %q", got)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	clock := khronostest.NewClock(time.Now())
+	pq.SetClock(clock)
+
+	execute(t, pq, "configure", "jobs", "delivery", "atleastonce")
+	execute(t, pq, "configure", "jobs", "visibility", "20ms")
+	execute(t, pq, "push", "jobs", "a", "1")
+	execute(t, pq, "push", "jobs", "b", "1")
+	execute(t, pq, "pop", "jobs")
+	execute(t, pq, "pop", "jobs")
+
+	if got := execute(t, pq, "touch", "jobs", "1", "5000"); got != ":1\r\n" {
+		t.Errorf("touch: got %q", got)
+	}
+	// b comes back after the visibility timeout, a stays reserved.
+	clock.Advance(time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if item, err := pq.DequeueContext(ctx, "jobs"); err != nil || item.Value() != "b" {
+		t.Fatalf("dequeue after the visibility timeout: got %v, %v", item, err)
+	}
+	if n := pq.Length("jobs"); n != 0 {
+		t.Errorf("Expected the touched item to stay reserved, got %d items", n)
+	}
+	if n := pq.Confirm("jobs", 1); n != 1 {
+		t.Errorf("confirm: got %d", n)
+	}
+	if got := execute(t, pq, "touch", "jobs", "1", "5000"); got != ":0\r\n" {
+		t.Errorf("touch after confirm: got %q", got)
+	}
+	if got := execute(t, pq, "touch", "jobs", "1", "0"); got != "-"+errNotInteger.Error()+"\r\n" {
+		t.Errorf("touch with a zero delay: got %q", got)
+	}
+}
+
+func TestGC(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+
+	execute(t, pq, "push", "user:1", "a", "1")
+	execute(t, pq, "pop", "user:1")
+	execute(t, pq, "push", "user:2", "b", "1")
+	if got := execute(t, pq, "gc", "60000"); got != ":0\r\n" {
+		t.Errorf("gc of recent routes: got %q", got)
+	}
+	if got := execute(t, pq, "gc"); got != ":1\r\n" {
+		t.Errorf("gc: got %q", got)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+
+	execute(t, pq, "push", "acme:jobs", "a", "1")
+	if got := execute(t, pq, "namespace", "config", "acme", "maxitems", "2"); got != "+OK\r\n" {
+		t.Errorf("namespace config: got %q", got)
+	}
+	execute(t, pq, "namespace", "config", "acme", "maxops", "2")
+	execute(t, pq, "push", "acme:mail", "b", "1")
+	if got := execute(t, pq, "push", "acme:jobs", "c", "1"); got != "-QUOTA namespace quota exceeded\r\n" {
+		t.Errorf("push over maxitems: got %q", got)
+	}
+	// the other namespaces are not limited.
+	execute(t, pq, "push", "other:jobs", "c", "1")
+	execute(t, pq, "push", "other:jobs", "d", "1")
+
+	if got := execute(t, pq, "length", "acme:jobs"); got != "-THROTTLED route operations quota exceeded\r\n" {
+		t.Errorf("operation over maxops: got %q", got)
+	}
+	want := "*10\r\n$6\r\nroutes\r\n$1\r\n2\r\n$5\r\nitems\r\n$1\r\n2\r\n$6\r\nmemory\r\n$3\r\n258\r\n" +
+		"$9\r\nthrottled\r\n$1\r\n1\r\n$8\r\nrejected\r\n$1\r\n1\r\n"
+	if got := execute(t, pq, "namespace", "stats", "acme"); got != want {
+		t.Errorf("namespace stats: got %q", got)
+	}
+	if got := execute(t, pq, "namespace", "list"); got != "*2\r\n$4\r\nacme\r\n$5\r\nother\r\n" {
+		t.Errorf("namespace list: got %q", got)
+	}
+
+	// a route renamed out of the namespace no longer counts.
+	if err := pq.RenameRoute("acme:mail", "mail", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := pq.admit("acme:jobs", 1, 1); err != nil {
+		t.Errorf("admit after the rename: %v", err)
+	}
+}
+
+func TestItemHeaders(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+
+	if got := execute(t, pq, "push", "jobs", "a", "1", "header", "trace", "t1", "tenant", "acme"); got != ":1\r\n" {
+		t.Errorf("push with headers: got %q", got)
+	}
+	if got := execute(t, pq, "push", "jobs", "b", "1", "header", "trace"); !strings.HasPrefix(got, "-ERR wrong number of arguments") {
+		t.Errorf("push with an incomplete header: got %q", got)
+	}
+	if got := execute(t, pq, "push", "jobs", "b", "1", "headers", "k", "v"); got != "-ERR syntax error\r\n" {
+		t.Errorf("push with a misspelled option: got %q", got)
+	}
+	execute(t, pq, "push", "jobs", "b", "0")
+
+	// the operations carry the headers to the replicas.
+	_, feed, _ := pq.subscribe(1)
+	item := NewItem("c", 0)
+	item.SetHeader("k", "v")
+	pq.Enqueue("other", item)
+	op := <-feed.ops
+	args := op.args()
+	if parsed, err := parseQueueOp(args[0], args[1:]); err != nil || parsed.headers["k"] != "v" {
+		t.Errorf("parse %q: got %+v, %v", args, parsed, err)
+	}
+	pq.unsubscribe(feed)
+
+	want := "*5\r\n$1\r\na\r\n$6\r\ntenant\r\n$4\r\nacme\r\n$5\r\ntrace\r\n$2\r\nt1\r\n"
+	if got := execute(t, pq, "pop", "jobs", "withheaders"); got != want {
+		t.Errorf("pop withheaders: got %q", got)
+	}
+	if got := execute(t, pq, "pop", "jobs", "withheaders"); got != "*1\r\n$1\r\nb\r\n" {
+		t.Errorf("pop withheaders without headers: got %q", got)
+	}
+}
+
+func TestPushDedup(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+
+	if got := execute(t, pq, "push", "jobs", "a", "1", "dedup", "order-1", "60000"); got != ":1\r\n" {
+		t.Errorf("push: got %q", got)
+	}
+	if got := execute(t, pq, "push", "jobs", "a", "1", "dedup", "order-1", "60000", "header", "k", "v"); got != ":0\r\n" {
+		t.Errorf("push again: got %q", got)
+	}
+	// the ids are scoped to the route.
+	if got := execute(t, pq, "push", "other", "a", "1", "dedup", "order-1", "60000"); got != ":2\r\n" {
+		t.Errorf("push to another route: got %q", got)
+	}
+	if got := execute(t, pq, "push", "jobs", "b", "1", "dedup", "order-2", "0"); got != "-"+errNotInteger.Error()+"\r\n" {
+		t.Errorf("push with a zero ttl: got %q", got)
+	}
+	if got := execute(t, pq, "push", "jobs", "b", "1", "dedup", "order-2"); !strings.HasPrefix(got, "-ERR wrong number of arguments") {
+		t.Errorf("push without a ttl: got %q", got)
+	}
+	if n := pq.Length("jobs"); n != 1 {
+		t.Errorf("Expected 1 item, got %d", n)
+	}
+
+	if !pq.EnqueueOnce("jobs", NewItem("b", 1), "order-2", time.Millisecond) {
+		t.Fatal("Expected the item to be enqueued")
+	}
+	time.Sleep(2 * time.Millisecond)
+	if !pq.EnqueueOnce("jobs", NewItem("b", 1), "order-2", time.Millisecond) {
+		t.Error("Expected the item to be enqueued once the id expired")
+	}
+}
+
+func TestPauseCommands(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	execute(t, pq, "push", "jobs", "a", "1")
+
+	if got := execute(t, pq, "pause", "jobs"); got != "+OK\r\n" {
+		t.Errorf("pause: got %q", got)
+	}
+	if got := execute(t, pq, "stat", "jobs"); !strings.HasSuffix(got, "$6\r\npaused\r\n$1\r\n1\r\n") {
+		t.Errorf("stat: got %q", got)
+	}
+	if got := execute(t, pq, "resume", "jobs"); got != ":1\r\n" {
+		t.Errorf("resume: got %q", got)
+	}
+	if got := execute(t, pq, "resume", "jobs"); got != ":0\r\n" {
+		t.Errorf("resume again: got %q", got)
+	}
+	if got := execute(t, pq, "pop", "jobs"); got != "$1\r\na\r\n" {
+		t.Errorf("pop: got %q", got)
+	}
+}
+
+func TestFilteredPop(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+
+	execute(t, pq, "push", "jobs", "a", "3", "header", "tenant", "other")
+	execute(t, pq, "push", "jobs", "b", "2", "header", "tenant", "acme")
+	execute(t, pq, "push", "jobs", "c", "1", "header", "tenant", "acme", "attempt", "2")
+
+	if got := execute(t, pq, "pop", "jobs", "filter", `tenant == "acme"`); got != "$1\r\nb\r\n" {
+		t.Errorf("pop filter: got %q", got)
+	}
+	if got := execute(t, pq, "pop", "jobs", "filter", `tenant != "other" && (attempt >= 2 || value == "x")`, "withheaders"); got != "*5\r\n$1\r\nc\r\n$7\r\nattempt\r\n$1\r\n2\r\n$6\r\ntenant\r\n$4\r\nacme\r\n" {
+		t.Errorf("pop filter withheaders: got %q", got)
+	}
+	for _, expr := range []string{"", "tenant", `tenant == "acme`, "tenant = 1", "(priority > 1"} {
+		if got := execute(t, pq, "pop", "jobs", "filter", expr); !strings.HasPrefix(got, "-ERR invalid filter") {
+			t.Errorf("pop filter %q: got %q", expr, got)
+		}
+	}
+	if got := execute(t, pq, "pop", "jobs", "other", "filter", "priority > 0"); got != "-ERR syntax error\r\n" {
+		t.Errorf("pop filter on several routes: got %q", got)
+	}
+	if got := execute(t, pq, "pop", "jobs", "filter", "priority > 2"); got != "$1\r\na\r\n" {
+		t.Errorf("pop filter on the priority: got %q", got)
+	}
+}
+
+func TestRangeCommand(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+
+	execute(t, pq, "push", "jobs", "b", "2")
+	execute(t, pq, "push", "jobs", "c", "1")
+	execute(t, pq, "push", "jobs", "a", "3")
+	execute(t, pq, "push", "jobs", "d", "1")
+	if got := execute(t, pq, "range", "jobs", "0", "-1"); got != "*4\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n" {
+		t.Errorf("range: got %q", got)
+	}
+	if got := execute(t, pq, "range", "jobs", "-1", "-1", "withscores"); got != "*2\r\n$1\r\nd\r\n$1\r\n1\r\n" {
+		t.Errorf("range withscores: got %q", got)
+	}
+	if n := pq.Length("jobs"); n != 4 {
+		t.Errorf("range removed items: length %d", n)
+	}
+
+	// the cursor of b is its priority and its identifier.
+	if got := execute(t, pq, "range", "jobs", "0", "1", "after", "0"); got != "*3\r\n$3\r\n2:1\r\n$1\r\na\r\n$1\r\nb\r\n" {
+		t.Fatalf("range first page: got %q", got)
+	}
+	// popping a does not shift the next page.
+	pq.Dequeue("jobs")
+	if got := execute(t, pq, "range", "jobs", "0", "1", "after", "2:1"); got != "*3\r\n$1\r\n0\r\n$1\r\nc\r\n$1\r\nd\r\n" {
+		t.Errorf("range last page: got %q", got)
+	}
+}
+
+func TestRouteOrder(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+
+	execute(t, pq, "push", "jobs", "low", "1")
+	execute(t, pq, "push", "jobs", "high", "3")
+	execute(t, pq, "push", "jobs", "mid", "2")
+	if got := execute(t, pq, "configure", "jobs", "order", "asc"); got != "+OK\r\n" {
+		t.Fatalf("configure order: got %q", got)
+	}
+	if got := execute(t, pq, "pop", "jobs"); got != "$3\r\nlow\r\n" {
+		t.Errorf("pop asc: got %q", got)
+	}
+	execute(t, pq, "configure", "jobs", "order", "desc")
+	if got := execute(t, pq, "pop", "jobs"); got != "$4\r\nhigh\r\n" {
+		t.Errorf("pop desc: got %q", got)
+	}
+	if got := execute(t, pq, "configure", "jobs", "order", "up"); got != "-"+errSyntax.Error()+"\r\n" {
+		t.Errorf("configure invalid order: got %q", got)
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+
+	execute(t, pq, "push", "jobs", "a", "1")
+	execute(t, pq, "push", "jobs", "b", "2", "header", "k", "v")
+	if got := execute(t, pq, "dump", "jobs", "items"); got != "*2\r\n*4\r\n$1\r\nb\r\n:2\r\n$1\r\nk\r\n$1\r\nv\r\n*2\r\n$1\r\na\r\n:1\r\n" {
+		t.Errorf("dump items: got %q", got)
+	}
+
+	blob := string(pq.Dump("jobs"))
+	if got := execute(t, pq, "restore", "copy", blob); got != ":2\r\n" {
+		t.Errorf("restore: got %q", got)
+	}
+	if got := execute(t, pq, "dump", "copy", "items"); got != execute(t, pq, "dump", "jobs", "items") {
+		t.Errorf("restored items: got %q", got)
+	}
+	if got := execute(t, pq, "restore", "copy", blob); got != "-"+ErrRouteExists.Error()+"\r\n" {
+		t.Errorf("restore to a route with items: got %q", got)
+	}
+	execute(t, pq, "push", "copy", "c", "3")
+	if got := execute(t, pq, "restore", "copy", blob, "replace"); got != ":2\r\n" {
+		t.Errorf("restore replace: got %q", got)
+	}
+	if n := pq.Length("copy"); n != 2 {
+		t.Errorf("restore replace: got %d items, want 2", n)
+	}
+
+	corrupt := []byte(blob)
+	corrupt[len(dumpMagic)+4] ^= 1
+	if got := execute(t, pq, "restore", "other", string(corrupt)); got != "-"+errDumpPayload.Error()+"\r\n" {
+		t.Errorf("restore a corrupt blob: got %q", got)
+	}
+	if got := execute(t, pq, "restore", "other", string(pq.Dump("empty"))); got != ":0\r\n" {
+		t.Errorf("restore an empty route: got %q", got)
+	}
+}
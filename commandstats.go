@@ -0,0 +1,61 @@
+package khronos
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// commandStat holds the execution statistics of a command, see "info commandstats".
+type commandStat struct {
+	calls  int64
+	errors int64
+	total  time.Duration
+	max    time.Duration
+}
+
+// commandStats holds the execution statistics of the commands of a server, by name.
+type commandStats struct {
+	mu    sync.Mutex
+	stats map[string]*commandStat
+}
+
+// record adds an execution of the command which took elapsed and failed if err is not nil.
+func (s *commandStats) record(name string, elapsed time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stats == nil {
+		s.stats = make(map[string]*commandStat)
+	}
+	stat, ok := s.stats[name]
+	if !ok {
+		stat = &commandStat{}
+		s.stats[name] = stat
+	}
+	stat.calls++
+	stat.total += elapsed
+	stat.max = max(stat.max, elapsed)
+	if err != nil {
+		stat.errors++
+	}
+}
+
+func (s *commandStats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.stats)
+}
+
+// fields returns the "info commandstats" lines, a line per command executed, sorted by name.
+func (s *commandStats) fields() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fields := make([]string, 0, len(s.stats))
+	for _, name := range sortedKeys(s.stats) {
+		stat := s.stats[name]
+		usec := stat.total.Microseconds()
+		fields = append(fields, fmt.Sprintf("cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,max_usec=%d,errors=%d",
+			name, stat.calls, usec, float64(usec)/float64(stat.calls), stat.max.Microseconds(), stat.errors))
+	}
+	return fields
+}
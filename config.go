@@ -0,0 +1,263 @@
+package khronos
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serverSettings are the settings of a server which can be changed at runtime by the "config" command.
+// They start from the fields of the Server, which are not read again once the server runs,
+// and are replaced as a whole, see updateSettings.
+type serverSettings struct {
+	slowLogThreshold time.Duration
+	slowLogMaxLen    int
+	latencyThreshold time.Duration
+	maxMemory        int64
+	maxMemoryPolicy  MemoryPolicy
+	keepAlive        time.Duration
+	// logLevel is the lowest level of the messages passed to Server.Logger, which filters them too.
+	logLevel slog.Level
+}
+
+// getSettings returns the settings of the server.
+func (srv *Server) getSettings() *serverSettings {
+	if s := srv.settings.Load(); s != nil {
+		return s
+	}
+	srv.settings.CompareAndSwap(nil, &serverSettings{
+		slowLogThreshold: srv.SlowLogThreshold,
+		slowLogMaxLen:    srv.SlowLogMaxLen,
+		latencyThreshold: srv.LatencyMonitorThreshold,
+		maxMemory:        srv.MaxMemory,
+		maxMemoryPolicy:  srv.MaxMemoryPolicy,
+		keepAlive:        srv.KeepAlive,
+		logLevel:         slog.LevelDebug,
+	})
+	return srv.settings.Load()
+}
+
+// updateSettings replaces the settings of the server with a copy changed by update.
+func (srv *Server) updateSettings(update func(s *serverSettings) error) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	s := *srv.getSettings()
+	if err := update(&s); err != nil {
+		return err
+	}
+	srv.settings.Store(&s)
+	return nil
+}
+
+// serverOption is a setting of a server which can be changed at runtime by the "config" command.
+type serverOption struct {
+	get func(srv *Server) string
+	set func(srv *Server, value string) error
+}
+
+// durationOption is an option of the settings in milliseconds.
+func durationOption(field func(s *serverSettings) *time.Duration) serverOption {
+	return serverOption{
+		get: func(srv *Server) string { return strconv.FormatInt(field(srv.getSettings()).Milliseconds(), 10) },
+		set: func(srv *Server, value string) error {
+			ms, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			return srv.updateSettings(func(s *serverSettings) error {
+				*field(s) = time.Duration(ms) * time.Millisecond
+				return nil
+			})
+		},
+	}
+}
+
+var serverOptions = map[string]serverOption{
+	"allowcidrs": {
+		get: func(srv *Server) string { return formatCIDRs(srv.getIPFilter().allow) },
+		set: func(srv *Server, value string) error {
+			prefixes, err := parseCIDRs(value)
+			if err != nil {
+				return err
+			}
+			srv.updateIPFilter(func(f *ipFilter) { f.allow = prefixes })
+			return nil
+		},
+	},
+	"denycidrs": {
+		get: func(srv *Server) string { return formatCIDRs(srv.getIPFilter().deny) },
+		set: func(srv *Server, value string) error {
+			prefixes, err := parseCIDRs(value)
+			if err != nil {
+				return err
+			}
+			srv.updateIPFilter(func(f *ipFilter) { f.deny = prefixes })
+			return nil
+		},
+	},
+	"slowlogthreshold":        durationOption(func(s *serverSettings) *time.Duration { return &s.slowLogThreshold }),
+	"latencymonitorthreshold": durationOption(func(s *serverSettings) *time.Duration { return &s.latencyThreshold }),
+	"keepalive":               durationOption(func(s *serverSettings) *time.Duration { return &s.keepAlive }),
+	"slowlogmaxlen": {
+		get: func(srv *Server) string { return strconv.Itoa(srv.getSettings().slowLogMaxLen) },
+		set: func(srv *Server, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return errNotInteger
+			}
+			return srv.updateSettings(func(s *serverSettings) error {
+				s.slowLogMaxLen = n
+				return nil
+			})
+		},
+	},
+	"maxmemory": {
+		get: func(srv *Server) string { return strconv.FormatInt(srv.getSettings().maxMemory, 10) },
+		set: func(srv *Server, value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			return srv.updateSettings(func(s *serverSettings) error {
+				s.maxMemory = n
+				return nil
+			})
+		},
+	},
+	"maxmemorypolicy": {
+		get: func(srv *Server) string { return srv.getSettings().maxMemoryPolicy.String() },
+		set: func(srv *Server, value string) error {
+			return srv.updateSettings(func(s *serverSettings) error {
+				switch strings.ToLower(value) {
+				case "reject":
+					s.maxMemoryPolicy = MemoryReject
+				case "evict":
+					s.maxMemoryPolicy = MemoryEvict
+				default:
+					return errSyntax
+				}
+				return nil
+			})
+		},
+	},
+	"loglevel": {
+		get: func(srv *Server) string { return strings.ToLower(srv.getSettings().logLevel.String()) },
+		set: func(srv *Server, value string) error {
+			var level slog.Level
+			if err := level.UnmarshalText([]byte(value)); err != nil {
+				return errSyntax
+			}
+			return srv.updateSettings(func(s *serverSettings) error {
+				s.logLevel = level
+				return nil
+			})
+		},
+	},
+	"lockprofiling": {
+		get: func(srv *Server) string { return yesNo(srv.Queue.LockContention().Profiling) },
+		set: func(srv *Server, value string) error {
+			switch strings.ToLower(value) {
+			case "yes":
+				srv.Queue.ProfileLock(true)
+			case "no":
+				srv.Queue.ProfileLock(false)
+			default:
+				return errSyntax
+			}
+			return nil
+		},
+	},
+	"maxlength": {
+		get: func(srv *Server) string { return strconv.Itoa(srv.Queue.DefaultRouteConfig().MaxLength) },
+		set: func(srv *Server, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errNotInteger
+			}
+			srv.Queue.updateDefaultRouteConfig(func(config *RouteConfig) { config.MaxLength = n })
+			return nil
+		},
+	},
+}
+
+// updateIPFilter replaces the filter of the server with a copy changed by update.
+func (srv *Server) updateIPFilter(update func(f *ipFilter)) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	f := *srv.getIPFilter()
+	update(&f)
+	srv.ipFilter.Store(&f)
+}
+
+// ConfigCommand is the command "config".
+// "config get <option>" replies with the option and its value,
+// "config set <option> <value>" changes the option for the running server.
+// "config resetstat" resets the statistics reported by "info commandstats" and "info contention".
+//
+// The options are:
+//
+//	allowcidrs <networks>             space separated networks allowed to connect, empty to allow any, see Server.AllowCIDRs
+//	denycidrs <networks>              space separated networks refused at accept time, see Server.DenyCIDRs
+//	slowlogthreshold <ms>             see Server.SlowLogThreshold
+//	slowlogmaxlen <n>                 see Server.SlowLogMaxLen
+//	latencymonitorthreshold <ms>      see Server.LatencyMonitorThreshold
+//	lockprofiling <yes|no>            see Server.LockProfiling
+//	maxmemory <bytes>                 see Server.MaxMemory
+//	maxmemorypolicy <reject|evict>    see Server.MaxMemoryPolicy
+//	keepalive <ms>                    see Server.KeepAlive, for the connections accepted next
+//	loglevel <debug|info|warn|error>  lowest level of the messages passed to Server.Logger, debug by default
+//	maxlength <n>                     RouteConfig.MaxLength of the routes created next, see SetDefaultRouteConfig
+type ConfigCommand struct {
+	ArgsCommand
+}
+
+func (c *ConfigCommand) Name() string {
+	return "config"
+}
+
+func (c *ConfigCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		return errNoServer
+	}
+	switch sub := strings.ToLower(args[0]); {
+	case sub == "get" && len(args) == 2:
+		name := strings.ToLower(args[1])
+		option, ok := serverOptions[name]
+		if !ok {
+			return &unknownOptionError{args[1]}
+		}
+		return writer.WriteArray([]string{name, option.get(srv)})
+	case sub == "set" && len(args) == 3:
+		option, ok := serverOptions[strings.ToLower(args[1])]
+		if !ok {
+			return &unknownOptionError{args[1]}
+		}
+		if err := option.set(srv, args[2]); err != nil {
+			return err
+		}
+		return writer.WriteStatus(OK)
+	case sub == "resetstat" && len(args) == 1:
+		srv.cmdstats.reset()
+		srv.Queue.ResetLockContention()
+		return writer.WriteStatus(OK)
+	default:
+		return &wrongCommandError{command: c.Name() + "|" + sub, args: args[1:]}
+	}
+}
+
+func NewConfigCommand(args []string) (Command, error) {
+	if len(args) == 0 {
+		return nil, &WrongArityError{"config"}
+	}
+	cmd := &ConfigCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["config"] = NewConfigCommand
+}
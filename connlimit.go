@@ -0,0 +1,53 @@
+package khronos
+
+import (
+	"net"
+	"time"
+)
+
+// rejectTimeout bounds the time spent replying to a rejected connection.
+const rejectTimeout = time.Second
+
+// getConnSlots returns the semaphore bounding the number of connections to MaxConns.
+func (srv *Server) getConnSlots() chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.connSlots == nil {
+		srv.connSlots = make(chan struct{}, srv.MaxConns)
+	}
+	return srv.connSlots
+}
+
+// acquireConnSlot reserves a slot for a new connection.
+// If wait is false, it reports whether a slot was free.
+// Otherwise it waits for a free slot, and reports false if the server shuts down first.
+func (srv *Server) acquireConnSlot(wait bool) bool {
+	slots := srv.getConnSlots()
+	if !wait {
+		select {
+		case slots <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-srv.getDoneChan():
+		return false
+	}
+}
+
+func (srv *Server) releaseConnSlot() {
+	<-srv.getConnSlots()
+}
+
+// rejectConn replies err to the connection and closes it.
+func (srv *Server) rejectConn(conn net.Conn, err error) {
+	srv.logger().Warn("khronos: conn rejected", "addr", conn.RemoteAddr().String(), "reason", err)
+	_ = conn.SetWriteDeadline(time.Now().Add(rejectTimeout))
+	writer := &responseWriter{conn}
+	_ = writer.WriteError(err)
+	_ = conn.Close()
+}
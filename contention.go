@@ -0,0 +1,92 @@
+package khronos
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// lockStats counts the acquisitions of the lock of a queue and the time spent waiting for it,
+// while the lock is profiled, see ProfileLock.
+type lockStats struct {
+	acquired  atomic.Uint64
+	contended atomic.Uint64
+	wait      atomic.Int64 // nanoseconds.
+	maxWait   atomic.Int64 // nanoseconds.
+}
+
+// add records an acquisition which waited for d, zero if the lock was free.
+func (s *lockStats) add(d time.Duration) {
+	s.acquired.Add(1)
+	if d <= 0 {
+		return
+	}
+	s.contended.Add(1)
+	s.wait.Add(int64(d))
+	for {
+		old := s.maxWait.Load()
+		if int64(d) <= old || s.maxWait.CompareAndSwap(old, int64(d)) {
+			return
+		}
+	}
+}
+
+func (s *lockStats) reset() {
+	s.acquired.Store(0)
+	s.contended.Store(0)
+	s.wait.Store(0)
+	s.maxWait.Store(0)
+}
+
+// LockContention is the contention on the lock of a queue measured since ProfileLock enabled
+// the profiling, or since ResetLockContention.
+type LockContention struct {
+	Profiling    bool          // Whether the lock is profiled.
+	Acquisitions uint64        // Number of times the lock was acquired, by an operation or a consumer waking up.
+	Contended    uint64        // Number of acquisitions which waited for the lock.
+	Wait         time.Duration // Total time spent waiting for the lock.
+	MaxWait      time.Duration // Longest wait for the lock.
+}
+
+// WaitPerAcquisition returns the average time an acquisition of the lock waited for it.
+func (c LockContention) WaitPerAcquisition() time.Duration {
+	if c.Acquisitions == 0 {
+		return 0
+	}
+	return c.Wait / time.Duration(c.Acquisitions)
+}
+
+func (c LockContention) fields() []string {
+	return []string{
+		"lock_profiling:" + strconv.Itoa(btoi(c.Profiling)),
+		"lock_acquisitions:" + strconv.FormatUint(c.Acquisitions, 10),
+		"lock_contended:" + strconv.FormatUint(c.Contended, 10),
+		"lock_wait_usec:" + strconv.FormatInt(c.Wait.Microseconds(), 10),
+		"lock_wait_usec_per_acquisition:" + strconv.FormatFloat(float64(c.WaitPerAcquisition())/float64(time.Microsecond), 'f', 2, 64),
+		"lock_max_wait_usec:" + strconv.FormatInt(c.MaxWait.Microseconds(), 10),
+	}
+}
+
+// ProfileLock starts or stops measuring the contention on the lock shared by all the routes of the queue,
+// reported by LockContention. It costs an atomic increment per operation while enabled.
+// It quantifies how much a workload would gain from spreading its routes over several queues.
+func (pq *PriorityQueueWithRouting) ProfileLock(enabled bool) {
+	pq.queueLock.profiling.Store(enabled)
+}
+
+// LockContention returns the contention on the lock of the queue measured while ProfileLock is enabled.
+func (pq *PriorityQueueWithRouting) LockContention() LockContention {
+	s := &pq.queueLock.stats
+	return LockContention{
+		Profiling:    pq.queueLock.profiling.Load(),
+		Acquisitions: s.acquired.Load(),
+		Contended:    s.contended.Load(),
+		Wait:         time.Duration(s.wait.Load()),
+		MaxWait:      time.Duration(s.maxWait.Load()),
+	}
+}
+
+// ResetLockContention resets the measures reported by LockContention.
+func (pq *PriorityQueueWithRouting) ResetLockContention() {
+	pq.queueLock.stats.reset()
+}
@@ -1,5 +1,7 @@
 package khronos
 
+import "context"
+
 type contextKey struct {
 	name string
 }
@@ -12,4 +14,19 @@ var (
 	ServerContextKey = &contextKey{"khronos-server"}
 
 	QueueContextKey = &contextKey{"khronos-queue"}
+
+	connContextKey = &contextKey{"khronos-conn"}
 )
+
+// ServerFromContext returns the server that is serving the command.
+// It returns nil if the context does not come from a server.
+func ServerFromContext(ctx context.Context) *Server {
+	srv, _ := ctx.Value(ServerContextKey).(*Server)
+	return srv
+}
+
+// connFromContext returns the connection that sent the command, or nil.
+func connFromContext(ctx context.Context) *connContext {
+	c, _ := ctx.Value(connContextKey).(*connContext)
+	return c
+}
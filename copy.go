@@ -0,0 +1,88 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+var errSameRoute = errors.New("ERR source and destination routes are the same")
+
+// CopyRoute pushes copies of the items of the route src, with their priorities and their headers,
+// to the route dst without removing them from src, and returns the number of items copied.
+// The copies get new identifiers, in the order the items would be dequeued from src.
+// It fails with ErrNoSuchRoute if src does not exist, and with ErrRouteExists if dst has items,
+// unless replace, in which case they are dropped first. The settings of dst are left as they are.
+// It lets a second fleet of consumers process the same items, or a copy be inspected without
+// disturbing the consumers of src.
+func (pq *PriorityQueueWithRouting) CopyRoute(src, dst string, replace bool) (int, error) {
+	if src == dst {
+		return 0, errSameRoute
+	}
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	s, ok := pq.routes[src]
+	if !ok {
+		return 0, ErrNoSuchRoute
+	}
+	s = s.resolve()
+	items, err := s.copyItems(nil)
+	if err != nil {
+		pq.overflowFailed()
+		return 0, err
+	}
+	sortItems(s.config, items)
+	d := pq.route(dst).resolve()
+	if d == s {
+		return 0, errSameRoute
+	}
+	if d.size() > 0 {
+		if !replace {
+			return 0, ErrRouteExists
+		}
+		pq.dropItems(d)
+	}
+	pq.pushBatch(d, items)
+	return len(items), nil
+}
+
+// CopyCommand is the command "copy".
+// "copy <src> <dst> [replace]" pushes copies of the items of a route to another one,
+// and replies with the number of items copied, see CopyRoute.
+type CopyCommand struct {
+	ArgsCommand
+}
+
+func (c *CopyCommand) Name() string {
+	return "copy"
+}
+
+func (c *CopyCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	replace := false
+	if len(args) == 3 {
+		if !strings.EqualFold(args[2], "replace") {
+			return errSyntax
+		}
+		replace = true
+	}
+	n, err := PqFromContext(ctx).CopyRoute(args[0], args[1], replace)
+	if err != nil {
+		return err
+	}
+	return writer.WriteInt64(int64(n))
+}
+
+func NewCopyCommand(args []string) (Command, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, &WrongArityError{"copy"}
+	}
+	cmd := &CopyCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["copy"] = NewCopyCommand
+}
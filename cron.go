@@ -0,0 +1,325 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errCronSpec  = errors.New("ERR invalid cron schedule")
+	errCronNever = errors.New("ERR cron schedule never fires")
+	// ErrNoSuchCronJob is returned when a cron job does not exist.
+	ErrNoSuchCronJob = errors.New("ERR no such cron job")
+)
+
+// cronHorizon is how far ahead the next run of a cron job is looked for.
+const cronHorizon = 5 // years
+
+// CronJob is a recurring push, run by the server on a cron schedule, see AddCronJob.
+type CronJob struct {
+	Name string
+	// Spec is the schedule of the job in the five fields cron format, "minute hour day-of-month month day-of-week",
+	// such as "*/5 * * * *" for every five minutes. A field is "*", a number, a range "a-b", a step "*/n" or "a-b/n",
+	// or a comma separated list of them. Days of the week go from 0, Sunday, to 6, 7 being Sunday too.
+	Spec     string
+	Route    string
+	Value    string
+	Priority int64
+	// Next is the time of the next run, in the time zone of the server.
+	Next time.Time
+}
+
+// cronJob is a CronJob with its parsed schedule.
+type cronJob struct {
+	CronJob
+	schedule *cronSchedule
+}
+
+// cronSchedule is a parsed cron schedule, a bit set per field.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// anyDay is true if the day of the month or the day of the week is "*": the other one decides alone.
+	// Otherwise, a day matches if either of them does, as in cron.
+	anyDay bool
+}
+
+// parseCronSchedule parses a schedule in the format of CronJob.Spec.
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errCronSpec
+	}
+	var (
+		s   cronSchedule
+		err error
+	)
+	for i, field := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dom, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dow, 0, 7},
+	} {
+		if *field.bits, err = parseCronField(fields[i], field.min, field.max); err != nil {
+			return nil, err
+		}
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.anyDay = strings.HasPrefix(fields[2], "*") || strings.HasPrefix(fields[4], "*")
+	return &s, nil
+}
+
+// parseCronField parses a field of a cron schedule, whose values go from min to max.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		values, step, hasStep := strings.Cut(part, "/")
+		every := 1
+		if hasStep {
+			n, err := strconv.Atoi(step)
+			if err != nil || n <= 0 {
+				return 0, errCronSpec
+			}
+			every = n
+		}
+		from, to := min, max
+		if values != "*" {
+			first, last, isRange := strings.Cut(values, "-")
+			var err error
+			if from, err = strconv.Atoi(first); err != nil {
+				return 0, errCronSpec
+			}
+			switch {
+			case isRange:
+				if to, err = strconv.Atoi(last); err != nil {
+					return 0, errCronSpec
+				}
+			case !hasStep:
+				// "a/n" is from a to max, "a" is a alone.
+				to = from
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, errCronSpec
+		}
+		for v := from; v <= to; v += every {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first time matching the schedule strictly after t, at the minute,
+// or the zero time if there is none in the next years.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronHorizon, 0, 0)
+	for t.Before(limit) {
+		year, month, day := t.Date()
+		switch {
+		case s.month&(1<<month) == 0:
+			t = time.Date(year, month+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchDay(t):
+			t = time.Date(year, month, day+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(year, month, day, t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) matchDay(t time.Time) bool {
+	dom, dow := s.dom&(1<<t.Day()) != 0, s.dow&(1<<t.Weekday()) != 0
+	if s.anyDay {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// AddCronJob adds a recurring push to the queue, or replaces the job with the same name.
+// The jobs are run by the servers of the queue, at most once per minute: a run missed while
+// the server was busy or down is made once, as soon as possible. Followers do not run the jobs
+// they replicate, until they are promoted.
+func (pq *PriorityQueueWithRouting) AddCronJob(job CronJob) error {
+	schedule, err := parseCronSchedule(job.Spec)
+	if err != nil {
+		return err
+	}
+
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	if job.Next = schedule.next(pq.now()); job.Next.IsZero() {
+		return errCronNever
+	}
+	if pq.crons == nil {
+		pq.crons = make(map[string]*cronJob)
+	}
+	pq.crons[job.Name] = &cronJob{CronJob: job, schedule: schedule}
+	pq.emit(cronAddOp(&job))
+	return nil
+}
+
+// DeleteCronJob removes a cron job and reports whether it existed.
+func (pq *PriorityQueueWithRouting) DeleteCronJob(name string) bool {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	if _, ok := pq.crons[name]; !ok {
+		return false
+	}
+	delete(pq.crons, name)
+	pq.emit(queueOp{kind: opCronDel, name: name})
+	return true
+}
+
+// applyCron applies a cron job operation received from another queue.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) applyCron(op queueOp) {
+	if op.kind == opCronDel {
+		delete(pq.crons, op.name)
+		pq.emit(op)
+		return
+	}
+	schedule, err := parseCronSchedule(op.spec)
+	if err != nil {
+		return
+	}
+	if pq.crons == nil {
+		pq.crons = make(map[string]*cronJob)
+	}
+	job := CronJob{Name: op.name, Spec: op.spec, Route: op.route, Value: op.value, Priority: op.priority, Next: schedule.next(pq.now())}
+	pq.crons[job.Name] = &cronJob{CronJob: job, schedule: schedule}
+	pq.emit(op)
+}
+
+// CronJobs returns the cron jobs of the queue, sorted by name.
+func (pq *PriorityQueueWithRouting) CronJobs() []CronJob {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	jobs := make([]CronJob, 0, len(pq.crons))
+	for _, name := range sortedKeys(pq.crons) {
+		jobs = append(jobs, pq.crons[name].CronJob)
+	}
+	return jobs
+}
+
+// runCron pushes the items of the cron jobs due at now, if push, and schedules their next run.
+func (pq *PriorityQueueWithRouting) runCron(now time.Time, push bool) int {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	pushed := 0
+	for _, job := range pq.crons {
+		if job.Next.After(now) {
+			continue
+		}
+		if push {
+			pq.push(pq.route(job.Route), NewItem(job.Value, job.Priority))
+			pushed++
+		}
+		job.Next = job.schedule.next(now)
+	}
+	return pushed
+}
+
+// startCron runs the cron jobs of the queue at the start of every minute, once.
+func (srv *Server) startCron() {
+	srv.cronOnce.Do(func() {
+		var tick func()
+		untilNextMinute := func() time.Duration {
+			now := srv.clock().Now()
+			return now.Truncate(time.Minute).Add(time.Minute).Sub(now)
+		}
+		tick = func() {
+			select {
+			case <-srv.getDoneChan():
+				return
+			default:
+			}
+			srv.repl.mu.Lock()
+			leader := srv.repl.leader == ""
+			srv.repl.mu.Unlock()
+			for _, pq := range srv.queues() {
+				if n := pq.runCron(srv.clock().Now(), leader); n > 0 {
+					srv.logger().Debug("khronos: cron jobs run", "jobs", n)
+				}
+			}
+			srv.clock().AfterFunc(untilNextMinute(), tick)
+		}
+		srv.clock().AfterFunc(untilNextMinute(), tick)
+	})
+}
+
+// CronCommand is the command "cron", managing the recurring pushes of the queue, see CronJob:
+//
+//	cron add <name> <spec> <route> <value> <priority>    adds or replaces a job, the spec being a single argument
+//	cron del <name>                                        removes a job
+//	cron list                                              replies with a line per job
+type CronCommand struct {
+	ArgsCommand
+}
+
+func (c *CronCommand) Name() string {
+	return "cron"
+}
+
+func (c *CronCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	pq := PqFromContext(ctx)
+	switch sub := strings.ToLower(args[0]); {
+	case sub == "add" && len(args) == 6:
+		priority, err := strconv.ParseInt(args[5], 10, 64)
+		if err != nil {
+			return errNotInteger
+		}
+		job := CronJob{Name: args[1], Spec: args[2], Route: args[3], Value: args[4], Priority: priority}
+		if err = pq.AddCronJob(job); err != nil {
+			return err
+		}
+		return writer.WriteStatus(OK)
+	case sub == "del" && len(args) == 2:
+		if !pq.DeleteCronJob(args[1]) {
+			return ErrNoSuchCronJob
+		}
+		return writer.WriteStatus(OK)
+	case sub == "list" && len(args) == 1:
+		jobs := pq.CronJobs()
+		list := make([]string, 0, len(jobs))
+		for _, job := range jobs {
+			list = append(list, strings.Join([]string{
+				job.Name, strconv.Quote(job.Spec), job.Route, strconv.Quote(job.Value),
+				strconv.FormatInt(job.Priority, 10), "next=" + job.Next.Format(time.RFC3339),
+			}, " "))
+		}
+		return writer.WriteArray(list)
+	default:
+		return &wrongCommandError{command: c.Name() + "|" + sub, args: args[1:]}
+	}
+}
+
+func NewCronCommand(args []string) (Command, error) {
+	if len(args) == 0 {
+		return nil, &WrongArityError{"cron"}
+	}
+	cmd := &CronCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["cron"] = NewCronCommand
+}
@@ -0,0 +1,99 @@
+package khronos
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DebugCommand is the command "debug", a family of subcommands to inspect the server
+// and to test the clients against it:
+//
+//	debug accounting    replies OK if the item counters balance, see Accounting.Check, an error otherwise
+//	debug sleep <ms>    blocks the connection for ms milliseconds, then replies OK
+//	debug jmap          replies with a dump of the internals of the queue, a line per route
+//	debug quit          closes the connection without replying
+type DebugCommand struct {
+	ArgsCommand
+}
+
+func (c *DebugCommand) Name() string {
+	return "debug"
+}
+
+func (c *DebugCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	switch sub := strings.ToLower(args[0]); {
+	case sub == "accounting" && len(args) == 1:
+		if err := PqFromContext(ctx).Accounting().Check(); err != nil {
+			return err
+		}
+		return writer.WriteStatus(OK)
+	case sub == "sleep" && len(args) == 2:
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || ms < 0 {
+			return errNotInteger
+		}
+		ctx, cancel := withTimeout(ctx, clockFromContext(ctx), time.Duration(ms)*time.Millisecond)
+		defer cancel()
+		<-ctx.Done()
+		if context.Cause(ctx) != context.DeadlineExceeded {
+			return ctx.Err()
+		}
+		return writer.WriteStatus(OK)
+	case sub == "jmap" && len(args) == 1:
+		return writer.WriteString(PqFromContext(ctx).dump())
+	case sub == "quit" && len(args) == 1:
+		return ErrQuit
+	default:
+		return &wrongCommandError{command: c.Name() + "|" + sub, args: args[1:]}
+	}
+}
+
+func NewDebugCommand(args []string) (Command, error) {
+	if len(args) == 0 {
+		return nil, &WrongArityError{"debug"}
+	}
+	cmd := &DebugCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["debug"] = NewDebugCommand
+}
+
+// dump describes the internals of the queue, for "debug jmap":
+// a line with the counters of the queue, then a line per route.
+func (pq *PriorityQueueWithRouting) dump() string {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	var b strings.Builder
+	b.WriteString("queue items=" + strconv.Itoa(len(pq.items)))
+	b.WriteString(" next_id=" + strconv.FormatUint(pq.nextID, 10))
+	b.WriteString(" offset=" + strconv.FormatUint(pq.opOffset, 10))
+	b.WriteString(" feeds=" + strconv.Itoa(len(pq.feeds)))
+	b.WriteString(" memory=" + strconv.FormatInt(pq.memory.used, 10))
+	b.WriteString(" any_waiters=" + strconv.Itoa(pq.anyWaiters))
+	b.WriteString("\n")
+	for _, name := range sortedKeys(pq.routes) {
+		r := pq.routes[name]
+		b.WriteString("route=" + strconv.Quote(name))
+		b.WriteString(" heap=" + strconv.Itoa(r.queue.Len()))
+		b.WriteString(" spilled=" + strconv.Itoa(r.spilled))
+		b.WriteString(" segments=" + strconv.Itoa(len(r.segments)))
+		b.WriteString(" memory=" + strconv.FormatInt(r.memory, 10))
+		b.WriteString(" waiters=" + strconv.Itoa(r.waiters))
+		b.WriteString(" enqueued=" + strconv.FormatUint(r.enqueued, 10))
+		b.WriteString(" dequeued=" + strconv.FormatUint(r.dequeued, 10))
+		b.WriteString(" groups=" + strings.Join(sortedKeys(r.groups), ","))
+		b.WriteString(" order=" + r.config.Order.String())
+		if r.moved != nil {
+			b.WriteString(" moved=" + strconv.Quote(r.moved.name))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
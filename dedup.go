@@ -0,0 +1,91 @@
+package khronos
+
+import (
+	"time"
+)
+
+// minDedupSweep is the number of deduplication ids of a route above which the expired ones are removed.
+const minDedupSweep = 64
+
+// dedupIndex holds the deduplication ids of the items recently pushed to a route, see EnqueueOnce.
+type dedupIndex struct {
+	expires map[string]time.Time // expiry of the ids.
+	sweepAt int                  // number of ids at which the expired ones are removed.
+}
+
+// seen reports whether id was recorded and has not expired at now.
+func (d *dedupIndex) seen(id string, now time.Time) bool {
+	expires, ok := d.expires[id]
+	return ok && expires.After(now)
+}
+
+// add records id until expires, removing the ids expired at now once in a while.
+func (d *dedupIndex) add(id string, now, expires time.Time) {
+	if d.expires == nil {
+		d.expires = make(map[string]time.Time)
+	}
+	if len(d.expires) >= d.sweepAt {
+		d.sweep(now)
+		d.sweepAt = max(minDedupSweep, 2*len(d.expires))
+	}
+	d.expires[id] = expires
+}
+
+// dedupOp returns the operation recording the deduplication id of the route until expires.
+func dedupOp(route, id string, expires time.Time) queueOp {
+	return queueOp{kind: opDedup, route: route, value: id, priority: expires.UnixMilli()}
+}
+
+// applyDedup applies a deduplication id operation received from another queue.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) applyDedup(op queueOp) {
+	now, expires := pq.now(), time.UnixMilli(op.priority)
+	if !expires.After(now) {
+		return
+	}
+	pq.route(op.route).dedup.add(op.value, now, expires)
+	pq.emit(op)
+}
+
+// sweep removes the ids expired at now.
+func (d *dedupIndex) sweep(now time.Time) {
+	for id, expires := range d.expires {
+		if !expires.After(now) {
+			delete(d.expires, id)
+		}
+	}
+}
+
+// EnqueueOnce adds an item to the route, unless an item with the same deduplication id was added
+// to the route in the last ttl, and reports whether the item was added.
+// It makes the retries of a producer idempotent: a push retried after a timeout does not create a duplicate.
+// The ids are persisted and replicated with their expiry, so that they survive a restart or a failover.
+func (pq *PriorityQueueWithRouting) EnqueueOnce(route string, item *Item, id string, ttl time.Duration) bool {
+	return pq.enqueueOnce(route, item, id, ttl) != 0
+}
+
+// enqueueOnce is EnqueueOnce, returning the identifier assigned to the item, or zero if it was not added.
+func (pq *PriorityQueueWithRouting) enqueueOnce(route string, item *Item, id string, ttl time.Duration) uint64 {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r := pq.route(route)
+	now := pq.now()
+	if r.dedup.seen(id, now) {
+		return 0
+	}
+	r.dedup.add(id, now, now.Add(ttl))
+	pq.emit(dedupOp(r.name, id, now.Add(ttl)))
+	pq.push(r, item)
+	return item.id
+}
+
+// Duplicate reports whether an item with the deduplication id was added to the route in the window
+// of EnqueueOnce.
+func (pq *PriorityQueueWithRouting) Duplicate(route, id string) bool {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r, ok := pq.routes[route]
+	return ok && r.dedup.seen(id, pq.now())
+}
@@ -0,0 +1,246 @@
+package khronos
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Delivery is the delivery guarantee of a route.
+type Delivery int
+
+const (
+	// DeliveryAtMostOnce removes an item from the route as it is dequeued, it is the default.
+	// An item is lost if its consumer fails before processing it.
+	DeliveryAtMostOnce Delivery = iota
+	// DeliveryAtLeastOnce reserves an item to its consumer as it is dequeued, until the consumer
+	// confirms it with Confirm. An item not confirmed within the visibility timeout of the route,
+	// see RouteConfig.VisibilityTimeout, is enqueued again with its attempt counter incremented,
+	// see Item.Attempt, so it may be processed more than once.
+	// The reserved items are persisted and replicated as queued items until they are confirmed,
+	// so that they are delivered again after a restart or a failover.
+	DeliveryAtLeastOnce
+)
+
+func (d Delivery) String() string {
+	if d == DeliveryAtLeastOnce {
+		return "atleastonce"
+	}
+	return "atmostonce"
+}
+
+// DefaultVisibilityTimeout is the visibility timeout of the routes with DeliveryAtLeastOnce
+// and no RouteConfig.VisibilityTimeout.
+const DefaultVisibilityTimeout = 30 * time.Second
+
+func (c RouteConfig) visibilityTimeout() time.Duration {
+	if c.VisibilityTimeout > 0 {
+		return c.VisibilityTimeout
+	}
+	return DefaultVisibilityTimeout
+}
+
+// reservation is an item delivered by a route with DeliveryAtLeastOnce and not confirmed yet.
+type reservation struct {
+	item *Item
+	stop func() bool // stops the redelivery timer.
+}
+
+// hold reserves an item dequeued from a route with DeliveryAtLeastOnce until it is confirmed,
+// and enqueues it again if it is not confirmed within the visibility timeout of the route.
+// The item stays in the feed of the queue, its deletion is emitted by unhold.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) hold(r *route, item *Item) {
+	pq.accounting.Inflight++
+	if r.reserved == nil {
+		r.reserved = make(map[uint64]*reservation)
+	}
+	r.reserved[item.id] = &reservation{item: item, stop: pq.redeliverAfter(r, item.id, r.config.visibilityTimeout())}
+}
+
+// unhold consumes the reserved item with the given identifier, confirmed or enqueued again.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) unhold(r *route, id uint64, res *reservation) {
+	delete(r.reserved, id)
+	res.stop()
+	pq.accounting.Inflight--
+	pq.accounting.Popped++
+	pq.emit(deleteOp(r.resolve().name, res.item))
+}
+
+// redeliverAfter starts the timer redelivering the reserved item with the given identifier after d,
+// and returns the function stopping it.
+func (pq *PriorityQueueWithRouting) redeliverAfter(r *route, id uint64, d time.Duration) func() bool {
+	return pq.afterFunc(d, func() {
+		pq.queueLock.Lock()
+		defer pq.queueLock.Unlock()
+		pq.redeliver(r, id)
+	})
+}
+
+// redeliver enqueues again the reserved item with the given identifier, if it was not confirmed,
+// as a new item with its attempt counter incremented.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) redeliver(r *route, id uint64) {
+	res, ok := r.reserved[id]
+	if !ok {
+		return
+	}
+	pq.unhold(r, id, res)
+	// the failed delivery is consumed, and the redelivery is a new item.
+	item := res.item.Clone()
+	item.SetHeader(AttemptHeader, strconv.Itoa(res.item.Attempt()+1))
+	pq.push(pq.route(r.resolve().name), item)
+}
+
+// requeueReserved enqueues again the items reserved by the routes and not confirmed yet,
+// as if their visibility timeout expired, and returns their number.
+func (pq *PriorityQueueWithRouting) requeueReserved() int {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	n := 0
+	for _, name := range sortedKeys(pq.routes) {
+		r := pq.routes[name]
+		ids := make([]uint64, 0, len(r.reserved))
+		for id := range r.reserved {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			pq.redeliver(r, id)
+			n++
+		}
+	}
+	return n
+}
+
+// Confirm confirms the processing of the items with the given identifiers, reserved by the route
+// with DeliveryAtLeastOnce, and returns the number of items which were reserved.
+// The items not confirmed in time were already enqueued again, and are not counted.
+func (pq *PriorityQueueWithRouting) Confirm(route string, ids ...uint64) int {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r, ok := pq.routes[route]
+	if !ok {
+		return 0
+	}
+	n := 0
+	for _, id := range ids {
+		res, ok := r.reserved[id]
+		if !ok {
+			continue
+		}
+		pq.unhold(r, id, res)
+		n++
+	}
+	return n
+}
+
+// Touch extends the reservation of an item delivered by the route with DeliveryAtLeastOnce:
+// the item is enqueued again if it is not confirmed within d from now, instead of within the rest
+// of its visibility timeout. It lets a consumer processing a long item keep it.
+// Touch returns false if the item is not reserved, because it was confirmed or already enqueued again.
+func (pq *PriorityQueueWithRouting) Touch(route string, id uint64, d time.Duration) bool {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r, ok := pq.routes[route]
+	if !ok {
+		return false
+	}
+	res, ok := r.reserved[id]
+	if !ok || !res.stop() {
+		// the timer already fired, and waits for the lock to redeliver the item.
+		return false
+	}
+	res.stop = pq.redeliverAfter(r, id, d)
+	return true
+}
+
+// isReserved reports whether the item is reserved by the route, waiting to be confirmed.
+func (pq *PriorityQueueWithRouting) isReserved(route string, item *Item) bool {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r, ok := pq.routes[route]
+	if !ok {
+		return false
+	}
+	_, ok = r.resolve().reserved[item.id]
+	return ok
+}
+
+// ConfirmCommand is the command "confirm".
+// "confirm <route> <id>..." confirms the processing of items popped from a route with
+// at-least-once delivery, see "configure <route> delivery atleastonce", and replies with
+// the number of items which were reserved.
+type ConfirmCommand struct {
+	ArgsCommand
+}
+
+func (c *ConfirmCommand) Name() string {
+	return "confirm"
+}
+
+func (c *ConfirmCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	ids, err := parseIDs(args[1:])
+	if err != nil {
+		return err
+	}
+	return writer.WriteInt64(int64(PqFromContext(ctx).Confirm(args[0], ids...)))
+}
+
+func NewConfirmCommand(args []string) (Command, error) {
+	if len(args) < 2 {
+		return nil, &WrongArityError{"confirm"}
+	}
+	cmd := &ConfirmCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+// TouchCommand is the command "touch".
+// "touch <route> <id> <ms>" extends the reservation of an item popped from a route with at-least-once
+// delivery, which is enqueued again if not confirmed within ms milliseconds, see Touch.
+// It replies 1 if the item was reserved, 0 otherwise.
+type TouchCommand struct {
+	ArgsCommand
+}
+
+func (c *TouchCommand) Name() string {
+	return "touch"
+}
+
+func (c *TouchCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	id, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	ms, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || ms <= 0 {
+		return errNotInteger
+	}
+	if PqFromContext(ctx).Touch(args[0], id, time.Duration(ms)*time.Millisecond) {
+		return writer.WriteInt64(1)
+	}
+	return writer.WriteInt64(0)
+}
+
+func NewTouchCommand(args []string) (Command, error) {
+	if len(args) != 3 {
+		return nil, &WrongArityError{"touch"}
+	}
+	cmd := &TouchCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["confirm"] = NewConfirmCommand
+	commandLibraries["touch"] = NewTouchCommand
+}
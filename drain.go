@@ -0,0 +1,132 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// drainPollInterval is how often Drain checks whether the queue is empty.
+const drainPollInterval = 10 * time.Millisecond
+
+// ErrDraining is returned for the pushes refused while the server drains, see Server.Drain.
+var ErrDraining = errors.New("READONLY drain in progress")
+
+// pushCommands are the commands adding items to the queue, refused while the server drains.
+var pushCommands = map[string]bool{"push": true, "restore": true}
+
+// DrainProgress is how far the queue of a draining server is from being empty.
+type DrainProgress struct {
+	// Draining reports whether the server refuses the pushes.
+	Draining bool
+	// Pending is the number of items waiting for a consumer.
+	Pending uint64
+	// Inflight is the number of items delivered and not acknowledged yet.
+	Inflight uint64
+}
+
+// Drain stops the server from accepting new items and waits for the consumers to empty the queue,
+// before a planned maintenance: the pushes are refused with ErrDraining, while the pops,
+// the confirmations and the other commands are served as usual.
+// It returns once no item is pending nor inflight, or ctx.Err() if ctx is done first.
+// The server keeps refusing the pushes until StopDrain, typically until it is shut down.
+func (srv *Server) Drain(ctx context.Context) error {
+	srv.startDrain()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		if p := srv.DrainProgress(); p.Pending == 0 && p.Inflight == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// StopDrain makes the server accept the pushes again after Drain.
+func (srv *Server) StopDrain() {
+	if atomic.CompareAndSwapInt32(&srv.draining, 1, 0) {
+		srv.logger().Info("khronos: drain stopped")
+	}
+}
+
+// DrainProgress returns the number of items left in the queue, see Drain.
+func (srv *Server) DrainProgress() DrainProgress {
+	a := srv.Queue.Accounting()
+	return DrainProgress{Draining: srv.isDraining(), Pending: a.Pending, Inflight: a.Inflight}
+}
+
+func (srv *Server) startDrain() {
+	if atomic.CompareAndSwapInt32(&srv.draining, 0, 1) {
+		srv.logger().Info("khronos: drain started")
+	}
+}
+
+func (srv *Server) isDraining() bool {
+	return atomic.LoadInt32(&srv.draining) != 0
+}
+
+// refuseDraining returns ErrDraining if the server drains and the command adds items.
+func (srv *Server) refuseDraining(name string) error {
+	if pushCommands[name] && srv.isDraining() {
+		return ErrDraining
+	}
+	return nil
+}
+
+// DrainCommand is the command "drain".
+// "drain" makes the server refuse the pushes with "-READONLY drain in progress" until "drain stop",
+// so that the consumers empty the queue before a planned maintenance, and replies OK, see Server.Drain.
+// "drain status" replies with the progress as "key:value" lines: draining, pending and inflight,
+// the queue is empty once pending and inflight are 0.
+type DrainCommand struct {
+	ArgsCommand
+}
+
+func (c *DrainCommand) Name() string {
+	return "drain"
+}
+
+func (c *DrainCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		return errNoServer
+	}
+	args := c.Args()
+	if len(args) == 0 {
+		srv.startDrain()
+		return writer.WriteStatus(OK)
+	}
+	switch strings.ToLower(args[0]) {
+	case "stop":
+		srv.StopDrain()
+		return writer.WriteStatus(OK)
+	case "status":
+		p := srv.DrainProgress()
+		return writer.WriteString(strings.Join([]string{
+			"draining:" + strconv.Itoa(btoi(p.Draining)),
+			"pending:" + strconv.FormatUint(p.Pending, 10),
+			"inflight:" + strconv.FormatUint(p.Inflight, 10),
+		}, "\r\n") + "\r\n")
+	}
+	return &wrongCommandError{command: c.Name() + "|" + args[0], args: args[1:]}
+}
+
+func NewDrainCommand(args []string) (Command, error) {
+	if len(args) > 1 {
+		return nil, &WrongArityError{"drain"}
+	}
+	cmd := &DrainCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["drain"] = NewDrainCommand
+}
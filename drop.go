@@ -0,0 +1,86 @@
+package khronos
+
+// DropReason is why an item left the queue without being delivered, see Server.OnDrop.
+type DropReason int
+
+const (
+	// DropExpired is an item removed because it expired.
+	DropExpired DropReason = iota
+	// DropEvicted is an item discarded to make room for another one, see MemoryEvict.
+	DropEvicted
+	// DropRejected is an item refused because its route held RouteConfig.MaxLength items.
+	DropRejected
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case DropEvicted:
+		return "evicted"
+	case DropRejected:
+		return "rejected"
+	}
+	return "expired"
+}
+
+// droppedItem is an item waiting to be passed to Server.OnDrop.
+type droppedItem struct {
+	route  string
+	item   Item
+	reason DropReason
+}
+
+// enableDrops makes the queue keep the items it drops, see takeDrops, and returns a channel
+// receiving a value when there are some.
+func (pq *PriorityQueueWithRouting) enableDrops() <-chan struct{} {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	if pq.dropReady == nil {
+		pq.dropReady = make(chan struct{}, 1)
+	}
+	return pq.dropReady
+}
+
+// drop keeps a copy of an item dropped from the route, if drops are enabled.
+// Unlike the events, no drop is lost: they are kept until taken.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) drop(r *route, item *Item, reason DropReason) {
+	if pq.dropReady == nil {
+		return
+	}
+	// the item may be reused once dropped, see putItem.
+	dropped := item.Clone()
+	dropped.id, dropped.enqueued = item.id, item.enqueued
+	pq.drops = append(pq.drops, droppedItem{route: r.name, item: *dropped, reason: reason})
+	select {
+	case pq.dropReady <- struct{}{}:
+	default:
+	}
+}
+
+// takeDrops returns the items dropped since the last call.
+func (pq *PriorityQueueWithRouting) takeDrops() []droppedItem {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	drops := pq.drops
+	pq.drops = nil
+	return drops
+}
+
+// startDrops passes the items dropped by the queue to OnDrop, once.
+func (srv *Server) startDrops() {
+	if srv.OnDrop == nil {
+		return
+	}
+	srv.dropsOnce.Do(func() {
+		ready := srv.Queue.enableDrops()
+		go func() {
+			for range ready {
+				for _, d := range srv.Queue.takeDrops() {
+					srv.OnDrop(d.route, d.item, d.reason)
+				}
+			}
+		}()
+	})
+}
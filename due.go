@@ -0,0 +1,143 @@
+package khronos
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// TryDequeueDue removes and returns, without blocking and in dequeue order, up to n items of the route
+// whose priority is at most until, such as the items of a time-ordered route due before a deadline,
+// see RouteConfig.TimestampPriority. The items further out are left in the route, even when they
+// come first in dequeue order. It returns nothing if the route is paused.
+func (pq *PriorityQueueWithRouting) TryDequeueDue(route string, until int64, n int) []*Item {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r, ok := pq.routes[route]
+	if !ok || pq.paused(r) || n <= 0 {
+		return nil
+	}
+	var items []*Item
+	if r.config.Order == OrderAsc {
+		// the due items come first.
+		for len(items) < n {
+			if next, ok := r.next(); !ok || next.priority > until {
+				break
+			}
+			item, _ := pq.pop(r)
+			items = append(items, item)
+		}
+		return items
+	}
+	// the due items come last, paged to disk first.
+	pq.unspill(r)
+	for _, item := range r.queue.Items() {
+		if item.priority <= until {
+			items = append(items, item)
+		}
+	}
+	sortItems(r.config, items)
+	if len(items) > n {
+		items = items[:n]
+	}
+	for _, item := range items {
+		r.take(item.index)
+		pq.delivered(r, item)
+	}
+	return items
+}
+
+// next returns the item pop would return, without removing it.
+// It must be called with queueLock held.
+func (r *route) next() (*Item, bool) {
+	var next *Item
+	if r.queue.Len() > 0 {
+		next = r.queue.items[0]
+	}
+	for _, s := range r.segments {
+		if next == nil || r.config.before(s.head, next) {
+			next = s.head
+		}
+	}
+	return next, next != nil
+}
+
+// PopDueCommand is the command "popdue".
+// "popdue <route> <until> [<count>]" removes up to count items, 1 by default, whose priority is at most until,
+// such as a Unix time in milliseconds on a time-ordered route, and replies with an array of their values,
+// empty if none is due, see TryDequeueDue. The bound "now" is the current Unix time in milliseconds.
+// It lets a worker take everything due in the next minute and nothing further out.
+// The options "withscore" and "withheaders" are those of "pop", as for "popn".
+type PopDueCommand struct {
+	ArgsCommand
+}
+
+func (c *PopDueCommand) Name() string {
+	return "popdue"
+}
+
+func (c *PopDueCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	key := args[0]
+	var until int64
+	if strings.EqualFold(args[1], "now") {
+		until = clockFromContext(ctx).Now().UnixMilli()
+	} else {
+		var err error
+		if until, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			return errNotInteger
+		}
+	}
+	count, rest := 1, args[2:]
+	if len(rest) > 0 {
+		if n, err := strconv.Atoi(rest[0]); err == nil {
+			if n < 0 {
+				return errNotInteger
+			}
+			count, rest = n, rest[1:]
+		}
+	}
+	routes, opts := parsePopArgs(rest)
+	if len(routes) > 0 || opts.group != "" || opts.consumer != "" || opts.filtered {
+		return errSyntax
+	}
+	pq := PqFromContext(ctx)
+	if err := pq.Throttle(key); err != nil {
+		return err
+	}
+	if pq.hasGroups(key) {
+		return ErrWrongType
+	}
+	items := pq.TryDequeueDue(key, until, count)
+	reply := make([]any, len(items))
+	for i, item := range items {
+		switch {
+		case pq.isReserved(key, item):
+			reply[i] = opts.reply(item, strconv.FormatUint(item.id, 10), item.value)
+		case opts.withScore || opts.withHeaders:
+			reply[i] = opts.reply(item, item.value)
+		default:
+			reply[i] = item.value
+		}
+	}
+	defer func() {
+		for _, item := range items {
+			pq.release(key, item)
+		}
+	}()
+	return WriteValue(writer, reply)
+}
+
+func NewPopDueCommand(args []string) (Command, error) {
+	if len(args) < 2 {
+		return nil, &WrongArityError{"popdue"}
+	}
+	cmd := &PopDueCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["popdue"] = NewPopDueCommand
+}
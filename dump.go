@@ -0,0 +1,197 @@
+package khronos
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// dumpMagic starts the blobs of Dump, it changes with their format.
+const dumpMagic = "khronos-dump-1\n"
+
+var errDumpPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+
+// Dump returns the items of the route as a blob, in the order they would be dequeued,
+// without removing them. The blob is restored with Restore, possibly on another server,
+// to migrate or back up a single route.
+//
+// The blob holds the values, the priorities and the headers of the items, as RESP arrays
+// [value, priority, key, value...], between a version line and a CRC-32 checksum.
+func (pq *PriorityQueueWithRouting) Dump(route string) []byte {
+	return dumpItems(pq.sortedItems(route, nil))
+}
+
+// dumpItems returns the items as a blob for Restore.
+func dumpItems(items []*Item) []byte {
+	builder := getprotocolBuilder()
+	defer putProtocolBuilder(builder)
+	builder.buf = append(builder.buf, dumpMagic...)
+	for _, item := range items {
+		builder.WriteArray(dumpArgs(item))
+	}
+	return binary.BigEndian.AppendUint32(bytes.Clone(builder.buf), crc32.ChecksumIEEE(builder.buf))
+}
+
+// dumpArgs returns the item as the array of its value, its priority and its headers.
+func dumpArgs(item *Item) []string {
+	args := []string{item.value, strconv.FormatInt(item.priority, 10)}
+	for _, key := range sortedKeys(item.headers) {
+		args = append(args, key, item.headers[key])
+	}
+	return args
+}
+
+// Restore pushes to the route the items of a blob returned by Dump, in their order, and returns
+// the number of items restored. The items get new identifiers.
+// It fails with ErrRouteExists if the route has items, unless replace, in which case they are dropped first.
+func (pq *PriorityQueueWithRouting) Restore(route string, blob []byte, replace bool) (int, error) {
+	items, err := parseDump(blob)
+	if err != nil {
+		return 0, err
+	}
+
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r := pq.route(route).resolve()
+	if r.size() > 0 {
+		if !replace {
+			return 0, ErrRouteExists
+		}
+		pq.dropItems(r)
+	}
+	pq.pushBatch(r, items)
+	return len(items), nil
+}
+
+// dropItems discards the items of the route.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) dropItems(r *route) {
+	pq.unspill(r)
+	for r.queue.Len() > 0 {
+		pq.removeItem(r, r.queue.items[0])
+		pq.accounting.Dropped++
+	}
+}
+
+// parseDump returns the items of a blob returned by Dump.
+func parseDump(blob []byte) ([]*Item, error) {
+	if len(blob) < len(dumpMagic)+crc32.Size || !bytes.HasPrefix(blob, []byte(dumpMagic)) {
+		return nil, errDumpPayload
+	}
+	payload, sum := blob[:len(blob)-crc32.Size], blob[len(blob)-crc32.Size:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(sum) {
+		return nil, errDumpPayload
+	}
+	parser := NewRespProtocolParser(bytes.NewReader(payload[len(dumpMagic):]))
+	parser.MaxBulkLen = len(payload)
+	var items []*Item
+	for {
+		value, args, err := parser.Parse()
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil || len(args)%2 != 1 {
+			return nil, errDumpPayload
+		}
+		priority, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return nil, errDumpPayload
+		}
+		item := NewItem(value, priority)
+		for i := 1; i < len(args); i += 2 {
+			item.SetHeader(args[i], args[i+1])
+		}
+		items = append(items, item)
+	}
+}
+
+// DumpCommand is the command "dump".
+// "dump <route>" replies with the items of the route as a blob for "restore", see Dump.
+// "dump <route> items" replies with them as an array of arrays [value, priority, key, value...],
+// in the order they would be dequeued.
+type DumpCommand struct {
+	ArgsCommand
+}
+
+func (c *DumpCommand) Name() string {
+	return "dump"
+}
+
+func (c *DumpCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	pq := PqFromContext(ctx)
+	if len(args) == 1 {
+		return writer.WriteString(string(pq.Dump(args[0])))
+	}
+	if !strings.EqualFold(args[1], "items") {
+		return errSyntax
+	}
+	items := pq.sortedItems(args[0], nil)
+	reply := make([]any, len(items))
+	for i, item := range items {
+		fields := dumpArgs(item)
+		elems := make([]any, len(fields))
+		for j, field := range fields {
+			elems[j] = field
+		}
+		elems[1] = item.priority
+		reply[i] = elems
+	}
+	return WriteValue(writer, reply)
+}
+
+func NewDumpCommand(args []string) (Command, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, &WrongArityError{"dump"}
+	}
+	cmd := &DumpCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+// RestoreCommand is the command "restore".
+// "restore <route> <blob> [replace]" pushes the items of a blob returned by "dump" to the route,
+// and replies with the number of items restored, see Restore.
+type RestoreCommand struct {
+	ArgsCommand
+}
+
+func (c *RestoreCommand) Name() string {
+	return "restore"
+}
+
+func (c *RestoreCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	replace := false
+	if len(args) == 3 {
+		if !strings.EqualFold(args[2], "replace") {
+			return errSyntax
+		}
+		replace = true
+	}
+	n, err := PqFromContext(ctx).Restore(args[0], []byte(args[1]), replace)
+	if err != nil {
+		return err
+	}
+	return writer.WriteInt64(int64(n))
+}
+
+func NewRestoreCommand(args []string) (Command, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, &WrongArityError{"restore"}
+	}
+	cmd := &RestoreCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["dump"] = NewDumpCommand
+	commandLibraries["restore"] = NewRestoreCommand
+}
@@ -0,0 +1,57 @@
+package khronos
+
+import (
+	"context"
+)
+
+// Embedded is a routing priority queue used in-process by a Go application,
+// without going through the network and the RESP protocol.
+// The same queue can also be served over the network to other processes, see NewServer.
+type Embedded struct {
+	queue *PriorityQueueWithRouting
+}
+
+// NewEmbedded returns an empty embedded queue.
+func NewEmbedded() *Embedded {
+	return &Embedded{queue: NewPriorityQueueWithRouting()}
+}
+
+// Queue returns the queue of e, for the operations not covered by the methods of Embedded.
+func (e *Embedded) Queue() *PriorityQueueWithRouting {
+	return e.queue
+}
+
+// Push adds a value to the route with the given priority and returns the identifier of the item.
+func (e *Embedded) Push(route, value string, priority int64) uint64 {
+	return e.queue.EnqueueID(route, NewItem(value, priority))
+}
+
+// Pop removes and returns the next item of the route, waiting for one until ctx is done.
+func (e *Embedded) Pop(ctx context.Context, route string) (*Item, error) {
+	return e.queue.DequeueContext(ctx, route)
+}
+
+// TryPop removes and returns the next item of the route without waiting.
+// It returns false if the route is empty.
+func (e *Embedded) TryPop(route string) (*Item, bool) {
+	return e.queue.TryDequeue(route)
+}
+
+// Subscribe calls handle with the items of the route as they arrive, one at a time and in order,
+// until ctx is done, and then returns ctx.Err(). Each item is delivered to a single subscriber.
+func (e *Embedded) Subscribe(ctx context.Context, route string, handle func(item *Item)) error {
+	for {
+		item, err := e.queue.DequeueContext(ctx, route)
+		if err != nil {
+			return err
+		}
+		handle(item)
+	}
+}
+
+// NewServer returns a server serving the queue of e over the network at addr,
+// sharing its state with the in-process users of e.
+// The server is started with ListenAndServe and stopped with Shutdown as usual.
+func (e *Embedded) NewServer(addr string) *Server {
+	return &Server{Addr: addr, Queue: e.queue}
+}
@@ -1,13 +1,44 @@
 package khronos
 
-import "strings"
+import (
+	"errors"
+	"strings"
+)
 
-type wrongNumberOfArgsError struct {
-	command string
+// Errors replied to the clients, which errors.Is matches against the errors of the commands.
+// The first word of an error replied is its class, such as ERR or NOAUTH, for the clients to tell them apart.
+var (
+	// ErrWrongArity is the class of the errors of the commands called with a wrong number of arguments,
+	// see WrongArityError.
+	ErrWrongArity = errors.New("ERR wrong number of arguments")
+	// ErrUnknownCommand is the class of the errors of the unknown commands and subcommands.
+	ErrUnknownCommand = errors.New("ERR unknown command")
+	// ErrWrongType is returned when a command operates on a route it does not apply to,
+	// such as a pop without a consumer group from a route with consumer groups.
+	ErrWrongType = errors.New("WRONGTYPE Operation against a route of the wrong kind")
+)
+
+// WrongArityError is the error of a command called with a wrong number of arguments.
+// Custom commands, see RegisterCommand, return it from their constructor to reply the standard error.
+type WrongArityError struct {
+	Command string
+}
+
+func (e *WrongArityError) Error() string {
+	return "ERR wrong number of arguments for '" + e.Command + "' command"
+}
+
+// Is reports whether target is ErrWrongArity.
+func (e *WrongArityError) Is(target error) bool {
+	return target == ErrWrongArity
 }
 
-func (e *wrongNumberOfArgsError) Error() string {
-	return "ERR wrong number of arguments for '" + e.command + "' command"
+type unknownOptionError struct {
+	option string
+}
+
+func (e *unknownOptionError) Error() string {
+	return "ERR unknown option '" + e.option + "'"
 }
 
 type wrongCommandError struct {
@@ -21,3 +52,34 @@ func (e *wrongCommandError) Error() string {
 	}
 	return "ERR unknown command '" + e.command + "'"
 }
+
+// Is reports whether target is ErrUnknownCommand.
+func (e *wrongCommandError) Is(target error) bool {
+	return target == ErrUnknownCommand
+}
+
+var errTimeoutNotValid = errors.New("ERR timeout is not a float or out of range")
+
+var errInvalidPort = errors.New("ERR invalid port")
+
+var errNoServer = errors.New("ERR command is only available on a server connection")
+
+var errNotInteger = errors.New("ERR value is not an integer or out of range")
+
+var errTokensDisabled = errors.New("ERR route tokens are disabled, set Server.TokenSecret")
+
+var errInvalidDuration = errors.New("ERR invalid duration")
+
+var errMaxClients = errors.New("ERR max number of clients reached")
+
+var errSyntax = errors.New("ERR syntax error")
+
+type invalidCIDRError struct {
+	cidr string
+}
+
+func (e *invalidCIDRError) Error() string {
+	return "ERR invalid CIDR '" + e.cidr + "'"
+}
+
+var errInvalidCursor = errors.New("ERR invalid cursor")
@@ -0,0 +1,105 @@
+package khronos
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// eventBacklog is the number of events waiting for Server.OnEvent before new ones are dropped.
+const eventBacklog = 4096
+
+// EventKind is a kind of queue event, see Server.OnEvent.
+// Kinds are bit flags, so that they can be combined in Server.Events.
+type EventKind int
+
+const (
+	// EventEnqueued is sent when an item is enqueued.
+	EventEnqueued EventKind = 1 << iota
+	// EventDequeued is sent when an item is dequeued by a consumer.
+	EventDequeued
+	// EventExpired is sent when an item is removed because it expired.
+	EventExpired
+	// EventDeadLettered is sent when an item is moved to a dead letter route.
+	EventDeadLettered
+	// EventHighWatermark is sent when a route reaches RouteConfig.HighWatermark items.
+	EventHighWatermark
+	// EventLowWatermark is sent when a route which reached its high watermark goes back to
+	// RouteConfig.LowWatermark items.
+	EventLowWatermark
+)
+
+func (k EventKind) String() string {
+	var names []string
+	for _, kind := range []struct {
+		kind EventKind
+		name string
+	}{
+		{EventEnqueued, "enqueued"},
+		{EventDequeued, "dequeued"},
+		{EventExpired, "expired"},
+		{EventDeadLettered, "deadlettered"},
+		{EventHighWatermark, "highwatermark"},
+		{EventLowWatermark, "lowwatermark"},
+	} {
+		if k&kind.kind != 0 {
+			names = append(names, kind.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// Event is a notification of an activity of the queue.
+// The watermark events have no item: their Value, Priority and ID are zero, and their Length is set.
+type Event struct {
+	Kind     EventKind
+	Route    string
+	Value    string
+	Priority int64
+	ID       uint64
+	Length   int // number of items of the route, for the watermark events.
+	Time     time.Time
+}
+
+// enableEvents makes the queue send its events to the returned channel.
+// If the channel is full, the events are dropped and counted.
+func (pq *PriorityQueueWithRouting) enableEvents(size int) <-chan Event {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	if pq.events == nil {
+		pq.events = make(chan Event, size)
+	}
+	return pq.events
+}
+
+// notify sends an event about item, if events are enabled.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) notify(kind EventKind, r *route, item *Item) {
+	if pq.events == nil {
+		return
+	}
+	select {
+	case pq.events <- Event{Kind: kind, Route: r.name, Value: item.value, Priority: item.priority, ID: item.id, Time: pq.now()}:
+	default:
+		atomic.AddUint64(&pq.eventsDropped, 1)
+	}
+}
+
+// startEvents delivers the events of the queue to OnEvent, once.
+func (srv *Server) startEvents() {
+	if srv.OnEvent == nil {
+		return
+	}
+	srv.eventsOnce.Do(func() {
+		events := srv.Queue.enableEvents(eventBacklog)
+		kinds := srv.Events
+		go func() {
+			for event := range events {
+				if kinds == 0 || kinds&event.Kind != 0 {
+					srv.OnEvent(event)
+				}
+			}
+		}()
+	})
+}
@@ -0,0 +1,241 @@
+package khronos
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultFailoverTimeout is how long a failover waits for the replicas to catch up with the leader.
+const defaultFailoverTimeout = 5 * time.Second
+
+var (
+	errNotFollower     = errors.New("ERR failover is only possible on a follower, use \"failover force\" to skip the leader")
+	errNotLeader       = errors.New("ERR the server is not a leader")
+	errFailoverTimeout = errors.New("ERR failover timed out waiting for the replicas")
+)
+
+// movedError redirects a client to the server which took over the role of the server.
+type movedError struct {
+	addr string
+}
+
+func (e *movedError) Error() string {
+	return "MOVED " + e.addr
+}
+
+// redirect returns a movedError if the server handed its role over with a failover
+// and the command changes the queue or waits for items, which the new leader serves.
+func (srv *Server) redirect(name string) error {
+	if commandInfos[name].Flags&(FlagWrite|FlagBlocking) == 0 {
+		return nil
+	}
+	srv.repl.mu.Lock()
+	defer srv.repl.mu.Unlock()
+	if srv.repl.movedTo == "" {
+		return nil
+	}
+	return &movedError{srv.repl.movedTo}
+}
+
+// setMovedTo redirects the clients changing the queue to addr, or stops redirecting them if addr is empty.
+// The connections blocked waiting for items are closed, so that they reconnect and get redirected.
+func (srv *Server) setMovedTo(addr string) {
+	srv.repl.mu.Lock()
+	srv.repl.movedTo = addr
+	srv.repl.mu.Unlock()
+	if addr == "" {
+		return
+	}
+	for _, c := range srv.clients.list() {
+		c.mu.Lock()
+		blocked := c.state == stateBlocked && commandInfos[c.lastCommand].Flags&FlagWrite != 0
+		c.mu.Unlock()
+		if blocked {
+			c.kill()
+		}
+	}
+}
+
+// handoff hands the role of leader over to the follower at addr: it redirects the writes to addr,
+// waits for the replicas to apply every operation and follows addr.
+// If the replicas do not catch up before ctx is done, the server stays a leader.
+func (srv *Server) handoff(ctx context.Context, addr string) error {
+	srv.repl.mu.Lock()
+	leader := srv.repl.leader
+	srv.repl.mu.Unlock()
+	if leader != "" {
+		return errNotLeader
+	}
+	srv.setMovedTo(addr)
+	srv.repl.mu.Lock()
+	replicas := len(srv.repl.acks)
+	srv.repl.mu.Unlock()
+	if srv.repl.waitAcks(ctx, srv.Queue.offset(), replicas) < replicas {
+		srv.setMovedTo("")
+		return errFailoverTimeout
+	}
+	// the promoted follower must not stream back the operations it sends,
+	// which it would until it stops following this server.
+	for _, c := range srv.clients.list() {
+		c.mu.Lock()
+		replica := c.mode() == "replica"
+		c.mu.Unlock()
+		if replica {
+			c.kill()
+		}
+	}
+	srv.replicaOf(addr)
+	srv.logger().Info("khronos: failover, now following", "leader", addr)
+	return nil
+}
+
+// promote makes the follower a leader in place of its leader.
+// Unless force is set, the leader first hands its role over, see handoff.
+func (srv *Server) promote(ctx context.Context, addr string, force bool, timeout time.Duration) error {
+	srv.repl.mu.Lock()
+	leader := srv.repl.leader
+	srv.repl.mu.Unlock()
+	if leader == "" && !force {
+		return errNotFollower
+	}
+	if !force {
+		if err := requestHandoff(ctx, leader, addr, timeout); err != nil {
+			return err
+		}
+	}
+	srv.replicaOf("")
+	srv.setMovedTo("")
+	srv.logger().Info("khronos: failover, now leader", "previous", leader)
+	return nil
+}
+
+// requestHandoff asks leader to hand its role over to the follower at addr.
+func requestHandoff(ctx context.Context, leader, addr string, timeout time.Duration) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", leader)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	// the leader waits for its replicas during timeout at most, leave it some time to reply.
+	_ = conn.SetDeadline(time.Now().Add(timeout + time.Second))
+	writer := &responseWriter{conn}
+	err = writer.WriteArray([]string{"failover", "handoff", addr, strconv.FormatInt(timeout.Milliseconds(), 10)})
+	if err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if reply = strings.TrimRight(reply, "\r\n"); strings.HasPrefix(reply, "-") {
+		return errors.New(reply[1:])
+	}
+	return nil
+}
+
+// FailoverCommand is the command "failover".
+// Sent to a follower, "failover [timeout <ms>]" promotes it to leader in place of its leader,
+// without losing operations: the leader redirects the commands changing the queue with
+// "-MOVED <addr>", waits for its replicas to apply every operation, and becomes a follower
+// of the promoted server. The failover fails, leaving the roles unchanged, if the replicas do
+// not catch up within the timeout, 5 seconds by default.
+// "failover force" promotes the follower without contacting the leader, for when it is down:
+// the operations the follower did not receive are lost.
+//
+// The promoted server is reached by the leader at the address the failover command was sent to,
+// or at Server.AnnounceAddr if set.
+// "failover handoff <addr> <timeout-ms>" is sent by the follower to its leader during a failover.
+type FailoverCommand struct {
+	ArgsCommand
+}
+
+func (c *FailoverCommand) Name() string {
+	return "failover"
+}
+
+func (c *FailoverCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		return errNoServer
+	}
+	args := c.Args()
+	timeout := defaultFailoverTimeout
+	if len(args) == 3 && strings.EqualFold(args[0], "handoff") {
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || ms <= 0 {
+			return errNotInteger
+		}
+		ctx, cancel := withTimeout(ctx, srv.clock(), time.Duration(ms)*time.Millisecond)
+		defer cancel()
+		defer markBlocked(ctx, "")()
+		addr := args[1]
+		if host, port, err := net.SplitHostPort(addr); err == nil && unspecifiedHost(host) {
+			// the follower listens on every interface, reach it where it comes from.
+			if conn := connFromContext(ctx); conn != nil {
+				addr = net.JoinHostPort(clientIP(conn.conn), port)
+			}
+		}
+		if err := srv.handoff(ctx, addr); err != nil {
+			return err
+		}
+		return writer.WriteStatus(OK)
+	}
+
+	force := false
+	for i := 0; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "force"):
+			force = true
+		case strings.EqualFold(args[i], "timeout") && i+1 < len(args):
+			ms, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || ms <= 0 {
+				return errNotInteger
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	addr := srv.AnnounceAddr
+	if addr == "" {
+		if conn := connFromContext(ctx); conn != nil {
+			addr = conn.conn.LocalAddr().String()
+		}
+	}
+	if addr == "" && !force {
+		return errNoServer
+	}
+	if err := srv.promote(ctx, addr, force, timeout); err != nil {
+		return err
+	}
+	return writer.WriteStatus(OK)
+}
+
+// unspecifiedHost reports whether host does not designate a single interface, as in ":6379".
+func unspecifiedHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+func NewFailoverCommand(args []string) (Command, error) {
+	if len(args) > 3 {
+		return nil, &WrongArityError{"failover"}
+	}
+	cmd := &FailoverCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["failover"] = NewFailoverCommand
+}
@@ -0,0 +1,84 @@
+package khronos
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// EnqueueMatching pushes a copy of the item, with its priority and its headers, to every existing route
+// whose name matches the pattern, as path.Match, and returns the number of routes it was pushed to.
+// The copies are pushed atomically, in the order of the route names: if one of the routes holds
+// RouteConfig.MaxLength items, it fails with ErrRouteFull and pushes nothing.
+// It schedules an item for every member of a family of routes, such as "workers:*", at once.
+func (pq *PriorityQueueWithRouting) EnqueueMatching(pattern string, item *Item) (int, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return 0, errSyntax
+	}
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	var routes []*route
+	for _, name := range sortedKeys(pq.routes) {
+		if isGroupRoute(name) {
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); !ok {
+			continue
+		}
+		r := pq.routes[name]
+		if r.full() {
+			pq.drop(r, item, DropRejected)
+			return 0, ErrRouteFull
+		}
+		routes = append(routes, r)
+	}
+	for _, r := range routes {
+		pq.push(r, item.Clone())
+	}
+	return len(routes), nil
+}
+
+// FanoutCommand is the command "fanout".
+// "fanout <pattern> <value> <priority>" pushes the item to every existing route matching the pattern,
+// such as "workers:*", and replies with the number of routes, see EnqueueMatching.
+// The priority "now" is the current Unix time in milliseconds, as for push.
+type FanoutCommand struct {
+	ArgsCommand
+}
+
+func (c *FanoutCommand) Name() string {
+	return "fanout"
+}
+
+func (c *FanoutCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	var priority int64
+	if strings.EqualFold(args[2], "now") {
+		priority = clockFromContext(ctx).Now().UnixMilli()
+	} else {
+		var err error
+		if priority, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+			return errNotInteger
+		}
+	}
+	n, err := PqFromContext(ctx).EnqueueMatching(args[0], NewItem(args[1], priority))
+	if err != nil {
+		return err
+	}
+	return writer.WriteInt64(int64(n))
+}
+
+func NewFanoutCommand(args []string) (Command, error) {
+	if len(args) != 3 {
+		return nil, &WrongArityError{"fanout"}
+	}
+	cmd := &FanoutCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["fanout"] = NewFanoutCommand
+}
@@ -0,0 +1,508 @@
+package khronos
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// opKind is the kind of operation applied to a PriorityQueueWithRouting.
+type opKind int
+
+const (
+	// opPush adds an item to a route.
+	opPush opKind = iota
+	// opDelete removes an item from a route.
+	opDelete
+	// opRename renames a route, replacing the target.
+	opRename
+	// opReset removes the items of every route, the route settings and the cron jobs.
+	opReset
+	// opCronAdd adds or replaces a cron job.
+	opCronAdd
+	// opCronDel removes a cron job.
+	opCronDel
+	// opConfig sets the settings of a route, see configOp.
+	opConfig
+	// opFlush removes the items of every route, see Flush.
+	opFlush
+	// opBind binds a route to a topic pattern, see Bind.
+	opBind
+	// opUnbind removes the binding of a route to a topic pattern.
+	opUnbind
+	// opGroupCreate creates a consumer group on a route, see CreateGroup.
+	opGroupCreate
+	// opGroupDestroy destroys a consumer group.
+	opGroupDestroy
+	// opGroupDeliver makes an item removed from the route of a group pending for a consumer, see DequeueGroup.
+	opGroupDeliver
+	// opGroupAck acknowledges a pending item of a group, see Ack.
+	opGroupAck
+	// opGroupClaim transfers a pending item of a group to another consumer, see Claim.
+	opGroupClaim
+	// opDedup records a deduplication id of a route until an expiry, see EnqueueOnce.
+	opDedup
+	// opUpdate changes the priority of an item, see UpdatePriority.
+	opUpdate
+)
+
+// queueOp is an operation applied to a PriorityQueueWithRouting.
+// Replaying the operations in order on an empty queue rebuilds the same state.
+// The items keep their identifiers, so that the operations on an item find it by its identifier.
+type queueOp struct {
+	kind     opKind
+	route    string
+	id       uint64 // the identifier of the item of opPush, opDelete, opUpdate and the opGroup operations on an item.
+	value    string // the value of the item, the new name of the route for opRename, the pattern of opBind and opUnbind, or the id of opDedup.
+	priority int64  // the priority of the item, the new one for opUpdate, or the expiry of opDedup in Unix milliseconds.
+	headers  map[string]string
+	name     string   // the name of the cron job of opCronAdd and opCronDel.
+	spec     string   // the schedule of the cron job of opCronAdd.
+	options  []string // the option, value pairs of "configure" of opConfig.
+	group    string   // the consumer group of the opGroup operations.
+	consumer string   // the consumer of opGroupDeliver and opGroupClaim.
+	count    int      // the number of deliveries of opGroupDeliver.
+}
+
+// pushOp returns the operation pushing item to route.
+func pushOp(route string, item *Item) queueOp {
+	return queueOp{kind: opPush, route: route, id: item.id, value: item.value, priority: item.priority, headers: item.headers}
+}
+
+// deleteOp returns the operation removing item from route.
+func deleteOp(route string, item *Item) queueOp {
+	return queueOp{kind: opDelete, route: route, id: item.id}
+}
+
+// updateOp returns the operation setting the priority of item, queued on route, to its current one.
+func updateOp(route string, item *Item) queueOp {
+	return queueOp{kind: opUpdate, route: route, id: item.id, priority: item.priority}
+}
+
+// cronAddOp returns the operation adding job.
+func cronAddOp(job *CronJob) queueOp {
+	return queueOp{kind: opCronAdd, route: job.Route, value: job.Value, priority: job.Priority, name: job.Name, spec: job.Spec}
+}
+
+// args encodes the operation as a command, so it can be sent with the RESP protocol.
+func (op queueOp) args() []string {
+	switch op.kind {
+	case opPush:
+		args := []string{"push", op.route, op.value, strconv.FormatInt(op.priority, 10), strconv.FormatUint(op.id, 10)}
+		for _, key := range sortedKeys(op.headers) {
+			args = append(args, key, op.headers[key])
+		}
+		return args
+	case opDelete:
+		return []string{"del", op.route, strconv.FormatUint(op.id, 10)}
+	case opUpdate:
+		return []string{"update", op.route, strconv.FormatUint(op.id, 10), strconv.FormatInt(op.priority, 10)}
+	case opRename:
+		return []string{"rename", op.route, op.value}
+	case opCronAdd:
+		return []string{"cron", "add", op.name, op.spec, op.route, op.value, strconv.FormatInt(op.priority, 10)}
+	case opCronDel:
+		return []string{"cron", "del", op.name}
+	case opConfig:
+		return append([]string{"configure", op.route}, op.options...)
+	case opFlush:
+		return []string{"flush"}
+	case opBind:
+		return []string{"bind", op.route, op.value}
+	case opUnbind:
+		return []string{"unbind", op.route, op.value}
+	case opDedup:
+		return []string{"dedup", op.route, op.value, strconv.FormatInt(op.priority, 10)}
+	case opGroupCreate:
+		return []string{"group", "create", op.route, op.group}
+	case opGroupDestroy:
+		return []string{"group", "destroy", op.route, op.group}
+	case opGroupDeliver:
+		args := []string{"group", "deliver", op.route, op.group, op.consumer, op.value, strconv.FormatInt(op.priority, 10),
+			strconv.Itoa(op.count), strconv.FormatUint(op.id, 10)}
+		for _, key := range sortedKeys(op.headers) {
+			args = append(args, key, op.headers[key])
+		}
+		return args
+	case opGroupAck:
+		return []string{"group", "ack", op.route, op.group, strconv.FormatUint(op.id, 10)}
+	case opGroupClaim:
+		return []string{"group", "claim", op.route, op.group, op.consumer, strconv.FormatUint(op.id, 10)}
+	}
+	return []string{"reset"}
+}
+
+// parseQueueOp decodes an operation encoded by queueOp.args.
+func parseQueueOp(name string, args []string) (queueOp, error) {
+	switch name {
+	case "reset":
+		if len(args) == 0 {
+			return queueOp{kind: opReset}, nil
+		}
+	case "flush":
+		if len(args) == 0 {
+			return queueOp{kind: opFlush}, nil
+		}
+	case "rename":
+		if len(args) == 2 {
+			return queueOp{kind: opRename, route: args[0], value: args[1]}, nil
+		}
+	case "cron":
+		if len(args) == 6 && args[0] == "add" {
+			priority, err := strconv.ParseInt(args[5], 10, 64)
+			if err != nil {
+				return queueOp{}, err
+			}
+			return queueOp{kind: opCronAdd, name: args[1], spec: args[2], route: args[3], value: args[4], priority: priority}, nil
+		}
+		if len(args) == 2 && args[0] == "del" {
+			return queueOp{kind: opCronDel, name: args[1]}, nil
+		}
+	case "group":
+		return parseGroupOp(args)
+	case "dedup":
+		if len(args) == 3 {
+			expires, err := strconv.ParseInt(args[2], 10, 64)
+			if err != nil {
+				return queueOp{}, err
+			}
+			return queueOp{kind: opDedup, route: args[0], value: args[1], priority: expires}, nil
+		}
+	case "bind", "unbind":
+		if len(args) == 2 {
+			op := queueOp{kind: opBind, route: args[0], value: args[1]}
+			if name == "unbind" {
+				op.kind = opUnbind
+			}
+			return op, nil
+		}
+	case "configure":
+		if len(args)%2 == 1 {
+			return queueOp{kind: opConfig, route: args[0], options: args[1:]}, nil
+		}
+	case "del":
+		if len(args) == 2 {
+			id, err := strconv.ParseUint(args[1], 10, 64)
+			if err != nil {
+				return queueOp{}, err
+			}
+			return queueOp{kind: opDelete, route: args[0], id: id}, nil
+		}
+	case "update":
+		if len(args) == 3 {
+			id, err := strconv.ParseUint(args[1], 10, 64)
+			if err != nil {
+				return queueOp{}, err
+			}
+			priority, err := strconv.ParseInt(args[2], 10, 64)
+			if err != nil {
+				return queueOp{}, err
+			}
+			return queueOp{kind: opUpdate, route: args[0], id: id, priority: priority}, nil
+		}
+	case "push":
+		if len(args) < 3 {
+			break
+		}
+		priority, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return queueOp{}, err
+		}
+		op := queueOp{kind: opPush, route: args[0], value: args[1], priority: priority}
+		headers := args[3:]
+		if len(args)%2 == 0 {
+			// the pushes written before the identifiers were persisted have none, the queue assigns them.
+			if op.id, err = strconv.ParseUint(args[3], 10, 64); err != nil {
+				return queueOp{}, err
+			}
+			headers = args[4:]
+		}
+		for i := 0; i < len(headers); i += 2 {
+			if op.headers == nil {
+				op.headers = make(map[string]string)
+			}
+			op.headers[headers[i]] = headers[i+1]
+		}
+		return op, nil
+	}
+	return queueOp{}, &wrongCommandError{command: name, args: args}
+}
+
+// parseGroupOp decodes a consumer group operation encoded by queueOp.args, without its "group" name.
+func parseGroupOp(args []string) (queueOp, error) {
+	if len(args) < 3 {
+		return queueOp{}, &wrongCommandError{command: "group", args: args}
+	}
+	op := queueOp{route: args[1], group: args[2]}
+	var err error
+	switch sub, rest := args[0], args[3:]; {
+	case sub == "create" && len(rest) == 0:
+		op.kind = opGroupCreate
+	case sub == "destroy" && len(rest) == 0:
+		op.kind = opGroupDestroy
+	case sub == "deliver" && len(rest) >= 5 && len(rest)%2 == 1:
+		op.kind, op.consumer, op.value = opGroupDeliver, rest[0], rest[1]
+		if op.priority, err = strconv.ParseInt(rest[2], 10, 64); err != nil {
+			return queueOp{}, err
+		}
+		if op.count, err = strconv.Atoi(rest[3]); err != nil {
+			return queueOp{}, err
+		}
+		if op.id, err = strconv.ParseUint(rest[4], 10, 64); err != nil {
+			return queueOp{}, err
+		}
+		for i := 5; i < len(rest); i += 2 {
+			if op.headers == nil {
+				op.headers = make(map[string]string)
+			}
+			op.headers[rest[i]] = rest[i+1]
+		}
+	case sub == "ack" && len(rest) == 1:
+		op.kind = opGroupAck
+		op.id, err = strconv.ParseUint(rest[0], 10, 64)
+	case sub == "claim" && len(rest) == 2:
+		op.kind, op.consumer = opGroupClaim, rest[0]
+		op.id, err = strconv.ParseUint(rest[1], 10, 64)
+	default:
+		return queueOp{}, &wrongCommandError{command: "group", args: args}
+	}
+	if err != nil {
+		return queueOp{}, err
+	}
+	return op, nil
+}
+
+// opFeed receives the operations applied to a queue after it subscribed.
+type opFeed struct {
+	ops    chan queueOp
+	offset uint64 // offset of the queue when the feed subscribed, see PriorityQueueWithRouting.opOffset.
+}
+
+// subscribe returns the operations rebuilding the current state of the queue,
+// and a feed receiving every following operation.
+// The snapshot and the feed are consistent: no operation is missed or seen twice.
+// If the subscriber falls more than size operations behind, the feed is closed.
+// The error reports the paged items which could not be read, and are missing from the snapshot.
+func (pq *PriorityQueueWithRouting) subscribe(size int) ([]queueOp, *opFeed, error) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	snapshot := []queueOp{{kind: opReset}}
+	now := pq.now()
+	var errs []error
+	pushItems := func(r *route) {
+		// replay the items in enqueue order, so that the ties between equal priorities are kept.
+		// the reserved items are queued until confirmed, see hold.
+		spilled, err := r.spilledItems()
+		if err != nil {
+			pq.overflowFailed()
+			errs = append(errs, err)
+		}
+		items := append(spilled, r.queue.Items()...)
+		for _, res := range r.reserved {
+			items = append(items, res.item)
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].id < items[j].id })
+		for _, item := range items {
+			snapshot = append(snapshot, pushOp(r.name, item))
+		}
+	}
+	for name, r := range pq.routes {
+		if isGroupRoute(name) {
+			continue
+		}
+		if r.config != pq.defaults {
+			snapshot = append(snapshot, configOp(name, r.config, pq.defaults))
+		}
+		for _, group := range sortedKeys(r.groups) {
+			snapshot = append(snapshot, queueOp{kind: opGroupCreate, route: name, group: group})
+		}
+		r.dedup.sweep(now)
+		for _, id := range sortedKeys(r.dedup.expires) {
+			snapshot = append(snapshot, dedupOp(name, id, r.dedup.expires[id]))
+		}
+		pushItems(r)
+	}
+	// the items of the groups, once they were created.
+	for name, r := range pq.routes {
+		g, ok := pq.groupOf(name)
+		if !ok {
+			continue
+		}
+		pushItems(r)
+		route, group, _ := strings.Cut(name, "\x00")
+		pending := make([]*delivery, 0, len(g.pending))
+		for _, d := range g.pending {
+			pending = append(pending, d)
+		}
+		sort.Slice(pending, func(i, j int) bool { return pending[i].item.id < pending[j].item.id })
+		for _, d := range pending {
+			snapshot = append(snapshot, pushOp(name, d.item), deleteOp(name, d.item), groupDeliverOp(route, group, d))
+		}
+	}
+	for _, name := range sortedKeys(pq.crons) {
+		snapshot = append(snapshot, cronAddOp(&pq.crons[name].CronJob))
+	}
+	for _, b := range pq.sortedBindings() {
+		snapshot = append(snapshot, queueOp{kind: opBind, route: b.Route, value: b.Pattern})
+	}
+	feed := &opFeed{ops: make(chan queueOp, size), offset: pq.opOffset}
+	if pq.feeds == nil {
+		pq.feeds = make(map[*opFeed]struct{})
+	}
+	pq.feeds[feed] = struct{}{}
+	return snapshot, feed, errors.Join(errs...)
+}
+
+// offset returns the number of operations applied to the queue so far.
+func (pq *PriorityQueueWithRouting) offset() uint64 {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	return pq.opOffset
+}
+
+// unsubscribe stops the feed.
+func (pq *PriorityQueueWithRouting) unsubscribe(feed *opFeed) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	if _, ok := pq.feeds[feed]; ok {
+		delete(pq.feeds, feed)
+		close(feed.ops)
+	}
+}
+
+// emit sends op to the subscribed feeds, dropping those which are full.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) emit(op queueOp) {
+	pq.opOffset++
+	for feed := range pq.feeds {
+		select {
+		case feed.ops <- op:
+		default:
+			delete(pq.feeds, feed)
+			close(feed.ops)
+		}
+	}
+}
+
+// apply applies an operation received from another queue.
+func (pq *PriorityQueueWithRouting) apply(op queueOp) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	switch op.kind {
+	case opPush:
+		if route, group, ok := strings.Cut(op.route, "\x00"); ok {
+			// the append-only files written before the groups were persisted only have their items.
+			if r := pq.route(route); r.groups[group] == nil {
+				pq.createGroup(r, group)
+			}
+		}
+		item := &Item{value: op.value, priority: op.priority, headers: op.headers}
+		if r := pq.route(op.route); op.id != 0 && len(r.groups) == 0 {
+			// the item keeps the identifier it has on the queue the operation comes from.
+			pq.nextID = max(pq.nextID, op.id)
+			pq.insert(r, item, op.id)
+		} else {
+			pq.push(r, item)
+		}
+	case opDelete:
+		if r, ok := pq.routes[op.route]; ok && pq.removeID(r, op.id) {
+			pq.accounting.Popped++
+		}
+	case opUpdate:
+		if r, ok := pq.routes[op.route]; ok {
+			pq.updateID(r, op.id, op.priority)
+		}
+	case opRename:
+		_ = pq.rename(op.route, op.value, true)
+	case opReset:
+		for _, r := range pq.routes {
+			for _, g := range r.groups {
+				pq.accounting.Dropped += uint64(len(g.pending))
+				pq.accounting.Inflight -= uint64(len(g.pending))
+			}
+			for _, res := range r.reserved {
+				res.stop()
+			}
+			pq.accounting.Dropped += uint64(r.size() + len(r.reserved))
+			pq.accounting.Inflight -= uint64(len(r.reserved))
+			r.groups, r.reserved, r.dedup = nil, nil, dedupIndex{}
+			r.queue.items = nil
+			r.recount()
+			r.dropSegments()
+			// the snapshot following the reset sets the routes which differ from the defaults.
+			r.config = pq.defaults
+			r.wakeProducers()
+			pq.watermark(r)
+		}
+		for name, r := range pq.routes {
+			if r.collectable(pq.defaults) {
+				delete(pq.routes, name)
+				pq.indexRoute(name, nil)
+			}
+		}
+		clear(pq.items)
+		clear(pq.crons)
+		clear(pq.bindings)
+		pq.emit(op)
+	case opCronAdd, opCronDel:
+		pq.applyCron(op)
+	case opConfig:
+		pq.applyConfig(op)
+	case opFlush:
+		pq.flush(false)
+	case opBind, opUnbind:
+		pq.applyBinding(op)
+	case opGroupCreate, opGroupDestroy, opGroupDeliver, opGroupAck, opGroupClaim:
+		pq.applyGroup(op)
+	case opDedup:
+		pq.applyDedup(op)
+	}
+}
+
+// removeID removes the item with the given identifier from the route, in memory or paged.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) removeID(r *route, id uint64) bool {
+	r = r.resolve()
+	if item, ok := pq.items[id]; ok && item.route.resolve() == r {
+		pq.removeItem(r, item)
+		return true
+	}
+	for i, s := range r.segments {
+		if s.head.id == id {
+			item := pq.takeHead(r, i)
+			r.wakeProducers()
+			pq.watermark(r)
+			pq.emit(deleteOp(r.name, item))
+			return true
+		}
+	}
+	if len(r.segments) == 0 {
+		return false
+	}
+	// an item paged behind the head of its segment, which is rare as the items leave in dequeue order.
+	pq.unspill(r)
+	if item, ok := pq.items[id]; ok && item.route.resolve() == r {
+		pq.removeItem(r, item)
+		return true
+	}
+	return false
+}
+
+// updateID sets the priority of the item with the given identifier queued on the route, in memory or paged.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) updateID(r *route, id uint64, priority int64) {
+	r = r.resolve()
+	item, ok := pq.items[id]
+	if !ok && len(r.segments) > 0 {
+		pq.unspill(r)
+		item, ok = pq.items[id]
+	}
+	if ok && item.route.resolve() == r {
+		pq.setPriority(r, item, priority)
+	}
+}
@@ -0,0 +1,287 @@
+package khronos
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DequeueFunc is like DequeueContext but only dequeues the items for which match returns true,
+// the item coming first in the order of the route among them.
+// The other items stay in the route, in place. The items paged to disk are not considered.
+// match is called with the queue locked: it must be fast and must not use the queue.
+func (pq *PriorityQueueWithRouting) DequeueFunc(ctx context.Context, route string, match func(item *Item) bool) (*Item, error) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r := pq.route(route)
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				pq.queueLock.Lock()
+				r.resolve().notEmpty.Broadcast()
+				pq.queueLock.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	for {
+		r = r.resolve()
+		// scan with skip: the heap does not index the items by content.
+		var best *Item
+		for _, item := range r.queue.Items() {
+			if (best == nil || r.config.before(item, best)) && match(item) {
+				best = item
+			}
+		}
+		if best != nil && !pq.paused(r) {
+			r.take(best.index)
+			pq.delivered(r, best)
+			return best, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		r.waiters++
+		r.notEmpty.Wait()
+		r.waiters--
+	}
+}
+
+// errInvalidFilter is returned for a filter expression which does not parse.
+type errInvalidFilter struct {
+	reason string
+}
+
+func (e *errInvalidFilter) Error() string {
+	return "ERR invalid filter: " + e.reason
+}
+
+// compileFilter compiles a filter expression of "pop ... filter <expr>" into a predicate over the items.
+//
+// An expression compares operands with ==, !=, <, <=, > and >=, and combines the comparisons
+// with && and ||, && binding tighter, and parentheses. An operand is a header name, the keyword
+// value or priority for the value or the priority of the item, a quoted string or an integer.
+// A missing header is the empty string. Two operands which are both integers are compared as
+// integers, otherwise as strings. For instance:
+//
+//	tenant == "acme" && (priority >= 10 || retries == 0)
+func compileFilter(expr string) (func(item *Item) bool, error) {
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	match, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, &errInvalidFilter{"unexpected " + p.tokens[p.pos].text}
+	}
+	return match, nil
+}
+
+type filterTokenKind int
+
+const (
+	filterIdent filterTokenKind = iota
+	filterString
+	filterNumber
+	filterOp
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+}
+
+func tokenizeFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(expr) && expr[end] != '"' {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, &errInvalidFilter{"unterminated string"}
+			}
+			s, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, &errInvalidFilter{"invalid string " + expr[i:end+1]}
+			}
+			tokens = append(tokens, filterToken{filterString, s})
+			i = end + 1
+		case c == '-' || unicode.IsDigit(c):
+			end := i + 1
+			for end < len(expr) && unicode.IsDigit(rune(expr[end])) {
+				end++
+			}
+			tokens = append(tokens, filterToken{filterNumber, expr[i:end]})
+			i = end
+		case c == '_' || unicode.IsLetter(c):
+			end := i + 1
+			for end < len(expr) && (expr[end] == '_' || expr[end] == '-' || expr[end] == '.' ||
+				unicode.IsLetter(rune(expr[end])) || unicode.IsDigit(rune(expr[end]))) {
+				end++
+			}
+			tokens = append(tokens, filterToken{filterIdent, expr[i:end]})
+			i = end
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "(", ")"} {
+				if strings.HasPrefix(expr[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, &errInvalidFilter{"unexpected " + string(c)}
+			}
+			tokens = append(tokens, filterToken{filterOp, op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// accept consumes the next token if it is the operator op.
+func (p *filterParser) accept(op string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == filterOp && p.tokens[p.pos].text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) or() (func(*Item) bool, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(item *Item) bool { return l(item) || right(item) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) and() (func(*Item) bool, error) {
+	left, err := p.comparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.comparison()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(item *Item) bool { return l(item) && right(item) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) comparison() (func(*Item) bool, error) {
+	if p.accept("(") {
+		match, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, &errInvalidFilter{"missing )"}
+		}
+		return match, nil
+	}
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != filterOp {
+		return nil, &errInvalidFilter{"missing comparison operator"}
+	}
+	op := p.tokens[p.pos].text
+	p.pos++
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	var test func(c int) bool
+	switch op {
+	case "==":
+		test = func(c int) bool { return c == 0 }
+	case "!=":
+		test = func(c int) bool { return c != 0 }
+	case "<":
+		test = func(c int) bool { return c < 0 }
+	case "<=":
+		test = func(c int) bool { return c <= 0 }
+	case ">":
+		test = func(c int) bool { return c > 0 }
+	case ">=":
+		test = func(c int) bool { return c >= 0 }
+	default:
+		return nil, &errInvalidFilter{"unexpected " + op}
+	}
+	return func(item *Item) bool { return test(compareOperands(left(item), right(item))) }, nil
+}
+
+// operand returns a function evaluating the next operand on an item.
+func (p *filterParser) operand() (func(*Item) string, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, &errInvalidFilter{"unexpected end"}
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	switch t.kind {
+	case filterString, filterNumber:
+		return func(*Item) string { return t.text }, nil
+	case filterIdent:
+		switch t.text {
+		case "value":
+			return func(item *Item) string { return item.value }, nil
+		case "priority":
+			return func(item *Item) string { return strconv.FormatInt(item.priority, 10) }, nil
+		}
+		return func(item *Item) string { return item.headers[t.text] }, nil
+	}
+	return nil, &errInvalidFilter{"unexpected " + t.text}
+}
+
+// compareOperands compares a and b as integers if they both are, as strings otherwise.
+func compareOperands(a, b string) int {
+	x, errA := strconv.ParseInt(a, 10, 64)
+	y, errB := strconv.ParseInt(b, 10, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,115 @@
+package khronos
+
+import (
+	"context"
+	"strings"
+)
+
+// Flush removes the items of every route of the queue, including the items reserved until confirmed,
+// and the deduplication ids, and returns the number of items removed. The routes left with nothing but
+// the default settings are removed, the others keep their settings and their consumer groups;
+// the items delivered to the consumer groups and not acknowledged yet are kept, as are the cron jobs.
+// If async, the routes are detached from their items under the lock, and the items paged to disk are
+// released in the background, so that flushing a large queue does not stall its other operations.
+func (pq *PriorityQueueWithRouting) Flush(async bool) int {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	return pq.flush(async)
+}
+
+// flush implements Flush.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) flush(async bool) int {
+	n := 0
+	var segments []*segment
+	for _, r := range pq.routes {
+		n += r.size() + len(r.reserved)
+		pq.accounting.Dropped += uint64(r.size() + len(r.reserved))
+		pq.accounting.Inflight -= uint64(len(r.reserved))
+		for _, res := range r.reserved {
+			res.stop()
+		}
+		r.queue.items, r.reserved, r.dedup = nil, nil, dedupIndex{}
+		r.recount()
+		segments = append(segments, r.segments...)
+		r.segments, r.spilled = nil, 0
+		r.wakeProducers()
+		pq.watermark(r)
+	}
+	pq.items = make(map[uint64]*Item)
+	pq.emit(queueOp{kind: opFlush})
+	for name, r := range pq.routes {
+		if !isGroupRoute(name) && r.collectable(pq.defaults) {
+			delete(pq.routes, name)
+			pq.indexRoute(name, nil)
+		}
+	}
+
+	closeSegments := func() {
+		for _, s := range segments {
+			s.close()
+		}
+	}
+	if async {
+		go closeSegments()
+	} else {
+		closeSegments()
+	}
+	return n
+}
+
+// FlushCommand is the command "flushall" or "flushspace".
+// "flushall [async|sync]" removes the items of every route of every queue space,
+// "flushspace [async|sync]" those of the queue space of the connection, see Flush and Server.MaxSpaces.
+// Both reply OK. With "async", the items are released in the background.
+type FlushCommand struct {
+	ArgsCommand
+	name string
+}
+
+func (c *FlushCommand) Name() string {
+	return c.name
+}
+
+func (c *FlushCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	async := false
+	if args := c.Args(); len(args) == 1 {
+		switch strings.ToLower(args[0]) {
+		case "async":
+			async = true
+		case "sync":
+		default:
+			return errSyntax
+		}
+	}
+	if c.name == "flushspace" {
+		PqFromContext(ctx).Flush(async)
+		return writer.WriteStatus(OK)
+	}
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		PqFromContext(ctx).Flush(async)
+		return writer.WriteStatus(OK)
+	}
+	for _, pq := range srv.queues() {
+		pq.Flush(async)
+	}
+	return writer.WriteStatus(OK)
+}
+
+func newFlushCommand(name string) CommandConstructor {
+	return func(args []string) (Command, error) {
+		if len(args) > 1 {
+			return nil, &WrongArityError{name}
+		}
+		cmd := &FlushCommand{name: name}
+		cmd.args = args
+		return cmd, nil
+	}
+}
+
+func init() {
+	commandLibraries["flushall"] = newFlushCommand("flushall")
+	commandLibraries["flushspace"] = newFlushCommand("flushspace")
+}
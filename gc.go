@@ -0,0 +1,101 @@
+package khronos
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// CollectRoutes removes the empty routes which were not used for at least idle, and returns
+// the number of routes removed. A route is kept while consumers wait on it, while it has consumer
+// groups, items reserved to consumers or deduplication ids, or if its settings differ from the default ones,
+// see SetDefaultRouteConfig. A removed route is created again, empty, as it is used.
+//
+// Routes are never removed otherwise: CollectRoutes keeps the memory of a queue with many
+// short-lived routes, such as a route per user, bounded. See also Server.RouteIdleTimeout.
+func (pq *PriorityQueueWithRouting) CollectRoutes(idle time.Duration) int {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	now := pq.now()
+	n := 0
+	for name, r := range pq.routes {
+		r.dedup.sweep(now)
+		if _, ok := pq.groupOf(name); ok || !r.collectable(pq.defaults) || now.Sub(r.lastUsed) < idle {
+			continue
+		}
+		delete(pq.routes, name)
+		pq.indexRoute(name, nil)
+		n++
+	}
+	return n
+}
+
+// collectable reports whether the route holds nothing but the default settings,
+// and can be removed.
+// It must be called with queueLock held.
+func (r *route) collectable(defaults RouteConfig) bool {
+	return r.size() == 0 && len(r.segments) == 0 && r.waiters == 0 && !r.paused &&
+		len(r.groups) == 0 && len(r.reserved) == 0 && len(r.dedup.expires) == 0 && r.config == defaults
+}
+
+// startCollector starts removing the idle routes of Queue every Server.RouteIdleTimeout, once.
+func (srv *Server) startCollector() {
+	idle := srv.RouteIdleTimeout
+	if idle <= 0 {
+		return
+	}
+	srv.collectorOnce.Do(func() {
+		var collect func()
+		collect = func() {
+			select {
+			case <-srv.getDoneChan():
+				return
+			default:
+			}
+			for _, pq := range srv.queues() {
+				if n := pq.CollectRoutes(idle); n > 0 {
+					srv.logger().Debug("khronos: idle routes removed", "routes", n)
+				}
+			}
+			srv.clock().AfterFunc(idle, collect)
+		}
+		srv.clock().AfterFunc(idle, collect)
+	})
+}
+
+// GCCommand is the command "gc".
+// "gc [idle-ms]" removes the empty routes not used for at least idle-ms milliseconds, 0 by default,
+// and replies with the number of routes removed, see CollectRoutes.
+type GCCommand struct {
+	ArgsCommand
+}
+
+func (c *GCCommand) Name() string {
+	return "gc"
+}
+
+func (c *GCCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	var idle time.Duration
+	if args := c.Args(); len(args) == 1 {
+		ms, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil || ms < 0 {
+			return errNotInteger
+		}
+		idle = time.Duration(ms) * time.Millisecond
+	}
+	return writer.WriteInt64(int64(PqFromContext(ctx).CollectRoutes(idle)))
+}
+
+func NewGCCommand(args []string) (Command, error) {
+	if len(args) > 1 {
+		return nil, &WrongArityError{"gc"}
+	}
+	cmd := &GCCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["gc"] = NewGCCommand
+}
@@ -1,3 +1,3 @@
 module khronos
 
-go 1.20
+go 1.21
@@ -0,0 +1,449 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoSuchGroup is returned for a consumer group which does not exist.
+	ErrNoSuchGroup = errors.New("ERR no such consumer group")
+	// ErrGroupExists is returned when creating a consumer group which already exists.
+	ErrGroupExists = errors.New("ERR consumer group already exists")
+)
+
+// group is a consumer group of a route.
+// It receives a copy of every item pushed to the route, each copy being delivered to a single
+// consumer of the group and tracked until it is acknowledged.
+type group struct {
+	route   *route               // Holds the items not delivered yet.
+	pending map[uint64]*delivery // Items delivered and not acknowledged yet, by identifier.
+}
+
+// delivery is an entry of the pending entries list of a group.
+type delivery struct {
+	item      *Item
+	consumer  string
+	delivered time.Time
+	count     int
+}
+
+// PendingEntry describes an item delivered to a consumer of a group and not acknowledged yet.
+type PendingEntry struct {
+	ID         uint64        // identifier of the item.
+	Consumer   string        // consumer the item was delivered to.
+	Idle       time.Duration // time since the item was delivered.
+	Deliveries int           // number of times the item was delivered.
+}
+
+// groupRouteName is the name of the internal route holding the items of a group not delivered yet.
+func groupRouteName(route, name string) string {
+	return route + "\x00" + name
+}
+
+// isGroupRoute reports whether the route is the internal route of a group, see groupRouteName.
+func isGroupRoute(name string) bool {
+	return strings.Contains(name, "\x00")
+}
+
+// CreateGroup creates a consumer group on the route.
+// From then on, every item pushed to the route is delivered to each of its groups, instead of
+// being kept in the route itself: a group is an independent fleet of consumers which sees all the
+// items, and within a group each item goes to a single consumer, see DequeueGroup.
+// Plain dequeues of a route with groups only get the items pushed before the first group was created.
+func (pq *PriorityQueueWithRouting) CreateGroup(route, name string) error {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r := pq.route(route)
+	if _, ok := r.groups[name]; ok {
+		return ErrGroupExists
+	}
+	pq.createGroup(r, name)
+	return nil
+}
+
+// createGroup creates the named group of the route.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) createGroup(r *route, name string) *group {
+	if r.groups == nil {
+		r.groups = make(map[string]*group)
+	}
+	g := &group{route: pq.route(groupRouteName(r.name, name)), pending: make(map[uint64]*delivery)}
+	r.groups[name] = g
+	pq.emit(queueOp{kind: opGroupCreate, route: r.name, group: name})
+	return g
+}
+
+// DestroyGroup destroys a consumer group of the route, discarding its undelivered and pending items.
+func (pq *PriorityQueueWithRouting) DestroyGroup(route, name string) error {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	g, err := pq.group(route, name)
+	if err != nil {
+		return err
+	}
+	pq.destroyGroup(route, name, g)
+	return nil
+}
+
+// destroyGroup destroys the named group g of the route.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) destroyGroup(route, name string, g *group) {
+	delete(pq.routes[route].groups, name)
+	pq.accounting.Dropped += uint64(g.route.size() + len(g.pending))
+	pq.accounting.Inflight -= uint64(len(g.pending))
+	for g.route.queue.Len() > 0 {
+		pq.removeItem(g.route, g.route.queue.items[0])
+	}
+	g.route.dropSegments()
+	// a consumer still waiting on the route keeps it, until CollectRoutes removes it.
+	if g.route.collectable(pq.defaults) {
+		delete(pq.routes, g.route.name)
+		pq.indexRoute(g.route.name, nil)
+	}
+	pq.emit(queueOp{kind: opGroupDestroy, route: route, group: name})
+}
+
+// groupOf returns the group whose internal route is named name, see groupRouteName.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) groupOf(name string) (*group, bool) {
+	route, group, _ := strings.Cut(name, "\x00")
+	g, err := pq.group(route, group)
+	return g, err == nil && g.route.name == name
+}
+
+// group returns the named group of the route.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) group(route, name string) (*group, error) {
+	r, ok := pq.routes[route]
+	if !ok {
+		return nil, ErrNoSuchGroup
+	}
+	g, ok := r.groups[name]
+	if !ok {
+		return nil, ErrNoSuchGroup
+	}
+	return g, nil
+}
+
+// hasGroups reports whether the route has consumer groups.
+func (pq *PriorityQueueWithRouting) hasGroups(route string) bool {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r, ok := pq.routes[route]
+	return ok && len(r.groups) > 0
+}
+
+// fanout pushes a copy of the item to each group of the route.
+// The item itself goes to the first group, so that its identifier is the one of a delivered copy.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) fanout(r *route, item *Item) {
+	r.enqueued++
+	for i, name := range sortedKeys(r.groups) {
+		c := item
+		if i > 0 {
+			c = item.Clone()
+		}
+		pq.push(r.groups[name].route, c)
+	}
+}
+
+// DequeueGroup removes and returns the next item of the group for the consumer,
+// waiting for an item until ctx is done, like DequeueContext.
+// The item stays pending in the group until it is acknowledged with Ack,
+// and can be taken over by another consumer with Claim in the meantime.
+func (pq *PriorityQueueWithRouting) DequeueGroup(ctx context.Context, route, name, consumer string) (*Item, error) {
+	pq.queueLock.Lock()
+	g, err := pq.group(route, name)
+	pq.queueLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	item, err := pq.DequeueContext(ctx, g.route.name)
+	if err != nil {
+		return nil, err
+	}
+
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+	if current, _ := pq.group(route, name); current == g {
+		// the item is delivered but not consumed until it is acknowledged.
+		pq.accounting.Popped--
+		pq.accounting.Inflight++
+		g.pending[item.id] = &delivery{item: item, consumer: consumer, delivered: pq.now(), count: 1}
+		pq.emit(groupDeliverOp(route, name, g.pending[item.id]))
+	}
+	return item, nil
+}
+
+// groupDeliverOp returns the operation making the item of d pending in the named group of the route.
+func groupDeliverOp(route, name string, d *delivery) queueOp {
+	return queueOp{kind: opGroupDeliver, route: route, group: name, consumer: d.consumer, id: d.item.id,
+		value: d.item.value, priority: d.item.priority, headers: d.item.headers, count: d.count}
+}
+
+// applyGroup applies a consumer group operation received from another queue.
+// The pending items keep the identifiers they have on the queue the operation comes from.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) applyGroup(op queueOp) {
+	if op.kind == opGroupCreate {
+		if r := pq.route(op.route); r.groups[op.group] == nil {
+			pq.createGroup(r, op.group)
+		}
+		return
+	}
+	g, err := pq.group(op.route, op.group)
+	if err != nil {
+		return
+	}
+	switch op.kind {
+	case opGroupDestroy:
+		pq.destroyGroup(op.route, op.group, g)
+		return
+	case opGroupDeliver:
+		// the item was removed from the route of the group by the operation preceding this one.
+		item := &Item{value: op.value, priority: op.priority, id: op.id, headers: op.headers}
+		pq.accounting.Popped--
+		pq.accounting.Inflight++
+		g.pending[item.id] = &delivery{item: item, consumer: op.consumer, delivered: pq.now(), count: op.count}
+	case opGroupAck:
+		if _, ok := g.pending[op.id]; !ok {
+			return
+		}
+		delete(g.pending, op.id)
+		pq.accounting.Inflight--
+		pq.accounting.Popped++
+	case opGroupClaim:
+		d, ok := g.pending[op.id]
+		if !ok {
+			return
+		}
+		d.consumer, d.delivered = op.consumer, pq.now()
+		d.count++
+	}
+	pq.emit(op)
+}
+
+// Ack acknowledges the pending items of the group with the given identifiers,
+// and returns the number of items which were pending.
+func (pq *PriorityQueueWithRouting) Ack(route, name string, ids ...uint64) (int, error) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	g, err := pq.group(route, name)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids {
+		if _, ok := g.pending[id]; ok {
+			delete(g.pending, id)
+			pq.accounting.Inflight--
+			pq.accounting.Popped++
+			pq.emit(queueOp{kind: opGroupAck, route: route, group: name, id: id})
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Claim transfers to the consumer the pending items of the group with the given identifiers
+// which were delivered at least minIdle ago, and returns them.
+// It lets a consumer take over the deliveries of a consumer which stalled.
+func (pq *PriorityQueueWithRouting) Claim(route, name, consumer string, minIdle time.Duration, ids ...uint64) ([]*Item, error) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	g, err := pq.group(route, name)
+	if err != nil {
+		return nil, err
+	}
+	now := pq.now()
+	var items []*Item
+	for _, id := range ids {
+		d, ok := g.pending[id]
+		if !ok || now.Sub(d.delivered) < minIdle {
+			continue
+		}
+		d.consumer, d.delivered = consumer, now
+		d.count++
+		pq.emit(queueOp{kind: opGroupClaim, route: route, group: name, consumer: consumer, id: id})
+		items = append(items, d.item)
+	}
+	return items, nil
+}
+
+// Pending returns the pending entries of the group, by increasing identifier.
+func (pq *PriorityQueueWithRouting) Pending(route, name string) ([]PendingEntry, error) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	g, err := pq.group(route, name)
+	if err != nil {
+		return nil, err
+	}
+	now := pq.now()
+	entries := make([]PendingEntry, 0, len(g.pending))
+	for id, d := range g.pending {
+		entries = append(entries, PendingEntry{ID: id, Consumer: d.consumer, Idle: now.Sub(d.delivered), Deliveries: d.count})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries, nil
+}
+
+// GroupCommand is the command "group".
+// "group create <route> <group>" creates a consumer group on the route,
+// "group destroy <route> <group>" destroys it,
+// and "group pending <route> <group>" replies with the pending entries of the group
+// as a flat array of id, consumer, idle time in milliseconds and delivery count.
+//
+// The consumers of a group pop with "pop <route> group=<group> consumer=<consumer>",
+// which replies with the id and the value of the item, acknowledge the items with "xack"
+// and take over stalled deliveries with "claim".
+type GroupCommand struct {
+	ArgsCommand
+}
+
+func (c *GroupCommand) Name() string {
+	return "group"
+}
+
+func (c *GroupCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	pq := PqFromContext(ctx)
+	route, name := args[1], args[2]
+	switch sub := strings.ToLower(args[0]); sub {
+	case "create":
+		if err := pq.CreateGroup(route, name); err != nil {
+			return err
+		}
+		return writer.WriteStatus(OK)
+	case "destroy":
+		if err := pq.DestroyGroup(route, name); err != nil {
+			return err
+		}
+		return writer.WriteStatus(OK)
+	case "pending":
+		entries, err := pq.Pending(route, name)
+		if err != nil {
+			return err
+		}
+		reply := make([]string, 0, 4*len(entries))
+		for _, e := range entries {
+			reply = append(reply, strconv.FormatUint(e.ID, 10), e.Consumer,
+				strconv.FormatInt(e.Idle.Milliseconds(), 10), strconv.Itoa(e.Deliveries))
+		}
+		return writer.WriteArray(reply)
+	default:
+		return &wrongCommandError{command: c.Name() + "|" + sub, args: args[1:]}
+	}
+}
+
+func NewGroupCommand(args []string) (Command, error) {
+	if len(args) != 3 {
+		return nil, &WrongArityError{"group"}
+	}
+	cmd := &GroupCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+// XAckCommand is the command "xack".
+// "xack <route> <group> <id>..." acknowledges items delivered to the consumers of the group,
+// and replies with the number of items which were pending.
+type XAckCommand struct {
+	ArgsCommand
+}
+
+func (c *XAckCommand) Name() string {
+	return "xack"
+}
+
+func (c *XAckCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	ids, err := parseIDs(args[2:])
+	if err != nil {
+		return err
+	}
+	n, err := PqFromContext(ctx).Ack(args[0], args[1], ids...)
+	if err != nil {
+		return err
+	}
+	return writer.WriteInt64(int64(n))
+}
+
+func NewXAckCommand(args []string) (Command, error) {
+	if len(args) < 3 {
+		return nil, &WrongArityError{"xack"}
+	}
+	cmd := &XAckCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+// ClaimCommand is the command "claim".
+// "claim <route> <group> <consumer> <min-idle-ms> <id>..." transfers to the consumer the pending items
+// of the group delivered at least min-idle-ms milliseconds ago, and replies with their ids and values
+// as a flat array.
+type ClaimCommand struct {
+	ArgsCommand
+}
+
+func (c *ClaimCommand) Name() string {
+	return "claim"
+}
+
+func (c *ClaimCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	minIdle, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil || minIdle < 0 {
+		return errNotInteger
+	}
+	ids, err := parseIDs(args[4:])
+	if err != nil {
+		return err
+	}
+	items, err := PqFromContext(ctx).Claim(args[0], args[1], args[2], time.Duration(minIdle)*time.Millisecond, ids...)
+	if err != nil {
+		return err
+	}
+	reply := make([]string, 0, 2*len(items))
+	for _, item := range items {
+		reply = append(reply, strconv.FormatUint(item.id, 10), item.value)
+	}
+	return writer.WriteArray(reply)
+}
+
+func NewClaimCommand(args []string) (Command, error) {
+	if len(args) < 5 {
+		return nil, &WrongArityError{"claim"}
+	}
+	cmd := &ClaimCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func parseIDs(args []string) ([]uint64, error) {
+	ids := make([]uint64, len(args))
+	for i, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return nil, errNotInteger
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+func init() {
+	commandLibraries["group"] = NewGroupCommand
+	commandLibraries["xack"] = NewXAckCommand
+	commandLibraries["claim"] = NewClaimCommand
+}
@@ -0,0 +1,57 @@
+package khronos
+
+import "context"
+
+// awaitHandoff blocks the only consumer of an empty route until a push hands it an item directly,
+// without going through the heap, see handoff. It returns false when the consumer must look at
+// the route again instead: the route was woken up without an item for it, or ctx is done.
+// It must be called with queueLock held, and returns with queueLock held.
+func (pq *PriorityQueueWithRouting) awaitHandoff(ctx context.Context, r *route) (*Item, bool) {
+	ch := make(chan *Item, 1)
+	r.handoff = ch
+	r.waiters++
+	pq.queueLock.Unlock()
+	var item *Item
+	select {
+	case item = <-ch:
+	case <-ctx.Done():
+	}
+	pq.queueLock.Lock()
+	r.waiters--
+	if r.handoff == ch {
+		r.handoff = nil
+	}
+	if item == nil {
+		// an item handed over while ctx was done is delivered all the same.
+		select {
+		case item = <-ch:
+		default:
+		}
+	}
+	return item, item != nil
+}
+
+// handoff delivers an item pushed to an empty route to its only consumer, blocked in awaitHandoff,
+// and reports whether it did. It saves the worker pattern a trip through the heap and a broadcast.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) handoff(r *route, item *Item) bool {
+	ch := r.handoff
+	if ch == nil || r.waiters != 1 || r.size() > 0 || pq.paused(r) {
+		return false
+	}
+	r.handoff = nil
+	pq.delivered(r, item)
+	ch <- item
+	return true
+}
+
+// signal wakes up the consumers blocked on the route, including the one waiting for a handoff,
+// so that they look at the route again.
+// It must be called with queueLock held.
+func (r *route) signal() {
+	r.notEmpty.Broadcast()
+	if r.handoff != nil {
+		r.handoff <- nil
+		r.handoff = nil
+	}
+}
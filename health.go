@@ -0,0 +1,212 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// livenessTimeout is how long Health waits for the queue before reporting the server as not live.
+	livenessTimeout = time.Second
+	// persistenceWindow is how long the server is reported as not ready after a failure to page items to disk.
+	persistenceWindow = time.Minute
+)
+
+// Health describes the state of a server, as checked by the probes of an orchestrator such as Kubernetes.
+type Health struct {
+	// Live reports whether the server makes progress: the queue is not stuck.
+	// A server which is not live should be restarted.
+	Live bool
+
+	// Ready reports whether the server should receive traffic, see Reasons otherwise.
+	Ready bool
+
+	// Reasons describe why the server is not live or not ready.
+	Reasons []string
+
+	// Accepting reports whether the server listens for connections and has room for more, see Server.MaxConns.
+	Accepting bool
+
+	// PersistenceOK reports whether the items were paged to disk without error lately, see RouteConfig.MaxInMemory.
+	PersistenceOK bool
+
+	// Role is "leader" or "follower".
+	Role string
+
+	// ReplicationLag is, for a leader, the number of operations the slowest replica did not acknowledge yet.
+	ReplicationLag uint64
+
+	// LinkUp reports, for a follower, whether it is in sync with its leader.
+	LinkUp bool
+}
+
+// Health checks the state of the server.
+// A server is ready when it accepts connections, pages items to disk without error,
+// and, as a follower, is in sync with its leader.
+func (srv *Server) Health() Health {
+	h := Health{Live: true, PersistenceOK: true, Role: "leader"}
+
+	locked := make(chan struct{})
+	go func() {
+		srv.Queue.queueLock.Lock()
+		srv.Queue.queueLock.Unlock()
+		close(locked)
+	}()
+	timer := time.NewTimer(livenessTimeout)
+	select {
+	case <-locked:
+		timer.Stop()
+	case <-timer.C:
+		h.Live = false
+		h.Reasons = append(h.Reasons, "queue locked for more than "+livenessTimeout.String())
+	}
+
+	srv.mu.Lock()
+	listening := len(srv.listeners) > 0
+	srv.mu.Unlock()
+	h.Accepting = listening && !srv.shuttingDown()
+	switch {
+	case !h.Accepting:
+		h.Reasons = append(h.Reasons, "not accepting connections")
+	case srv.MaxConns > 0 && len(srv.clients.list()) >= srv.MaxConns:
+		h.Accepting = false
+		h.Reasons = append(h.Reasons, "maximum number of connections reached")
+	}
+
+	if failed := atomic.LoadInt64(&srv.Queue.overflowFailedAt); failed != 0 && time.Since(time.Unix(0, failed)) < persistenceWindow {
+		h.PersistenceOK = false
+		h.Reasons = append(h.Reasons, "failed to page items to disk")
+	}
+	if srv.aof.failedSince(persistenceWindow) {
+		h.PersistenceOK = false
+		h.Reasons = append(h.Reasons, "failed to write the append only file")
+	}
+
+	srv.repl.mu.Lock()
+	if srv.repl.leader != "" {
+		h.Role, h.LinkUp = "follower", srv.repl.linkUp
+	}
+	acks := make([]uint64, 0, len(srv.repl.acks))
+	for _, ack := range srv.repl.acks {
+		acks = append(acks, ack)
+	}
+	srv.repl.mu.Unlock()
+	if h.Role == "follower" && !h.LinkUp {
+		h.Reasons = append(h.Reasons, "not in sync with the leader")
+	}
+	if len(acks) > 0 && h.Live {
+		offset := srv.Queue.offset()
+		for _, ack := range acks {
+			if ack < offset && offset-ack > h.ReplicationLag {
+				h.ReplicationLag = offset - ack
+			}
+		}
+	}
+
+	h.Ready = h.Live && h.Accepting && h.PersistenceOK && (h.Role == "leader" || h.LinkUp)
+	return h
+}
+
+// HealthCommand is the command "health".
+// "health" replies with the state of the server as an array of field, value pairs:
+// live, ready, accepting, persistence, role, replication_lag and link, the booleans as "yes" or "no",
+// see Health. "health live" and "health ready" reply OK, or an error with the reasons otherwise,
+// for the probes of an orchestrator such as Kubernetes.
+type HealthCommand struct {
+	ArgsCommand
+}
+
+func (c *HealthCommand) Name() string {
+	return "health"
+}
+
+func (c *HealthCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		return errNoServer
+	}
+	h := srv.Health()
+	args := c.Args()
+	if len(args) == 0 {
+		return writer.WriteArray([]string{
+			"live", yesNo(h.Live),
+			"ready", yesNo(h.Ready),
+			"accepting", yesNo(h.Accepting),
+			"persistence", yesNo(h.PersistenceOK),
+			"role", h.Role,
+			"replication_lag", strconv.FormatUint(h.ReplicationLag, 10),
+			"link", yesNo(h.LinkUp),
+		})
+	}
+	switch sub := strings.ToLower(args[0]); sub {
+	case "live":
+		if !h.Live {
+			return errors.New("UNHEALTHY " + strings.Join(h.Reasons, ", "))
+		}
+	case "ready":
+		if !h.Ready {
+			return errors.New("UNREADY " + strings.Join(h.Reasons, ", "))
+		}
+	default:
+		return &wrongCommandError{command: c.Name() + "|" + sub, args: args[1:]}
+	}
+	return writer.WriteStatus(OK)
+}
+
+func NewHealthCommand(args []string) (Command, error) {
+	if len(args) > 1 {
+		return nil, &WrongArityError{"health"}
+	}
+	cmd := &HealthCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["health"] = NewHealthCommand
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// serveHealth serves the health endpoints of the HTTP gateway, see Server.HealthEndpoints,
+// and reports whether the request was for one of them.
+func (srv *Server) serveHealth(w http.ResponseWriter, r *http.Request) bool {
+	if !srv.HealthEndpoints || (r.URL.Path != "/healthz" && r.URL.Path != "/readyz") {
+		return false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", http.MethodGet)
+		writeGatewayError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return true
+	}
+	h := srv.Health()
+	ok := h.Live
+	if r.URL.Path == "/readyz" {
+		ok = h.Ready
+	}
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+	writeGatewayJSON(w, status, map[string]any{
+		"live":            h.Live,
+		"ready":           h.Ready,
+		"reasons":         h.Reasons,
+		"accepting":       h.Accepting,
+		"persistence":     h.PersistenceOK,
+		"role":            h.Role,
+		"replication_lag": h.ReplicationLag,
+		"link":            h.LinkUp,
+	})
+	return true
+}
@@ -0,0 +1,152 @@
+package khronos
+
+// PriorityQueue is a binary heap of items of type T, in the order given by a comparator.
+// The routes of PriorityQueueWithRouting keep their items in one, ordered by their settings,
+// and it can be reused for richer items, for instance ordered by deadline and then by weight.
+// It is not safe for concurrent use.
+type PriorityQueue[T any] struct {
+	items []T
+	less  func(a, b T) bool
+	index func(item T, i int)
+}
+
+// NewPriorityQueue returns an empty priority queue in which Pop returns first the items
+// for which less reports that they come before the others.
+func NewPriorityQueue[T any](less func(a, b T) bool) *PriorityQueue[T] {
+	return &PriorityQueue[T]{less: less}
+}
+
+// OnIndex sets a function called with the new index of an item each time it moves in the heap,
+// and with -1 when it leaves it. It lets the items remember their index for Fix and Remove.
+func (q *PriorityQueue[T]) OnIndex(index func(item T, i int)) {
+	q.index = index
+}
+
+// Len returns the number of items in the queue.
+func (q *PriorityQueue[T]) Len() int { return len(q.items) }
+
+// Items returns the items of the queue in the order of the heap, only the first one is in order.
+// The slice must not be modified.
+func (q *PriorityQueue[T]) Items() []T { return q.items }
+
+// Push adds an item to the queue.
+func (q *PriorityQueue[T]) Push(item T) {
+	q.items = append(q.items, item)
+	q.moved(len(q.items) - 1)
+	q.up(len(q.items) - 1)
+}
+
+// PushBatch adds several items to the queue. A batch larger than the queue is appended
+// and the heap is rebuilt once, in linear time, rather than pushing the items one by one.
+func (q *PriorityQueue[T]) PushBatch(items ...T) {
+	if len(items) <= len(q.items) {
+		for _, item := range items {
+			q.Push(item)
+		}
+		return
+	}
+	q.items = append(q.items, items...)
+	q.Init()
+}
+
+// Peek returns the first item of the queue without removing it.
+// It returns false if the queue is empty.
+func (q *PriorityQueue[T]) Peek() (T, bool) {
+	if len(q.items) == 0 {
+		var zero T
+		return zero, false
+	}
+	return q.items[0], true
+}
+
+// Pop removes and returns the first item of the queue.
+// It returns false if the queue is empty.
+func (q *PriorityQueue[T]) Pop() (T, bool) {
+	if len(q.items) == 0 {
+		var zero T
+		return zero, false
+	}
+	return q.Remove(0), true
+}
+
+// Remove removes and returns the item at index i of the heap.
+func (q *PriorityQueue[T]) Remove(i int) T {
+	n := len(q.items) - 1
+	if n != i {
+		q.swap(i, n)
+		if !q.down(i, n) {
+			q.up(i)
+		}
+	}
+	item := q.items[n]
+	var zero T
+	q.items[n] = zero // for the garbage collector
+	q.items = q.items[:n]
+	if q.index != nil {
+		q.index(item, -1) // for safety
+	}
+	return item
+}
+
+// Fix restores the order of the heap after the item at index i changed.
+func (q *PriorityQueue[T]) Fix(i int) {
+	if !q.down(i, len(q.items)) {
+		q.up(i)
+	}
+}
+
+// Init restores the order of the heap after the items were replaced or the comparator changed.
+func (q *PriorityQueue[T]) Init() {
+	for i := range q.items {
+		q.moved(i)
+	}
+	n := len(q.items)
+	for i := n/2 - 1; i >= 0; i-- {
+		q.down(i, n)
+	}
+}
+
+func (q *PriorityQueue[T]) moved(i int) {
+	if q.index != nil {
+		q.index(q.items[i], i)
+	}
+}
+
+func (q *PriorityQueue[T]) swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+	q.moved(i)
+	q.moved(j)
+}
+
+func (q *PriorityQueue[T]) up(j int) {
+	for {
+		i := (j - 1) / 2 // parent
+		if i == j || !q.less(q.items[j], q.items[i]) {
+			break
+		}
+		q.swap(i, j)
+		j = i
+	}
+}
+
+// down moves the item at index i0 down the first n items of the heap,
+// and reports whether it moved.
+func (q *PriorityQueue[T]) down(i0, n int) bool {
+	i := i0
+	for {
+		j1 := 2*i + 1
+		if j1 >= n || j1 < 0 { // j1 < 0 after int overflow
+			break
+		}
+		j := j1 // left child
+		if j2 := j1 + 1; j2 < n && q.less(q.items[j2], q.items[j1]) {
+			j = j2 // right child
+		}
+		if !q.less(q.items[j], q.items[i]) {
+			break
+		}
+		q.swap(i, j)
+		i = j
+	}
+	return i > i0
+}
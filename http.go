@@ -0,0 +1,242 @@
+package khronos
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxHTTPValueSize bounds the body of the push requests of the HTTP gateway.
+	maxHTTPValueSize = 1 << 20
+	// maxHTTPPopTimeout bounds the long-poll timeout of the pop requests of the HTTP gateway.
+	maxHTTPPopTimeout = 5 * time.Minute
+)
+
+// HTTPHandler returns the HTTP gateway of the server, for the clients which can not speak RESP.
+// It shares Queue with the RESP listeners and exposes:
+//
+//	POST /queues/{route}?priority=<n>            push the request body, replies {"id": <id>}
+//	DELETE /queues/{route}/head?timeout=<d>      pop, waiting up to the duration d (e.g. "5s") for an item,
+//	                                             replies {"value": ..., "priority": ..., "id": ..., "headers": {...}} or 204 No Content on timeout
+//	GET /queues/{route}/length                   replies {"length": <n>}
+//	GET /queues/{route}/ws?prefetch=<n>          WebSocket consumer, see below
+//	GET /healthz, GET /readyz                    liveness and readiness with HealthEndpoints, see Health:
+//	                                             200 or 503 with {"live": ..., "ready": ..., "reasons": [...], ...}
+//
+// The WebSocket consumer receives the items of the route as text messages {"id": ..., "value": ..., "priority": ...}
+// as they become available, and acknowledges each of them with a message {"ack": <id>}.
+// At most prefetch items, 1 by default, are delivered without being acknowledged;
+// the items not acknowledged when the connection closes are enqueued again.
+//
+// If the server requires authentication, requests must carry an "Authorization: Bearer <password or route token>" header,
+// or a "token" query parameter since browsers can not set headers on WebSocket requests.
+// Errors are replied as {"error": <message>}.
+func (srv *Server) HTTPHandler() http.Handler {
+	return http.HandlerFunc(srv.serveGateway)
+}
+
+// ServeHTTPGateway serves the HTTP gateway on ln until the server shuts down.
+func (srv *Server) ServeHTTPGateway(ln net.Listener) error {
+	if !srv.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(ln, false)
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ServerContextKey, srv))
+	defer cancel()
+	go func() {
+		// the long polls end when the server shuts down.
+		select {
+		case <-srv.getDoneChan():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	httpSrv := &http.Server{
+		Handler:     srv.HTTPHandler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	err := httpSrv.Serve(ln)
+	if srv.shuttingDown() {
+		return ErrServerClosed
+	}
+	return err
+}
+
+func (srv *Server) serveGateway(w http.ResponseWriter, r *http.Request) {
+	if srv.serveHealth(w, r) {
+		return
+	}
+	route, action, ok := parseGatewayPath(r.URL.Path)
+	if !ok {
+		writeGatewayError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	method := map[string]string{"": http.MethodPost, "head": http.MethodDelete, "length": http.MethodGet, "ws": http.MethodGet}[action]
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeGatewayError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if err := srv.authorizeGateway(r, route); err != nil {
+		writeGatewayError(w, gatewayStatus(err), err)
+		return
+	}
+	if err := srv.refuseReplicaWrite(map[string]string{"": "push", "head": "pop"}[action]); err != nil {
+		writeGatewayError(w, gatewayStatus(err), err)
+		return
+	}
+	pq := srv.Queue
+	if err := pq.Throttle(route); err != nil {
+		writeGatewayError(w, gatewayStatus(err), err)
+		return
+	}
+
+	switch action {
+	case "":
+		priority, err := strconv.ParseInt(r.URL.Query().Get("priority"), 10, 64)
+		if err != nil && r.URL.Query().Has("priority") {
+			writeGatewayError(w, http.StatusBadRequest, errNotInteger)
+			return
+		}
+		value, err := io.ReadAll(io.LimitReader(r.Body, maxHTTPValueSize+1))
+		if err != nil {
+			writeGatewayError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(value) > maxHTTPValueSize {
+			writeGatewayError(w, http.StatusRequestEntityTooLarge, errors.New("value too large"))
+			return
+		}
+		if err = srv.refuseDraining("push"); err != nil {
+			writeGatewayError(w, gatewayStatus(err), err)
+			return
+		}
+		item := &Item{value: string(value), priority: priority}
+		if err = srv.reserveMemory(pq, route, item); err != nil {
+			writeGatewayError(w, gatewayStatus(err), err)
+			return
+		}
+		id := pq.EnqueueID(route, item)
+		writeGatewayJSON(w, http.StatusCreated, map[string]any{"id": id})
+	case "head":
+		timeout := time.Duration(0)
+		if s := r.URL.Query().Get("timeout"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 {
+				writeGatewayError(w, http.StatusBadRequest, errInvalidDuration)
+				return
+			}
+			timeout = min(d, maxHTTPPopTimeout)
+		}
+		item, ok := pq.TryDequeue(route)
+		if !ok && timeout > 0 {
+			ctx, cancel := withTimeout(r.Context(), srv.clock(), timeout)
+			item, _ = pq.DequeueContext(ctx, route)
+			cancel()
+		}
+		if item == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		reply := map[string]any{"value": item.value, "priority": item.priority, "id": item.ID()}
+		if len(item.headers) > 0 {
+			reply["headers"] = item.headers
+		}
+		writeGatewayJSON(w, http.StatusOK, reply)
+	case "length":
+		writeGatewayJSON(w, http.StatusOK, map[string]any{"length": pq.Length(route)})
+	case "ws":
+		prefetch := 1
+		if s := r.URL.Query().Get("prefetch"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 || n > maxWebSocketPrefetch {
+				writeGatewayError(w, http.StatusBadRequest, errNotInteger)
+				return
+			}
+			prefetch = n
+		}
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			writeGatewayError(w, http.StatusBadRequest, err)
+			return
+		}
+		srv.serveWebSocket(r.Context(), ws, route, prefetch)
+	}
+}
+
+// parseGatewayPath splits "/queues/{route}[/head|/length|/ws]".
+func parseGatewayPath(path string) (route, action string, ok bool) {
+	rest, ok := strings.CutPrefix(path, "/queues/")
+	if !ok {
+		return "", "", false
+	}
+	route, action, _ = strings.Cut(rest, "/")
+	if route == "" || (action != "" && action != "head" && action != "length" && action != "ws") {
+		return "", "", false
+	}
+	return route, action, true
+}
+
+// authorizeGateway checks the credentials of a gateway request on route.
+func (srv *Server) authorizeGateway(r *http.Request, route string) error {
+	if !srv.authRequired() {
+		return nil
+	}
+	credentials, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		credentials = r.URL.Query().Get("token")
+	}
+	if credentials == "" {
+		return ErrNoAuth
+	}
+	if srv.Password != "" && subtle.ConstantTimeCompare([]byte(credentials), []byte(srv.Password)) == 1 {
+		return nil
+	}
+	scope, _, err := verifyRouteToken(srv.TokenSecret, credentials, srv.clock().Now())
+	if err != nil {
+		return err
+	}
+	if scope != route {
+		return errTokenScope
+	}
+	return nil
+}
+
+// gatewayStatus returns the HTTP status of an error of the queue.
+func gatewayStatus(err error) int {
+	if moved := (*movedError)(nil); errors.As(err, &moved) {
+		return http.StatusMisdirectedRequest
+	}
+	switch err {
+	case ErrNoAuth, errInvalidToken:
+		return http.StatusUnauthorized
+	case errTokenScope:
+		return http.StatusForbidden
+	case ErrThrottled:
+		return http.StatusTooManyRequests
+	case ErrOutOfMemory:
+		return http.StatusInsufficientStorage
+	case ErrDraining, ErrReadOnlyReplica:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func writeGatewayJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeGatewayError(w http.ResponseWriter, status int, err error) {
+	writeGatewayJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,164 @@
+package khronos
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPGateway(t *testing.T) {
+	srv := &Server{Queue: NewPriorityQueueWithRouting(), TokenSecret: []byte("secret")}
+	ts := httptest.NewServer(srv.HTTPHandler())
+	defer ts.Close()
+	token := NewRouteToken(srv.TokenSecret, "jobs", time.Now().Add(time.Minute))
+
+	do := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		var b strings.Builder
+		_, _ = io.Copy(&b, resp.Body)
+		return resp.StatusCode, strings.TrimSpace(b.String())
+	}
+
+	if status, body := do(http.MethodPost, "/queues/jobs?priority=2", "a"); status != http.StatusCreated || body != `{"id":1}` {
+		t.Errorf("push: got %d %s", status, body)
+	}
+	do(http.MethodPost, "/queues/jobs?priority=5", "b")
+	if status, body := do(http.MethodGet, "/queues/jobs/length", ""); status != http.StatusOK || body != `{"length":2}` {
+		t.Errorf("length: got %d %s", status, body)
+	}
+	if status, body := do(http.MethodDelete, "/queues/jobs/head", ""); status != http.StatusOK || body != `{"id":2,"priority":5,"value":"b"}` {
+		t.Errorf("pop: got %d %s", status, body)
+	}
+	if status, _ := do(http.MethodPost, "/queues/other", "c"); status != http.StatusForbidden {
+		t.Errorf("push out of the token scope: got %d", status)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		srv.Queue.Enqueue("jobs", &Item{value: "late", priority: 1})
+	}()
+	do(http.MethodDelete, "/queues/jobs/head", "")
+	if status, body := do(http.MethodDelete, "/queues/jobs/head?timeout=5s", ""); status != http.StatusOK || !strings.Contains(body, `"value":"late"`) {
+		t.Errorf("long poll: got %d %s", status, body)
+	}
+	if status, _ := do(http.MethodDelete, "/queues/jobs/head?timeout=10ms", ""); status != http.StatusNoContent {
+		t.Errorf("long poll timeout: got %d", status)
+	}
+}
+
+func TestHTTPGatewayWebSocket(t *testing.T) {
+	srv := &Server{Queue: NewPriorityQueueWithRouting()}
+	ts := httptest.NewServer(srv.HTTPHandler())
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.WriteString(conn, "GET /queues/jobs/ws?prefetch=2 HTTP/1.1\r\nHost: khronos\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake: got %d %v", resp.StatusCode, resp.Header)
+	}
+	receive := func() string {
+		t.Helper()
+		_, opcode, payload, err := readWebSocketFrame(r, maxWebSocketMessage)
+		if err != nil || opcode != wsText {
+			t.Fatalf("receive: got opcode %d, %v", opcode, err)
+		}
+		return string(payload)
+	}
+	send := func(message string) {
+		t.Helper()
+		if err := writeWebSocketFrame(conn, wsText, []byte(message), []byte{1, 2, 3, 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, value := range []string{"a", "b", "c"} {
+		srv.Queue.Enqueue("jobs", &Item{value: value, priority: int64(3 - i)})
+	}
+	if got := receive(); got != `{"id":1,"priority":3,"value":"a"}` {
+		t.Errorf("first item: got %s", got)
+	}
+	if got := receive(); got != `{"id":2,"priority":2,"value":"b"}` {
+		t.Errorf("second item: got %s", got)
+	}
+	// the third item is delivered once an item is acknowledged.
+	if n := srv.Queue.Length("jobs"); n != 1 {
+		t.Errorf("length before the ack: got %d, want 1", n)
+	}
+	send(`{"ack":1}`)
+	if got := receive(); got != `{"id":3,"priority":1,"value":"c"}` {
+		t.Errorf("third item: got %s", got)
+	}
+
+	// closing the connection enqueues the unacknowledged items again.
+	send(`{"ack":3}`)
+	_ = writeWebSocketFrame(conn, wsClose, nil, []byte{1, 2, 3, 4})
+	eventually(t, func() bool { return srv.Queue.Length("jobs") == 1 })
+	if item, _ := srv.Queue.TryDequeue("jobs"); item == nil || item.Value() != "b" {
+		t.Errorf("requeued item: got %v", item)
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	srv := &Server{Queue: NewPriorityQueueWithRouting(), Password: "secret", HealthEndpoints: true}
+	ts := httptest.NewServer(srv.HTTPHandler())
+	defer ts.Close()
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	// the server is live, but does not listen for RESP connections.
+	if status, _ := get("/healthz"); status != http.StatusOK {
+		t.Errorf("healthz: got %d", status)
+	}
+	if status, body := get("/readyz"); status != http.StatusServiceUnavailable || !strings.Contains(body, "not accepting connections") {
+		t.Errorf("readyz: got %d %s", status, body)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(ln) }()
+	defer func() { _ = ln.Close() }()
+	for !srv.Health().Ready {
+		time.Sleep(time.Millisecond)
+	}
+	if status, body := get("/readyz"); status != http.StatusOK || !strings.Contains(body, `"role":"leader"`) {
+		t.Errorf("readyz: got %d %s", status, body)
+	}
+}
@@ -0,0 +1,143 @@
+package khronos
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// serverStats holds the counters of a server reported by the "info" command.
+type serverStats struct {
+	connsAccepted int64 // connections served.
+	connsRejected int64 // connections refused because MaxConns was reached.
+	connsDenied   int64 // connections refused by AllowCIDRs and DenyCIDRs.
+	oomRejected   int64 // pushes refused because of MaxMemory.
+}
+
+// infoSection is a section of the "info" reply.
+type infoSection struct {
+	name   string
+	fields func(srv *Server) []string // "key:value" lines.
+}
+
+var infoSections = []infoSection{
+	{"clients", func(srv *Server) []string {
+		return []string{
+			"connected_clients:" + strconv.Itoa(len(srv.clients.list())),
+		}
+	}},
+	{"blocked", func(srv *Server) []string {
+		blocked := srv.Queue.blockedRoutes()
+		fields := make([]string, 0, len(blocked))
+		for _, route := range sortedKeys(blocked) {
+			fields = append(fields, "route:"+route+":"+strconv.Itoa(blocked[route]))
+		}
+		return fields
+	}},
+	{"watermarks", func(srv *Server) []string {
+		above := srv.Queue.AboveHighWatermark()
+		fields := make([]string, 0, len(above))
+		for _, route := range sortedKeys(above) {
+			fields = append(fields, "route:"+route+":"+strconv.Itoa(above[route]))
+		}
+		return fields
+	}},
+	{"accounting", func(srv *Server) []string {
+		return srv.Queue.Accounting().fields()
+	}},
+	{"persistence", func(srv *Server) []string {
+		fields := srv.aof.fields()
+		if srv.Uploader != nil {
+			fields = append(fields, srv.uploads.fields()...)
+		}
+		return fields
+	}},
+	{"commandstats", func(srv *Server) []string {
+		return srv.cmdstats.fields()
+	}},
+	{"spaces", func(srv *Server) []string {
+		return srv.spaceFields()
+	}},
+	{"contention", func(srv *Server) []string {
+		return srv.Queue.LockContention().fields()
+	}},
+	{"stats", func(srv *Server) []string {
+		return []string{
+			"total_connections_received:" + strconv.FormatInt(atomic.LoadInt64(&srv.stats.connsAccepted), 10),
+			"rejected_connections:" + strconv.FormatInt(atomic.LoadInt64(&srv.stats.connsRejected), 10),
+			"denied_connections:" + strconv.FormatInt(atomic.LoadInt64(&srv.stats.connsDenied), 10),
+			"dropped_events:" + strconv.FormatUint(atomic.LoadUint64(&srv.Queue.eventsDropped), 10),
+			"overflow_errors:" + strconv.FormatUint(atomic.LoadUint64(&srv.Queue.overflowErrors), 10),
+		}
+	}},
+}
+
+// InfoCommand is the command "info".
+// "info [section]" replies with the statistics of the server as "key:value" lines,
+// grouped in sections starting with a "# Section" line.
+//
+// The sections are:
+//
+//	clients       connected clients
+//	blocked       consumers waiting for an item, a "route:<route>:<n>" line per route with some, see Blocked
+//	watermarks    the routes above their high watermark, a "route:<route>:<length>" line per route, see AboveHighWatermark
+//	accounting    items pushed, popped, pending, inflight, expired, dead lettered and dropped, see Accounting
+//	persistence   the append only file: enabled, rewrite in progress, rewrites, last write status, current and base size,
+//	              and the uploads of its snapshots, see Server.Uploader
+//	commandstats  a "cmdstat_<command>:calls=<n>,usec=<total>,usec_per_call=<average>,max_usec=<max>,errors=<n>" line
+//	              per command executed, the time of the blocking commands includes the wait, reset by "config resetstat"
+//	spaces        a "space:<space>:routes=<n>,items=<n>" line per queue space, see Server.MaxSpaces
+//	contention    the waits for the lock of the queue while Server.LockProfiling is set: acquisitions, contended ones,
+//	              total, average and longest wait in microseconds, reset by "config resetstat"
+//	stats         connections accepted, rejected by MaxConns and denied by AllowCIDRs/DenyCIDRs, events dropped, disk overflow errors
+type InfoCommand struct {
+	ArgsCommand
+}
+
+func (c *InfoCommand) Name() string {
+	return "info"
+}
+
+func (c *InfoCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		return errNoServer
+	}
+	var want string
+	if args := c.Args(); len(args) == 1 {
+		want = strings.ToLower(args[0])
+	}
+	var b strings.Builder
+	found := false
+	for _, section := range infoSections {
+		if want != "" && want != "all" && want != section.name {
+			continue
+		}
+		found = true
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + strings.ToUpper(section.name[:1]) + section.name[1:] + "\r\n")
+		for _, field := range section.fields(srv) {
+			b.WriteString(field + "\r\n")
+		}
+	}
+	if !found {
+		return &unknownOptionError{want}
+	}
+	return writer.WriteString(b.String())
+}
+
+func NewInfoCommand(args []string) (Command, error) {
+	if len(args) > 1 {
+		return nil, &WrongArityError{"info"}
+	}
+	cmd := &InfoCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["info"] = NewInfoCommand
+}
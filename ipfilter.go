@@ -0,0 +1,92 @@
+package khronos
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ipFilter is the set of networks allowed to connect to a server.
+type ipFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// allows reports whether a client connecting from addr may be served.
+// Denied networks take precedence over allowed ones, and an empty allow list allows every address.
+// Addresses which are not IP addresses, such as unix sockets, are always allowed.
+func (f *ipFilter) allows(addr net.Addr) bool {
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return true
+	}
+	ip, ok := addrIP(addr)
+	if !ok {
+		return true
+	}
+	for _, prefix := range f.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, prefix := range f.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.IPAddr:
+		ip = addr.IP
+	default:
+		return netip.Addr{}, false
+	}
+	parsed, ok := netip.AddrFromSlice(ip)
+	return parsed.Unmap(), ok
+}
+
+// getIPFilter returns the filter of the server, built from AllowCIDRs and DenyCIDRs
+// unless it was replaced with the "config set" command.
+func (srv *Server) getIPFilter() *ipFilter {
+	if f := srv.ipFilter.Load(); f != nil {
+		return f
+	}
+	srv.ipFilter.CompareAndSwap(nil, &ipFilter{allow: srv.AllowCIDRs, deny: srv.DenyCIDRs})
+	return srv.ipFilter.Load()
+}
+
+// parseCIDRs parses a space or comma separated list of networks, such as "10.0.0.0/8 192.168.1.10".
+// A single address stands for the network containing only this address.
+func parseCIDRs(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' }) {
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(field)
+			if addrErr != nil {
+				return nil, &invalidCIDRError{field}
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func formatCIDRs(prefixes []netip.Prefix) string {
+	fields := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		fields[i] = prefix.String()
+	}
+	return strings.Join(fields, " ")
+}
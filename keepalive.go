@@ -0,0 +1,56 @@
+package khronos
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// setKeepAlive configures the TCP keepalive of an accepted connection, see Server.KeepAlive.
+func (srv *Server) setKeepAlive(conn net.Conn) {
+	keepAlive := srv.getSettings().keepAlive
+	if keepAlive == 0 {
+		return
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if keepAlive < 0 {
+		_ = tcpConn.SetKeepAlive(false)
+		return
+	}
+	_ = tcpConn.SetKeepAlive(true)
+	_ = tcpConn.SetKeepAlivePeriod(keepAlive)
+}
+
+// watch kills the connection as soon as its peer goes away while it waits for an item,
+// so that the item is not delivered to a dead socket and lost.
+// The peer is gone when the connection is closed, or when it stops answering the TCP keepalive probes.
+// Watching stops once the client sends something, which is left for the next command.
+// The returned function stops watching, it must be called before reading the next command.
+func (c *connContext) watch() func() {
+	p := c.parser.parser
+	if p == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Peek waits for the next bytes without consuming them.
+		if _, err := p.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			c.kill()
+		}
+	}()
+	return func() {
+		// wake Peek up, the deadline error is not kept by the reader.
+		_ = c.conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		_ = c.conn.SetReadDeadline(time.Time{})
+	}
+}
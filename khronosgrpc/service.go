@@ -0,0 +1,87 @@
+// Package khronosgrpc serves the routes of a khronos queue over gRPC,
+// with the QueueService defined in queuepb/queue.proto.
+//
+// It lives in its own module so that the khronos module stays free of dependencies.
+// Serve it alongside the RESP listener of a khronos.Server sharing the same queue:
+//
+//	pq := khronos.NewPriorityQueueWithRouting()
+//	s := grpc.NewServer()
+//	khronosgrpc.Register(s, pq)
+//	go s.Serve(grpcListener)
+//	srv := &khronos.Server{Queue: pq}
+//	srv.Serve(respListener)
+//
+// The code of queuepb is generated with "buf generate" from this directory.
+package khronosgrpc
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"khronos"
+	"khronos/khronosgrpc/queuepb"
+)
+
+// Register registers the QueueService of pq on s.
+func Register(s grpc.ServiceRegistrar, pq *khronos.PriorityQueueWithRouting) {
+	queuepb.RegisterQueueServiceServer(s, NewService(pq))
+}
+
+// NewService returns the QueueService of pq.
+func NewService(pq *khronos.PriorityQueueWithRouting) queuepb.QueueServiceServer {
+	return &service{pq: pq}
+}
+
+type service struct {
+	queuepb.UnimplementedQueueServiceServer
+	pq *khronos.PriorityQueueWithRouting
+}
+
+func (s *service) Push(_ context.Context, req *queuepb.PushRequest) (*queuepb.PushResponse, error) {
+	if req.GetRoute() == "" {
+		return nil, status.Error(codes.InvalidArgument, "route is required")
+	}
+	if err := s.pq.Throttle(req.GetRoute()); err != nil {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	id := s.pq.EnqueueID(req.GetRoute(), khronos.NewItem(string(req.GetValue()), req.GetPriority()))
+	return &queuepb.PushResponse{Id: id}, nil
+}
+
+func (s *service) Pop(req *queuepb.PopRequest, stream queuepb.QueueService_PopServer) error {
+	if req.GetRoute() == "" {
+		return status.Error(codes.InvalidArgument, "route is required")
+	}
+	ctx := stream.Context()
+	for sent := uint32(0); req.GetCount() == 0 || sent < req.GetCount(); sent++ {
+		item, err := s.pq.DequeueContext(ctx, req.GetRoute())
+		if err != nil {
+			return status.FromContextError(err).Err()
+		}
+		if err = stream.Send(toProto(req.GetRoute(), item)); err != nil {
+			// the item did not reach the client, give it back to the other consumers.
+			s.pq.Enqueue(req.GetRoute(), item.Clone())
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *service) Length(_ context.Context, req *queuepb.LengthRequest) (*queuepb.LengthResponse, error) {
+	return &queuepb.LengthResponse{Length: uint64(s.pq.Length(req.GetRoute()))}, nil
+}
+
+func (s *service) Peek(_ context.Context, req *queuepb.PeekRequest) (*queuepb.PeekResponse, error) {
+	items := s.pq.Range(req.GetRoute(), 0, 0)
+	if len(items) == 0 {
+		return &queuepb.PeekResponse{}, nil
+	}
+	return &queuepb.PeekResponse{Item: toProto(req.GetRoute(), items[0])}, nil
+}
+
+func toProto(route string, item *khronos.Item) *queuepb.Item {
+	return &queuepb.Item{Id: item.ID(), Route: route, Value: []byte(item.Value()), Priority: item.Priority()}
+}
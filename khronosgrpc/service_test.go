@@ -0,0 +1,64 @@
+package khronosgrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"khronos"
+	"khronos/khronosgrpc/queuepb"
+)
+
+func TestQueueService(t *testing.T) {
+	pq := khronos.NewPriorityQueueWithRouting()
+	ln := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	Register(s, pq)
+	go func() { _ = s.Serve(ln) }()
+	defer s.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	client := queuepb.NewQueueServiceClient(conn)
+	ctx := context.Background()
+
+	for i, value := range []string{"low", "high"} {
+		if _, err = client.Push(ctx, &queuepb.PushRequest{Route: "jobs", Value: []byte(value), Priority: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	length, err := client.Length(ctx, &queuepb.LengthRequest{Route: "jobs"})
+	if err != nil || length.GetLength() != 2 {
+		t.Fatalf("Length: got %v, %v", length, err)
+	}
+	peek, err := client.Peek(ctx, &queuepb.PeekRequest{Route: "jobs"})
+	if err != nil || string(peek.GetItem().GetValue()) != "high" {
+		t.Fatalf("Peek: got %v, %v", peek, err)
+	}
+
+	stream, err := client.Pop(ctx, &queuepb.PopRequest{Route: "jobs", Count: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go pq.Enqueue("jobs", khronos.NewItem("late", 0))
+	var got []string
+	for {
+		item, err := stream.Recv()
+		if err != nil {
+			break
+		}
+		got = append(got, string(item.GetValue()))
+	}
+	if len(got) != 3 || got[0] != "high" || got[1] != "low" || got[2] != "late" {
+		t.Errorf("Pop: got %v", got)
+	}
+}
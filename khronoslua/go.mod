@@ -0,0 +1,10 @@
+module khronos/khronoslua
+
+go 1.22
+
+require (
+	github.com/yuin/gopher-lua v1.1.1
+	khronos v0.0.0
+)
+
+replace khronos => ../
@@ -0,0 +1,315 @@
+// Package khronoslua adds Lua scripting to a khronos server, with the commands
+// "eval", "evalsha" and "script".
+//
+// A script runs atomically: no other operation on the queue is interleaved with its operations,
+// which makes patterns such as moving an item from a route to another, or requeueing it
+// conditionally, safe under concurrency. The scripts see the global tables KEYS and ARGV,
+// and a table khronos with the functions:
+//
+//	khronos.push(route, value [, priority])  pushes a value, returns its id
+//	khronos.pop(route)                       pops the next item without blocking, returns its value and priority, or nil
+//	khronos.peek(route)                      returns the value and priority of the next item, or nil
+//	khronos.length(route)                    returns the number of items of the route
+//
+// Lua numbers are floats: priorities beyond 2^53 lose precision.
+// The value returned by a script is replied as an integer for a number, a bulk string for a string,
+// 1 for true, nil for nil and false, and an array of strings for a sequence.
+//
+// It lives in its own module so that the khronos module stays free of dependencies.
+// Call Register before the server starts serving:
+//
+//	khronoslua.Register()
+//	srv := &khronos.Server{Queue: khronos.NewPriorityQueueWithRouting()}
+package khronoslua
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"khronos"
+)
+
+// ScriptTimeout bounds the run time of a script, during which the queue is locked.
+var ScriptTimeout = 5 * time.Second
+
+var errNoScript = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+
+var errNumKeys = errors.New("ERR Number of keys can't be greater than number of args")
+
+// scriptError is an error raised by a script.
+type scriptError struct {
+	err error
+}
+
+func (e *scriptError) Error() string {
+	return "ERR Error running script: " + strings.ReplaceAll(e.err.Error(), "\n", " ")
+}
+
+// Register registers the commands "eval", "evalsha" and "script".
+// It must be called before the server starts serving.
+func Register() {
+	khronos.RegisterCommand("eval", NewEvalCommand)
+	khronos.RegisterCommand("evalsha", NewEvalSHACommand)
+	khronos.RegisterCommand("script", NewScriptCommand)
+	// the routes of eval follow the number of keys, they are not at fixed positions.
+	khronos.RegisterCommandInfo("eval", khronos.CommandInfo{Arity: -3, Flags: khronos.FlagWrite})
+	khronos.RegisterCommandInfo("evalsha", khronos.CommandInfo{Arity: -3, Flags: khronos.FlagWrite})
+	khronos.RegisterCommandInfo("script", khronos.CommandInfo{Arity: -2, Flags: khronos.FlagAdmin})
+}
+
+// scripts caches the compiled scripts by the hex SHA1 of their source.
+var scripts = struct {
+	sync.Mutex
+	byHash map[string]*lua.FunctionProto
+}{byHash: make(map[string]*lua.FunctionProto)}
+
+// load compiles the script and caches it, returning its hash.
+func load(source string) (string, *lua.FunctionProto, error) {
+	sum := sha1.Sum([]byte(source))
+	hash := hex.EncodeToString(sum[:])
+	scripts.Lock()
+	proto, ok := scripts.byHash[hash]
+	scripts.Unlock()
+	if ok {
+		return hash, proto, nil
+	}
+	chunk, err := parse.Parse(strings.NewReader(source), "script")
+	if err != nil {
+		return "", nil, &scriptError{err}
+	}
+	proto, err = lua.Compile(chunk, "script")
+	if err != nil {
+		return "", nil, &scriptError{err}
+	}
+	scripts.Lock()
+	scripts.byHash[hash] = proto
+	scripts.Unlock()
+	return hash, proto, nil
+}
+
+func lookup(hash string) (*lua.FunctionProto, bool) {
+	scripts.Lock()
+	defer scripts.Unlock()
+
+	proto, ok := scripts.byHash[strings.ToLower(hash)]
+	return proto, ok
+}
+
+// EvalCommand is the command "eval".
+// "eval <script> <numkeys> [key ...] [arg ...]" runs the script with the keys, which are routes, and the arguments.
+type EvalCommand struct {
+	args []string
+	name string
+}
+
+func (c *EvalCommand) Name() string {
+	return c.name
+}
+
+func (c *EvalCommand) Args() []string {
+	return c.args
+}
+
+func (c *EvalCommand) Execute(ctx context.Context, writer khronos.ResponseWriter) error {
+	var proto *lua.FunctionProto
+	if c.name == "evalsha" {
+		var ok bool
+		if proto, ok = lookup(c.args[0]); !ok {
+			return errNoScript
+		}
+	} else {
+		var err error
+		if _, proto, err = load(c.args[0]); err != nil {
+			return err
+		}
+	}
+	numKeys, err := strconv.Atoi(c.args[1])
+	if err != nil || numKeys < 0 {
+		return errors.New("ERR value is not an integer or out of range")
+	}
+	if numKeys > len(c.args)-2 {
+		return errNumKeys
+	}
+	keys, argv := c.args[2:2+numKeys], c.args[2+numKeys:]
+
+	pq := khronos.PqFromContext(ctx)
+	for _, key := range keys {
+		if err = pq.Throttle(key); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, ScriptTimeout)
+	defer cancel()
+	var result lua.LValue
+	err = pq.Atomically(func(tx *khronos.Tx) error {
+		result, err = run(ctx, tx, proto, keys, argv)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return writeResult(writer, result)
+}
+
+func NewEvalCommand(args []string) (khronos.Command, error) {
+	if len(args) < 2 {
+		return nil, &khronos.WrongArityError{Command: "eval"}
+	}
+	return &EvalCommand{args: args, name: "eval"}, nil
+}
+
+// NewEvalSHACommand returns the command "evalsha", which is like "eval"
+// with the SHA1 of a script loaded with "script load" or run by "eval" instead of its source.
+func NewEvalSHACommand(args []string) (khronos.Command, error) {
+	if len(args) < 2 {
+		return nil, &khronos.WrongArityError{Command: "evalsha"}
+	}
+	return &EvalCommand{args: args, name: "evalsha"}, nil
+}
+
+// run runs the script within a transaction.
+func run(ctx context.Context, tx *khronos.Tx, proto *lua.FunctionProto, keys, argv []string) (lua.LValue, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// the scripts have no access to the file system nor to the output of the server.
+	for _, name := range []string{"dofile", "loadfile", "print"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetGlobal("KEYS", stringTable(L, keys))
+	L.SetGlobal("ARGV", stringTable(L, argv))
+	L.SetGlobal("khronos", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"push": func(L *lua.LState) int {
+			item := khronos.NewItem(L.CheckString(2), int64(L.OptNumber(3, 0)))
+			tx.Push(L.CheckString(1), item)
+			L.Push(lua.LNumber(item.ID()))
+			return 1
+		},
+		"pop": func(L *lua.LState) int {
+			item, ok := tx.Pop(L.CheckString(1))
+			return pushItem(L, item, ok)
+		},
+		"peek": func(L *lua.LState) int {
+			item, ok := tx.Peek(L.CheckString(1))
+			return pushItem(L, item, ok)
+		},
+		"length": func(L *lua.LState) int {
+			L.Push(lua.LNumber(tx.Length(L.CheckString(1))))
+			return 1
+		},
+	}))
+	L.SetContext(ctx)
+
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 1, nil); err != nil {
+		return nil, &scriptError{err}
+	}
+	return L.Get(-1), nil
+}
+
+func stringTable(L *lua.LState, values []string) *lua.LTable {
+	table := L.CreateTable(len(values), 0)
+	for _, value := range values {
+		table.Append(lua.LString(value))
+	}
+	return table
+}
+
+// pushItem pushes the value and the priority of the item, or nil.
+func pushItem(L *lua.LState, item *khronos.Item, ok bool) int {
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LString(item.Value()))
+	L.Push(lua.LNumber(item.Priority()))
+	return 2
+}
+
+// writeResult replies with the value returned by a script.
+func writeResult(writer khronos.ResponseWriter, v lua.LValue) error {
+	switch v := v.(type) {
+	case lua.LNumber:
+		return writer.WriteInt64(int64(v))
+	case lua.LString:
+		return writer.WriteString(string(v))
+	case lua.LBool:
+		if v {
+			return writer.WriteInt64(1)
+		}
+	case *lua.LTable:
+		var values []string
+		for i := 1; i <= v.MaxN(); i++ {
+			values = append(values, formatValue(v.RawGetInt(i)))
+		}
+		return writer.WriteArray(values)
+	}
+	return writer.WriteNil()
+}
+
+func formatValue(v lua.LValue) string {
+	if n, ok := v.(lua.LNumber); ok {
+		return strconv.FormatInt(int64(n), 10)
+	}
+	return v.String()
+}
+
+// ScriptCommand is the command "script".
+// "script load <script>" compiles and caches the script, and replies with its SHA1 for "evalsha",
+// and "script flush" empties the cache.
+type ScriptCommand struct {
+	args []string
+}
+
+func (c *ScriptCommand) Name() string {
+	return "script"
+}
+
+func (c *ScriptCommand) Args() []string {
+	return c.args
+}
+
+func (c *ScriptCommand) Execute(_ context.Context, writer khronos.ResponseWriter) error {
+	switch sub := strings.ToLower(c.args[0]); {
+	case sub == "load" && len(c.args) == 2:
+		hash, _, err := load(c.args[1])
+		if err != nil {
+			return err
+		}
+		return writer.WriteString(hash)
+	case sub == "flush" && len(c.args) == 1:
+		scripts.Lock()
+		scripts.byHash = make(map[string]*lua.FunctionProto)
+		scripts.Unlock()
+		return writer.WriteStatus(khronos.OK)
+	}
+	return &khronos.WrongArityError{Command: "script|" + c.args[0]}
+}
+
+func NewScriptCommand(args []string) (khronos.Command, error) {
+	if len(args) == 0 {
+		return nil, &khronos.WrongArityError{Command: "script"}
+	}
+	return &ScriptCommand{args: args}, nil
+}
@@ -0,0 +1,90 @@
+package khronoslua
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"khronos"
+)
+
+// recorder is a khronos.ResponseWriter keeping the last reply in a readable form.
+type recorder struct {
+	reply string
+}
+
+func (r *recorder) WriteError(err error) error         { r.reply = "-" + err.Error(); return nil }
+func (r *recorder) WriteStatus(s khronos.Status) error { r.reply = s.String(); return nil }
+func (r *recorder) WriteInt64(i int64) error           { r.reply = fmt.Sprint(":", i); return nil }
+func (r *recorder) WriteArray(a []string) error        { r.reply = strings.Join(a, " "); return nil }
+func (r *recorder) WriteString(s string) error         { r.reply = s; return nil }
+func (r *recorder) WriteNil() error                    { r.reply = "(nil)"; return nil }
+func (r *recorder) Write(b []byte) (int, error)        { r.reply = string(b); return len(b), nil }
+
+func execute(t *testing.T, pq *khronos.PriorityQueueWithRouting, name string, args ...string) string {
+	t.Helper()
+	constructors := map[string]khronos.CommandConstructor{"eval": NewEvalCommand, "evalsha": NewEvalSHACommand, "script": NewScriptCommand}
+	cmd, err := constructors[name](args)
+	if err != nil {
+		return "-" + err.Error()
+	}
+	w := &recorder{}
+	if err = cmd.Execute(khronos.PqWithContext(context.Background(), pq), w); err != nil {
+		return "-" + err.Error()
+	}
+	return w.reply
+}
+
+func TestEval(t *testing.T) {
+	pq := khronos.NewPriorityQueueWithRouting()
+	pq.Enqueue("ready", khronos.NewItem("a", 1))
+	pq.Enqueue("ready", khronos.NewItem("b", 5))
+
+	move := `
+		local value, priority = khronos.pop(KEYS[1])
+		if value == nil then return nil end
+		khronos.push(KEYS[2], value, priority + tonumber(ARGV[1]))
+		return {value, priority}`
+	if got := execute(t, pq, "eval", move, "2", "ready", "running", "10"); got != "b 5" {
+		t.Errorf("eval: got %q", got)
+	}
+	if item, _ := pq.TryDequeue("running"); item == nil || item.Value() != "b" || item.Priority() != 15 {
+		t.Errorf("moved item: got %v", item)
+	}
+
+	hash := execute(t, pq, "script", "load", move)
+	if got := execute(t, pq, "evalsha", hash, "2", "ready", "running", "0"); got != "a 1" {
+		t.Errorf("evalsha: got %q", got)
+	}
+	if got := execute(t, pq, "evalsha", hash, "2", "ready", "running", "0"); got != "(nil)" {
+		t.Errorf("evalsha on an empty route: got %q", got)
+	}
+	if got := execute(t, pq, "eval", "return khronos.length(KEYS[1])", "1", "running"); got != ":1" {
+		t.Errorf("length: got %q", got)
+	}
+	if got := execute(t, pq, "eval", "return khronos.peek(KEYS[1])", "1", "running"); got != "a" {
+		t.Errorf("peek: got %q", got)
+	}
+
+	if got := execute(t, pq, "eval", "return dofile('/etc/passwd')", "0"); !strings.HasPrefix(got, "-ERR Error running script") {
+		t.Errorf("dofile: got %q", got)
+	}
+	if got := execute(t, pq, "eval", "return 1", "3", "a"); !strings.HasPrefix(got, "-ERR Number of keys") {
+		t.Errorf("too many keys: got %q", got)
+	}
+	if got := execute(t, pq, "evalsha", "0000", "0"); !strings.HasPrefix(got, "-NOSCRIPT") {
+		t.Errorf("unknown script: got %q", got)
+	}
+
+	defer func(timeout time.Duration) { ScriptTimeout = timeout }(ScriptTimeout)
+	ScriptTimeout = 50 * time.Millisecond
+	if got := execute(t, pq, "eval", "while true do end", "0"); !strings.HasPrefix(got, "-ERR Error running script") {
+		t.Errorf("endless script: got %q", got)
+	}
+	// the queue is unlocked once the script is stopped.
+	if n := pq.Length("running"); n != 1 {
+		t.Errorf("length after the timeout: got %d", n)
+	}
+}
@@ -0,0 +1,111 @@
+// Package khronostest provides utilities for testing code built on khronos.
+package khronostest
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is a fake clock implementing khronos.Clock.
+// Its time only moves when Advance or Set is called, which runs the timers that become due.
+// It is safe for concurrent use.
+type Clock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	timers  []*timer
+	nextSeq int
+}
+
+type timer struct {
+	when time.Time
+	seq  int
+	f    func()
+}
+
+// NewClock returns a fake clock set to now.
+func NewClock(now time.Time) *Clock {
+	c := &Clock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc calls f in its own goroutine once the clock has advanced by d.
+func (c *Clock) AfterFunc(d time.Duration, f func()) func() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextSeq++
+	t := &timer{when: c.now.Add(d), seq: c.nextSeq, f: f}
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, pending := range c.timers {
+			if pending == t {
+				c.timers = append(c.timers[:i], c.timers[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Advance moves the clock forward by d and runs the timers that become due.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	now := c.now.Add(d)
+	c.mu.Unlock()
+	c.Set(now)
+}
+
+// Set sets the time of the clock and runs the timers that become due, in the order they are due.
+func (c *Clock) Set(now time.Time) {
+	c.mu.Lock()
+	c.now = now
+	var due, pending []*timer
+	for _, t := range c.timers {
+		if !t.when.After(now) {
+			due = append(due, t)
+		} else {
+			pending = append(pending, t)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].when.Equal(due[j].when) {
+			return due[i].seq < due[j].seq
+		}
+		return due[i].when.Before(due[j].when)
+	})
+	for _, t := range due {
+		go t.f()
+	}
+}
+
+// Timers returns the number of timers waiting for the clock to advance.
+func (c *Clock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil blocks until at least n timers are waiting for the clock to advance.
+// It lets a test wait for the code under test to start waiting before moving the time.
+func (c *Clock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
@@ -0,0 +1,30 @@
+package khronostest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewClock(start)
+
+	fired := make(chan int, 2)
+	clock.AfterFunc(2*time.Second, func() { fired <- 2 })
+	stop := clock.AfterFunc(time.Second, func() { fired <- 1 })
+	clock.AfterFunc(3*time.Second, func() { fired <- 3 })
+	if !stop() {
+		t.Fatal("stop should report the timer was pending")
+	}
+
+	clock.Advance(2 * time.Second)
+	if got := <-fired; got != 2 {
+		t.Errorf("expected timer 2 to fire, got %d", got)
+	}
+	if now := clock.Now(); !now.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("unexpected time %v", now)
+	}
+	if n := clock.Timers(); n != 1 {
+		t.Errorf("expected 1 pending timer, got %d", n)
+	}
+}
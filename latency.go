@@ -0,0 +1,225 @@
+package khronos
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyHistoryLen is the number of samples kept per latency event.
+const latencyHistoryLen = 160
+
+// The latency events recorded by the latency monitor, see Server.LatencyMonitorThreshold.
+const (
+	latencyCommand  = "command"   // execution of a command, blocking commands excluded.
+	latencyAOFFsync = "aof-fsync" // sync of the append only file to disk.
+	latencyLockWait = "lock-wait" // wait to acquire the lock of the queue.
+)
+
+// queueMutex is the lock of a queue, which reports the time spent waiting for it to an optional observer,
+// and counts it while profiled, see ProfileLock.
+type queueMutex struct {
+	sync.Mutex
+	observer  atomic.Pointer[func(time.Duration)]
+	profiling atomic.Bool
+	stats     lockStats
+}
+
+// Lock locks m, measuring the wait if it is held and an observer is set or m is profiled.
+func (m *queueMutex) Lock() {
+	profiling := m.profiling.Load()
+	if m.Mutex.TryLock() {
+		if profiling {
+			m.stats.add(0)
+		}
+		return
+	}
+	observe := m.observer.Load()
+	if observe == nil && !profiling {
+		m.Mutex.Lock()
+		return
+	}
+	start := time.Now()
+	m.Mutex.Lock()
+	wait := time.Since(start)
+	if profiling {
+		m.stats.add(wait)
+	}
+	if observe != nil {
+		(*observe)(wait)
+	}
+}
+
+// observe calls fn with the time spent waiting for m, each time it is held when locked.
+func (m *queueMutex) observe(fn func(time.Duration)) {
+	m.observer.Store(&fn)
+}
+
+// latencySample is the highest latency of an event within a second.
+type latencySample struct {
+	time    time.Time
+	latency time.Duration
+}
+
+// latencyEvent holds the latest samples of an event in a ring.
+type latencyEvent struct {
+	samples [latencyHistoryLen]latencySample
+	next    int           // index of the next sample.
+	n       int           // number of samples.
+	max     time.Duration // highest latency since the event was reset.
+}
+
+// latest returns the newest sample.
+func (e *latencyEvent) latest() latencySample {
+	return e.samples[(e.next+latencyHistoryLen-1)%latencyHistoryLen]
+}
+
+// latencyMonitor records the latency spikes of a server by event, see Server.LatencyMonitorThreshold.
+type latencyMonitor struct {
+	mu     sync.Mutex
+	events map[string]*latencyEvent
+}
+
+// add records a latency of the event at now, merged with the sample of the same second.
+func (m *latencyMonitor) add(event string, now time.Time, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.events == nil {
+		m.events = make(map[string]*latencyEvent)
+	}
+	e, ok := m.events[event]
+	if !ok {
+		e = &latencyEvent{}
+		m.events[event] = e
+	}
+	e.max = max(e.max, latency)
+	now = now.Truncate(time.Second)
+	if e.n > 0 && e.latest().time.Equal(now) {
+		last := &e.samples[(e.next+latencyHistoryLen-1)%latencyHistoryLen]
+		last.latency = max(last.latency, latency)
+		return
+	}
+	e.samples[e.next] = latencySample{time: now, latency: latency}
+	e.next = (e.next + 1) % latencyHistoryLen
+	e.n = min(e.n+1, latencyHistoryLen)
+}
+
+// history returns the samples of the event, the oldest first.
+func (m *latencyMonitor) history(event string) []latencySample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.events[event]
+	if !ok {
+		return nil
+	}
+	samples := make([]latencySample, 0, e.n)
+	for i := e.n; i > 0; i-- {
+		samples = append(samples, e.samples[(e.next+latencyHistoryLen-i)%latencyHistoryLen])
+	}
+	return samples
+}
+
+// reset removes the samples of the events, of every event if none is given,
+// and returns the number of events removed.
+func (m *latencyMonitor) reset(events ...string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(events) == 0 {
+		n := len(m.events)
+		clear(m.events)
+		return n
+	}
+	n := 0
+	for _, event := range events {
+		if _, ok := m.events[event]; ok {
+			delete(m.events, event)
+			n++
+		}
+	}
+	return n
+}
+
+// startLatencyMonitor starts measuring the waits for the lock of the queue, once.
+// They are only recorded when Server.LatencyMonitorThreshold is set, which can be changed at runtime.
+func (srv *Server) startLatencyMonitor() {
+	srv.latencyOnce.Do(func() {
+		srv.Queue.queueLock.observe(func(d time.Duration) { srv.observeLatency(latencyLockWait, d) })
+		if srv.LockProfiling {
+			srv.Queue.ProfileLock(true)
+		}
+	})
+}
+
+// observeLatency records the latency of the event if it reaches Server.LatencyMonitorThreshold.
+func (srv *Server) observeLatency(event string, latency time.Duration) {
+	threshold := srv.getSettings().latencyThreshold
+	if threshold <= 0 || latency < threshold {
+		return
+	}
+	srv.latency.add(event, srv.clock().Now(), latency)
+}
+
+// LatencyCommand is the command "latency".
+// It inspects the latency spikes recorded when Server.LatencyMonitorThreshold is set,
+// to diagnose intermittent stalls. The events are "command" for the execution of the commands,
+// blocking commands excluded, "aof-fsync" for the syncs of the append only file to disk, and
+// "lock-wait" for the waits to acquire the lock of the queue. The samples of an event within
+// the same second are merged, keeping the highest, and the latest 160 are kept.
+//
+//	latency latest               an array [event, unix time, latest ms, max ms] per event
+//	latency history <event>      an array [unix time, ms] per sample of the event, the oldest first
+//	latency reset [event ...]    removes the samples of the events, or of all, and replies with the number of events reset
+type LatencyCommand struct {
+	ArgsCommand
+}
+
+func (c *LatencyCommand) Name() string {
+	return "latency"
+}
+
+func (c *LatencyCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		return errNoServer
+	}
+	args := c.Args()
+	m := &srv.latency
+	switch sub := strings.ToLower(args[0]); {
+	case sub == "latest" && len(args) == 1:
+		m.mu.Lock()
+		reply := make([]any, 0, len(m.events))
+		for _, event := range sortedKeys(m.events) {
+			e := m.events[event]
+			latest := e.latest()
+			reply = append(reply, []any{event, latest.time.Unix(), latest.latency.Milliseconds(), e.max.Milliseconds()})
+		}
+		m.mu.Unlock()
+		return WriteValue(writer, reply)
+	case sub == "history" && len(args) == 2:
+		samples := m.history(args[1])
+		reply := make([]any, len(samples))
+		for i, sample := range samples {
+			reply[i] = []int64{sample.time.Unix(), sample.latency.Milliseconds()}
+		}
+		return WriteValue(writer, reply)
+	case sub == "reset":
+		return writer.WriteInt64(int64(m.reset(args[1:]...)))
+	default:
+		return &wrongCommandError{command: c.Name() + "|" + sub, args: args[1:]}
+	}
+}
+
+func NewLatencyCommand(args []string) (Command, error) {
+	if len(args) == 0 {
+		return nil, &WrongArityError{"latency"}
+	}
+	cmd := &LatencyCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["latency"] = NewLatencyCommand
+}
@@ -0,0 +1,196 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// listPriority is the priority of the items pushed by the list commands.
+// The items of equal priority are dequeued in the order they were enqueued, which the identifiers
+// keep across a restart and on the replicas, so the route hands them back in insertion order.
+const listPriority = 0
+
+// checkList returns ErrWrongType if the list pops do not apply to the route:
+// a route with consumer groups, or with DeliveryAtLeastOnce whose items are confirmed
+// by an identifier the replies do not carry.
+func checkList(pq *PriorityQueueWithRouting, key string) error {
+	if pq.hasGroups(key) || pq.RouteConfig(key).Delivery == DeliveryAtLeastOnce {
+		return ErrWrongType
+	}
+	return nil
+}
+
+// RegisterListCommands registers a wire-compatible subset of the Redis list commands:
+// lpush, rpush, lpop, rpop, llen, blpop and brpop.
+//
+// The commands operate on ordinary khronos routes in FIFO mode: both push commands append
+// to the tail of the route, and all the pop commands remove the oldest item,
+// which is how Redis lists are used as job queues.
+// The pops reply WRONGTYPE on the routes with consumer groups or with DeliveryAtLeastOnce.
+// It lets applications built on Redis lists point at khronos while they migrate to the native commands.
+// RegisterListCommands must be called before the server starts serving.
+func RegisterListCommands() {
+	for _, name := range []string{"lpush", "rpush"} {
+		RegisterCommand(name, newListPushCommand(name))
+		RegisterCommandInfo(name, CommandInfo{Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1})
+	}
+	for _, name := range []string{"lpop", "rpop"} {
+		RegisterCommand(name, newListPopCommand(name))
+		RegisterCommandInfo(name, CommandInfo{Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1})
+	}
+	for _, name := range []string{"blpop", "brpop"} {
+		RegisterCommand(name, newListBlockingPopCommand(name))
+		RegisterCommandInfo(name, CommandInfo{Arity: 3, Flags: FlagWrite | FlagBlocking, FirstKey: 1, LastKey: 1, Step: 1})
+	}
+	RegisterCommand("llen", NewLengthCommand)
+	RegisterCommandInfo("llen", CommandInfo{Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1})
+}
+
+// ListPushCommand is the command "lpush" or "rpush".
+// It pushes one or more values to the route and replies with the length of the route.
+type ListPushCommand struct {
+	ArgsCommand
+	name string
+}
+
+func (c *ListPushCommand) Name() string {
+	return c.name
+}
+
+func (c *ListPushCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	if len(args) < 2 {
+		return &WrongArityError{c.name}
+	}
+	key := args[0]
+	pq := PqFromContext(ctx)
+	if err := pq.Throttle(key); err != nil {
+		return err
+	}
+	items := make([]*Item, len(args)-1)
+	for i, value := range args[1:] {
+		items[i] = &Item{value: value, priority: listPriority}
+	}
+	if err := ServerFromContext(ctx).reserveMemory(pq, key, items...); err != nil {
+		return err
+	}
+	pq.EnqueueBatch(key, items)
+	return writer.WriteInt64(int64(pq.Length(key)))
+}
+
+func newListPushCommand(name string) CommandConstructor {
+	return func(args []string) (Command, error) {
+		if len(args) < 2 {
+			return nil, &WrongArityError{name}
+		}
+		cmd := &ListPushCommand{name: name}
+		cmd.args = args
+		return cmd, nil
+	}
+}
+
+// ListPopCommand is the command "lpop" or "rpop".
+// It removes the oldest item of the route without blocking and replies with its value,
+// or with nil if the route is empty.
+type ListPopCommand struct {
+	ArgsCommand
+	name string
+}
+
+func (c *ListPopCommand) Name() string {
+	return c.name
+}
+
+func (c *ListPopCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	if len(args) != 1 {
+		return &WrongArityError{c.name}
+	}
+	pq := PqFromContext(ctx)
+	if err := pq.Throttle(args[0]); err != nil {
+		return err
+	}
+	if err := checkList(pq, args[0]); err != nil {
+		return err
+	}
+	item, ok := pq.TryDequeue(args[0])
+	if !ok {
+		return writer.WriteNil()
+	}
+	defer pq.release(args[0], item)
+	return writer.WriteString(item.value)
+}
+
+func newListPopCommand(name string) CommandConstructor {
+	return func(args []string) (Command, error) {
+		if len(args) != 1 {
+			return nil, &WrongArityError{name}
+		}
+		cmd := &ListPopCommand{name: name}
+		cmd.args = args
+		return cmd, nil
+	}
+}
+
+// ListBlockingPopCommand is the command "blpop" or "brpop".
+// It has the form "blpop key timeout", where timeout is in seconds and zero blocks forever.
+// The server replies with a two elements array of the key and the value,
+// or with a null array if the timeout expired.
+type ListBlockingPopCommand struct {
+	ArgsCommand
+	name    string
+	timeout time.Duration
+}
+
+func (c *ListBlockingPopCommand) Name() string {
+	return c.name
+}
+
+func (c *ListBlockingPopCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	if len(args) != 2 {
+		return &WrongArityError{c.name}
+	}
+	key := args[0]
+	pq := PqFromContext(ctx)
+	if err := pq.Throttle(key); err != nil {
+		return err
+	}
+	if err := checkList(pq, key); err != nil {
+		return err
+	}
+	waitCtx := ctx
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = withTimeout(ctx, clockFromContext(ctx), c.timeout)
+		defer cancel()
+	}
+	unblock := markBlocked(ctx, key)
+	item, err := pq.DequeueContext(waitCtx, key)
+	unblock()
+	if err != nil {
+		if errors.Is(context.Cause(waitCtx), context.DeadlineExceeded) && ctx.Err() == nil {
+			return writeNilArray(writer)
+		}
+		return err
+	}
+	defer pq.release(key, item)
+	return writer.WriteArray([]string{key, item.value})
+}
+
+func newListBlockingPopCommand(name string) CommandConstructor {
+	return func(args []string) (Command, error) {
+		if len(args) != 2 {
+			return nil, &WrongArityError{name}
+		}
+		seconds, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || seconds < 0 {
+			return nil, errTimeoutNotValid
+		}
+		cmd := &ListBlockingPopCommand{name: name, timeout: time.Duration(seconds * float64(time.Second))}
+		cmd.args = args
+		return cmd, nil
+	}
+}
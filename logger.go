@@ -0,0 +1,106 @@
+package khronos
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// Logger is a leveled, structured logger.
+// The args are alternating keys and values, as in "conn closed", "id", 1, "reason", err.
+//
+// *slog.Logger implements Logger, and NewStdLogger adapts a *log.Logger.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+var _ Logger = (*slog.Logger)(nil)
+
+// stdLogger adapts a *log.Logger to Logger.
+type stdLogger struct {
+	logger *log.Logger
+	level  slog.Level
+}
+
+// NewStdLogger returns a Logger writing the messages of at least the given level to logger,
+// one line per message in the form "LEVEL msg key=value key=value".
+func NewStdLogger(logger *log.Logger, level slog.Level) Logger {
+	return &stdLogger{logger: logger, level: level}
+}
+
+func (l *stdLogger) log(level slog.Level, msg string, args []any) {
+	if level < l.level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 < len(args) {
+			_, _ = fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+		} else {
+			_, _ = fmt.Fprintf(&b, " !BADKEY=%v", args[i])
+		}
+	}
+	l.logger.Print(b.String())
+}
+
+func (l *stdLogger) Debug(msg string, args ...any) { l.log(slog.LevelDebug, msg, args) }
+func (l *stdLogger) Info(msg string, args ...any)  { l.log(slog.LevelInfo, msg, args) }
+func (l *stdLogger) Warn(msg string, args ...any)  { l.log(slog.LevelWarn, msg, args) }
+func (l *stdLogger) Error(msg string, args ...any) { l.log(slog.LevelError, msg, args) }
+
+// nopLogger discards every message.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// levelLogger passes the messages of at least a level to a Logger.
+type levelLogger struct {
+	logger Logger
+	level  slog.Level
+}
+
+func (l levelLogger) Debug(msg string, args ...any) {
+	if l.level <= slog.LevelDebug {
+		l.logger.Debug(msg, args...)
+	}
+}
+
+func (l levelLogger) Info(msg string, args ...any) {
+	if l.level <= slog.LevelInfo {
+		l.logger.Info(msg, args...)
+	}
+}
+
+func (l levelLogger) Warn(msg string, args ...any) {
+	if l.level <= slog.LevelWarn {
+		l.logger.Warn(msg, args...)
+	}
+}
+
+func (l levelLogger) Error(msg string, args ...any) {
+	if l.level <= slog.LevelError {
+		l.logger.Error(msg, args...)
+	}
+}
+
+// logger returns the logger of the server, discarding the messages if Server.Logger is nil,
+// and those below the level set by "config set loglevel".
+func (srv *Server) logger() Logger {
+	if srv.Logger == nil {
+		return nopLogger{}
+	}
+	if level := srv.getSettings().logLevel; level > slog.LevelDebug {
+		return levelLogger{logger: srv.Logger, level: level}
+	}
+	return srv.Logger
+}
@@ -0,0 +1,208 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// itemOverhead is the approximate number of bytes used by an item besides its value:
+// the Item struct, its slot in the heap and its entry in the index of identifiers.
+const itemOverhead = 128
+
+// ErrOutOfMemory is returned when an item does not fit in Server.MaxMemory.
+var ErrOutOfMemory = errors.New("OOM command not allowed when used memory > 'maxmemory'")
+
+// MemoryPolicy is what a server does when an item does not fit in Server.MaxMemory.
+type MemoryPolicy int
+
+const (
+	// MemoryReject refuses the new item with ErrOutOfMemory, it is the default.
+	MemoryReject MemoryPolicy = iota
+	// MemoryEvict discards the coldest items of the route, those dequeued last, to make room for the new item.
+	// The new item is refused if the route has not enough items to discard.
+	MemoryEvict
+)
+
+func (p MemoryPolicy) String() string {
+	if p == MemoryEvict {
+		return "evict"
+	}
+	return "reject"
+}
+
+// itemMemory returns the approximate number of bytes used by an item in memory.
+func itemMemory(value string) int64 {
+	return int64(len(value)) + itemOverhead
+}
+
+// MemoryStats describes the memory used by the items of a queue.
+type MemoryStats struct {
+	Used    int64  // approximate bytes used by the items in memory.
+	Peak    int64  // highest value of Used.
+	Items   int    // items in memory, the items paged to disk are not counted.
+	Routes  int    // routes.
+	Evicted uint64 // items discarded to make room, see MemoryEvict.
+}
+
+// MemoryUsage returns the approximate number of bytes used by the items of the route in memory.
+func (pq *PriorityQueueWithRouting) MemoryUsage(route string) int64 {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	if r, ok := pq.routes[route]; ok {
+		return r.memory
+	}
+	return 0
+}
+
+// MemoryStats returns the memory used by the items of the queue.
+func (pq *PriorityQueueWithRouting) MemoryStats() MemoryStats {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	routes := 0
+	for name := range pq.routes {
+		if !isGroupRoute(name) {
+			routes++
+		}
+	}
+	return MemoryStats{Used: pq.memory.used, Peak: pq.memory.peak, Items: len(pq.items), Routes: routes, Evicted: pq.memory.evicted}
+}
+
+// queueMemory counts the memory used by the items of a queue.
+type queueMemory struct {
+	used    int64
+	peak    int64
+	evicted uint64
+}
+
+func (m *queueMemory) add(n int64) {
+	m.used += n
+	if m.used > m.peak {
+		m.peak = m.used
+	}
+}
+
+// recount computes the memory used by the items of the route in memory,
+// after they were replaced.
+// It must be called with queueLock held.
+func (r *route) recount() {
+	var memory int64
+	for _, item := range r.queue.Items() {
+		memory += item.memory()
+	}
+	r.total.add(memory - r.memory)
+	r.memory = memory
+}
+
+// reserve makes room for an item of size bytes on the route, within max bytes for the whole queue.
+// With MemoryEvict, it discards the coldest items of the route until the item fits.
+func (pq *PriorityQueueWithRouting) reserve(route string, size, max int64, policy MemoryPolicy) error {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	if pq.memory.used+size <= max {
+		return nil
+	}
+	r, ok := pq.routes[route]
+	if policy != MemoryEvict || !ok || r.memory < pq.memory.used+size-max {
+		return ErrOutOfMemory
+	}
+	for pq.memory.used+size > max && r.queue.Len() > 0 {
+		coldest := r.queue.items[0]
+		// the coldest item is a leaf of the heap.
+		for _, item := range r.queue.items[r.queue.Len()/2:] {
+			if r.config.before(coldest, item) {
+				coldest = item
+			}
+		}
+		pq.removeItem(r, coldest)
+		pq.accounting.Dropped++
+		pq.drop(r, coldest, DropEvicted)
+		pq.memory.evicted++
+	}
+	if pq.memory.used+size > max {
+		return ErrOutOfMemory
+	}
+	return nil
+}
+
+// reserveMemory makes room for the items pushed to route by a command, according to the quotas
+// of the namespace of the route and to MaxMemory.
+func (srv *Server) reserveMemory(pq *PriorityQueueWithRouting, route string, items ...*Item) error {
+	var size int64
+	for _, item := range items {
+		size += item.memory()
+	}
+	if err := pq.admit(route, len(items), size); err != nil {
+		return err
+	}
+	if srv == nil {
+		return nil
+	}
+	settings := srv.getSettings()
+	if settings.maxMemory <= 0 {
+		return nil
+	}
+	if err := pq.reserve(route, size, settings.maxMemory, settings.maxMemoryPolicy); err != nil {
+		atomic.AddInt64(&srv.stats.oomRejected, 1)
+		return err
+	}
+	return nil
+}
+
+// MemoryCommand is the command "memory".
+//
+//	memory usage <route>    the approximate number of bytes used by the items of the route in memory
+//	memory stats            an array of field, value pairs: used, peak, items, routes, evicted, rejected, maxmemory and policy
+type MemoryCommand struct {
+	ArgsCommand
+}
+
+func (c *MemoryCommand) Name() string {
+	return "memory"
+}
+
+func (c *MemoryCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	pq := PqFromContext(ctx)
+	switch sub := strings.ToLower(args[0]); {
+	case sub == "usage" && len(args) == 2:
+		return writer.WriteInt64(pq.MemoryUsage(args[1]))
+	case sub == "stats" && len(args) == 1:
+		stats := pq.MemoryStats()
+		reply := []string{
+			"used", strconv.FormatInt(stats.Used, 10),
+			"peak", strconv.FormatInt(stats.Peak, 10),
+			"items", strconv.Itoa(stats.Items),
+			"routes", strconv.Itoa(stats.Routes),
+			"evicted", strconv.FormatUint(stats.Evicted, 10),
+		}
+		if srv := ServerFromContext(ctx); srv != nil {
+			reply = append(reply,
+				"rejected", strconv.FormatInt(atomic.LoadInt64(&srv.stats.oomRejected), 10),
+				"maxmemory", strconv.FormatInt(srv.getSettings().maxMemory, 10),
+				"policy", srv.getSettings().maxMemoryPolicy.String(),
+			)
+		}
+		return writer.WriteArray(reply)
+	default:
+		return &wrongCommandError{command: c.Name() + "|" + sub, args: args[1:]}
+	}
+}
+
+func NewMemoryCommand(args []string) (Command, error) {
+	if len(args) == 0 {
+		return nil, &WrongArityError{"memory"}
+	}
+	cmd := &MemoryCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["memory"] = NewMemoryCommand
+}
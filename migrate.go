@@ -0,0 +1,167 @@
+package khronos
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultMigrateTimeout is how long "migrate" waits for the target server by default.
+const defaultMigrateTimeout = 5 * time.Second
+
+// Migrate moves the items of the route to the same route of the khronos server at addr,
+// and returns the number of items moved. It lets routes be rebalanced between servers.
+//
+// The items are removed from the route before they are sent, so that they are not delivered
+// by both servers while they move, and pushed back with new identifiers if the target refuses them
+// or does not reply. The restore is not idempotent: if the target restored the items but its reply
+// was lost, such as when ctx expires first, they are on both servers and Migrate fails.
+// The target fails with ErrRouteExists if its route has items, unless replace, in which case
+// they are dropped first. The reserved items waiting for their confirmation are not moved.
+// If keep is set, the items are sent but kept in the route.
+// If password is not empty, the connection to the target is authenticated with it.
+func (pq *PriorityQueueWithRouting) Migrate(ctx context.Context, addr, route, password string, keep, replace bool) (int, error) {
+	var items []*Item
+	if keep {
+		items = pq.sortedItems(route, nil)
+	} else {
+		items = pq.takeItems(route)
+	}
+	if len(items) == 0 {
+		return 0, nil
+	}
+	args := []string{"restore", route, string(dumpItems(items))}
+	if replace {
+		args = append(args, "replace")
+	}
+	err := sendCommands(ctx, addr, password, args)
+	if err != nil && !keep {
+		pq.queueLock.Lock()
+		r := pq.route(route).resolve()
+		for _, item := range items {
+			pq.push(r, item)
+		}
+		pq.queueLock.Unlock()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(items), nil
+}
+
+// takeItems removes the items of the route and returns them in the order they would be dequeued.
+func (pq *PriorityQueueWithRouting) takeItems(route string) []*Item {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r, ok := pq.routes[route]
+	if !ok {
+		return nil
+	}
+	r = r.resolve()
+	pq.unspill(r)
+	items := make([]*Item, 0, r.queue.Len())
+	for r.queue.Len() > 0 {
+		item := r.queue.items[0]
+		pq.removeItem(r, item)
+		items = append(items, item)
+	}
+	sortItems(r.config, items)
+	return items
+}
+
+// sendCommands sends a command to the server at addr, after "auth <password>" if password
+// is not empty, and returns the error replied to either.
+func sendCommands(ctx context.Context, addr, password string, args []string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	writer, reader := &responseWriter{conn}, bufio.NewReader(conn)
+	commands := [][]string{args}
+	if password != "" {
+		commands = [][]string{{"auth", password}, args}
+	}
+	for _, command := range commands {
+		if err = writer.WriteArray(command); err != nil {
+			return err
+		}
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if reply = strings.TrimRight(reply, "\r\n"); strings.HasPrefix(reply, "-") {
+			return errors.New(reply[1:])
+		}
+	}
+	return nil
+}
+
+// MigrateCommand is the command "migrate".
+// "migrate <host> <port> <route> [copy] [replace] [auth <password>] [timeout <ms>]" moves the items
+// of the route to the khronos server at host:port, and replies with the number of items moved, see Migrate.
+// The target is given 5 seconds to accept the items by default.
+type MigrateCommand struct {
+	ArgsCommand
+}
+
+func (c *MigrateCommand) Name() string {
+	return "migrate"
+}
+
+func (c *MigrateCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	addr, route := net.JoinHostPort(args[0], args[1]), args[2]
+	var keep, replace bool
+	var password string
+	timeout := defaultMigrateTimeout
+	for i := 3; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "copy"):
+			keep = true
+		case strings.EqualFold(args[i], "replace"):
+			replace = true
+		case strings.EqualFold(args[i], "auth") && i+1 < len(args):
+			password = args[i+1]
+			i++
+		case strings.EqualFold(args[i], "timeout") && i+1 < len(args):
+			ms, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || ms <= 0 {
+				return errNotInteger
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	n, err := PqFromContext(ctx).Migrate(ctx, addr, route, password, keep, replace)
+	if err != nil {
+		return err
+	}
+	return writer.WriteInt64(int64(n))
+}
+
+func NewMigrateCommand(args []string) (Command, error) {
+	if len(args) < 3 {
+		return nil, &WrongArityError{"migrate"}
+	}
+	cmd := &MigrateCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["migrate"] = NewMigrateCommand
+}
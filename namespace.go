@@ -0,0 +1,279 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrQuotaExceeded is returned when an item does not fit in the quotas of the namespace of its route,
+// see NamespaceConfig.
+var ErrQuotaExceeded = errors.New("QUOTA namespace quota exceeded")
+
+// NamespaceConfig holds the quotas of a namespace.
+// The namespace of a route is the part of its name before the first colon, "acme" for "acme:jobs".
+// The quotas isolate the tenants of a server sharing routes by namespace, so that one of them
+// cannot exhaust the server.
+type NamespaceConfig struct {
+	// MaxItems is the number of items the routes of the namespace may hold, zero means unlimited.
+	MaxItems int
+
+	// MaxMemory is the approximate number of bytes the items of the namespace may use in memory,
+	// zero means unlimited.
+	MaxMemory int64
+
+	// MaxOps is the number of operations per second on the routes of the namespace, zero means unlimited.
+	// Operations over the quota fail with ErrThrottled, see Throttle.
+	MaxOps int
+}
+
+// NamespaceStats describes the usage of a namespace.
+type NamespaceStats struct {
+	Routes    int    // routes of the namespace.
+	Items     int    // items in the routes of the namespace.
+	Memory    int64  // approximate bytes used by the items of the namespace in memory.
+	Throttled uint64 // operations refused by NamespaceConfig.MaxOps.
+	Rejected  uint64 // items refused by NamespaceConfig.MaxItems and MaxMemory.
+}
+
+// namespace holds the quotas of a namespace and the routes they apply to.
+type namespace struct {
+	config    NamespaceConfig
+	routes    map[string]*route // routes of the namespace by name, to check the quotas without scanning every route.
+	bucket    *tokenBucket      // operations quota, see NamespaceConfig.MaxOps.
+	throttled uint64
+	rejected  uint64
+}
+
+// namespaceOf returns the namespace of the route, empty if the route has none.
+func namespaceOf(route string) string {
+	ns, _, ok := strings.Cut(route, ":")
+	if !ok {
+		return ""
+	}
+	return ns
+}
+
+// NamespaceConfig returns the quotas of the namespace.
+func (pq *PriorityQueueWithRouting) NamespaceConfig(name string) NamespaceConfig {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	if ns, ok := pq.namespaces[name]; ok {
+		return ns.config
+	}
+	return NamespaceConfig{}
+}
+
+// SetNamespaceConfig replaces the quotas of the namespace.
+// The commands pushing items check MaxItems and MaxMemory, and fail with ErrQuotaExceeded
+// when an item does not fit, the items already queued are kept.
+func (pq *PriorityQueueWithRouting) SetNamespaceConfig(name string, config NamespaceConfig) {
+	pq.updateNamespaceConfig(name, func(c *NamespaceConfig) { *c = config })
+}
+
+// updateNamespaceConfig atomically updates the quotas of the namespace with update.
+func (pq *PriorityQueueWithRouting) updateNamespaceConfig(name string, update func(config *NamespaceConfig)) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	ns, ok := pq.namespaces[name]
+	if !ok {
+		ns = &namespace{routes: make(map[string]*route)}
+		for routeName, r := range pq.routes {
+			if namespaceOf(routeName) == name {
+				ns.routes[routeName] = r
+			}
+		}
+		if pq.namespaces == nil {
+			pq.namespaces = make(map[string]*namespace)
+		}
+		pq.namespaces[name] = ns
+	}
+	update(&ns.config)
+}
+
+// indexRoute adds the route to the index of its namespace, or removes it if r is nil.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) indexRoute(name string, r *route) {
+	ns, ok := pq.namespaces[namespaceOf(name)]
+	if !ok {
+		return
+	}
+	if r == nil {
+		delete(ns.routes, name)
+	} else {
+		ns.routes[name] = r
+	}
+}
+
+// NamespaceStats returns the usage of the namespace.
+func (pq *PriorityQueueWithRouting) NamespaceStats(name string) NamespaceStats {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	var stats NamespaceStats
+	for routeName, r := range pq.routes {
+		if namespaceOf(routeName) != name {
+			continue
+		}
+		if !isGroupRoute(routeName) {
+			stats.Routes++
+		}
+		stats.Items += r.size()
+		stats.Memory += r.memory
+	}
+	if ns, ok := pq.namespaces[name]; ok {
+		stats.Throttled, stats.Rejected = ns.throttled, ns.rejected
+	}
+	return stats
+}
+
+// Namespaces returns the namespaces of the routes and the namespaces with quotas, in increasing order.
+func (pq *PriorityQueueWithRouting) Namespaces() []string {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	names := make(map[string]struct{}, len(pq.namespaces))
+	for name := range pq.namespaces {
+		names[name] = struct{}{}
+	}
+	for routeName := range pq.routes {
+		if name := namespaceOf(routeName); name != "" {
+			names[name] = struct{}{}
+		}
+	}
+	return sortedKeys(names)
+}
+
+// throttleNamespace counts an operation on the route against the quota of its namespace in need.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) throttleNamespace(route string, need quotas, now time.Time) error {
+	ns, ok := pq.namespaces[namespaceOf(route)]
+	if !ok || ns.config.MaxOps <= 0 {
+		return nil
+	}
+	maxOps := float64(ns.config.MaxOps)
+	if ns.bucket == nil || ns.bucket.rate != maxOps {
+		ns.bucket = newTokenBucket(maxOps, maxOps, now)
+	}
+	if !need.add(ns.bucket, now) {
+		ns.throttled++
+		return ErrThrottled
+	}
+	return nil
+}
+
+// admit checks that n items of size bytes in total fit in the quotas of the namespace of the route.
+func (pq *PriorityQueueWithRouting) admit(route string, n int, size int64) error {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	ns, ok := pq.namespaces[namespaceOf(route)]
+	if !ok || (ns.config.MaxItems <= 0 && ns.config.MaxMemory <= 0) {
+		return nil
+	}
+	items, memory := n, size
+	for _, r := range ns.routes {
+		items += r.size()
+		memory += r.memory
+	}
+	if (ns.config.MaxItems > 0 && items > ns.config.MaxItems) || (ns.config.MaxMemory > 0 && memory > ns.config.MaxMemory) {
+		ns.rejected++
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// namespaceOption is a quota of a namespace which can be changed by the "namespace" command.
+type namespaceOption struct {
+	get func(config *NamespaceConfig) string
+	set func(config *NamespaceConfig, n int64)
+}
+
+var namespaceOptions = map[string]namespaceOption{
+	"maxitems": {
+		get: func(config *NamespaceConfig) string { return strconv.Itoa(config.MaxItems) },
+		set: func(config *NamespaceConfig, n int64) { config.MaxItems = int(n) },
+	},
+	"maxmemory": {
+		get: func(config *NamespaceConfig) string { return strconv.FormatInt(config.MaxMemory, 10) },
+		set: func(config *NamespaceConfig, n int64) { config.MaxMemory = n },
+	},
+	"maxops": {
+		get: func(config *NamespaceConfig) string { return strconv.Itoa(config.MaxOps) },
+		set: func(config *NamespaceConfig, n int64) { config.MaxOps = int(n) },
+	},
+}
+
+// NamespaceCommand is the command "namespace".
+// "namespace config <namespace>" replies with the quotas of the namespace as an array of option, value pairs,
+// "namespace config <namespace> <option> <n>" changes a quota, zero meaning unlimited, see NamespaceConfig:
+//
+//	maxitems <n>     items in the routes of the namespace
+//	maxmemory <n>    approximate bytes used by the items of the namespace in memory
+//	maxops <n>       operations per second on the routes of the namespace
+//
+// "namespace stats <namespace>" replies with the usage of the namespace as an array of field, value pairs:
+// routes, items, memory, throttled and rejected.
+// "namespace list" replies with the namespaces of the routes and the namespaces with quotas.
+type NamespaceCommand struct {
+	ArgsCommand
+}
+
+func (c *NamespaceCommand) Name() string {
+	return "namespace"
+}
+
+func (c *NamespaceCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	pq := PqFromContext(ctx)
+	switch sub := strings.ToLower(args[0]); {
+	case sub == "list" && len(args) == 1:
+		return writer.WriteArray(pq.Namespaces())
+	case sub == "stats" && len(args) == 2:
+		stats := pq.NamespaceStats(args[1])
+		return writer.WriteArray([]string{
+			"routes", strconv.Itoa(stats.Routes),
+			"items", strconv.Itoa(stats.Items),
+			"memory", strconv.FormatInt(stats.Memory, 10),
+			"throttled", strconv.FormatUint(stats.Throttled, 10),
+			"rejected", strconv.FormatUint(stats.Rejected, 10),
+		})
+	case sub == "config" && len(args) == 2:
+		config := pq.NamespaceConfig(args[1])
+		var reply []string
+		for _, name := range sortedKeys(namespaceOptions) {
+			reply = append(reply, name, namespaceOptions[name].get(&config))
+		}
+		return writer.WriteArray(reply)
+	case sub == "config" && len(args) == 4:
+		option, ok := namespaceOptions[strings.ToLower(args[2])]
+		if !ok {
+			return &unknownOptionError{args[2]}
+		}
+		n, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil || n < 0 {
+			return errNotInteger
+		}
+		pq.updateNamespaceConfig(args[1], func(config *NamespaceConfig) { option.set(config, n) })
+		return writer.WriteStatus(OK)
+	default:
+		return &wrongCommandError{command: c.Name() + "|" + sub, args: args[1:]}
+	}
+}
+
+func NewNamespaceCommand(args []string) (Command, error) {
+	if len(args) == 0 {
+		return nil, &WrongArityError{"namespace"}
+	}
+	cmd := &NamespaceCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["namespace"] = NewNamespaceCommand
+}
@@ -0,0 +1,352 @@
+package khronos
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// maxSegments is the number of overflow segments of a route above which they are merged into one.
+const maxSegments = 8
+
+// SetOverflowDir sets the directory where the routes with a RouteConfig.MaxInMemory
+// page their coldest items. Paging is disabled while the directory is empty.
+func (pq *PriorityQueueWithRouting) SetOverflowDir(dir string) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	pq.overflowDir = dir
+}
+
+// segment is a file holding items of a route sorted in dequeue order.
+// Only its first item, the head, is kept in memory.
+type segment struct {
+	file   *os.File
+	reader *bufio.Reader
+	offset int64 // offset of the record following the head.
+	head   *Item
+	count  int // number of items in the segment, including the head.
+}
+
+// writeItem appends the record of item to w.
+func writeItem(w *bufio.Writer, item *Item) error {
+	var buf [4 * binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], item.priority)
+	n += binary.PutUvarint(buf[n:], item.id)
+	n += binary.PutVarint(buf[n:], item.enqueued.UnixNano())
+	n += binary.PutUvarint(buf[n:], uint64(len(item.headers)))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	for key, value := range item.headers {
+		if err := writeString(w, key); err != nil {
+			return err
+		}
+		if err := writeString(w, value); err != nil {
+			return err
+		}
+	}
+	return writeString(w, item.value)
+}
+
+// writeString writes s prefixed with its length.
+func writeString(w *bufio.Writer, s string) error {
+	var buf [binary.MaxVarintLen64]byte
+	if _, err := w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(s)))]); err != nil {
+		return err
+	}
+	_, err := w.WriteString(s)
+	return err
+}
+
+// countingReader counts the bytes read from a bufio.Reader.
+type countingReader struct {
+	*bufio.Reader
+	n int64
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	b, err := r.Reader.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return b, err
+}
+
+// readItem reads a record written by writeItem, and returns the number of bytes read.
+func readItem(r *bufio.Reader) (*Item, int64, error) {
+	cr := &countingReader{Reader: r}
+	priority, err := binary.ReadVarint(cr)
+	if err != nil {
+		return nil, cr.n, err
+	}
+	id, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return nil, cr.n, err
+	}
+	enqueued, err := binary.ReadVarint(cr)
+	if err != nil {
+		return nil, cr.n, err
+	}
+	headers, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return nil, cr.n, err
+	}
+	item := &Item{priority: priority, id: id, enqueued: time.Unix(0, enqueued)}
+	for i := uint64(0); i < headers; i++ {
+		key, err := readString(cr)
+		if err != nil {
+			return nil, cr.n, err
+		}
+		value, err := readString(cr)
+		if err != nil {
+			return nil, cr.n, err
+		}
+		item.SetHeader(key, value)
+	}
+	if item.value, err = readString(cr); err != nil {
+		return nil, cr.n, err
+	}
+	return item, cr.n, nil
+}
+
+// readString reads a string written by writeString.
+func readString(r *countingReader) (string, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, size)
+	n, err := io.ReadFull(r.Reader, b)
+	r.n += int64(n)
+	return string(b), err
+}
+
+// newSegment writes items, sorted in dequeue order, to a new segment file in dir.
+func newSegment(dir string, items []*Item) (*segment, error) {
+	file, err := os.CreateTemp(dir, "khronos-overflow-*")
+	if err != nil {
+		return nil, err
+	}
+	// the file is only used through its descriptor, it disappears with the process.
+	_ = os.Remove(file.Name())
+	w := bufio.NewWriter(file)
+	for _, item := range items {
+		if err = writeItem(w, item); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	s := &segment{file: file, reader: bufio.NewReader(file), count: len(items)}
+	if err = s.readHead(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// readHead reads the head of the segment.
+func (s *segment) readHead() error {
+	item, n, err := readItem(s.reader)
+	s.offset += n
+	s.head = item
+	return err
+}
+
+// next consumes the head and reads the following item, if any.
+func (s *segment) next() error {
+	s.count--
+	s.head = nil
+	if s.count == 0 {
+		return nil
+	}
+	return s.readHead()
+}
+
+// rest returns the items of the segment after the head, without consuming them.
+func (s *segment) rest() ([]*Item, error) {
+	r := bufio.NewReader(io.NewSectionReader(s.file, s.offset, 1<<62))
+	items := make([]*Item, 0, s.count-1)
+	for i := 1; i < s.count; i++ {
+		item, _, err := readItem(r)
+		if err != nil {
+			return items, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (s *segment) close() {
+	_ = s.file.Close()
+}
+
+// overflowFailed counts a failure to page items to or from disk.
+func (pq *PriorityQueueWithRouting) overflowFailed() {
+	atomic.AddUint64(&pq.overflowErrors, 1)
+	atomic.StoreInt64(&pq.overflowFailedAt, time.Now().UnixNano())
+}
+
+// spill pages the coldest items of the route to a new segment if it holds too many items in memory.
+// If the segment can not be written, the items stay in memory.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) spill(r *route) {
+	keep := r.config.MaxInMemory
+	if keep <= 0 || pq.overflowDir == "" || r.queue.Len() < 2*keep {
+		return
+	}
+	items := append([]*Item(nil), r.queue.items...)
+	sort.Slice(items, func(i, j int) bool { return r.config.before(items[i], items[j]) })
+	cold := items[keep:]
+	if len(r.segments)+1 > maxSegments {
+		// merge the segments with the new items rather than opening one more file.
+		merged, err := r.drainSegments()
+		if err != nil {
+			pq.accounting.Dropped += uint64(r.spilled - len(merged))
+		}
+		r.spilled = 0
+		cold = append(cold, merged...)
+		sort.Slice(cold, func(i, j int) bool { return r.config.before(cold[i], cold[j]) })
+	}
+	s, err := newSegment(pq.overflowDir, cold)
+	if err != nil {
+		pq.overflowFailed()
+		for _, item := range cold {
+			if item.route == nil {
+				// an item read back from a merged segment.
+				item.route = r
+				pq.items[item.id] = item
+				r.add(item)
+			}
+		}
+		return
+	}
+	r.queue.items = append(r.queue.items[:0], items[:keep]...)
+	r.reindex()
+	for _, item := range cold {
+		pq.forget(item)
+	}
+	r.segments = append(r.segments, s)
+	r.spilled += len(cold)
+}
+
+// drainSegments reads and closes the segments of the route and returns their items.
+// It must be called with queueLock held.
+func (r *route) drainSegments() ([]*Item, error) {
+	var items []*Item
+	var errs []error
+	for _, s := range r.segments {
+		if s.head != nil {
+			items = append(items, s.head)
+		}
+		rest, err := s.rest()
+		items = append(items, rest...)
+		errs = append(errs, err)
+		s.close()
+	}
+	r.segments = nil
+	return items, errors.Join(errs...)
+}
+
+// unspill moves the paged items of the route back to memory,
+// for instance because the order of the route changed.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) unspill(r *route) {
+	if len(r.segments) == 0 {
+		return
+	}
+	items, err := r.drainSegments()
+	if err != nil {
+		pq.accounting.Dropped += uint64(r.spilled - len(items))
+	}
+	r.spilled = 0
+	for _, item := range items {
+		item.route = r
+		pq.items[item.id] = item
+		r.queue.items = append(r.queue.items, item)
+	}
+	r.reindex()
+}
+
+// reindex restores the heap invariants after the items of the route were replaced.
+func (r *route) reindex() {
+	r.queue.Init()
+	r.recount()
+}
+
+// dropSegments discards the paged items of the route.
+// It must be called with queueLock held.
+func (r *route) dropSegments() {
+	for _, s := range r.segments {
+		s.close()
+	}
+	r.segments, r.spilled = nil, 0
+}
+
+// popSegment removes and returns the head of the segment which comes first in dequeue order,
+// if it comes before the first item in memory.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) popSegment(r *route) (*Item, bool) {
+	best := -1
+	for i, s := range r.segments {
+		if best < 0 || r.config.before(s.head, r.segments[best].head) {
+			best = i
+		}
+	}
+	if best < 0 || (r.queue.Len() > 0 && r.config.before(r.queue.items[0], r.segments[best].head)) {
+		return nil, false
+	}
+	return pq.takeHead(r, best), true
+}
+
+// takeHead removes and returns the head of the i-th segment of the route, closing the segment once empty.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) takeHead(r *route, i int) *Item {
+	s := r.segments[i]
+	item := s.head
+	r.spilled--
+	if err := s.next(); err != nil || s.head == nil {
+		if err != nil {
+			// the rest of the segment is lost, account for it.
+			pq.accounting.Dropped += uint64(s.count)
+			r.spilled -= s.count
+			pq.overflowFailed()
+		}
+		s.close()
+		r.segments = append(r.segments[:i], r.segments[i+1:]...)
+	}
+	return item
+}
+
+// spilledItems returns the paged items of the route, without consuming them.
+// If a segment can not be read, the items read before the error are returned with it.
+// It must be called with queueLock held.
+func (r *route) spilledItems() ([]*Item, error) {
+	var items []*Item
+	var errs []error
+	for _, s := range r.segments {
+		items = append(items, s.head)
+		rest, err := s.rest()
+		items = append(items, rest...)
+		errs = append(errs, err)
+	}
+	return items, errors.Join(errs...)
+}
+
+// size returns the number of items of the route, in memory or paged.
+func (r *route) size() int {
+	return r.queue.Len() + r.spilled
+}
@@ -0,0 +1,114 @@
+package khronos
+
+import (
+	"context"
+	"strings"
+)
+
+// Pause stops the delivery of the items of the route, and of its consumer groups, until Resume.
+// Pushes are still accepted, and the consumers waiting for an item keep waiting.
+// It lets operators freeze a pipeline during an incident without stopping the consumers.
+func (pq *PriorityQueueWithRouting) Pause(route string) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	pq.route(route).resolve().paused = true
+}
+
+// Resume resumes the delivery of the items of a route paused with Pause,
+// and reports whether the route was paused.
+func (pq *PriorityQueueWithRouting) Resume(route string) bool {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r, ok := pq.routes[route]
+	if !ok || !r.resolve().paused {
+		return false
+	}
+	r = r.resolve()
+	r.paused = false
+	pq.wake(r)
+	for _, g := range r.groups {
+		pq.wake(g.route)
+	}
+	return true
+}
+
+// Paused reports whether the delivery of the items of the route is paused.
+func (pq *PriorityQueueWithRouting) Paused(route string) bool {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r, ok := pq.routes[route]
+	return ok && pq.paused(r)
+}
+
+// paused reports whether the route, or the route of its consumer group, is paused.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) paused(r *route) bool {
+	if r.paused {
+		return true
+	}
+	if parent, _, ok := strings.Cut(r.name, "\x00"); ok {
+		if p, ok := pq.routes[parent]; ok {
+			return p.paused
+		}
+	}
+	return false
+}
+
+// PauseCommand is the command "pause".
+// "pause <route>" stops the delivery of the items of the route, see Pause.
+type PauseCommand struct {
+	ArgsCommand
+}
+
+func (c *PauseCommand) Name() string {
+	return "pause"
+}
+
+func (c *PauseCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	PqFromContext(ctx).Pause(c.Args()[0])
+	return writer.WriteStatus(OK)
+}
+
+func NewPauseCommand(args []string) (Command, error) {
+	if len(args) != 1 {
+		return nil, &WrongArityError{"pause"}
+	}
+	cmd := &PauseCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+// ResumeCommand is the command "resume".
+// "resume <route>" resumes the delivery of the items of a paused route,
+// and replies 1 if the route was paused, 0 otherwise.
+type ResumeCommand struct {
+	ArgsCommand
+}
+
+func (c *ResumeCommand) Name() string {
+	return "resume"
+}
+
+func (c *ResumeCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	if PqFromContext(ctx).Resume(c.Args()[0]) {
+		return writer.WriteInt64(1)
+	}
+	return writer.WriteInt64(0)
+}
+
+func NewResumeCommand(args []string) (Command, error) {
+	if len(args) != 1 {
+		return nil, &WrongArityError{"resume"}
+	}
+	cmd := &ResumeCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["pause"] = NewPauseCommand
+	commandLibraries["resume"] = NewResumeCommand
+}
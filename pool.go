@@ -0,0 +1,73 @@
+package khronos
+
+import "sync"
+
+// itemPool holds the items pushed and popped by the commands, so that a busy server does not allocate
+// an item per push. Only the items taken from the pool by getItem go back to it: the items of the callers
+// of the queue, such as NewItem, may still be referenced by them once popped.
+var itemPool = sync.Pool{
+	New: func() interface{} {
+		return new(Item)
+	},
+}
+
+// getItem returns an item from the pool with the given value and priority.
+func getItem(value string, priority int64) *Item {
+	item := itemPool.Get().(*Item)
+	item.value, item.priority, item.pooled = value, priority, true
+	return item
+}
+
+// putItem returns an item to the pool. The item must not be referenced anymore.
+func putItem(item *Item) {
+	*item = Item{}
+	itemPool.Put(item)
+}
+
+// release returns to the pool an item popped from the route by a command once it was replied,
+// if it came from the pool, unless the queue still references it, as the items reserved until confirmed,
+// see DeliveryAtLeastOnce.
+func (pq *PriorityQueueWithRouting) release(route string, item *Item) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	if !item.pooled || item.route != nil {
+		return
+	}
+	if r, ok := pq.routes[route]; ok {
+		if _, ok = r.resolve().reserved[item.id]; ok {
+			return
+		}
+	}
+	putItem(item)
+}
+
+// replyPool holds the arrays replied by "popn".
+var replyPool = sync.Pool{
+	New: func() interface{} {
+		return new([]any)
+	},
+}
+
+// getReply returns an array of n nil values from the pool.
+func getReply(n int) *[]any {
+	reply := replyPool.Get().(*[]any)
+	if cap(*reply) < n {
+		*reply = make([]any, n)
+	}
+	*reply = (*reply)[:n]
+	return reply
+}
+
+// maxPooledReply is the length above which the arrays are left to the garbage collector
+// rather than kept in the pool.
+const maxPooledReply = 1024
+
+// putReply returns an array to the pool once it was replied.
+func putReply(reply *[]any) {
+	if cap(*reply) > maxPooledReply {
+		return
+	}
+	clear(*reply)
+	replyPool.Put(reply)
+}
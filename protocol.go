@@ -4,12 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"strconv"
 	"strings"
 	"sync"
 )
 
+// ErrInvalidSyntax is the class of the errors of malformed frames, see SyntaxError.
 var ErrInvalidSyntax = errors.New("invalid syntax")
 
 const (
@@ -20,65 +22,202 @@ const (
 	ArrayReply  = '*'
 )
 
-func parseInt(b []byte) (int, error) {
-	if len(b) == 0 {
-		return 0, ErrInvalidSyntax
+// SyntaxError describes a malformed frame read by RespProtocolParser.
+// errors.Is matches it against ErrInvalidSyntax.
+type SyntaxError struct {
+	Offset   int64  // offset in the input of the line or the bytes at fault.
+	Expected string // what the parser expected, such as "'$'" or "length".
+	Got      string // what the parser read instead, quoted.
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("invalid syntax at offset %d: expected %s, got %s", e.Offset, e.Expected, e.Got)
+}
+
+// Is reports whether target is ErrInvalidSyntax.
+func (e *SyntaxError) Is(target error) bool {
+	return target == ErrInvalidSyntax
+}
+
+var (
+	// errBulkLength is returned for a bulk string longer than RespProtocolParser.MaxBulkLen.
+	errBulkLength = errors.New("invalid bulk length")
+	// errArrayLength is returned for an array longer than RespProtocolParser.MaxArrayLen.
+	errArrayLength = errors.New("invalid multibulk length")
+	// errLineLength is returned for a line longer than RespProtocolParser.MaxLineLen.
+	errLineLength = errors.New("too long line")
+)
+
+const (
+	// DefaultMaxBulkLen is the maximum length of a bulk string when RespProtocolParser.MaxBulkLen is zero.
+	DefaultMaxBulkLen = 512 << 20
+	// DefaultMaxArrayLen is the maximum number of elements of an array when RespProtocolParser.MaxArrayLen is zero.
+	DefaultMaxArrayLen = 1 << 20
+	// DefaultMaxLineLen is the maximum length of a line when RespProtocolParser.MaxLineLen is zero.
+	DefaultMaxLineLen = 64 << 10
+)
+
+// preallocLimit is the length above which a bulk string or an array is grown as its elements
+// are read, instead of being allocated upfront from the length announced by the client.
+const preallocLimit = 64 << 10
+
+// RespProtocolParser reads the commands sent as RESP arrays of bulk strings.
+// A frame which is not valid RESP fails with a *SyntaxError, and a frame exceeding the limits
+// of the parser with an error for which tooLarge is true; the parser never allocates more
+// than the limits for a frame, whatever the input.
+type RespProtocolParser struct {
+	*bufio.Reader
+
+	// MaxBulkLen is the maximum length of a bulk string, DefaultMaxBulkLen if zero.
+	MaxBulkLen int
+
+	// MaxArrayLen is the maximum number of elements of an array, DefaultMaxArrayLen if zero.
+	MaxArrayLen int
+
+	// MaxLineLen is the maximum length of a line, the type and the length of a frame, DefaultMaxLineLen if zero.
+	MaxLineLen int
+
+	offset int64 // number of bytes consumed from the input.
+}
+
+// tooLarge reports whether err is about a frame exceeding the limits of the parser,
+// after which the rest of the input can not be parsed.
+func tooLarge(err error) bool {
+	return errors.Is(err, errBulkLength) || errors.Is(err, errArrayLength) || errors.Is(err, errLineLength)
+}
+
+// syntaxError returns a *SyntaxError at offset for the bytes got.
+func syntaxError(offset int64, expected string, got []byte) error {
+	const maxQuoted = 32
+	if len(got) > maxQuoted {
+		return &SyntaxError{Offset: offset, Expected: expected, Got: strconv.Quote(string(got[:maxQuoted])) + "..."}
 	}
-	return strconv.Atoi(string(b))
+	return &SyntaxError{Offset: offset, Expected: expected, Got: strconv.Quote(string(got))}
 }
 
-type RespProtocolParser struct{ *bufio.Reader }
+// readLine reads a line, without its line ending, and returns it with its offset.
+// The line is only valid until the next read.
+func (p *RespProtocolParser) readLine() ([]byte, int64, error) {
+	max := p.MaxLineLen
+	if max <= 0 {
+		max = DefaultMaxLineLen
+	}
+	start := p.offset
+	var long []byte // the line, if it does not fit in the buffer of the reader.
+	for {
+		chunk, err := p.Reader.ReadSlice('\n')
+		p.offset += int64(len(chunk))
+		if len(long)+len(chunk) > max+2 {
+			return nil, start, errLineLength
+		}
+		if err == bufio.ErrBufferFull {
+			long = append(long, chunk...)
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && p.offset > start {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, start, err
+		}
+		line := chunk
+		if long != nil {
+			line = append(long, chunk...)
+		}
+		line = line[:len(line)-1]
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+		return line, start, nil
+	}
+}
 
-func (p *RespProtocolParser) readLine() ([]byte, error) {
-	line, _, err := p.Reader.ReadLine()
+// readHeader reads the line starting a frame of the given type, and returns the length it announces.
+// A negative length, or a length over max, fails with errLength.
+func (p *RespProtocolParser) readHeader(typ byte, max int, errLength error) (int, error) {
+	line, offset, err := p.readLine()
+	if err != nil {
+		return 0, err
+	}
+	if len(line) == 0 || line[0] != typ {
+		return 0, syntaxError(offset, strconv.QuoteRune(rune(typ)), line)
+	}
+	digits := line[1:]
+	if len(digits) == 0 || digits[0] == '+' {
+		return 0, syntaxError(offset+1, "length", digits)
+	}
+	length, err := strconv.Atoi(string(digits))
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, errLength
+	}
 	if err != nil {
-		return nil, err
+		return 0, syntaxError(offset+1, "length", digits)
+	}
+	if length < 0 || length > max {
+		return 0, errLength
 	}
-	return line, nil
+	return length, nil
 }
 
 // readArrayLength reads the array length from the reader.
 // each protocol message starts with a byte indicating the type of the message.
 // for array, it is '*'.
 func (p *RespProtocolParser) readArrayLength() (int, error) {
-	line, err := p.readLine()
-	if err != nil {
-		return 0, err
-	}
-	if len(line) == 0 {
-		return 0, ErrInvalidSyntax
+	max := p.MaxArrayLen
+	if max <= 0 {
+		max = DefaultMaxArrayLen
 	}
-	if line[0] != ArrayReply {
-		return 0, ErrInvalidSyntax
-	}
-	return parseInt(line[1:])
+	return p.readHeader(ArrayReply, max, errArrayLength)
 }
 
 // readString reads an argument from the reader.
 func (p *RespProtocolParser) readString() (string, error) {
-	line, err := p.readLine()
+	max := p.MaxBulkLen
+	if max <= 0 {
+		max = DefaultMaxBulkLen
+	}
+	length, err := p.readHeader(StringReply, max, errBulkLength)
 	if err != nil {
 		return "", err
 	}
-	if len(line) == 0 {
-		return "", ErrInvalidSyntax
-	}
-	if line[0] != StringReply {
-		return "", ErrInvalidSyntax
+	var s string
+	if length <= preallocLimit {
+		var buf = make([]byte, length)
+		n, err := io.ReadFull(p, buf)
+		p.offset += int64(n)
+		if err != nil {
+			return "", unexpectedEOF(err)
+		}
+		s = string(buf)
+	} else {
+		// the memory is only used as the client actually sends the string.
+		var b strings.Builder
+		n, err := io.CopyN(&b, p, int64(length))
+		p.offset += n
+		if err != nil {
+			return "", unexpectedEOF(err)
+		}
+		s = b.String()
 	}
-	length, err := parseInt(line[1:])
+	// the string is followed by a crlf.
+	crlf, err := p.Peek(2)
 	if err != nil {
-		return "", err
+		return "", unexpectedEOF(err)
 	}
-	var buf = make([]byte, length)
-	if _, err = io.ReadFull(p, buf); err != nil {
-		return "", err
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		return "", syntaxError(p.offset, `"\r\n"`, crlf)
 	}
-	// discard the trailing crlf
-	if _, err = p.Discard(2); err != nil {
-		return "", err
+	n, _ := p.Discard(2)
+	p.offset += int64(n)
+	return s, nil
+}
+
+// unexpectedEOF returns io.ErrUnexpectedEOF for an input ending in the middle of a frame.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
 	}
-	return string(buf), nil
+	return err
 }
 
 // readCommandName reads the command name from the reader.
@@ -88,25 +227,27 @@ func (p *RespProtocolParser) readCommandName() (string, error) {
 
 // readCommandArgs reads the command arguments from the reader.
 func (p *RespProtocolParser) readCommandArgs(length int) ([]string, error) {
-	var args = make([]string, length)
+	var args = make([]string, 0, min(length, preallocLimit))
 	for i := 0; i < length; i++ {
 		arg, err := p.readString()
 		if err != nil {
 			return nil, err
 		}
-		args[i] = arg
+		args = append(args, arg)
 	}
 	return args, nil
 }
 
 // Parse reads a command from the reader.
+// It returns io.EOF if the input ends between two commands, and io.ErrUnexpectedEOF in the middle of one.
 func (p *RespProtocolParser) Parse() (string, []string, error) {
+	offset := p.offset
 	length, err := p.readArrayLength()
 	if err != nil {
 		return "", nil, err
 	}
-	if length == 0 {
-		return "", nil, ErrInvalidSyntax
+	if length <= 0 {
+		return "", nil, &SyntaxError{Offset: offset, Expected: "command", Got: "empty array"}
 	}
 	name, err := p.readCommandName()
 	if err != nil {
@@ -120,11 +261,61 @@ func (p *RespProtocolParser) Parse() (string, []string, error) {
 }
 
 func NewRespProtocolParser(r io.Reader) *RespProtocolParser {
-	return &RespProtocolParser{bufio.NewReader(r)}
+	return &RespProtocolParser{Reader: bufio.NewReader(r)}
+}
+
+// protocolError is returned when a client sends a frame which is not valid RESP.
+type protocolError struct {
+	err error
+}
+
+func (e *protocolError) Error() string {
+	return "ERR Protocol error: " + e.err.Error()
+}
+
+func (e *protocolError) Unwrap() error {
+	return e.err
+}
+
+// resync skips the buffered input up to the next line starting an array, which is likely the next command,
+// so that the parser recovers from a malformed frame.
+// It does not wait for more input: if no such line is buffered, the buffered input is discarded.
+func (p *RespProtocolParser) resync() {
+	for p.Buffered() > 0 {
+		b, _ := p.Peek(1)
+		if b[0] == ArrayReply {
+			return
+		}
+		line, err := p.Peek(p.Buffered())
+		if err != nil {
+			return
+		}
+		skip := len(line)
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			skip = i + 1
+		}
+		n, _ := p.Discard(skip)
+		p.offset += int64(n)
+	}
 }
 
+// CommandParser reads the commands of a connection.
+// It keeps its reader between commands, so it must not be shared between connections.
 type CommandParser struct {
 	command Command
+	parser  *RespProtocolParser
+	broken  bool // whether the last frame was malformed and the input must be resynchronized.
+
+	// tokens is whether the trailing "token <t>" arguments of the tokenCommands are split from them,
+	// when the server has a Server.TokenSecret. The token of the last command is kept in routeToken.
+	tokens     bool
+	routeToken string
+	hasToken   bool
+}
+
+// token returns the route token sent with the last command, see NewRouteToken.
+func (p *CommandParser) token() (string, bool) {
+	return p.routeToken, p.hasToken
 }
 
 // Write do nothing just to implement io.Writer.
@@ -135,16 +326,33 @@ func (p *CommandParser) Write(b []byte) (int, error) {
 
 // ReadFrom hooks io.Copy
 func (p *CommandParser) ReadFrom(r io.Reader) (int64, error) {
-	parser := NewRespProtocolParser(r)
-	cmd, args, err := parser.Parse()
+	if p.parser == nil {
+		p.parser = NewRespProtocolParser(r)
+	}
+	if p.broken {
+		p.parser.resync()
+		p.broken = false
+	}
+	cmd, args, err := p.parser.Parse()
 	if err != nil {
-		return 0, err
+		if isConnClosed(err) {
+			return 0, err
+		}
+		p.broken = true
+		return 0, &protocolError{err}
 	}
 	cmd = strings.ToLower(cmd)
 	constructor, ok := commandLibraries[cmd]
 	if !ok {
 		return 0, &wrongCommandError{command: cmd, args: args}
 	}
+	p.routeToken, p.hasToken = "", false
+	if p.tokens && tokenCommands[cmd] {
+		args, p.routeToken, p.hasToken = splitToken(args)
+	}
+	if err = checkArity(cmd, args); err != nil {
+		return 0, err
+	}
 	command, err := constructor(args)
 	if err != nil {
 		return 0, err
@@ -153,36 +361,141 @@ func (p *CommandParser) ReadFrom(r io.Reader) (int64, error) {
 	return 0, err
 }
 
+// protocolBuilder builds RESP replies by appending to a byte slice, so that building a reply
+// does not allocate once the buffer of a pooled builder has grown to the size of the replies.
 type protocolBuilder struct {
-	*bytes.Buffer
+	buf []byte
+}
+
+// smallInts holds the decimal forms of the small integers, which make most of the lengths
+// and integer replies, to append them without formatting.
+var smallInts = func() [256][]byte {
+	var ints [256][]byte
+	for i := range ints {
+		ints[i] = strconv.AppendInt(nil, int64(i), 10)
+	}
+	return ints
+}()
+
+// maxPooledBuilder is the capacity above which a builder is not put back in the pool,
+// so that a single large reply does not pin its buffer forever.
+const maxPooledBuilder = 64 << 10
+
+func (w *protocolBuilder) Bytes() []byte { return w.buf }
+
+func (w *protocolBuilder) Reset() { w.buf = w.buf[:0] }
+
+// appendInt appends the decimal form of i.
+func (w *protocolBuilder) appendInt(i int64) {
+	if i >= 0 && i < int64(len(smallInts)) {
+		w.buf = append(w.buf, smallInts[i]...)
+		return
+	}
+	w.buf = strconv.AppendInt(w.buf, i, 10)
+}
+
+// appendLine appends a line made of the type of a reply and an integer.
+func (w *protocolBuilder) appendLine(kind byte, i int64) {
+	w.buf = append(w.buf, kind)
+	w.appendInt(i)
+	w.buf = append(w.buf, '\r', '\n')
 }
 
 func (w *protocolBuilder) WriteString(s string) {
-	w.Write([]byte("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"))
+	w.appendLine(StringReply, int64(len(s)))
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, '\r', '\n')
 }
 
 func (w *protocolBuilder) WriteInt64(i int64) {
-	w.Write([]byte(":" + strconv.FormatInt(i, 10) + "\r\n"))
+	w.appendLine(IntReply, i)
 }
 
 func (w *protocolBuilder) WriteError(err error) {
-	w.Write([]byte("-" + err.Error() + "\r\n"))
+	w.buf = append(w.buf, ErrorReply)
+	w.buf = append(w.buf, err.Error()...)
+	w.buf = append(w.buf, '\r', '\n')
 }
 
 func (w *protocolBuilder) WriteStatus(s string) {
-	w.Write([]byte("+" + s + "\r\n"))
+	w.buf = append(w.buf, StatusReply)
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+func (w *protocolBuilder) WriteNil() {
+	w.buf = append(w.buf, "$-1\r\n"...)
+}
+
+func (w *protocolBuilder) WriteArrayHeader(n int) {
+	w.appendLine(ArrayReply, int64(n))
 }
 
 func (w *protocolBuilder) WriteArray(a []string) {
-	w.WriteInt64(int64(len(a)))
+	w.WriteArrayHeader(len(a))
 	for _, s := range a {
 		w.WriteString(s)
 	}
 }
 
+// WriteValue appends the reply of v, see WriteValue.
+func (w *protocolBuilder) WriteValue(v any) error {
+	switch v := v.(type) {
+	case nil:
+		w.WriteNil()
+	case string:
+		w.WriteString(v)
+	case []byte:
+		w.WriteString(string(v))
+	case int:
+		w.WriteInt64(int64(v))
+	case int8:
+		w.WriteInt64(int64(v))
+	case int16:
+		w.WriteInt64(int64(v))
+	case int32:
+		w.WriteInt64(int64(v))
+	case int64:
+		w.WriteInt64(v)
+	case uint:
+		w.WriteInt64(int64(v))
+	case uint8:
+		w.WriteInt64(int64(v))
+	case uint16:
+		w.WriteInt64(int64(v))
+	case uint32:
+		w.WriteInt64(int64(v))
+	case uint64:
+		w.WriteInt64(int64(v))
+	case bool:
+		w.WriteInt64(int64(btoi(v)))
+	case Status:
+		w.WriteStatus(v.String())
+	case error:
+		w.WriteError(v)
+	case []string:
+		w.WriteArray(v)
+	case []int64:
+		w.WriteArrayHeader(len(v))
+		for _, i := range v {
+			w.WriteInt64(i)
+		}
+	case []any:
+		w.WriteArrayHeader(len(v))
+		for _, elem := range v {
+			if err := w.WriteValue(elem); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("khronos: unsupported reply type %T", v)
+	}
+	return nil
+}
+
 var protocolWriterPool = sync.Pool{
 	New: func() interface{} {
-		return &protocolBuilder{bytes.NewBuffer(nil)}
+		return &protocolBuilder{buf: make([]byte, 0, 64)}
 	},
 }
 
@@ -191,6 +504,9 @@ func getprotocolBuilder() *protocolBuilder {
 }
 
 func putProtocolBuilder(w *protocolBuilder) {
+	if cap(w.buf) > maxPooledBuilder {
+		return
+	}
 	w.Reset()
 	protocolWriterPool.Put(w)
 }
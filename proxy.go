@@ -0,0 +1,160 @@
+package khronos
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// proxyHeaderTimeout is how long a connection has to send its PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// maxProxyV1Len is the maximum length of a version 1 header, "\r\n" included.
+const maxProxyV1Len = 107
+
+var errProxyHeader = errors.New("khronos: invalid PROXY protocol header")
+
+// proxyV2Signature starts the version 2, binary, headers.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxiedConn is a connection whose client address is the one sent in its PROXY protocol header.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// acceptProxy reads the PROXY protocol header of conn, see Server.ProxyProtocol, and returns conn
+// with the address of the client it carries. It closes conn and returns false if the header is invalid,
+// or if the client is not allowed by the IP filter.
+func (srv *Server) acceptProxy(conn net.Conn) (net.Conn, bool) {
+	proxied, err := readProxy(conn)
+	if err != nil {
+		srv.logger().Info("khronos: conn closed", "addr", conn.RemoteAddr().String(), "reason", err)
+		_ = conn.Close()
+		return nil, false
+	}
+	if !srv.getIPFilter().allows(proxied.RemoteAddr()) {
+		atomic.AddInt64(&srv.stats.connsDenied, 1)
+		srv.logger().Debug("khronos: conn denied", "addr", proxied.RemoteAddr().String())
+		_ = conn.Close()
+		return nil, false
+	}
+	return proxied, true
+}
+
+// readProxy reads the PROXY protocol header of conn and returns conn with the address of the client it carries.
+// Headers of health checks, without an address, leave the address of the connection.
+func readProxy(conn net.Conn) (net.Conn, error) {
+	// the header comes before the TLS handshake, and is read without buffering,
+	// so that the rest is left to the connection.
+	raw := conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		raw = tlsConn.NetConn()
+	}
+	_ = raw.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer raw.SetReadDeadline(time.Time{})
+
+	remote, err := readProxyHeader(raw)
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		return conn, nil
+	}
+	return &proxiedConn{Conn: conn, remote: remote}, nil
+}
+
+// readProxyHeader reads a PROXY protocol header of version 1 or 2 from r,
+// and returns the source address it carries, nil if it has none.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	// the shortest header, "PROXY UNKNOWN\r\n", is longer than the signature of version 2.
+	head := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(head, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if !bytes.HasPrefix(head, []byte("PROXY ")) {
+		return nil, errProxyHeader
+	}
+	line := head
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == maxProxyV1Len {
+			return nil, errProxyHeader
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	return parseProxyV1(string(line[:len(line)-2]))
+}
+
+// parseProxyV1 parses the line of a version 1 header, such as
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443".
+func parseProxyV1(line string) (net.Addr, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return nil, errProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyV2 reads the rest of a version 2 header, after its signature.
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if head[0]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	switch head[0] & 0xf {
+	case 0x0: // LOCAL, the connection of the proxy itself.
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errProxyHeader
+	}
+	var ip netip.Addr
+	switch family := head[1]; {
+	case family == 0x11 && len(body) >= 12: // TCP over IPv4
+		ip = netip.AddrFrom4([4]byte(body[:4]))
+		body = body[8:]
+	case family == 0x21 && len(body) >= 36: // TCP over IPv6
+		ip = netip.AddrFrom16([16]byte(body[:16]))
+		body = body[32:]
+	default: // unspecified, UDP or unix addresses
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body))), nil
+}
@@ -1,9 +1,11 @@
 package khronos
 
 import (
-	"container/heap"
 	"context"
+	"maps"
+	"runtime"
 	"sync"
+	"time"
 )
 
 func PqFromContext(ctx context.Context) *PriorityQueueWithRouting {
@@ -16,119 +18,499 @@ func PqWithContext(ctx context.Context, pq *PriorityQueueWithRouting) context.Co
 
 // Item represents an item in the queue.
 type Item struct {
-	value    string // The value of the item.
-	priority int64  // The priority of the item.
-	index    int    // The index of the item in the heap.
+	value    string            // The value of the item.
+	priority int64             // The priority of the item.
+	index    int               // The index of the item in the heap.
+	id       uint64            // The identifier of the item, increasing in enqueue order, it breaks ties between equal priorities.
+	route    *route            // The route holding the item, nil once it left the queue.
+	enqueued time.Time         // When the item was enqueued.
+	headers  map[string]string // Metadata of the item, such as a correlation identifier.
+	pooled   bool              // Whether the item comes from itemPool, see release.
 }
 
-// PriorityQueue implements a priority queue.
-type PriorityQueue []*Item
+// NewItem returns an item to enqueue with the given value and priority.
+func NewItem(value string, priority int64) *Item {
+	return &Item{value: value, priority: priority}
+}
 
-// Len returns the length of the priority queue.
-func (pq PriorityQueue) Len() int { return len(pq) }
+// Value returns the value of the item.
+func (item *Item) Value() string {
+	return item.value
+}
 
-// Less compares two items by their priorities.
-func (pq PriorityQueue) Less(i, j int) bool {
-	return pq[i].priority > pq[j].priority
+// Priority returns the priority of the item.
+func (item *Item) Priority() int64 {
+	return item.priority
 }
 
-// Swap swaps two items in the priority queue.
-func (pq PriorityQueue) Swap(i, j int) {
-	pq[i], pq[j] = pq[j], pq[i]
-	pq[i].index = i
-	pq[j].index = j
+// ID returns the identifier assigned to the item when it was enqueued, or zero.
+// It can be passed to UpdatePriority while the item is queued.
+func (item *Item) ID() uint64 {
+	return item.id
 }
 
-// Push adds an item to the priority queue.
-func (pq *PriorityQueue) Push(x interface{}) {
-	n := len(*pq)
-	item := x.(*Item)
-	item.index = n
-	*pq = append(*pq, item)
+// Header returns the value of a header of the item, or "".
+func (item *Item) Header(key string) string {
+	return item.headers[key]
 }
 
-// Pop removes and returns the item with the highest priority from the priority queue.
-func (pq *PriorityQueue) Pop() interface{} {
-	old := *pq
-	n := len(old)
-	item := old[n-1]
-	item.index = -1 // for safety
-	*pq = old[0 : n-1]
-	return item
+// Headers returns a copy of the headers of the item.
+func (item *Item) Headers() map[string]string {
+	return maps.Clone(item.headers)
+}
+
+// SetHeader sets a header of the item. It must be called before the item is enqueued.
+func (item *Item) SetHeader(key, value string) {
+	if item.headers == nil {
+		item.headers = make(map[string]string)
+	}
+	item.headers[key] = value
+}
+
+// Clone returns a new item with the value, the priority and the headers of the item,
+// for instance to enqueue it again once it was dequeued.
+func (item *Item) Clone() *Item {
+	return &Item{value: item.value, priority: item.priority, headers: maps.Clone(item.headers)}
+}
+
+// memory returns the approximate number of bytes used by the item in memory.
+func (item *Item) memory() int64 {
+	n := itemMemory(item.value)
+	for key, value := range item.headers {
+		n += int64(len(key) + len(value))
+	}
+	return n
 }
 
 // PriorityQueueWithRouting implements a thread-safe priority queue with routing support.
 type PriorityQueueWithRouting struct {
-	queueMap  map[string]*PriorityQueue // Map of queues based on routes.
-	queueLock sync.Mutex                // Lock for concurrent access to the queues.
-	notEmpty  map[string]*sync.Cond     // Condition variables for each route to block when the queue is empty.
+	routes    map[string]*route    // State of the routes by name.
+	queueLock queueMutex           // Lock for concurrent access to the queues.
+	feeds     map[*opFeed]struct{} // Subscribers of the operations applied to the queues.
+	opOffset  uint64               // Number of operations applied to the queues, see emit.
+	items     map[uint64]*Item     // Queued items by identifier.
+	nextID    uint64               // Identifier of the last enqueued item.
+
+	accounting Accounting // Counters of the items which entered and left the queues, Pending is not maintained.
+
+	defaults RouteConfig // Settings of the new routes.
+
+	namespaces map[string]*namespace // Quotas of the namespaces, see SetNamespaceConfig.
+
+	events        chan Event // Receives the events of the queue if enabled, see Server.OnEvent.
+	eventsDropped uint64     // Number of events dropped because the channel was full, updated atomically.
+
+	drops     []droppedItem // Items dropped and not passed to Server.OnDrop yet, see enableDrops.
+	dropReady chan struct{} // Receives a value when drops has items, nil unless drops are enabled.
+
+	memory queueMemory // Memory used by the items.
+
+	overflowDir      string // Directory of the paged items, see SetOverflowDir.
+	overflowErrors   uint64 // Number of failures to page items to or from disk, updated atomically.
+	overflowFailedAt int64  // Time of the last failure to page items, in Unix nanoseconds, updated atomically.
+
+	crons map[string]*cronJob // Recurring pushes by name, see AddCronJob.
+
+	bindings map[Binding]struct{} // Topic patterns of the routes, see Bind.
+
+	clock Clock // Source of time of the queue, SystemClock if nil, see SetClock.
+
+	anyPushed  *sync.Cond // Condition variable of the consumers blocked on several routes, see DequeueAny.
+	anyWaiters int        // Number of consumers blocked on several routes.
+}
+
+// route holds the items and the settings of a route.
+type route struct {
+	name      string
+	queue     PriorityQueue[*Item]    // Items in memory, in the order given by config.
+	notEmpty  *sync.Cond              // Condition variable to block when the queue is empty.
+	handoff   chan *Item              // Receives the next item pushed for the only consumer of the route, see awaitHandoff.
+	notFull   *sync.Cond              // Condition variable to block producers when the queue is full, see FullBlock.
+	config    RouteConfig             // Settings of the route.
+	bucket    *tokenBucket            // Operations quota of the route, see RouteConfig.MaxOps.
+	moved     *route                  // The route the items were moved to by a rename, followed by the waiters.
+	enqueued  uint64                  // Number of items enqueued on the route.
+	dequeued  uint64                  // Number of items dequeued from the route.
+	waiters   int                     // Number of consumers blocked on the route.
+	producers int                     // Number of producers blocked on the full route, see EnqueueContext.
+	segments  []*segment              // Items paged to disk, see RouteConfig.MaxInMemory.
+	spilled   int                     // Number of items paged to disk.
+	memory    int64                   // Approximate bytes used by the items in memory.
+	total     *queueMemory            // Memory used by all the routes of the queue.
+	groups    map[string]*group       // Consumer groups receiving the items pushed to the route, see CreateGroup.
+	reserved  map[uint64]*reservation // Items delivered and not confirmed yet, see DeliveryAtLeastOnce.
+	dedup     dedupIndex              // Deduplication ids of the items recently enqueued, see EnqueueOnce.
+	paused    bool                    // Whether the delivery of the items is stopped, see Pause.
+	aboveHigh bool                    // Whether the route reached its high watermark, see RouteConfig.HighWatermark.
+	lastUsed  time.Time               // Last time the route was looked up by name, see CollectRoutes.
+}
+
+// add adds an item to the heap of the route.
+func (r *route) add(item *Item) {
+	r.queue.Push(item)
+	r.addMemory(item.memory())
+}
+
+// addBatch adds several items to the heap of the route.
+func (r *route) addBatch(items []*Item) {
+	r.queue.PushBatch(items...)
+	for _, item := range items {
+		r.addMemory(item.memory())
+	}
+}
+
+// take removes and returns the item at index i of the heap of the route.
+func (r *route) take(i int) *Item {
+	item := r.queue.Remove(i)
+	r.addMemory(-item.memory())
+	return item
+}
+
+// setItemIndex records the index of the item in the heap of its route.
+func setItemIndex(item *Item, i int) { item.index = i }
+
+// addMemory counts n more bytes used by the route.
+func (r *route) addMemory(n int64) {
+	r.memory += n
+	r.total.add(n)
+}
+
+// resolve follows the renames of the route and returns the route now holding its items.
+func (r *route) resolve() *route {
+	for r.moved != nil {
+		r = r.moved
+	}
+	return r
 }
 
 // NewPriorityQueueWithRouting creates a new instance of PriorityQueueWithRouting.
 func NewPriorityQueueWithRouting() *PriorityQueueWithRouting {
 	return &PriorityQueueWithRouting{
-		queueMap: make(map[string]*PriorityQueue),
-		notEmpty: make(map[string]*sync.Cond),
+		routes: make(map[string]*route),
+		items:  make(map[uint64]*Item),
 	}
 }
 
+// route returns the state of the named route, creating it if necessary.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) route(name string) *route {
+	r, ok := pq.routes[name]
+	if !ok {
+		r = &route{name: name, notEmpty: sync.NewCond(&pq.queueLock), notFull: sync.NewCond(&pq.queueLock), config: pq.defaults, total: &pq.memory}
+		r.queue = PriorityQueue[*Item]{less: func(a, b *Item) bool { return r.config.before(a, b) }, index: setItemIndex}
+		pq.routes[name] = r
+		pq.indexRoute(name, r)
+	}
+	r.lastUsed = pq.now()
+	return r
+}
+
 // Enqueue adds an item to the queue based on the specified route and priority.
+// The item is assigned an identifier, see Item.ID.
 func (pq *PriorityQueueWithRouting) Enqueue(route string, item *Item) {
 	pq.queueLock.Lock()
 	defer pq.queueLock.Unlock()
 
-	queue, ok := pq.queueMap[route]
-	if !ok {
-		queue = &PriorityQueue{}
-		heap.Init(queue)
-		pq.queueMap[route] = queue
+	pq.push(pq.route(route), item)
+}
+
+// EnqueueID is like Enqueue, and returns the identifier assigned to the item.
+// Unlike Item.ID called after Enqueue, it cannot observe a consumer popping and requeuing the item
+// in the meantime.
+func (pq *PriorityQueueWithRouting) EnqueueID(route string, item *Item) uint64 {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	pq.push(pq.route(route), item)
+	return item.id
+}
+
+// push adds an item to the route and wakes up its waiters.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) push(r *route, item *Item) {
+	if len(r.groups) > 0 {
+		pq.fanout(r, item)
+		return
+	}
+	pq.nextID++
+	pq.insert(r, item, pq.nextID)
+}
+
+// insert adds an item to the route with the given identifier and wakes up its waiters.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) insert(r *route, item *Item, id uint64) {
+	item.id, item.route, item.enqueued = id, r, pq.now()
+	pq.items[item.id] = item
+	pq.accounting.Pushed++
+	r.enqueued++
+	pq.emit(pushOp(r.name, item))
+	pq.notify(EventEnqueued, r, item)
+	if pq.handoff(r, item) {
+		return
 	}
+	r.add(item)
+	pq.spill(r)
+	pq.watermark(r)
+
+	pq.wake(r)
+}
 
-	heap.Push(queue, item)
+// EnqueueBatch adds several items to the route, like Enqueue for each of them, but rebuilds
+// the heap of the route once for a large batch, which makes bulk loading a large schedule faster.
+func (pq *PriorityQueueWithRouting) EnqueueBatch(route string, items []*Item) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	pq.pushBatch(pq.route(route), items)
+}
 
-	cond, condExists := pq.notEmpty[route]
-	if !condExists {
-		cond = sync.NewCond(&pq.queueLock)
-		pq.notEmpty[route] = cond
+// pushBatch adds several items to the route and wakes up its waiters.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) pushBatch(r *route, items []*Item) {
+	if len(r.groups) > 0 || len(items) < 2 {
+		for _, item := range items {
+			pq.push(r, item)
+		}
+		return
+	}
+	now := pq.now()
+	for _, item := range items {
+		pq.nextID++
+		item.id, item.route, item.enqueued = pq.nextID, r, now
+		pq.items[item.id] = item
+	}
+	pq.accounting.Pushed += uint64(len(items))
+	r.enqueued += uint64(len(items))
+	r.addBatch(items)
+	for _, item := range items {
+		pq.emit(pushOp(r.name, item))
+		pq.notify(EventEnqueued, r, item)
+	}
+	pq.spill(r)
+	pq.watermark(r)
+
+	pq.wake(r)
+}
+
+// wake wakes up the consumers waiting for an item on the route.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) wake(r *route) {
+	r.signal()
+	if pq.anyWaiters > 0 {
+		pq.anyPushed.Broadcast()
 	}
+}
 
-	cond.Broadcast()
+// pop removes and returns the item with the highest priority of the route.
+// It returns false if the route is empty or paused.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) pop(r *route) (*Item, bool) {
+	if pq.paused(r) {
+		return nil, false
+	}
+	item, ok := pq.popSegment(r)
+	if !ok {
+		if r.queue.Len() == 0 {
+			return nil, false
+		}
+		item = r.take(0)
+	}
+	pq.delivered(r, item)
+	return item, true
+}
+
+// delivered accounts for an item removed from the route by a consumer.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) delivered(r *route, item *Item) {
+	pq.forget(item)
+	if r.config.Delivery == DeliveryAtLeastOnce && !isGroupRoute(r.name) {
+		// the item leaves the feed once confirmed, see hold.
+		pq.hold(r, item)
+	} else {
+		pq.accounting.Popped++
+		pq.emit(deleteOp(r.name, item))
+	}
+	r.dequeued++
+	r.wakeProducers()
+	pq.watermark(r)
+	pq.notify(EventDequeued, r, item)
+}
+
+// forget removes an item which left the queue from the index of identifiers.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) forget(item *Item) {
+	delete(pq.items, item.id)
+	item.route = nil
 }
 
 // Dequeue removes and returns the item with the highest priority from the queue based on the specified route.
 // If the queue is empty, it blocks until an item is available.
 func (pq *PriorityQueueWithRouting) Dequeue(route string) *Item {
+	item, _ := pq.DequeueContext(context.Background(), route)
+	return item
+}
+
+// DequeueContext is like Dequeue but gives up waiting when ctx is done,
+// in which case it returns ctx.Err().
+// If the route is renamed while waiting, DequeueContext follows it to its new name.
+func (pq *PriorityQueueWithRouting) DequeueContext(ctx context.Context, route string) (*Item, error) {
 	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r := pq.route(route)
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				// wake up the waiter below so that it can observe ctx.Err()
+				pq.queueLock.Lock()
+				r.resolve().notEmpty.Broadcast()
+				pq.queueLock.Unlock()
+			case <-stop:
+			}
+		}()
+	}
 
+	spun := false
 	for {
-		queue, ok := pq.queueMap[route]
-		if ok && queue.Len() > 0 {
-			item := heap.Pop(queue).(*Item)
-			pq.queueLock.Unlock()
-			return item
+		r = r.resolve()
+		if item, ok := pq.pop(r); ok {
+			return item, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if budget := r.config.SpinBudget; !spun && budget > 0 {
+			spun = true
+			r.waiters++
+			item, ok := pq.spin(ctx, r, budget)
+			r.waiters--
+			if ok {
+				return item, nil
+			}
+			continue
+		}
+		if r.waiters == 0 && r.handoff == nil {
+			if item, ok := pq.awaitHandoff(ctx, r); ok {
+				return item, nil
+			}
+			continue
 		}
+		r.waiters++
+		r.notEmpty.Wait()
+		r.waiters--
+	}
+}
 
-		cond, condExists := pq.notEmpty[route]
-		if !condExists {
-			cond = sync.NewCond(&sync.Mutex{})
-			pq.notEmpty[route] = cond
+// spin polls the route for an item during budget, yielding the lock between two attempts.
+// It must be called with queueLock held, and returns with queueLock held.
+func (pq *PriorityQueueWithRouting) spin(ctx context.Context, r *route, budget time.Duration) (*Item, bool) {
+	deadline := time.Now().Add(budget)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		pq.queueLock.Unlock()
+		runtime.Gosched()
+		pq.queueLock.Lock()
+		if item, ok := pq.pop(r.resolve()); ok {
+			return item, true
 		}
+	}
+	return nil, false
+}
+
+// TryDequeue removes and returns the item with the highest priority without blocking.
+// It returns false if the queue is empty.
+func (pq *PriorityQueueWithRouting) TryDequeue(route string) (*Item, bool) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
 
-		pq.queueLock.Unlock() // 释放主锁，允许其他队列操作
-		cond.L.Lock()
-		cond.Wait()
-		cond.L.Unlock()
-		pq.queueLock.Lock() // 重新获取主锁
+	r, ok := pq.routes[route]
+	if !ok {
+		return nil, false
 	}
+	return pq.pop(r)
+}
+
+// TryDequeueN removes and returns up to n items with the highest priorities without blocking,
+// in dequeue order.
+func (pq *PriorityQueueWithRouting) TryDequeueN(route string, n int) []*Item {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r, ok := pq.routes[route]
+	if !ok {
+		return nil
+	}
+	var items []*Item
+	for len(items) < n {
+		item, ok := pq.pop(r)
+		if !ok {
+			break
+		}
+		items = append(items, item)
+	}
+	return items
 }
 
 func (pq *PriorityQueueWithRouting) Length(route string) int {
 	pq.queueLock.Lock()
 	defer pq.queueLock.Unlock()
 
-	queue, ok := pq.queueMap[route]
+	r, ok := pq.routes[route]
 	if !ok {
 		return 0
 	}
-	return queue.Len()
+	return r.size()
+}
+
+// DequeueAny removes and returns the item with the highest priority of the first non-empty route among routes,
+// together with the name of its route.
+// If all the routes are empty, it blocks until an item is available on one of them or ctx is done,
+// in which case it returns ctx.Err().
+func (pq *PriorityQueueWithRouting) DequeueAny(ctx context.Context, routes ...string) (string, *Item, error) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	if pq.anyPushed == nil {
+		pq.anyPushed = sync.NewCond(&pq.queueLock)
+	}
+	rs := make([]*route, len(routes))
+	for i, name := range routes {
+		rs[i] = pq.route(name)
+	}
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				pq.queueLock.Lock()
+				pq.anyPushed.Broadcast()
+				pq.queueLock.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	for {
+		for i, r := range rs {
+			rs[i] = r.resolve()
+			if item, ok := pq.pop(rs[i]); ok {
+				return rs[i].name, item, nil
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return "", nil, err
+		}
+		for _, r := range rs {
+			r.waiters++
+		}
+		pq.anyWaiters++
+		pq.anyPushed.Wait()
+		pq.anyWaiters--
+		for _, r := range rs {
+			r.waiters--
+		}
+	}
 }
@@ -1,14 +1,21 @@
 package khronos
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"khronos/khronostest"
 )
 
 func ExamplePriorityQueue() {
 	pq := NewPriorityQueueWithRouting()
+	// Dequeue the lowest priorities first.
+	pq.SetDefaultRouteConfig(RouteConfig{Order: OrderAsc})
 
 	// Enqueue items with different routes and priorities.
 	pq.Enqueue("route", &Item{value: "item2", priority: 2})
@@ -20,6 +27,42 @@ func ExamplePriorityQueue() {
 	fmt.Println(item1.value) // Output: item1
 }
 
+func ExampleNewPriorityQueue() {
+	type job struct {
+		name     string
+		deadline time.Time
+		weight   int
+		index    int
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Dequeue the earliest deadlines first, and the heaviest jobs first among the same deadline.
+	q := NewPriorityQueue(func(a, b *job) bool {
+		if !a.deadline.Equal(b.deadline) {
+			return a.deadline.Before(b.deadline)
+		}
+		return a.weight > b.weight
+	})
+	q.OnIndex(func(j *job, i int) { j.index = i })
+
+	report := &job{name: "report", deadline: now.Add(time.Hour), weight: 1}
+	q.Push(report)
+	q.Push(&job{name: "backup", deadline: now.Add(2 * time.Hour), weight: 5})
+	q.Push(&job{name: "email", deadline: now.Add(time.Hour), weight: 3})
+
+	// Postpone the report after the backup.
+	report.deadline = now.Add(3 * time.Hour)
+	q.Fix(report.index)
+
+	for q.Len() > 0 {
+		j, _ := q.Pop()
+		fmt.Println(j.name)
+	}
+	// Output:
+	// email
+	// backup
+	// report
+}
+
 func BenchmarkPriorityQueue(b *testing.B) {
 	pq := NewPriorityQueueWithRouting()
 
@@ -36,6 +79,7 @@ func BenchmarkPriorityQueue(b *testing.B) {
 
 func TestPriorityQueue(t *testing.T) {
 	pq := NewPriorityQueueWithRouting()
+	pq.SetRouteConfig("route", RouteConfig{Order: OrderAsc})
 
 	// Enqueue items with different routes and priorities.
 	pq.Enqueue("route", &Item{value: "item2", priority: 2})
@@ -57,6 +101,152 @@ func TestPriorityQueue(t *testing.T) {
 	}
 }
 
+func TestGenericPriorityQueue(t *testing.T) {
+	q := NewPriorityQueue(func(a, b int) bool { return a < b })
+	if _, ok := q.Pop(); ok {
+		t.Fatal("Pop on an empty queue succeeded")
+	}
+	for _, n := range []int{5, 3, 8} {
+		q.Push(n)
+	}
+	q.PushBatch(1, 9, 2, 7)
+	if head, _ := q.Peek(); head != 1 {
+		t.Fatalf("Peek = %d, want 1", head)
+	}
+	// remove 8 wherever it is in the heap.
+	for i, n := range q.Items() {
+		if n == 8 {
+			q.Remove(i)
+			break
+		}
+	}
+	var got []int
+	for q.Len() > 0 {
+		n, _ := q.Pop()
+		got = append(got, n)
+	}
+	if fmt.Sprint(got) != "[1 2 3 5 7 9]" {
+		t.Fatalf("popped %v", got)
+	}
+}
+
+func TestEnqueueBatch(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	pq.Enqueue("route", NewItem("item5", 5))
+	items := make([]*Item, 0, 10)
+	for _, p := range []int64{3, 9, 1, 7, 5, 2, 8, 4, 6, 0} {
+		items = append(items, NewItem(fmt.Sprintf("item%d", p), p))
+	}
+	pq.EnqueueBatch("route", items)
+	if n := pq.Length("route"); n != 11 {
+		t.Fatalf("Length = %d, want 11", n)
+	}
+	var got []string
+	for _, item := range pq.TryDequeueN("route", 11) {
+		got = append(got, item.Value())
+	}
+	// the items of equal priorities are dequeued in the order they were enqueued.
+	want := "[item9 item8 item7 item6 item5 item5 item4 item3 item2 item1 item0]"
+	if fmt.Sprint(got) != want {
+		t.Fatalf("dequeued %v, want %s", got, want)
+	}
+	if items[0].ID() == 0 || items[0].ID() >= items[1].ID() {
+		t.Fatalf("ids %d, %d are not increasing", items[0].ID(), items[1].ID())
+	}
+}
+
+func benchmarkBulkLoad(b *testing.B, enqueue func(pq *PriorityQueueWithRouting, items []*Item)) {
+	const n = 100000
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		pq := NewPriorityQueueWithRouting()
+		items := make([]*Item, n)
+		for j := range items {
+			items[j] = NewItem("item", int64((j*7919)%n))
+		}
+		b.StartTimer()
+		enqueue(pq, items)
+	}
+}
+
+func BenchmarkEnqueueBulk(b *testing.B) {
+	benchmarkBulkLoad(b, func(pq *PriorityQueueWithRouting, items []*Item) {
+		for _, item := range items {
+			pq.Enqueue("route", item)
+		}
+	})
+	// BenchmarkEnqueueBulk-8   	      28	  40051315 ns/op
+}
+
+func BenchmarkEnqueueBatch(b *testing.B) {
+	benchmarkBulkLoad(b, func(pq *PriorityQueueWithRouting, items []*Item) {
+		pq.EnqueueBatch("route", items)
+	})
+	// BenchmarkEnqueueBatch-8   	      63	  16192261 ns/op
+}
+
+func TestHandoff(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	waiting := func() bool {
+		pq.queueLock.Lock()
+		defer pq.queueLock.Unlock()
+		r, ok := pq.routes["route"]
+		return ok && r.handoff != nil
+	}
+	dequeue := func() <-chan *Item {
+		popped := make(chan *Item, 1)
+		go func() { popped <- pq.Dequeue("route") }()
+		for !waiting() {
+			time.Sleep(time.Millisecond)
+		}
+		return popped
+	}
+
+	// the item pushed for the only consumer is handed over to it.
+	popped := dequeue()
+	pq.Enqueue("route", NewItem("item1", 1))
+	if item := <-popped; item.Value() != "item1" || item.ID() == 0 {
+		t.Fatalf("Dequeue = %q with id %d", item.Value(), item.ID())
+	}
+	if n := pq.Length("route"); n != 0 {
+		t.Fatalf("Length = %d after the handoff", n)
+	}
+	if stats := pq.Accounting(); stats.Pushed != 1 || stats.Popped != 1 {
+		t.Fatalf("accounting = %+v", stats)
+	}
+
+	// a paused route keeps the item until it is resumed.
+	popped = dequeue()
+	pq.Pause("route")
+	pq.Enqueue("route", NewItem("item2", 2))
+	if n := pq.Length("route"); n != 1 {
+		t.Fatalf("Length = %d on the paused route", n)
+	}
+	pq.Resume("route")
+	if item := <-popped; item.Value() != "item2" {
+		t.Fatalf("Dequeue = %q after Resume", item.Value())
+	}
+
+	// a consumer giving up does not lose the next item.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := pq.DequeueContext(ctx, "route")
+		done <- err
+	}()
+	for !waiting() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("DequeueContext = %v, want context.Canceled", err)
+	}
+	pq.Enqueue("route", NewItem("item3", 3))
+	if item, ok := pq.TryDequeue("route"); !ok || item.Value() != "item3" {
+		t.Fatalf("TryDequeue = %v, %v", item, ok)
+	}
+}
+
 func TestPriorityQueue_Pop(t *testing.T) {
 	pq := NewPriorityQueueWithRouting()
 
@@ -115,3 +305,622 @@ func BenchmarkEnqueueDequeue1000(b *testing.B) {
 	benchmarkEnqueueDequeue(b, 1000)
 	// BenchmarkEnqueueDequeue1000-8   	    4462	    270369 ns/op
 }
+
+// benchmarkWakeupLatency measures the time between an Enqueue and the return of
+// the Dequeue waiting for it, and reports its percentiles.
+func benchmarkWakeupLatency(b *testing.B, spin time.Duration) {
+	pq := NewPriorityQueueWithRouting()
+	pq.SetRouteConfig("route", RouteConfig{SpinBudget: spin})
+
+	starts := make([]time.Time, b.N)
+	latencies := make([]time.Duration, b.N)
+	received := make(chan struct{})
+	go func() {
+		for i := 0; i < b.N; i++ {
+			pq.Dequeue("route")
+			latencies[i] = time.Since(starts[i])
+			received <- struct{}{}
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		starts[i] = time.Now()
+		pq.Enqueue("route", &Item{value: "item", priority: 0})
+		<-received
+	}
+	b.StopTimer()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	b.ReportMetric(float64(latencies[len(latencies)*50/100].Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+}
+
+func BenchmarkWakeupLatencyBlocking(b *testing.B) {
+	benchmarkWakeupLatency(b, 0)
+	// BenchmarkWakeupLatencyBlocking   	   20000	       747.4 ns/op	       379.0 p50-ns	      1590 p99-ns
+}
+
+func BenchmarkWakeupLatencySpin(b *testing.B) {
+	benchmarkWakeupLatency(b, 50*time.Microsecond)
+	// BenchmarkWakeupLatencySpin       	   20000	       775.9 ns/op	       280.0 p50-ns	       389.0 p99-ns
+}
+
+func TestPriorityQueue_Spin(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	pq.SetRouteConfig("route", RouteConfig{SpinBudget: time.Millisecond})
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pq.Enqueue("route", &Item{value: "item", priority: 1})
+	}()
+
+	// the item arrives after the spin budget, the dequeue must fall back to blocking.
+	if item := pq.Dequeue("route"); item.value != "item" {
+		t.Errorf("Expected item, got %s", item.value)
+	}
+}
+
+func TestPriorityQueue_DequeueFunc(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	pq.Enqueue("route", &Item{value: "a", priority: 3})
+	pq.Enqueue("route", &Item{value: "b", priority: 1})
+	pq.Enqueue("route", &Item{value: "c", priority: 2})
+
+	odd := func(item *Item) bool { return item.priority%2 == 1 }
+	for _, want := range []string{"a", "b"} {
+		item, err := pq.DequeueFunc(context.Background(), "route", odd)
+		if err != nil || item.value != want {
+			t.Fatalf("Expected %s, got %v, %v", want, item, err)
+		}
+	}
+	if n := pq.Length("route"); n != 1 {
+		t.Errorf("Expected the item c to stay, got length %d", n)
+	}
+
+	// no item matches: the dequeue waits for one.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pq.Enqueue("route", &Item{value: "d", priority: 5})
+	}()
+	if item, err := pq.DequeueFunc(context.Background(), "route", odd); err != nil || item.value != "d" {
+		t.Errorf("Expected d, got %v, %v", item, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := pq.DequeueFunc(ctx, "route", odd); err != context.DeadlineExceeded {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if a := pq.Accounting(); a.Popped != 3 || a.Pending != 1 {
+		t.Errorf("Expected 3 popped and 1 pending, got %+v", a)
+	}
+}
+
+func TestPriorityQueue_Snapshot(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	pq.Enqueue("b", &Item{value: "b1", priority: 1})
+	pq.Enqueue("a", &Item{value: "a1", priority: 1})
+	pq.Enqueue("a", &Item{value: "a2", priority: 2})
+
+	snapshot := pq.Snapshot("a")
+	if len(snapshot) != 2 || snapshot[0].Value() != "a2" || snapshot[0].ID() != 3 || snapshot[1].Value() != "a1" {
+		t.Errorf("Expected a2, a1, got %+v", snapshot)
+	}
+	if n := pq.Length("a"); n != 2 {
+		t.Errorf("Expected the items to stay, got length %d", n)
+	}
+
+	var visited []string
+	pq.ForEach(func(route string, item Item) bool {
+		visited = append(visited, route+"/"+item.Value())
+		// the queue can be used from fn.
+		pq.Enqueue("c", &Item{value: "c1"})
+		return len(visited) < 2
+	})
+	if strings.Join(visited, " ") != "a/a2 a/a1" {
+		t.Errorf("Expected a/a2 a/a1, got %v", visited)
+	}
+}
+
+func TestPriorityQueue_RenameRoute(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	pq.SetRouteConfig("old", RouteConfig{MaxOps: 10})
+
+	popped := make(chan *Item)
+	go func() { popped <- pq.Dequeue("old") }()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := pq.RenameRoute("old", "new", false); err != nil {
+		t.Fatal(err)
+	}
+	if config := pq.RouteConfig("new"); config.MaxOps != 10 {
+		t.Errorf("Expected the config to move, got %+v", config)
+	}
+	pq.Enqueue("new", &Item{value: "item1", priority: 1})
+	if item := <-popped; item.value != "item1" {
+		t.Errorf("Expected item1, got %s", item.value)
+	}
+
+	pq.Enqueue("a", &Item{value: "item2", priority: 1})
+	pq.Enqueue("b", &Item{value: "item3", priority: 1})
+	if err := pq.RenameRoute("a", "b", false); err != ErrRouteExists {
+		t.Errorf("Expected ErrRouteExists, got %v", err)
+	}
+	go func() { popped <- pq.Dequeue("a") }()
+	time.Sleep(10 * time.Millisecond)
+	if err := pq.RenameRoute("a", "b", true); err != nil {
+		t.Fatal(err)
+	}
+	// the consumer blocked on a follows its items to b.
+	if item := <-popped; item.value != "item2" {
+		t.Errorf("Expected item2, got %s", item.value)
+	}
+	if n := pq.Length("b"); n != 0 {
+		t.Errorf("Expected item3 to be replaced, got %d items in b", n)
+	}
+	if err := pq.RenameRoute("missing", "b", true); err != ErrNoSuchRoute {
+		t.Errorf("Expected ErrNoSuchRoute, got %v", err)
+	}
+}
+
+func TestPriorityQueue_UpdatePriority(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	low := &Item{value: "low", priority: 1}
+	pq.Enqueue("a", low)
+	pq.Enqueue("a", &Item{value: "high", priority: 5})
+	if err := pq.RenameRoute("a", "b", false); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, feed, _ := pq.subscribe(10)
+	defer pq.unsubscribe(feed)
+	follower := NewPriorityQueueWithRouting()
+	for _, op := range snapshot {
+		follower.apply(op)
+	}
+
+	if err := pq.UpdatePriority(low.ID(), 10); err != nil {
+		t.Fatal(err)
+	}
+	// the change is replicated as a single operation, keeping the identifier of the item.
+	if len(feed.ops) != 1 {
+		t.Fatalf("Expected a single operation, got %d", len(feed.ops))
+	}
+	follower.apply(<-feed.ops)
+	if item, _ := follower.TryDequeue("b"); item.value != "low" || item.priority != 10 || item.id != low.ID() {
+		t.Errorf("Expected the follower to boost the item, got %v", item)
+	}
+	if acc := follower.Accounting(); acc.Pushed != 2 {
+		t.Errorf("Expected 2 items pushed on the follower, got %d", acc.Pushed)
+	}
+	if item := pq.Dequeue("b"); item.value != "low" || item.priority != 10 {
+		t.Errorf("Expected the boosted item first, got %s with priority %d", item.value, item.priority)
+	}
+	if err := pq.UpdatePriority(low.ID(), 1); err != ErrNoSuchItem {
+		t.Errorf("Expected ErrNoSuchItem for a popped item, got %v", err)
+	}
+}
+
+func TestPriorityQueue_RouteStats(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	pq.Enqueue("jobs", &Item{value: "a", priority: 3})
+	pq.Enqueue("jobs", &Item{value: "b", priority: -1})
+	pq.Enqueue("jobs", &Item{value: "c", priority: 7})
+	pq.Dequeue("jobs")
+
+	stats := pq.RouteStats("jobs")
+	if stats.Enqueued != 3 || stats.Dequeued != 1 || stats.Length != 2 {
+		t.Errorf("Expected 3 enqueued, 1 dequeued and 2 items, got %+v", stats)
+	}
+	if stats.MaxPriority != 3 || stats.MinPriority != -1 {
+		t.Errorf("Expected priorities from -1 to 3, got %+v", stats)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pq.Dequeue("empty")
+		close(done)
+	}()
+	for pq.RouteStats("empty").Blocked != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	pq.Enqueue("empty", &Item{value: "d", priority: 1})
+	<-done
+	if stats := pq.RouteStats("empty"); stats.Blocked != 0 {
+		t.Errorf("Expected no blocked consumer, got %+v", stats)
+	}
+}
+
+func TestPriorityQueue_Blocked(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	if err := pq.CreateGroup("jobs", "workers"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		pq.DequeueGroup(ctx, "jobs", "workers", "w1")
+	}()
+	go func() {
+		defer wg.Done()
+		pq.DequeueAny(ctx, "jobs", "mail")
+	}()
+	go func() {
+		defer wg.Done()
+		pq.DequeueContext(ctx, "mail")
+	}()
+	for pq.Blocked("jobs") != 2 || pq.Blocked("mail") != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if got := pq.blockedRoutes(); len(got) != 2 {
+		t.Errorf("Expected 2 routes with blocked consumers, got %v", got)
+	}
+	cancel()
+	wg.Wait()
+	if n := pq.Blocked("jobs"); n != 0 {
+		t.Errorf("Expected no blocked consumer, got %d", n)
+	}
+	if n := pq.Blocked("nosuch"); n != 0 {
+		t.Errorf("Expected no blocked consumer on a missing route, got %d", n)
+	}
+}
+
+func TestPriorityQueue_CollectRoutes(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	pq.Enqueue("empty", &Item{value: "a"})
+	pq.Dequeue("empty")
+	pq.Enqueue("full", &Item{value: "b"})
+	pq.SetRouteConfig("configured", RouteConfig{Order: OrderAsc})
+	if err := pq.CreateGroup("grouped", "workers"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pq.DequeueContext(ctx, "waiting")
+		close(done)
+	}()
+	for pq.Blocked("waiting") != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := pq.CollectRoutes(time.Hour); n != 0 {
+		t.Errorf("Expected no route idle for an hour, got %d", n)
+	}
+	if n := pq.CollectRoutes(0); n != 1 {
+		t.Errorf("Expected the empty route to be removed, got %d", n)
+	}
+	if _, ok := pq.routes["empty"]; ok {
+		t.Error("Expected the empty route to be removed")
+	}
+
+	cancel()
+	<-done
+	if n := pq.CollectRoutes(0); n != 1 {
+		t.Errorf("Expected the route without consumers to be removed, got %d", n)
+	}
+	pq.Enqueue("empty", &Item{value: "c"})
+	if item, ok := pq.TryDequeue("empty"); !ok || item.Value() != "c" {
+		t.Errorf("Expected a removed route to be usable again, got %v", item)
+	}
+}
+
+func TestPriorityQueue_TieBreak(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	for _, value := range []string{"a", "b", "c", "d", "e"} {
+		pq.Enqueue("route", &Item{value: value, priority: 1})
+	}
+	pq.Enqueue("route", &Item{value: "first", priority: 2})
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, pq.Dequeue("route").value)
+	}
+	pq.SetRouteConfig("route", RouteConfig{LIFO: true})
+	for i := 0; i < 3; i++ {
+		got = append(got, pq.Dequeue("route").value)
+	}
+	if want := "first a b e d c"; strings.Join(got, " ") != want {
+		t.Errorf("Expected %q, got %q", want, strings.Join(got, " "))
+	}
+}
+
+func TestPriorityQueue_Overflow(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	pq.SetOverflowDir(t.TempDir())
+	pq.SetRouteConfig("route", RouteConfig{MaxInMemory: 2})
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		// interleave hot and cold items, so that both memory and disk are merged on dequeue.
+		item := &Item{value: fmt.Sprint(i), priority: int64((i * 37) % n)}
+		item.SetHeader("value", item.value)
+		pq.Enqueue("route", item)
+	}
+	pq.queueLock.Lock()
+	inMemory, segments := pq.routes["route"].queue.Len(), len(pq.routes["route"].segments)
+	pq.queueLock.Unlock()
+	if inMemory >= 4 || segments == 0 || segments > maxSegments {
+		t.Errorf("Expected at most 4 items in memory and some segments, got %d items and %d segments", inMemory, segments)
+	}
+	if length := pq.Length("route"); length != n {
+		t.Errorf("Expected %d items, got %d", n, length)
+	}
+	if got := pq.Range("route", 0, 0); len(got) != 1 || got[0].priority != n-1 {
+		t.Errorf("Expected the range to include paged items, got %v", got)
+	}
+
+	for want := int64(n - 1); want >= 0; want-- {
+		item := pq.Dequeue("route")
+		if item.priority != want {
+			t.Fatalf("Expected priority %d, got %d", want, item.priority)
+		}
+		if item.Header("value") != item.value {
+			t.Fatalf("Expected the headers to be paged with the item, got %v", item.headers)
+		}
+		if want == n/2 {
+			// reordering the route moves the paged items back to memory.
+			pq.SetRouteConfig("route", RouteConfig{MaxInMemory: 2, Order: OrderAsc})
+			pq.SetRouteConfig("route", RouteConfig{MaxInMemory: 2})
+		}
+	}
+	if err := pq.Accounting().Check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPriorityQueue_ReplicaOverflow(t *testing.T) {
+	leader := NewPriorityQueueWithRouting()
+	leader.SetRouteConfig("route", RouteConfig{MaxInMemory: 2})
+	snapshot, feed, _ := leader.subscribe(1000)
+	defer leader.unsubscribe(feed)
+	follower := NewPriorityQueueWithRouting()
+	follower.SetOverflowDir(t.TempDir())
+	for _, op := range snapshot {
+		follower.apply(op)
+	}
+	replicate := func() {
+		for len(feed.ops) > 0 {
+			follower.apply(<-feed.ops)
+		}
+	}
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		leader.Enqueue("route", NewItem(fmt.Sprint(i), int64(i%5)))
+	}
+	replicate()
+	follower.queueLock.Lock()
+	segments := len(follower.routes["route"].segments)
+	follower.queueLock.Unlock()
+	if segments == 0 {
+		t.Fatal("Expected the follower to page items")
+	}
+
+	// the items popped by the leader are removed by the follower, paged or not.
+	for i := 0; i < n-1; i++ {
+		leader.TryDequeue("route")
+	}
+	replicate()
+	want, _ := leader.TryDequeue("route")
+	if got := follower.Length("route"); got != 1 {
+		t.Fatalf("Expected 1 item on the follower, got %d", got)
+	}
+	if got, _ := follower.TryDequeue("route"); got.value != want.value || got.id != want.id {
+		t.Errorf("Expected the follower to keep %v, got %v", want, got)
+	}
+	if err := follower.Accounting().Check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPriorityQueue_ReplicaReset(t *testing.T) {
+	follower := NewPriorityQueueWithRouting()
+	follower.SetRouteConfig("route", RouteConfig{Delivery: DeliveryAtLeastOnce, MaxLength: 10})
+	follower.Enqueue("route", NewItem("a", 1))
+	follower.Enqueue("route", NewItem("b", 2))
+	if _, ok := follower.TryDequeue("route"); !ok {
+		t.Fatal("Expected an item")
+	}
+
+	// a new snapshot starts with a reset, and sets the routes which differ from the defaults.
+	follower.apply(queueOp{kind: opReset})
+	if got := follower.RouteConfig("route"); got != (RouteConfig{}) {
+		t.Errorf("Expected the default settings after the reset, got %+v", got)
+	}
+	if got := follower.Length("route"); got != 0 {
+		t.Errorf("Expected no item after the reset, got %d", got)
+	}
+	accounting := follower.Accounting()
+	if accounting.Inflight != 0 {
+		t.Errorf("Expected no reserved item after the reset, got %d", accounting.Inflight)
+	}
+	if err := accounting.Check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPriorityQueue_CronJobs(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		tm, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	for _, tt := range []struct {
+		spec, from, want string
+	}{
+		{"*/5 * * * *", "2026-01-01 00:03", "2026-01-01 00:05"},
+		{"*/5 * * * *", "2026-01-01 00:05", "2026-01-01 00:10"},
+		{"0 9 * * 1-5", "2026-01-03 10:00", "2026-01-05 09:00"},
+		{"0 0 1 * 0", "2026-01-01 00:00", "2026-01-04 00:00"},
+		{"15,45 */6 * 3 *", "2026-01-01 00:00", "2026-03-01 00:15"},
+		{"30 12 29 2 *", "2026-01-01 00:00", "2028-02-29 12:30"},
+	} {
+		schedule, err := parseCronSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		if got := schedule.next(at(tt.from)); !got.Equal(at(tt.want)) {
+			t.Errorf("%q after %s: got %s, want %s", tt.spec, tt.from, got, tt.want)
+		}
+	}
+	for _, spec := range []string{"60 * * * *", "* * *", "*/0 * * * *", "5-1 * * * *", "* * 0 * *"} {
+		if _, err := parseCronSchedule(spec); err != errCronSpec {
+			t.Errorf("%q: got %v, want errCronSpec", spec, err)
+		}
+	}
+
+	pq := NewPriorityQueueWithRouting()
+	if err := pq.AddCronJob(CronJob{Name: "never", Spec: "0 0 30 2 *", Route: "jobs"}); err != errCronNever {
+		t.Errorf("Expected errCronNever, got %v", err)
+	}
+	pq.SetClock(khronostest.NewClock(at("2026-01-01 00:30")))
+	if err := pq.AddCronJob(CronJob{Name: "hourly", Spec: "0 * * * *", Route: "jobs", Value: "tick"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := pq.runCron(at("2026-01-01 00:59"), true); n != 0 {
+		t.Errorf("Expected no job to run before the hour, got %d", n)
+	}
+	// the runs missed in the meantime are made once.
+	if n := pq.runCron(at("2026-01-01 03:10"), true); n != 1 || pq.Length("jobs") != 1 {
+		t.Errorf("Expected a single run, got %d runs and %d items", n, pq.Length("jobs"))
+	}
+	if jobs := pq.CronJobs(); len(jobs) != 1 || !jobs[0].Next.Equal(at("2026-01-01 04:00")) {
+		t.Errorf("unexpected jobs %v", jobs)
+	}
+	if !pq.DeleteCronJob("hourly") || pq.DeleteCronJob("hourly") {
+		t.Error("Expected the job to be deleted once")
+	}
+}
+
+func TestPriorityQueue_Pause(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	pq.Enqueue("jobs", NewItem("a", 1))
+	pq.Pause("jobs")
+	if !pq.Paused("jobs") {
+		t.Fatal("Expected the route to be paused")
+	}
+	if _, ok := pq.TryDequeue("jobs"); ok {
+		t.Fatal("Expected no item from a paused route")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := pq.DequeueFunc(ctx, "jobs", func(*Item) bool { return true }); err != context.DeadlineExceeded {
+		t.Fatalf("Expected no matching item from a paused route, got %v", err)
+	}
+
+	got := make(chan *Item)
+	go func() {
+		item, _ := pq.DequeueContext(context.Background(), "jobs")
+		got <- item
+	}()
+	pq.Enqueue("jobs", NewItem("b", 2))
+	select {
+	case item := <-got:
+		t.Fatalf("Expected the consumer to stay blocked, got %s", item.value)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if n := pq.Length("jobs"); n != 2 {
+		t.Errorf("Expected the pushes to be accepted, got %d items", n)
+	}
+
+	if !pq.Resume("jobs") || pq.Resume("jobs") {
+		t.Error("Expected the route to be resumed once")
+	}
+	if item := <-got; item.value != "b" {
+		t.Errorf("Expected b, got %s", item.value)
+	}
+}
+
+func TestPriorityQueue_EnqueueContext(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	pq.SetRouteConfig("jobs", RouteConfig{MaxLength: 2})
+	ctx := context.Background()
+
+	for _, value := range []string{"a", "b"} {
+		if err := pq.EnqueueContext(ctx, "jobs", NewItem(value, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pq.EnqueueContext(ctx, "jobs", NewItem("c", 1)); err != ErrRouteFull {
+		t.Fatalf("Expected ErrRouteFull, got %v", err)
+	}
+	if pq.TryEnqueue("jobs", NewItem("c", 1)) {
+		t.Fatal("Expected TryEnqueue to fail on a full route")
+	}
+	// Enqueue ignores the maximum length.
+	pq.Enqueue("jobs", NewItem("c", 1))
+
+	pq.UpdateRouteConfig("jobs", func(c *RouteConfig) error {
+		c.OnFull = FullBlock
+		return nil
+	})
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := pq.EnqueueContext(timeout, "jobs", NewItem("d", 1)); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the producer to give up, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- pq.EnqueueContext(ctx, "jobs", NewItem("d", 1)) }()
+	pq.Dequeue("jobs")
+	select {
+	case err := <-done:
+		t.Fatalf("Expected the producer to block while the route is full, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	pq.Dequeue("jobs")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := pq.Length("jobs"); n != 2 {
+		t.Errorf("Expected 2 items, got %d", n)
+	}
+}
+
+func TestPriorityQueue_Watermarks(t *testing.T) {
+	pq := NewPriorityQueueWithRouting()
+	events := pq.enableEvents(16)
+	pq.SetRouteConfig("jobs", RouteConfig{HighWatermark: 3, LowWatermark: 1})
+
+	next := func() Event {
+		t.Helper()
+		for {
+			select {
+			case e := <-events:
+				if e.Kind&(EventHighWatermark|EventLowWatermark) != 0 {
+					return e
+				}
+			default:
+				return Event{}
+			}
+		}
+	}
+	for i := 0; i < 4; i++ {
+		pq.Enqueue("jobs", NewItem("a", 1))
+	}
+	if e := next(); e.Kind != EventHighWatermark || e.Route != "jobs" || e.Length != 3 {
+		t.Errorf("Expected a high watermark event at 3 items, got %+v", e)
+	}
+	if above := pq.AboveHighWatermark(); above["jobs"] != 4 {
+		t.Errorf("Expected the route above its high watermark, got %v", above)
+	}
+	pq.Dequeue("jobs")
+	pq.Dequeue("jobs")
+	if e := next(); e.Kind != 0 {
+		t.Errorf("Expected no event above the low watermark, got %+v", e)
+	}
+	pq.Dequeue("jobs")
+	if e := next(); e.Kind != EventLowWatermark || e.Length != 1 {
+		t.Errorf("Expected a low watermark event at 1 item, got %+v", e)
+	}
+	if above := pq.AboveHighWatermark(); len(above) != 0 {
+		t.Errorf("Expected no route above its high watermark, got %v", above)
+	}
+}
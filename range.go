@@ -0,0 +1,234 @@
+package khronos
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Range returns copies of the items of the route ranked from start to stop, both included,
+// in the order they would be dequeued, without removing them.
+// Negative ranks count from the end, -1 being the last item.
+func (pq *PriorityQueueWithRouting) Range(route string, start, stop int) []*Item {
+	return rankRange(pq.sortedItems(route, nil), start, stop)
+}
+
+// sortedItems returns copies of the items of the route in dequeue order,
+// only those after the cursor if it is not nil.
+func (pq *PriorityQueueWithRouting) sortedItems(route string, after *rangeCursor) []*Item {
+	pq.queueLock.Lock()
+	r, ok := pq.routes[route]
+	var items []*Item
+	var config RouteConfig
+	if ok {
+		config = r.config
+		var err error
+		if items, err = r.copyItems(after); err != nil {
+			pq.overflowFailed()
+		}
+	}
+	pq.queueLock.Unlock()
+
+	sortItems(config, items)
+	return items
+}
+
+// copyItems returns copies of the items of the route, only those after the cursor if it is not nil,
+// and the error reading its paged items, see spilledItems.
+// It must be called with queueLock held.
+func (r *route) copyItems(after *rangeCursor) ([]*Item, error) {
+	items := make([]*Item, 0, r.size())
+	spilled, err := r.spilledItems()
+	for _, item := range append(spilled, r.queue.Items()...) {
+		c := item.Clone()
+		c.id, c.enqueued = item.id, item.enqueued
+		if after == nil || r.config.before(&Item{priority: after.priority, id: after.id}, c) {
+			items = append(items, c)
+		}
+	}
+	return items, err
+}
+
+// sortItems sorts the items in the dequeue order of a route with the given settings.
+func sortItems(config RouteConfig, items []*Item) {
+	sort.Slice(items, func(i, j int) bool {
+		return config.before(items[i], items[j])
+	})
+}
+
+// Snapshot returns copies of the items of the route in the order they would be dequeued,
+// without removing them.
+func (pq *PriorityQueueWithRouting) Snapshot(route string) []Item {
+	items := pq.sortedItems(route, nil)
+	snapshot := make([]Item, len(items))
+	for i, item := range items {
+		snapshot[i] = *item
+	}
+	return snapshot
+}
+
+// ForEach calls fn with a copy of every item of the queue, route by route in increasing name
+// and in dequeue order within a route, until fn returns false.
+// The items are copied at once under the lock, so that fn sees a consistent state of the queue
+// and may use the queue without deadlocking. The items held by the consumer groups are left out.
+func (pq *PriorityQueueWithRouting) ForEach(fn func(route string, item Item) bool) {
+	pq.queueLock.Lock()
+	names := make([]string, 0, len(pq.routes))
+	for _, name := range sortedKeys(pq.routes) {
+		if !isGroupRoute(name) {
+			names = append(names, name)
+		}
+	}
+	configs := make([]RouteConfig, len(names))
+	items := make([][]*Item, len(names))
+	for i, name := range names {
+		r := pq.routes[name]
+		var err error
+		if items[i], err = r.copyItems(nil); err != nil {
+			pq.overflowFailed()
+		}
+		configs[i] = r.config
+	}
+	pq.queueLock.Unlock()
+
+	for i, name := range names {
+		sortItems(configs[i], items[i])
+		for _, item := range items[i] {
+			if !fn(name, *item) {
+				return
+			}
+		}
+	}
+}
+
+// rankRange returns items[start:stop+1] with the range semantics of Range.
+func rankRange(items []*Item, start, stop int) []*Item {
+	n := len(items)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return nil
+	}
+	return items[start : stop+1]
+}
+
+// rangeCursor is the position of the last item returned by a page of "range ... after".
+type rangeCursor struct {
+	priority int64
+	id       uint64
+}
+
+func (c rangeCursor) String() string {
+	return strconv.FormatInt(c.priority, 10) + ":" + strconv.FormatUint(c.id, 10)
+}
+
+// parseRangeCursor parses a cursor, "0" meaning the start of the route.
+func parseRangeCursor(s string) (*rangeCursor, error) {
+	if s == "0" {
+		return nil, nil
+	}
+	priority, id, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, errInvalidCursor
+	}
+	var c rangeCursor
+	var err error
+	if c.priority, err = strconv.ParseInt(priority, 10, 64); err != nil {
+		return nil, errInvalidCursor
+	}
+	if c.id, err = strconv.ParseUint(id, 10, 64); err != nil {
+		return nil, errInvalidCursor
+	}
+	return &c, nil
+}
+
+// RangeCommand is the command "range".
+// "range <route> <start> <stop> [withscores]" replies with the values of the items ranked from start to stop
+// in dequeue order, without removing them, and with their priorities if "withscores" is given.
+//
+// For large routes, "range <route> <start> <stop> [withscores] after <cursor>" pages through the route:
+// the ranks count from the item after the cursor, and the reply starts with the cursor of the next page,
+// "0" once the end of the route is reached. The first page is requested with the cursor "0".
+// Unlike ranks, cursors are not shifted when items are popped between two pages.
+type RangeCommand struct {
+	ArgsCommand
+}
+
+func (c *RangeCommand) Name() string {
+	return "range"
+}
+
+func (c *RangeCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	route := args[0]
+	start, err := strconv.Atoi(args[1])
+	if err != nil {
+		return errNotInteger
+	}
+	stop, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errNotInteger
+	}
+	var withScores, paged bool
+	var after *rangeCursor
+	for i := 3; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "withscores":
+			withScores = true
+		case "after":
+			if i+1 == len(args) {
+				return errSyntax
+			}
+			i++
+			if after, err = parseRangeCursor(args[i]); err != nil {
+				return err
+			}
+			paged = true
+		default:
+			return errSyntax
+		}
+	}
+
+	all := PqFromContext(ctx).sortedItems(route, after)
+	items := rankRange(all, start, stop)
+	var reply []string
+	if paged {
+		next := "0"
+		if len(items) > 0 && items[len(items)-1] != all[len(all)-1] {
+			last := items[len(items)-1]
+			next = rangeCursor{priority: last.priority, id: last.id}.String()
+		}
+		reply = append(reply, next)
+	}
+	for _, item := range items {
+		reply = append(reply, item.value)
+		if withScores {
+			reply = append(reply, strconv.FormatInt(item.priority, 10))
+		}
+	}
+	return writer.WriteArray(reply)
+}
+
+func NewRangeCommand(args []string) (Command, error) {
+	if len(args) < 3 {
+		return nil, &WrongArityError{"range"}
+	}
+	cmd := &RangeCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["range"] = NewRangeCommand
+}
@@ -0,0 +1,106 @@
+package khronos
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned when Server.RateLimiter refuses a command.
+var ErrRateLimited = errors.New("RATELIMIT too many requests")
+
+// RateLimiter decides whether a client may execute a command.
+// It is consulted by the server before every command.
+type RateLimiter interface {
+	// Allow reports whether the client at addr, the IP address of the connection,
+	// may execute the named command now.
+	Allow(addr, command string) bool
+}
+
+// RateLimitKey selects what a TokenBucketLimiter keeps a bucket for.
+type RateLimitKey int
+
+const (
+	// RateLimitByAddr limits each client address.
+	RateLimitByAddr RateLimitKey = iota
+	// RateLimitByCommand limits each command, for all the clients together.
+	RateLimitByCommand
+	// RateLimitByAddrAndCommand limits each command of each client address.
+	RateLimitByAddrAndCommand
+)
+
+// maxIdleBuckets is the number of buckets a TokenBucketLimiter holds before it forgets the full ones.
+const maxIdleBuckets = 10000
+
+// TokenBucketLimiter is a RateLimiter allowing Rate commands per second with bursts of Burst commands,
+// for each key selected by Key.
+type TokenBucketLimiter struct {
+	Rate  float64
+	Burst int
+	Key   RateLimitKey
+
+	// Clock is the source of time of the limiter, SystemClock if nil.
+	Clock Clock
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// NewTokenBucketLimiter returns a TokenBucketLimiter allowing rate commands per second
+// with bursts of burst commands for each key.
+func NewTokenBucketLimiter(rate float64, burst int, key RateLimitKey) *TokenBucketLimiter {
+	return &TokenBucketLimiter{Rate: rate, Burst: burst, Key: key}
+}
+
+// Allow implements RateLimiter.
+func (l *TokenBucketLimiter) Allow(addr, command string) bool {
+	var key string
+	switch l.Key {
+	case RateLimitByAddr:
+		key = addr
+	case RateLimitByCommand:
+		key = command
+	default:
+		key = addr + " " + command
+	}
+	clock := l.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	now := clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.forgetFull(now)
+		}
+		bucket = newTokenBucket(l.Rate, float64(l.Burst), now)
+		l.buckets[key] = bucket
+	}
+	return bucket.take(now)
+}
+
+// forgetFull removes the buckets which refilled completely, they are the same as new ones.
+// It must be called with l.mu held.
+func (l *TokenBucketLimiter) forgetFull(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate >= bucket.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientIP returns the IP address of a connection, or its whole address if it has no port.
+func clientIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,76 @@
+package khronos
+
+import (
+	"errors"
+)
+
+// ErrReadOnlyReplica is returned for the commands changing the queue of a follower, see Server.ReplicaReadOnly.
+var ErrReadOnlyReplica = errors.New("READONLY You can't write against a read only replica")
+
+// ReplicaPopPolicy is what a read-only follower does with the commands consuming items, see Server.ReplicaPops.
+type ReplicaPopPolicy int
+
+const (
+	// ReplicaPopsAllow serves the pops from the queue of the follower, it is the default.
+	// The items popped from a follower are still delivered by the leader.
+	ReplicaPopsAllow ReplicaPopPolicy = iota
+	// ReplicaPopsRefuse refuses the pops with ErrReadOnlyReplica.
+	ReplicaPopsRefuse
+	// ReplicaPopsRedirect redirects the pops to the leader with "-MOVED <leader>", as after a failover.
+	ReplicaPopsRedirect
+)
+
+func (p ReplicaPopPolicy) String() string {
+	switch p {
+	case ReplicaPopsRefuse:
+		return "refuse"
+	case ReplicaPopsRedirect:
+		return "redirect"
+	}
+	return "allow"
+}
+
+// consumerCommands are the commands consuming items, whose handling by a read-only follower
+// is set by Server.ReplicaPops.
+var consumerCommands = map[string]bool{
+	"pop":     true,
+	"popn":    true,
+	"popdue":  true,
+	"confirm": true,
+	"touch":   true,
+	"retry":   true,
+	"claim":   true,
+	"xack":    true,
+	// the list commands, see RegisterListCommands.
+	"lpop":  true,
+	"rpop":  true,
+	"blpop": true,
+	"brpop": true,
+	// the sorted set commands, see RegisterSortedSetCommands.
+	"zpopmax":  true,
+	"bzpopmax": true,
+}
+
+// refuseReplicaWrite returns an error if the server is a read-only follower and the command
+// changes the queue, see Server.ReplicaReadOnly.
+func (srv *Server) refuseReplicaWrite(name string) error {
+	if !srv.ReplicaReadOnly || commandInfos[name].Flags&FlagWrite == 0 {
+		return nil
+	}
+	srv.repl.mu.Lock()
+	leader := srv.repl.leader
+	srv.repl.mu.Unlock()
+	if leader == "" {
+		return nil
+	}
+	if !consumerCommands[name] {
+		return ErrReadOnlyReplica
+	}
+	switch srv.ReplicaPops {
+	case ReplicaPopsRefuse:
+		return ErrReadOnlyReplica
+	case ReplicaPopsRedirect:
+		return &movedError{leader}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package khronos
+
+import (
+	"context"
+	"strconv"
+)
+
+// Remove removes the pending item with the given identifier from the route, see Item.ID.
+// It reports whether the item was found on this route.
+func (pq *PriorityQueueWithRouting) Remove(route string, id uint64) bool {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	item, ok := pq.items[id]
+	if !ok {
+		return false
+	}
+	r := item.route.resolve()
+	if r.name != route {
+		return false
+	}
+	pq.removeItem(r, item)
+	pq.accounting.Dropped++
+	return true
+}
+
+// RemoveValue removes the pending items with the given value from the route,
+// in memory or paged, and returns the number of removed items.
+func (pq *PriorityQueueWithRouting) RemoveValue(route, value string) int {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r, ok := pq.routes[route]
+	if !ok {
+		return 0
+	}
+	if len(r.segments) > 0 {
+		// the segments are sorted files, so the paged matches are brought back to memory
+		// and the rest of the items is paged again below.
+		spilled, err := r.spilledItems()
+		if err != nil {
+			pq.overflowFailed()
+		}
+		if err != nil || hasValue(spilled, value) {
+			pq.unspill(r)
+			defer pq.spill(r)
+		}
+	}
+	var matches []*Item
+	for _, item := range r.queue.Items() {
+		if item.value == value {
+			matches = append(matches, item)
+		}
+	}
+	for _, item := range matches {
+		pq.removeItem(r, item)
+	}
+	pq.accounting.Dropped += uint64(len(matches))
+	return len(matches)
+}
+
+// hasValue reports whether one of the items has the value.
+func hasValue(items []*Item, value string) bool {
+	for _, item := range items {
+		if item.value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// removeItem removes a queued item from its route.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) removeItem(r *route, item *Item) {
+	r.take(item.index)
+	pq.forget(item)
+	r.wakeProducers()
+	pq.watermark(r)
+	pq.emit(deleteOp(r.name, item))
+}
+
+// RemoveCommand is the command "remove".
+// "remove <route> <id>" removes the pending item with the identifier returned by push,
+// and replies 1, or 0 if the item is not queued on this route.
+type RemoveCommand struct {
+	ArgsCommand
+}
+
+func (c *RemoveCommand) Name() string {
+	return "remove"
+}
+
+func (c *RemoveCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	id, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	if PqFromContext(ctx).Remove(args[0], id) {
+		return writer.WriteInt64(1)
+	}
+	return writer.WriteInt64(0)
+}
+
+func NewRemoveCommand(args []string) (Command, error) {
+	if len(args) != 2 {
+		return nil, &WrongArityError{"remove"}
+	}
+	cmd := &RemoveCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+// RemoveValueCommand is the command "removevalue".
+// "removevalue <route> <value>" removes the pending items with the value and replies their number.
+type RemoveValueCommand struct {
+	ArgsCommand
+}
+
+func (c *RemoveValueCommand) Name() string {
+	return "removevalue"
+}
+
+func (c *RemoveValueCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	return writer.WriteInt64(int64(PqFromContext(ctx).RemoveValue(args[0], args[1])))
+}
+
+func NewRemoveValueCommand(args []string) (Command, error) {
+	if len(args) != 2 {
+		return nil, &WrongArityError{"removevalue"}
+	}
+	cmd := &RemoveValueCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["remove"] = NewRemoveCommand
+	commandLibraries["removevalue"] = NewRemoveValueCommand
+}
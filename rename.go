@@ -0,0 +1,142 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrNoSuchRoute is returned when an operation requires a route which does not exist.
+	ErrNoSuchRoute = errors.New("ERR no such route")
+	// ErrRouteExists is returned when renaming a route to the name of a route which has items.
+	ErrRouteExists = errors.New("ERR target route already exists")
+)
+
+// RenameRoute atomically moves the items, the settings and the blocked consumers of
+// the route oldName to newName.
+// If newName already has items, RenameRoute fails with ErrRouteExists, unless replace is true,
+// in which case they are discarded; the consumers blocked on newName keep waiting on it.
+func (pq *PriorityQueueWithRouting) RenameRoute(oldName, newName string, replace bool) error {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	return pq.rename(oldName, newName, replace)
+}
+
+// rename implements RenameRoute.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) rename(oldName, newName string, replace bool) error {
+	src, ok := pq.routes[oldName]
+	if !ok {
+		return ErrNoSuchRoute
+	}
+	if oldName == newName {
+		return nil
+	}
+	dst, ok := pq.routes[newName]
+	if ok && dst.size() > 0 && !replace {
+		return ErrRouteExists
+	}
+
+	delete(pq.routes, oldName)
+	pq.indexRoute(oldName, nil)
+	if !ok {
+		src.name = newName
+		pq.routes[newName] = src
+		pq.indexRoute(newName, src)
+	} else {
+		for _, item := range dst.queue.Items() {
+			pq.forget(item)
+		}
+		pq.accounting.Dropped += uint64(dst.size())
+		dst.dropSegments()
+		dst.queue.items, dst.config, dst.bucket = src.queue.items, src.config, src.bucket
+		dst.aboveHigh, src.aboveHigh = src.aboveHigh, false
+		dst.enqueued, dst.dequeued = src.enqueued, src.dequeued
+		dst.segments, dst.spilled = src.segments, src.spilled
+		dst.groups, src.groups = src.groups, nil
+		dst.total.add(src.memory - dst.memory)
+		dst.memory, src.memory = src.memory, 0
+		src.queue.items, src.segments, src.spilled, src.moved = nil, nil, 0, dst
+		// the consumers blocked on the source wake up and follow it to the target.
+		src.signal()
+		src.notFull.Broadcast()
+	}
+	pq.emit(queueOp{kind: opRename, route: oldName, value: newName})
+	pq.wake(pq.routes[newName])
+	return nil
+}
+
+// RenameRouteCommand is the command "renameroute".
+// "renameroute <old> <new> [replace]" renames a route without draining it,
+// the consumers blocked on the old name are moved to the new one.
+// It fails if the new route has items, unless "replace" is given.
+type RenameRouteCommand struct {
+	ArgsCommand
+}
+
+func (c *RenameRouteCommand) Name() string {
+	return "renameroute"
+}
+
+func (c *RenameRouteCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	replace := false
+	if len(args) == 3 {
+		if !strings.EqualFold(args[2], "replace") {
+			return errSyntax
+		}
+		replace = true
+	} else if len(args) != 2 {
+		return &WrongArityError{c.Name()}
+	}
+	pq := PqFromContext(ctx)
+	if err := pq.RenameRoute(args[0], args[1], replace); err != nil {
+		return err
+	}
+	return writer.WriteStatus(OK)
+}
+
+func NewRenameRouteCommand(args []string) (Command, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, &WrongArityError{"renameroute"}
+	}
+	cmd := &RenameRouteCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+// RenameCommand is the command "rename".
+// "rename <old> <new>" renames a route like the Redis RENAME, the items of the new route,
+// if any, are discarded: it is "renameroute <old> <new> replace".
+// The settings of the route and the consumers blocked on the old name go with its items.
+type RenameCommand struct {
+	ArgsCommand
+}
+
+func (c *RenameCommand) Name() string {
+	return "rename"
+}
+
+func (c *RenameCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	if err := PqFromContext(ctx).RenameRoute(args[0], args[1], true); err != nil {
+		return err
+	}
+	return writer.WriteStatus(OK)
+}
+
+func NewRenameCommand(args []string) (Command, error) {
+	if len(args) != 2 {
+		return nil, &WrongArityError{"rename"}
+	}
+	cmd := &RenameCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["renameroute"] = NewRenameRouteCommand
+	commandLibraries["rename"] = NewRenameCommand
+}
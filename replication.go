@@ -0,0 +1,429 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// replicationBacklog is the number of operations a replica may fall behind before it is dropped.
+	replicationBacklog = 1 << 14
+	// replicationRetryInterval is how long a replica waits before reconnecting to its leader.
+	replicationRetryInterval = time.Second
+)
+
+var errReplicaTooSlow = errors.New("ERR replica can not keep up with the replication stream")
+
+// replication holds the replication state of a server.
+// A server is either a leader, streaming its operations to the replicas connected with the "sync" command,
+// or a follower of another server.
+type replication struct {
+	once     sync.Once
+	mu       sync.Mutex
+	leader   string             // address of the leader, empty if the server is a leader.
+	cancel   context.CancelFunc // stops following the leader.
+	linkUp   bool               // whether the follower is in sync with its leader.
+	replicas int32              // number of replicas following this server.
+	movedTo  string             // leader the clients are redirected to after a failover, see "failover".
+
+	acks  map[*opFeed]uint64 // offset of the queue acknowledged by each replica, see "wait".
+	acked chan struct{}      // closed when a replica acknowledges operations.
+}
+
+// track starts tracking the acknowledgments of the replica streaming feed.
+func (r *replication) track(feed *opFeed) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.acks == nil {
+		r.acks = make(map[*opFeed]uint64)
+	}
+	r.acks[feed] = 0
+}
+
+func (r *replication) untrack(feed *opFeed) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.acks, feed)
+}
+
+// readAcks reads the "replconf ack <n>" frames sent by a replica, n being the number of operations
+// it applied since it sent "sync", snapshot included, until the connection is closed.
+func (r *replication) readAcks(parser *RespProtocolParser, feed *opFeed, snapshot int) {
+	for {
+		name, args, err := parser.Parse()
+		if err != nil {
+			return
+		}
+		if !strings.EqualFold(name, "replconf") || len(args) != 2 || !strings.EqualFold(args[0], "ack") {
+			continue
+		}
+		n, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil || n < uint64(snapshot) {
+			continue
+		}
+		r.mu.Lock()
+		if _, ok := r.acks[feed]; ok {
+			r.acks[feed] = feed.offset + n - uint64(snapshot)
+			if r.acked != nil {
+				close(r.acked)
+				r.acked = nil
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// waitAcks waits until n replicas acknowledged the offset of the queue, or ctx is done,
+// and returns the number of replicas which acknowledged it.
+func (r *replication) waitAcks(ctx context.Context, offset uint64, n int) int {
+	for {
+		r.mu.Lock()
+		acked := 0
+		for _, ack := range r.acks {
+			if ack >= offset {
+				acked++
+			}
+		}
+		if r.acked == nil {
+			r.acked = make(chan struct{})
+		}
+		changed := r.acked
+		r.mu.Unlock()
+		if acked >= n {
+			return acked
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return acked
+		}
+	}
+}
+
+// startReplication starts following Server.ReplicaOf, once.
+func (srv *Server) startReplication() {
+	srv.repl.once.Do(func() {
+		if srv.ReplicaOf != "" {
+			srv.replicaOf(srv.ReplicaOf)
+		}
+	})
+}
+
+// replicaOf makes the server follow leader, or stops following if leader is empty.
+func (srv *Server) replicaOf(leader string) {
+	srv.repl.mu.Lock()
+	defer srv.repl.mu.Unlock()
+	if srv.repl.cancel != nil {
+		srv.repl.cancel()
+		srv.repl.cancel = nil
+	}
+	srv.repl.leader = leader
+	srv.repl.linkUp = false
+	if leader == "" {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.repl.cancel = cancel
+	go srv.follow(ctx, leader)
+}
+
+// follow replicates leader until ctx is done, reconnecting on errors.
+func (srv *Server) follow(ctx context.Context, leader string) {
+	for {
+		err := srv.syncWith(ctx, leader)
+		srv.repl.mu.Lock()
+		srv.repl.linkUp = false
+		srv.repl.mu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		srv.logger().Warn("khronos: replication link down", "leader", leader, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(replicationRetryInterval):
+		}
+	}
+}
+
+// syncWith receives the snapshot and then the operation stream of leader,
+// applying them to the server queue.
+func (srv *Server) syncWith(ctx context.Context, leader string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", leader)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-stop:
+		}
+	}()
+
+	writer := &responseWriter{conn}
+	parser := NewRespProtocolParser(conn)
+	if srv.LeaderPassword != "" {
+		auth := []string{"auth", srv.LeaderPassword}
+		if srv.LeaderUser != "" {
+			auth = []string{"auth", srv.LeaderUser, srv.LeaderPassword}
+		}
+		if err = writer.WriteArray(auth); err != nil {
+			return err
+		}
+		reply, err := parser.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if reply = strings.TrimRight(reply, "\r\n"); strings.HasPrefix(reply, "-") {
+			return errors.New(reply[1:])
+		}
+	}
+	if err = writer.WriteArray([]string{"sync"}); err != nil {
+		return err
+	}
+	applied := 0
+	for {
+		name, args, err := parser.Parse()
+		if err != nil {
+			return err
+		}
+		op, err := parseQueueOp(name, args)
+		if err != nil {
+			return err
+		}
+		if op.kind == opReset {
+			srv.repl.mu.Lock()
+			srv.repl.linkUp = true
+			srv.repl.mu.Unlock()
+			srv.logger().Info("khronos: replication link up", "leader", leader)
+		}
+		srv.Queue.apply(op)
+		applied++
+		if parser.Buffered() == 0 {
+			// acknowledge the operations once the stream is drained, see "wait".
+			if err = writer.WriteArray([]string{"replconf", "ack", strconv.Itoa(applied)}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// SyncCommand is the command "sync".
+// It is sent by a replica to its leader, which replies with a snapshot of its queues
+// followed by the stream of every operation applied to them, each encoded as a command.
+// The replica acknowledges the operations it applied with "replconf ack <n>" frames.
+// This command never returns while the replica keeps up with the stream, the connection is closed once it does.
+type SyncCommand struct {
+	ArgsCommand
+}
+
+func (c *SyncCommand) Name() string {
+	return "sync"
+}
+
+func (c *SyncCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	pq := PqFromContext(ctx)
+	snapshot, feed, missing := pq.subscribe(replicationBacklog)
+	defer pq.unsubscribe(feed)
+	// a replica only waits for operations, it can be closed at any time.
+	defer markBlocked(ctx, "")()
+	if srv := ServerFromContext(ctx); srv != nil {
+		if missing != nil {
+			srv.logger().Warn("khronos: replica snapshot misses paged items", "error", missing)
+		}
+		atomic.AddInt32(&srv.repl.replicas, 1)
+		defer atomic.AddInt32(&srv.repl.replicas, -1)
+		if c := connFromContext(ctx); c != nil && c.parser.parser != nil {
+			// the replica acknowledges the operations on the same connection.
+			srv.repl.track(feed)
+			defer srv.repl.untrack(feed)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				srv.repl.readAcks(c.parser.parser, feed, len(snapshot))
+			}()
+			// the acks are read with the parser of the connection, which cannot serve other commands
+			// while they are: the connection is closed, and the replica reconnects, once sync returns.
+			defer func() {
+				_ = c.conn.Close()
+				<-done
+			}()
+		}
+	}
+
+	for _, op := range snapshot {
+		if err := writer.WriteArray(op.args()); err != nil {
+			return err
+		}
+	}
+	for {
+		if len(feed.ops) == 0 {
+			// send the operations written so far before waiting for the next ones.
+			if err := Flush(writer); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case op, ok := <-feed.ops:
+			if !ok {
+				return errReplicaTooSlow
+			}
+			if err := writer.WriteArray(op.args()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func NewSyncCommand(args []string) (Command, error) {
+	if len(args) != 0 {
+		return nil, &WrongArityError{"sync"}
+	}
+	return &SyncCommand{}, nil
+}
+
+// ReplicaOfCommand is the command "replicaof".
+// "replicaof host port" makes the server a follower of the given leader,
+// discarding its own queues, and "replicaof no one" turns it back into a leader.
+type ReplicaOfCommand struct {
+	ArgsCommand
+}
+
+func (c *ReplicaOfCommand) Name() string {
+	return "replicaof"
+}
+
+func (c *ReplicaOfCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	if len(args) != 2 {
+		return &WrongArityError{c.Name()}
+	}
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		return errNoServer
+	}
+	srv.setMovedTo("")
+	if strings.EqualFold(args[0], "no") && strings.EqualFold(args[1], "one") {
+		srv.replicaOf("")
+		return writer.WriteStatus(OK)
+	}
+	if _, err := strconv.ParseUint(args[1], 10, 16); err != nil {
+		return errInvalidPort
+	}
+	srv.replicaOf(net.JoinHostPort(args[0], args[1]))
+	return writer.WriteStatus(OK)
+}
+
+func NewReplicaOfCommand(args []string) (Command, error) {
+	if len(args) != 2 {
+		return nil, &WrongArityError{"replicaof"}
+	}
+	cmd := &ReplicaOfCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+// RoleCommand is the command "role".
+// A leader replies with ["leader", <number of replicas>],
+// a follower with ["follower", <leader address>, "connected"|"connecting"].
+type RoleCommand struct {
+	ArgsCommand
+}
+
+func (c *RoleCommand) Name() string {
+	return "role"
+}
+
+func (c *RoleCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		return errNoServer
+	}
+	srv.repl.mu.Lock()
+	leader, linkUp := srv.repl.leader, srv.repl.linkUp
+	srv.repl.mu.Unlock()
+	if leader == "" {
+		replicas := atomic.LoadInt32(&srv.repl.replicas)
+		return writer.WriteArray([]string{"leader", strconv.Itoa(int(replicas))})
+	}
+	state := "connecting"
+	if linkUp {
+		state = "connected"
+	}
+	return writer.WriteArray([]string{"follower", leader, state})
+}
+
+func NewRoleCommand(args []string) (Command, error) {
+	if len(args) != 0 {
+		return nil, &WrongArityError{"role"}
+	}
+	return &RoleCommand{}, nil
+}
+
+// WaitCommand is the command "wait".
+// "wait <numreplicas> <timeout>" waits until numreplicas replicas applied every operation
+// applied to the queue before the command, or until timeout milliseconds elapse, 0 waiting forever.
+// It replies with the number of replicas which applied them, which lets a producer
+// make sure its pushes are replicated before going on.
+type WaitCommand struct {
+	ArgsCommand
+}
+
+func (c *WaitCommand) Name() string {
+	return "wait"
+}
+
+func (c *WaitCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		return errNoServer
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 {
+		return errNotInteger
+	}
+	timeout, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || timeout < 0 {
+		return errTimeoutNotValid
+	}
+	offset := srv.Queue.offset()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = withTimeout(ctx, srv.clock(), time.Duration(timeout)*time.Millisecond)
+		defer cancel()
+	}
+	unblock := markBlocked(ctx, "")
+	acked := srv.repl.waitAcks(ctx, offset, n)
+	unblock()
+	return writer.WriteInt64(int64(acked))
+}
+
+func NewWaitCommand(args []string) (Command, error) {
+	if len(args) != 2 {
+		return nil, &WrongArityError{"wait"}
+	}
+	cmd := &WaitCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["wait"] = NewWaitCommand
+	commandLibraries["sync"] = NewSyncCommand
+	commandLibraries["replicaof"] = NewReplicaOfCommand
+	commandLibraries["role"] = NewRoleCommand
+}
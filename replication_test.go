@@ -0,0 +1,183 @@
+package khronos
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// eventually fails the test if cond does not become true within a few seconds.
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	leader := &Server{}
+	leaderAddr := startServer(t, leader)
+	conn := dial(t, leaderAddr)
+	conn.do("push", "jobs", "a", "1")
+	conn.do("push", "jobs", "b", "2")
+	conn.do("cron", "add", "hourly", "0 * * * *", "jobs", "tick", "1")
+
+	follower := &Server{ReplicaOf: leaderAddr}
+	followerAddr := startServer(t, follower)
+	t.Cleanup(func() { follower.replicaOf("") })
+	eventually(t, func() bool { return follower.Queue.Length("jobs") == 2 })
+
+	conn.do("push", "jobs", "c", "3")
+	if got := conn.do("pop", "jobs"); got != "c" {
+		t.Fatalf("pop: got %q", got)
+	}
+	conn.do("push", "other", "d", "1")
+	conn.do("cron", "del", "hourly")
+	conn.do("cron", "add", "daily", "0 0 * * *", "jobs", "tick", "1")
+	eventually(t, func() bool {
+		return follower.Queue.Length("jobs") == 2 && follower.Queue.Length("other") == 1
+	})
+	if jobs := follower.Queue.CronJobs(); len(jobs) != 1 || jobs[0].Name != "daily" {
+		t.Errorf("unexpected cron jobs on the follower %v", jobs)
+	}
+
+	if got := dial(t, followerAddr).do("role"); got != "follower "+leaderAddr+" connected" {
+		t.Errorf("role: got %q", got)
+	}
+	if got := conn.do("role"); got != "leader 1" {
+		t.Errorf("role: got %q", got)
+	}
+	if item := follower.Queue.Dequeue("jobs"); item.value != "b" {
+		t.Errorf("follower dequeue: got %s", item.value)
+	}
+}
+
+func TestReplicationAuth(t *testing.T) {
+	leaderAddr := startServer(t, &Server{Password: "pass"})
+	conn := dial(t, leaderAddr)
+	conn.do("auth", "pass")
+	conn.do("push", "jobs", "a", "1")
+
+	follower := &Server{ReplicaOf: leaderAddr, LeaderPassword: "pass"}
+	startServer(t, follower)
+	t.Cleanup(func() { follower.replicaOf("") })
+	eventually(t, func() bool { return follower.Queue.Length("jobs") == 1 })
+	conn.do("push", "jobs", "b", "2")
+	eventually(t, func() bool { return follower.Queue.Length("jobs") == 2 })
+}
+
+func TestWait(t *testing.T) {
+	leader := &Server{}
+	leaderAddr := startServer(t, leader)
+	conn := dial(t, leaderAddr)
+	if got := conn.do("wait", "1", "10"); got != ":0" {
+		t.Errorf("wait without replica: got %q", got)
+	}
+
+	follower := &Server{ReplicaOf: leaderAddr}
+	startServer(t, follower)
+	t.Cleanup(func() { follower.replicaOf("") })
+	for i := 0; i < 100; i++ {
+		conn.do("push", "jobs", strconv.Itoa(i), "1")
+	}
+	if got := conn.do("wait", "1", "0"); got != ":1" {
+		t.Errorf("wait: got %q", got)
+	}
+	// the replica applied every push before wait replied.
+	if n := follower.Queue.Length("jobs"); n != 100 {
+		t.Errorf("follower length: got %d, want 100", n)
+	}
+	if got := conn.do("wait", "2", "10"); got != ":1" {
+		t.Errorf("wait for more replicas than connected: got %q", got)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	leader := &Server{}
+	leaderAddr := startServer(t, leader)
+	follower := &Server{ReplicaOf: leaderAddr}
+	followerAddr := startServer(t, follower)
+	t.Cleanup(func() {
+		follower.replicaOf("")
+		leader.replicaOf("")
+	})
+
+	conn := dial(t, leaderAddr)
+	conn.do("push", "jobs", "a", "1")
+	conn.do("push", "jobs", "b", "2")
+	if got := conn.do("failover"); got != "-ERR failover is only possible on a follower, use \"failover force\" to skip the leader" {
+		t.Errorf("failover on the leader: got %q", got)
+	}
+	if got := dial(t, followerAddr).do("failover", "timeout", "2000"); got != "OK" {
+		t.Fatalf("failover: got %q", got)
+	}
+
+	// the former leader redirects the writes and follows the promoted server.
+	if got := conn.do("push", "jobs", "c", "3"); got != "-MOVED "+followerAddr {
+		t.Errorf("push on the former leader: got %q", got)
+	}
+	if got := conn.do("length", "jobs"); got != ":2" {
+		t.Errorf("length on the former leader: got %q", got)
+	}
+	promoted := dial(t, followerAddr)
+	if got := promoted.do("pop", "jobs"); got != "b" {
+		t.Errorf("pop on the promoted server: got %q", got)
+	}
+	eventually(t, func() bool { return leader.Queue.Length("jobs") == 1 })
+	if got := promoted.do("role"); got != "leader 1" {
+		t.Errorf("role of the promoted server: got %q", got)
+	}
+	if got := conn.do("role"); got != "follower "+followerAddr+" connected" {
+		t.Errorf("role of the former leader: got %q", got)
+	}
+}
+
+func TestReplicaReadOnly(t *testing.T) {
+	RegisterListCommands()
+	leaderAddr := startServer(t, &Server{})
+	dial(t, leaderAddr).do("push", "jobs", "a", "1")
+
+	for _, tt := range []struct {
+		pops ReplicaPopPolicy
+		want string
+	}{
+		{ReplicaPopsAllow, "a"},
+		{ReplicaPopsRefuse, "-" + ErrReadOnlyReplica.Error()},
+		{ReplicaPopsRedirect, "-MOVED " + leaderAddr},
+	} {
+		t.Run(tt.pops.String(), func(t *testing.T) {
+			follower := &Server{ReplicaOf: leaderAddr, ReplicaReadOnly: true, ReplicaPops: tt.pops}
+			conn := dial(t, startServer(t, follower))
+			t.Cleanup(func() { follower.replicaOf("") })
+			eventually(t, func() bool { return follower.Queue.Length("jobs") == 1 })
+
+			if got := conn.do("push", "jobs", "b", "2"); got != "-"+ErrReadOnlyReplica.Error() {
+				t.Errorf("push: got %q", got)
+			}
+			if got := conn.do("remove", "jobs", "1"); got != "-"+ErrReadOnlyReplica.Error() {
+				t.Errorf("remove: got %q", got)
+			}
+			if got := conn.do("length", "jobs"); got != ":1" {
+				t.Errorf("length: got %q", got)
+			}
+			if tt.pops != ReplicaPopsAllow {
+				if got := conn.do("lpop", "jobs"); got != tt.want {
+					t.Errorf("lpop: got %q, want %q", got, tt.want)
+				}
+			}
+			if got := conn.do("pop", "jobs"); got != tt.want {
+				t.Errorf("pop: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// a leader is never read-only.
+	leader := dial(t, startServer(t, &Server{ReplicaReadOnly: true, ReplicaPops: ReplicaPopsRefuse}))
+	if got := leader.do("push", "jobs", "b", "2"); got != ":1" {
+		t.Errorf("push to a leader: got %q", got)
+	}
+}
@@ -11,15 +11,68 @@ type ResponseWriter interface {
 	WriteInt64(i int64) error
 	WriteArray(a []string) error
 	WriteString(s string) error
+	WriteNil() error
 	Write(b []byte) (int, error)
 }
 
+// Flusher is implemented by the ResponseWriters buffering the replies.
+// The replies are sent once the client waits for them, and the commands streaming replies,
+// such as "sync", flush them as they go.
+type Flusher interface {
+	Flush() error
+}
+
+// Flush sends the replies buffered by writer, if it implements Flusher.
+func Flush(writer ResponseWriter) error {
+	if f, ok := writer.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// WriteValue writes v as a single reply, which can mix types and nest arrays, such as
+// []any{"value", int64(10), []any{"key", "value"}, nil}:
+//
+//	nil                              a nil reply
+//	string, []byte                   a bulk string
+//	int, int64, uint64 and the other integers, bool as 1 or 0
+//	                                 an integer
+//	Status                           a status
+//	error                            an error, within an array too
+//	[]string, []int64, []any         an array of the replies of its elements
+//
+// It fails without writing anything if v, or one of its elements, has another type.
+func WriteValue(writer ResponseWriter, v any) error {
+	builder := getprotocolBuilder()
+	defer putProtocolBuilder(builder)
+	if err := builder.WriteValue(v); err != nil {
+		return err
+	}
+	_, err := writer.Write(builder.buf)
+	return err
+}
+
+// writeNilArray writes the null array "*-1", which the blocking pops of Redis reply on timeout.
+func writeNilArray(writer ResponseWriter) error {
+	_, err := writer.Write([]byte("*-1\r\n"))
+	return err
+}
+
 type responseWriter struct {
 	io.Writer
 }
 
-func (w *responseWriter) WriteFrom(reader io.Reader) error {
-	_, err := io.Copy(w.Writer, reader)
+// Flush sends the buffered replies, if the underlying writer buffers them.
+func (w *responseWriter) Flush() error {
+	if f, ok := w.Writer.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// write sends the reply built by builder.
+func (w *responseWriter) write(builder *protocolBuilder) error {
+	_, err := w.Writer.Write(builder.buf)
 	return err
 }
 
@@ -27,33 +80,40 @@ func (w *responseWriter) WriteError(err error) error {
 	builder := getprotocolBuilder()
 	defer putProtocolBuilder(builder)
 	builder.WriteError(err)
-	return w.WriteFrom(builder)
+	return w.write(builder)
 }
 
 func (w *responseWriter) WriteStatus(status Status) error {
 	builder := getprotocolBuilder()
 	defer putProtocolBuilder(builder)
 	builder.WriteStatus(status.String())
-	return w.WriteFrom(builder)
+	return w.write(builder)
 }
 
 func (w *responseWriter) WriteInt64(i int64) error {
 	builder := getprotocolBuilder()
 	defer putProtocolBuilder(builder)
 	builder.WriteInt64(i)
-	return w.WriteFrom(builder)
+	return w.write(builder)
 }
 
 func (w *responseWriter) WriteString(s string) error {
 	builder := getprotocolBuilder()
 	defer putProtocolBuilder(builder)
 	builder.WriteString(s)
-	return w.WriteFrom(builder)
+	return w.write(builder)
 }
 
 func (w *responseWriter) WriteArray(a []string) error {
 	builder := getprotocolBuilder()
 	defer putProtocolBuilder(builder)
 	builder.WriteArray(a)
-	return w.WriteFrom(builder)
+	return w.write(builder)
+}
+
+func (w *responseWriter) WriteNil() error {
+	builder := getprotocolBuilder()
+	defer putProtocolBuilder(builder)
+	builder.WriteNil()
+	return w.write(builder)
 }
@@ -0,0 +1,159 @@
+package khronos
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+)
+
+// AttemptHeader is the header holding the number of the delivery attempt of a retried item,
+// see Retry. The items which were never retried have no such header.
+const AttemptHeader = "attempt"
+
+// Attempt returns the number of the delivery attempt of the item, starting at 1.
+func (item *Item) Attempt() int {
+	if n, err := strconv.Atoi(item.Header(AttemptHeader)); err == nil && n > 0 {
+		return n
+	}
+	return 1
+}
+
+// backoff returns the delay before the given attempt from the retry policy of the route:
+// RetryBackoff for the second attempt, doubled at each further attempt up to RetryMaxBackoff.
+func (c RouteConfig) backoff(attempt int) time.Duration {
+	d := c.RetryBackoff
+	for i := 2; i < attempt && d < math.MaxInt64/2; i++ {
+		if c.RetryMaxBackoff > 0 && d >= c.RetryMaxBackoff {
+			break
+		}
+		d *= 2
+	}
+	if c.RetryMaxBackoff > 0 && d > c.RetryMaxBackoff {
+		d = c.RetryMaxBackoff
+	}
+	return d
+}
+
+// Retry gives up the delivery of a pending item of a consumer group of the route, see DequeueGroup,
+// or of an item reserved by the route, see DeliveryAtLeastOnce,
+// and enqueues it again to its group or route after delay, with its attempt counter incremented, see Attempt.
+// A negative delay uses the backoff of the retry policy of the route, see RouteConfig.RetryBackoff.
+// The item gets a new identifier once enqueued again. Retry returns the delay, and ErrNoSuchItem
+// if the item is not pending.
+//
+// Retrying on the server, instead of acknowledging and pushing the item again from the consumer,
+// keeps the item in flight during the delay so that it can not be lost nor claimed twice.
+func (pq *PriorityQueueWithRouting) Retry(route string, id uint64, delay time.Duration) (time.Duration, error) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r, ok := pq.routes[route]
+	if !ok {
+		return 0, ErrNoSuchItem
+	}
+	if res, ok := r.reserved[id]; ok {
+		if delay < 0 {
+			delay = r.config.backoff(res.item.Attempt() + 1)
+		}
+		if delay == 0 {
+			pq.redeliver(r, id)
+			return 0, nil
+		}
+		// the item stays reserved until it is enqueued again.
+		res.stop()
+		res.stop = pq.afterFunc(delay, func() {
+			pq.queueLock.Lock()
+			defer pq.queueLock.Unlock()
+			pq.redeliver(r, id)
+		})
+		return delay, nil
+	}
+	for _, name := range sortedKeys(r.groups) {
+		g := r.groups[name]
+		d, ok := g.pending[id]
+		if !ok {
+			continue
+		}
+		delete(g.pending, id)
+		item := d.item.Clone()
+		attempt := d.item.Attempt() + 1
+		item.SetHeader(AttemptHeader, strconv.Itoa(attempt))
+		if delay < 0 {
+			delay = r.config.backoff(attempt)
+		}
+		if delay == 0 {
+			pq.requeue(route, name, g, id, item)
+			return 0, nil
+		}
+		// the item stays in flight until it is enqueued again.
+		pq.afterFunc(delay, func() {
+			pq.queueLock.Lock()
+			defer pq.queueLock.Unlock()
+			pq.requeue(route, name, g, id, item)
+		})
+		return delay, nil
+	}
+	return 0, ErrNoSuchItem
+}
+
+// requeue enqueues again to its group an item whose delivery, pending with the given identifier, was given up.
+// The item is dropped if the group was destroyed in the meantime.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) requeue(route, name string, g *group, id uint64, item *Item) {
+	pq.accounting.Inflight--
+	if current, _ := pq.group(route, name); current != g {
+		pq.accounting.Dropped++
+		return
+	}
+	// the failed delivery is consumed, and the retry is a new item.
+	pq.accounting.Popped++
+	pq.emit(queueOp{kind: opGroupAck, route: route, group: name, id: id})
+	pq.push(g.route, item)
+}
+
+// RetryCommand is the command "retry".
+// "retry <route> <id> [delay-ms]" gives up the delivery of an item pending in a consumer group of
+// the route or reserved by the route, and enqueues it again after the delay, or after the backoff of the retry
+// policy of the route without delay, see Retry. It replies with the delay in milliseconds.
+type RetryCommand struct {
+	ArgsCommand
+}
+
+func (c *RetryCommand) Name() string {
+	return "retry"
+}
+
+func (c *RetryCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	id, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	delay := time.Duration(-1)
+	if len(args) == 3 {
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || ms < 0 {
+			return errNotInteger
+		}
+		delay = time.Duration(ms) * time.Millisecond
+	}
+	delay, err = PqFromContext(ctx).Retry(args[0], id, delay)
+	if err != nil {
+		return err
+	}
+	return writer.WriteInt64(delay.Milliseconds())
+}
+
+func NewRetryCommand(args []string) (Command, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, &WrongArityError{"retry"}
+	}
+	cmd := &RetryCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["retry"] = NewRetryCommand
+}
@@ -0,0 +1,492 @@
+package khronos
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Order is the order in which the items of a route are dequeued.
+type Order int
+
+const (
+	// OrderDesc dequeues the item with the highest priority first, it is the default.
+	OrderDesc Order = iota
+	// OrderAsc dequeues the item with the lowest priority first.
+	OrderAsc
+)
+
+func (o Order) String() string {
+	if o == OrderAsc {
+		return "asc"
+	}
+	return "desc"
+}
+
+// RouteConfig holds the settings of a route.
+// The zero value is the default configuration, unless changed with SetDefaultRouteConfig.
+type RouteConfig struct {
+	// Order is the order of the priorities, highest first by default.
+	Order Order
+
+	// SpinBudget is how long Dequeue keeps polling an empty route before blocking.
+	// Spinning trades CPU for a lower wakeup latency on latency-sensitive routes.
+	SpinBudget time.Duration
+
+	// MaxOps is the maximum number of operations per second on the route, zero means unlimited.
+	// Operations over the quota fail with ErrThrottled.
+	MaxOps int
+
+	// MaxInMemory, if positive, is the number of items kept in memory by the route.
+	// When the route holds twice as many items, the coldest ones, dequeued last, are paged
+	// to disk in the directory set with SetOverflowDir, and read back as they are dequeued.
+	// Paged items are not visible to UpdatePriority and Remove.
+	MaxInMemory int
+
+	// LIFO delivers the items of equal priority in reverse enqueue order, instead of enqueue order.
+	LIFO bool
+
+	// RetryBackoff is the delay before the second attempt of an item given up with Retry,
+	// doubled at each further attempt. Zero retries immediately.
+	RetryBackoff time.Duration
+
+	// RetryMaxBackoff, if positive, caps the delay before an attempt.
+	RetryMaxBackoff time.Duration
+
+	// Delivery is the delivery guarantee of the route, at most once by default.
+	Delivery Delivery
+
+	// VisibilityTimeout is how long an item dequeued from a route with DeliveryAtLeastOnce stays
+	// reserved to its consumer before being enqueued again, DefaultVisibilityTimeout if zero.
+	VisibilityTimeout time.Duration
+
+	// MaxLength, if positive, is the number of items of the route from which EnqueueContext, TryEnqueue
+	// and the command "push" apply OnFull. Enqueue ignores it.
+	MaxLength int
+
+	// OnFull is what EnqueueContext does when the route holds MaxLength items, FullReject by default.
+	OnFull FullPolicy
+
+	// DefaultPriority is the priority of the items pushed without a priority by the command "push".
+	DefaultPriority int64
+
+	// HighWatermark, if positive, is the number of items from which the route sends EventHighWatermark,
+	// for autoscalers to add consumers before the route reaches MaxLength. Once it did, the route sends
+	// EventLowWatermark when it goes back to LowWatermark items, which should be below HighWatermark.
+	HighWatermark int
+	LowWatermark  int
+
+	// TimestampPriority makes the priority of the items pushed without a priority the current Unix time
+	// in milliseconds, instead of DefaultPriority.
+	TimestampPriority bool
+}
+
+// before reports whether a is dequeued before b from a route with these settings.
+func (c RouteConfig) before(a, b *Item) bool {
+	if a.priority != b.priority {
+		return (a.priority > b.priority) != (c.Order == OrderAsc)
+	}
+	return (a.id < b.id) != c.LIFO
+}
+
+// RouteConfig returns the settings of the route.
+func (pq *PriorityQueueWithRouting) RouteConfig(route string) RouteConfig {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	return pq.config(route)
+}
+
+// SetRouteConfig replaces the settings of the route.
+func (pq *PriorityQueueWithRouting) SetRouteConfig(route string, config RouteConfig) {
+	_ = pq.UpdateRouteConfig(route, func(c *RouteConfig) error {
+		*c = config
+		return nil
+	})
+}
+
+// UpdateRouteConfig atomically updates the settings of the route with update.
+// If update returns an error, the settings are left unchanged.
+func (pq *PriorityQueueWithRouting) UpdateRouteConfig(route string, update func(config *RouteConfig) error) error {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r := pq.route(route)
+	config := r.config
+	if err := update(&config); err != nil {
+		return err
+	}
+	pq.setRouteConfig(r, config)
+	return nil
+}
+
+// setRouteConfig replaces the settings of the route, reordering its items if needed.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) setRouteConfig(r *route, config RouteConfig) {
+	reorder := config.LIFO != r.config.LIFO || config.Order != r.config.Order
+	if reorder {
+		// the paged items are sorted in the previous order.
+		pq.unspill(r)
+	}
+	r.config = config
+	if reorder {
+		r.queue.Init()
+	}
+	pq.spill(r)
+	// a larger maximum length makes room for the blocked producers.
+	r.wakeProducers()
+	pq.watermark(r)
+	pq.emit(configOp(r.name, config, pq.defaults))
+}
+
+// configOp returns the operation setting the settings of the route, as the options
+// of the "configure" command which differ from the defaults.
+func configOp(route string, config, defaults RouteConfig) queueOp {
+	op := queueOp{kind: opConfig, route: route}
+	for _, name := range sortedKeys(routeOptions) {
+		option := routeOptions[name]
+		if value := option.get(&config); value != option.get(&defaults) {
+			op.options = append(op.options, name, value)
+		}
+	}
+	return op
+}
+
+// applyConfig applies an operation returned by configOp.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) applyConfig(op queueOp) {
+	config := pq.defaults
+	for i := 0; i+1 < len(op.options); i += 2 {
+		if option, ok := routeOptions[op.options[i]]; ok {
+			_ = option.set(&config, op.options[i+1])
+		}
+	}
+	pq.setRouteConfig(pq.route(op.route), config)
+}
+
+// SetDefaultRouteConfig sets the settings of the routes created from now on.
+// The existing routes keep their settings.
+func (pq *PriorityQueueWithRouting) SetDefaultRouteConfig(config RouteConfig) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	pq.defaults = config
+}
+
+// DefaultRouteConfig returns the settings of the routes created from now on.
+func (pq *PriorityQueueWithRouting) DefaultRouteConfig() RouteConfig {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	return pq.defaults
+}
+
+// updateDefaultRouteConfig changes the settings of the routes created from now on with update.
+func (pq *PriorityQueueWithRouting) updateDefaultRouteConfig(update func(config *RouteConfig)) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	update(&pq.defaults)
+}
+
+// config returns the settings of the route.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) config(route string) RouteConfig {
+	if r, ok := pq.routes[route]; ok {
+		return r.config
+	}
+	return pq.defaults
+}
+
+// routeOption is a setting of a route which can be changed by the "configure" command.
+type routeOption struct {
+	get func(config *RouteConfig) string
+	set func(config *RouteConfig, value string) error
+}
+
+var routeOptions = map[string]routeOption{
+	"defaultpriority": {
+		get: func(config *RouteConfig) string {
+			if config.TimestampPriority {
+				return "now"
+			}
+			return strconv.FormatInt(config.DefaultPriority, 10)
+		},
+		set: func(config *RouteConfig, value string) error {
+			if strings.EqualFold(value, "now") {
+				config.TimestampPriority = true
+				return nil
+			}
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			config.DefaultPriority, config.TimestampPriority = n, false
+			return nil
+		},
+	},
+	"delivery": {
+		get: func(config *RouteConfig) string { return config.Delivery.String() },
+		set: func(config *RouteConfig, value string) error {
+			switch strings.ToLower(value) {
+			case "atmostonce":
+				config.Delivery = DeliveryAtMostOnce
+			case "atleastonce":
+				config.Delivery = DeliveryAtLeastOnce
+			default:
+				return errSyntax
+			}
+			return nil
+		},
+	},
+	"maxops": {
+		get: func(config *RouteConfig) string { return strconv.Itoa(config.MaxOps) },
+		set: func(config *RouteConfig, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errNotInteger
+			}
+			config.MaxOps = n
+			return nil
+		},
+	},
+	"highwatermark": {
+		get: func(config *RouteConfig) string { return strconv.Itoa(config.HighWatermark) },
+		set: func(config *RouteConfig, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errNotInteger
+			}
+			config.HighWatermark = n
+			return nil
+		},
+	},
+	"lowwatermark": {
+		get: func(config *RouteConfig) string { return strconv.Itoa(config.LowWatermark) },
+		set: func(config *RouteConfig, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errNotInteger
+			}
+			config.LowWatermark = n
+			return nil
+		},
+	},
+	"maxlength": {
+		get: func(config *RouteConfig) string { return strconv.Itoa(config.MaxLength) },
+		set: func(config *RouteConfig, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errNotInteger
+			}
+			config.MaxLength = n
+			return nil
+		},
+	},
+	"onfull": {
+		get: func(config *RouteConfig) string { return config.OnFull.String() },
+		set: func(config *RouteConfig, value string) error {
+			switch strings.ToLower(value) {
+			case "reject":
+				config.OnFull = FullReject
+			case "block":
+				config.OnFull = FullBlock
+			default:
+				return errSyntax
+			}
+			return nil
+		},
+	},
+	"order": {
+		get: func(config *RouteConfig) string { return config.Order.String() },
+		set: func(config *RouteConfig, value string) error {
+			switch strings.ToLower(value) {
+			case "desc":
+				config.Order = OrderDesc
+			case "asc":
+				config.Order = OrderAsc
+			default:
+				return errSyntax
+			}
+			return nil
+		},
+	},
+	"maxinmemory": {
+		get: func(config *RouteConfig) string { return strconv.Itoa(config.MaxInMemory) },
+		set: func(config *RouteConfig, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errNotInteger
+			}
+			config.MaxInMemory = n
+			return nil
+		},
+	},
+	"visibility": {
+		get: func(config *RouteConfig) string { return config.visibilityTimeout().String() },
+		set: func(config *RouteConfig, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return errInvalidDuration
+			}
+			config.VisibilityTimeout = d
+			return nil
+		},
+	},
+	"tiebreak": {
+		get: func(config *RouteConfig) string {
+			if config.LIFO {
+				return "lifo"
+			}
+			return "fifo"
+		},
+		set: func(config *RouteConfig, value string) error {
+			switch strings.ToLower(value) {
+			case "fifo":
+				config.LIFO = false
+			case "lifo":
+				config.LIFO = true
+			default:
+				return errSyntax
+			}
+			return nil
+		},
+	},
+	"retrybackoff": {
+		get: func(config *RouteConfig) string { return config.RetryBackoff.String() },
+		set: func(config *RouteConfig, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return errInvalidDuration
+			}
+			config.RetryBackoff = d
+			return nil
+		},
+	},
+	"retrymaxbackoff": {
+		get: func(config *RouteConfig) string { return config.RetryMaxBackoff.String() },
+		set: func(config *RouteConfig, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return errInvalidDuration
+			}
+			config.RetryMaxBackoff = d
+			return nil
+		},
+	},
+	"spin": {
+		get: func(config *RouteConfig) string { return config.SpinBudget.String() },
+		set: func(config *RouteConfig, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return errInvalidDuration
+			}
+			config.SpinBudget = d
+			return nil
+		},
+	},
+}
+
+// ConfigureCommand is the command "configure".
+// "configure <route> <option> <value>" changes a setting of the route,
+// "configure <route> get" replies with the settings of the route as an array of option, value pairs,
+// and "configure <route> get <option>" with the value of a single setting.
+// The settings are replicated, and persisted in the append only file, with the items of the route.
+//
+// The command is also available as "queueconfig".
+//
+// The options are:
+//
+//	defaultpriority <n>|now
+//	                      priority of the items pushed without one, or the current Unix time in milliseconds
+//	delivery atmostonce|atleastonce
+//	                      remove the popped items (default), or reserve them until confirmed, see Delivery
+//	highwatermark <n>     number of items from which the route sends EventHighWatermark, 0 to disable
+//	lowwatermark <n>      number of items at which the route sends EventLowWatermark after the high watermark
+//	maxinmemory <n>       items kept in memory, the coldest are paged to disk beyond twice as many, 0 to disable
+//	maxlength <n>         number of items from which the pushes apply onfull, 0 for unlimited
+//	maxops <n>            maximum number of operations per second on the route, 0 for unlimited
+//	onfull reject|block   refuse the pushes to a full route (default), or block them until it has room
+//	order asc|desc        dequeue the lowest or the highest (default) priority first
+//	retrybackoff <d>      delay before the second attempt of a retried item, doubled at each attempt
+//	retrymaxbackoff <d>   maximum delay before an attempt, 0 for unlimited
+//	spin <duration>       how long pop polls the empty route before blocking, e.g. "50us"
+//	tiebreak fifo|lifo    order of the items of equal priority, enqueue order (fifo) by default
+//	visibility <d>        how long an item popped with at-least-once delivery waits to be confirmed, e.g. "30s"
+type ConfigureCommand struct {
+	ArgsCommand
+	name string
+}
+
+func (c *ConfigureCommand) Name() string {
+	return c.name
+}
+
+func (c *ConfigureCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	pq := PqFromContext(ctx)
+	route := args[0]
+	if len(args) == 2 && strings.EqualFold(args[1], "get") {
+		config := pq.RouteConfig(route)
+		var reply []string
+		for _, name := range sortedKeys(routeOptions) {
+			reply = append(reply, name, routeOptions[name].get(&config))
+		}
+		return writer.WriteArray(reply)
+	}
+	if len(args) != 3 {
+		return &WrongArityError{c.Name()}
+	}
+	if strings.EqualFold(args[1], "get") {
+		option, ok := routeOptions[strings.ToLower(args[2])]
+		if !ok {
+			return &unknownOptionError{args[2]}
+		}
+		config := pq.RouteConfig(route)
+		return writer.WriteString(option.get(&config))
+	}
+	option, ok := routeOptions[strings.ToLower(args[1])]
+	if !ok {
+		return &unknownOptionError{args[1]}
+	}
+	err := pq.UpdateRouteConfig(route, func(config *RouteConfig) error {
+		return option.set(config, args[2])
+	})
+	if err != nil {
+		return err
+	}
+	return writer.WriteStatus(OK)
+}
+
+func NewConfigureCommand(args []string) (Command, error) {
+	return newConfigureCommand("configure")(args)
+}
+
+// newConfigureCommand returns the constructor of ConfigureCommand under name, "configure" or its alias.
+func newConfigureCommand(name string) CommandConstructor {
+	return func(args []string) (Command, error) {
+		if len(args) != 2 && len(args) != 3 {
+			return nil, &WrongArityError{name}
+		}
+		cmd := &ConfigureCommand{name: name}
+		cmd.args = args
+		return cmd, nil
+	}
+}
+
+func init() {
+	commandLibraries["configure"] = NewConfigureCommand
+	commandLibraries["queueconfig"] = newConfigureCommand("queueconfig")
+}
+
+// sortedKeys returns the keys of m in increasing order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,37 +1,354 @@
 package khronos
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"log"
+	"log/slog"
 	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var ErrQuit = errors.New("quit")
 
+// ErrServerClosed is returned by the Server's Serve and ListenAndServe methods after a call to Shutdown.
+var ErrServerClosed = errors.New("khronos: Server closed")
+
 type Server struct {
 	Addr string
 
+	// Addrs are more addresses served by ListenAndServe along with Addr, all sharing the queue,
+	// the clients and the shutdown of the server. An address is either "host:port" for TCP,
+	// "tcp://host:port", "tcp4://host:port" or "tcp6://host:port" to choose the IP version,
+	// "unix:///path/to/socket" for a unix socket, or "tls://host:port" for TCP with TLSConfig.
+	// Addr defaults to ":7464" only if Addrs is empty.
+	Addrs []string
+
+	// TLSConfig is the configuration of the "tls://" addresses of Addrs.
+	TLSConfig *tls.Config
+
+	// HTTPAddr, if set, is the address of the HTTP gateway started by ListenAndServe, see HTTPHandler.
+	HTTPAddr string
+
+	// HealthEndpoints makes the HTTP gateway serve GET /healthz and GET /readyz without authentication,
+	// for the liveness and readiness probes of Kubernetes, see Health.
+	HealthEndpoints bool
+
 	BaseContext func(net.Listener) context.Context
 
 	ConnContext func(context.Context, net.Conn) context.Context
 
-	Logger *log.Logger
+	// Logger receives the connection lifecycle, command errors and slow commands.
+	// If nil, nothing is logged.
+	Logger Logger
+
+	// SlowLogThreshold, if positive, is the execution time above which a command is logged as slow
+	// and recorded in the slow log, see the "slowlog" command.
+	// It can be changed at runtime with "config set slowlogthreshold".
+	SlowLogThreshold time.Duration
+
+	// SlowLogMaxLen is the number of entries kept in the slow log, 128 if zero.
+	// It can be changed at runtime with "config set slowlogmaxlen".
+	SlowLogMaxLen int
+
+	// LatencyMonitorThreshold, if positive, is the latency above which the executions of the commands,
+	// the syncs of the append only file and the waits for the lock of the queue are recorded by the
+	// latency monitor, see the "latency" command.
+	// It can be changed at runtime with "config set latencymonitorthreshold".
+	LatencyMonitorThreshold time.Duration
+
+	// LockProfiling, if set, measures the time the operations spend waiting for the lock of the queue,
+	// reported by "info contention", see PriorityQueueWithRouting.ProfileLock.
+	// It can be changed at runtime with "config set lockprofiling".
+	LockProfiling bool
 
 	Queue *PriorityQueueWithRouting
+
+	// MaxSpaces is the number of queue spaces, besides Queue, the connections can create and switch to
+	// with the "select" and "use" commands, none if zero or negative. Each space has its own routes,
+	// so that workloads such as staging and production can share a server without sharing route names.
+	// The other spaces are neither persisted to AppendOnlyFile nor replicated, their items are lost
+	// on a restart or a failover, and MaxMemory applies to each space.
+	MaxSpaces int
+
+	// ReplicaOf is the address of the leader to replicate, in the form "host:port".
+	// If empty, the server starts as a leader.
+	// It can be changed at runtime with the "replicaof" command.
+	ReplicaOf string
+
+	// LeaderUser and LeaderPassword, if LeaderPassword is set, authenticate the replication link
+	// with "auth" before "sync", when the leader has a Password or an access control list.
+	// LeaderUser is empty to authenticate with the Password of the leader.
+	// As a follower may be promoted, and its leader follow it, they are usually the same on every server.
+	LeaderUser     string
+	LeaderPassword string
+
+	// ReplicaReadOnly makes a follower refuse the commands changing its queue, such as push, remove
+	// or renameroute, with "-READONLY", so that it does not diverge from its leader.
+	// The commands consuming items, such as pop and confirm, are handled as set by ReplicaPops.
+	ReplicaReadOnly bool
+
+	// ReplicaPops is what a follower with ReplicaReadOnly does with the commands consuming items:
+	// serve them from its queue, refuse them, or redirect them to its leader.
+	ReplicaPops ReplicaPopPolicy
+
+	// AnnounceAddr is the address the leader reaches the server at after a failover, in the form "host:port".
+	// If empty, it is the address the "failover" command was sent to.
+	AnnounceAddr string
+
+	// Password, if set, must be sent with the "auth" command before any other command.
+	Password string
+
+	// TokenSecret, if set, enables the route-scoped tokens created by NewRouteToken.
+	// A token grants access to push, pop and length on a single route, either for
+	// the whole connection with "auth token <t>" or for a single command with
+	// trailing "token <t>" arguments.
+	// Setting TokenSecret requires clients to authenticate, as Password does.
+	TokenSecret []byte
+
+	// MaxConns is the maximum number of connections served at the same time, zero means unlimited.
+	// When it is reached, new connections receive an error reply and are closed,
+	// unless MaxConnsBlock is set.
+	MaxConns int
+
+	// MaxConnsBlock makes the server stop accepting connections while MaxConns is reached,
+	// leaving the pending ones in the listen backlog, instead of rejecting them.
+	MaxConnsBlock bool
+
+	// Clock is the source of time of the server, SystemClock if nil.
+	// It is also set on Queue as it starts serving, unless the queue has its own, see SetClock.
+	// Tests can replace it with a fake clock such as khronostest.Clock.
+	Clock Clock
+
+	// RateLimiter, if set, is consulted before every command.
+	// Refused commands fail with ErrRateLimited.
+	RateLimiter RateLimiter
+
+	// AllowCIDRs, if not empty, are the only networks clients may connect from.
+	// DenyCIDRs are networks clients may not connect from, even if allowed by AllowCIDRs.
+	// Refused connections are closed right after accept, before reading anything,
+	// and counted as denied_connections by the "info" command.
+	// Both lists can be changed at runtime with "config set allowcidrs|denycidrs".
+	AllowCIDRs []netip.Prefix
+	DenyCIDRs  []netip.Prefix
+
+	// MaxProtocolErrors is the number of consecutive malformed frames after which a connection is closed,
+	// 3 if zero. After a malformed frame, the input is skipped up to the next line starting an array.
+	MaxProtocolErrors int
+
+	// MaxBulkLen is the maximum length of an argument of a command, DefaultMaxBulkLen if zero.
+	// MaxArrayLen is the maximum number of arguments of a command, DefaultMaxArrayLen if zero.
+	// MaxLineLen is the maximum length of the line announcing an array or an argument, DefaultMaxLineLen if zero.
+	// A client sending a larger frame receives an error and is disconnected, before the server
+	// allocates memory for it.
+	MaxBulkLen  int
+	MaxArrayLen int
+	MaxLineLen  int
+
+	// OnEvent, if set, is called with the events of Queue, from a single goroutine.
+	// Events are buffered: if OnEvent does not keep up, new events are dropped
+	// and counted as dropped_events by the "info" command.
+	OnEvent func(Event)
+
+	// Events are the kinds of events sent to OnEvent, all of them if zero.
+	Events EventKind
+
+	// OnDrop, if set, is called with the items of Queue which leave it without being delivered:
+	// evicted by MaxMemoryPolicy, or rejected because their route reached RouteConfig.MaxLength,
+	// so that they can be logged or redirected rather than lost silently.
+	// It is called from a single goroutine, in the order the items were dropped; unlike OnEvent,
+	// no call is skipped if it does not keep up, the items wait in memory.
+	OnDrop func(route string, item Item, reason DropReason)
+
+	// MaxMemory, if positive, is the approximate number of bytes the items of Queue may use in memory.
+	// Pushing an item beyond the limit fails with ErrOutOfMemory, or evicts items depending on MaxMemoryPolicy.
+	// It can be changed at runtime with "config set maxmemory".
+	MaxMemory int64
+
+	// MaxMemoryPolicy is what happens when a pushed item does not fit in MaxMemory.
+	// It can be changed at runtime with "config set maxmemorypolicy".
+	MaxMemoryPolicy MemoryPolicy
+
+	// KeepAlive is the period of the TCP keepalive probes of the connections. Zero keeps the setting
+	// of the listener, probes every 15 seconds for the ones of ListenAndServe, and negative disables them.
+	// A consumer waiting for an item is disconnected as soon as its connection is closed or stops
+	// answering the probes, so that the item is not delivered to a dead socket.
+	// It can be changed at runtime with "config set keepalive", for the connections accepted next.
+	KeepAlive time.Duration
+
+	// RouteIdleTimeout, if positive, is how long an empty route stays unused before it is removed
+	// to free its memory, see PriorityQueueWithRouting.CollectRoutes.
+	RouteIdleTimeout time.Duration
+
+	// ProxyProtocol makes the server read a PROXY protocol header, version 1 or 2, at the start of
+	// the connections, as sent by HAProxy or a network load balancer in front of the server.
+	// The address of the client it carries is used by "client list", the logs, the rate limiter
+	// and AllowCIDRs and DenyCIDRs. Connections without a valid header are closed.
+	ProxyProtocol bool
+
+	// Audit, if set, is called after every command sent by a client, including the ones refused
+	// by the authentication, the access control list or the rate limiter, for compliance logging.
+	// It is called from the goroutine serving the connection, before its next command.
+	Audit func(AuditEvent)
+
+	// AuditRedactArgs hides all the arguments of the commands from Audit, not only the credentials,
+	// for instance to keep the values of the items out of the audit logs.
+	AuditRedactArgs bool
+
+	// AppendOnlyFile, if set, is the path of the file logging the operations applied to Queue, for durability.
+	// The queue is rebuilt from the file when the server starts, and the file is compacted then.
+	// The operations are appended as they happen and synced to disk every second, so that a crash
+	// loses at most the last second. The file is rewritten as the smallest list of pushes rebuilding
+	// the queue when it doubles in size, or with the "bgrewriteaof" command.
+	// Each operation is written with a checksum: a file truncated or corrupted by a crash is loaded up to
+	// its last valid operation, the rest is discarded, see CheckAppendOnlyFile and the khronos-check command.
+	// It is the FileStorage used when Storage is nil.
+	AppendOnlyFile string
+
+	// Storage, if set, persists the operations applied to Queue instead of AppendOnlyFile,
+	// with the same behavior, for instance in an embedded database or an object store.
+	Storage Storage
+
+	// Uploader, if set, receives a snapshot of the persisted operations after each compaction of
+	// AppendOnlyFile or Storage, in the background, to back them up off the server, for instance to S3.
+	// The snapshots completed during an upload are uploaded at once after it. A shutdown waits for
+	// the uploads in progress, including the one of the snapshot of "shutdown save".
+	// The uploads are reported by "info persistence".
+	Uploader Uploader
+
+	// UploadPrefix is prepended to the names of the snapshots given to Uploader, followed by the
+	// time of the upload, such as "backups/khronos-" for "backups/khronos-20240102T150405.000Z.aof".
+	UploadPrefix string
+
+	// AsyncWorkers is the number of goroutines running the commands registered with RegisterAsyncCommand,
+	// GOMAXPROCS if zero.
+	AsyncWorkers int
+
+	clients      clientRegistry
+	nextClientID int64
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	inShutdown int32
+	draining   int32
+	done       chan struct{}
+	connSlots  chan struct{}
+
+	repl replication
+
+	acl acl
+
+	slowlog  slowLog
+	cmdstats commandStats
+	latency  latencyMonitor
+
+	ipFilter atomic.Pointer[ipFilter]
+	settings atomic.Pointer[serverSettings]
+	stats    serverStats
+
+	tasks   asyncTasks
+	spaces  queueSpaces
+	uploads snapshotUploads
+
+	eventsOnce    sync.Once
+	dropsOnce     sync.Once
+	collectorOnce sync.Once
+	cronOnce      sync.Once
+	latencyOnce   sync.Once
+	aof           appendOnly
+}
+
+// defaultMaxProtocolErrors is the number of consecutive malformed frames tolerated when Server.MaxProtocolErrors is zero.
+const defaultMaxProtocolErrors = 3
+
+func (srv *Server) maxProtocolErrors() int {
+	if srv.MaxProtocolErrors > 0 {
+		return srv.MaxProtocolErrors
+	}
+	return defaultMaxProtocolErrors
 }
 
 func (srv *Server) ListenAndServe() error {
-	addr := srv.Addr
-	if addr == "" {
-		addr = ":7464"
+	if srv.shuttingDown() {
+		return ErrServerClosed
 	}
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+	addrs := srv.Addrs
+	if srv.Addr != "" || len(addrs) == 0 {
+		addr := srv.Addr
+		if addr == "" {
+			addr = ":7464"
+		}
+		addrs = append([]string{addr}, addrs...)
+	}
+	listeners := make([]net.Listener, 0, len(addrs))
+	closeAll := func() {
+		for _, ln := range listeners {
+			_ = ln.Close()
+		}
+	}
+	for _, addr := range addrs {
+		ln, err := srv.listen(addr)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+	if srv.HTTPAddr != "" {
+		httpLn, err := net.Listen("tcp", srv.HTTPAddr)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		go func() {
+			if err := srv.ServeHTTPGateway(httpLn); err != nil && !errors.Is(err, ErrServerClosed) {
+				srv.logger().Error("khronos: http gateway error", "error", err)
+			}
+		}()
+	}
+	if len(listeners) == 1 {
+		return srv.Serve(listeners[0])
+	}
+	errs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln net.Listener) { errs <- srv.Serve(ln) }(ln)
+	}
+	// the first listener to stop, on shutdown or on an error, stops the others.
+	err := <-errs
+	closeAll()
+	for range listeners[1:] {
+		<-errs
+	}
+	return err
+}
+
+// listen opens the listener of an address of Server.Addrs.
+func (srv *Server) listen(addr string) (net.Listener, error) {
+	scheme, rest, ok := strings.Cut(addr, "://")
+	if !ok {
+		return net.Listen("tcp", addr)
 	}
-	return srv.Serve(ln)
+	switch scheme {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return net.Listen(scheme, rest)
+	case "tls":
+		if srv.TLSConfig == nil {
+			return nil, errors.New("khronos: " + addr + " requires Server.TLSConfig")
+		}
+		ln, err := net.Listen("tcp", rest)
+		if err != nil {
+			return nil, err
+		}
+		return tls.NewListener(ln, srv.TLSConfig), nil
+	}
+	return nil, errors.New("khronos: unsupported address " + addr)
 }
 
 func (srv *Server) Serve(listener net.Listener) error {
@@ -45,69 +362,281 @@ func (srv *Server) Serve(listener net.Listener) error {
 	// set server to context
 	ctx = context.WithValue(ctx, ServerContextKey, srv)
 
+	if !srv.trackListener(listener, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(listener, false)
+
+	if err := srv.startAppendOnly(); err != nil {
+		return err
+	}
+	if srv.Clock != nil {
+		srv.Queue.useClock(srv.Clock)
+	}
+	srv.startReplication()
+	srv.startEvents()
+	srv.startDrops()
+	srv.startCollector()
+	srv.startCron()
+	srv.startLatencyMonitor()
+
 	for {
+		if srv.MaxConns > 0 && srv.MaxConnsBlock {
+			if !srv.acquireConnSlot(true) {
+				return ErrServerClosed
+			}
+		}
 		conn, err := listener.Accept()
 		if err != nil {
+			if srv.MaxConns > 0 && srv.MaxConnsBlock {
+				srv.releaseConnSlot()
+			}
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
-		// copy listener's context and add conn
-		connCtx := ctx
-		if srv.ConnContext != nil {
-			connCtx = srv.ConnContext(connCtx, conn)
-			if connCtx == nil {
-				panic("ConnContext returned a nil context")
+		// behind a proxy, the address of the client is only known once its PROXY protocol header is read.
+		if !srv.ProxyProtocol && !srv.getIPFilter().allows(conn.RemoteAddr()) {
+			atomic.AddInt64(&srv.stats.connsDenied, 1)
+			srv.logger().Debug("khronos: conn denied", "addr", conn.RemoteAddr().String())
+			_ = conn.Close()
+			if srv.MaxConns > 0 && srv.MaxConnsBlock {
+				srv.releaseConnSlot()
 			}
+			continue
+		}
+		if srv.MaxConns > 0 && !srv.MaxConnsBlock && !srv.acquireConnSlot(false) {
+			atomic.AddInt64(&srv.stats.connsRejected, 1)
+			srv.rejectConn(conn, errMaxClients)
+			continue
 		}
+		atomic.AddInt64(&srv.stats.connsAccepted, 1)
+		go srv.serveConn(srv.baseConnContext(ctx, conn), conn)
+	}
+}
 
-		connCtx = PqWithContext(connCtx, srv.Queue)
+// ServeConn serves the RESP protocol on a connection accepted by the caller,
+// such as a connection of a custom listener, of a QUIC stream or of an ssh tunnel.
+// It blocks until the connection is closed, and closes it.
+// The values of ctx are seen by the commands, as the context returned by Server.BaseContext.
+//
+// The connection counts against Server.MaxConns, and is closed by Shutdown as the others.
+// ServeConn returns ErrServerClosed after Shutdown.
+func (srv *Server) ServeConn(ctx context.Context, conn net.Conn) error {
+	if srv.shuttingDown() {
+		_ = conn.Close()
+		return ErrServerClosed
+	}
+	if err := srv.startAppendOnly(); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if srv.Clock != nil {
+		srv.Queue.useClock(srv.Clock)
+	}
+	srv.startReplication()
+	srv.startEvents()
+	srv.startDrops()
+	srv.startCollector()
+	srv.startCron()
+	srv.startLatencyMonitor()
 
-		go srv.serveConn(connCtx, conn)
+	if srv.MaxConns > 0 && !srv.acquireConnSlot(srv.MaxConnsBlock) {
+		if srv.MaxConnsBlock {
+			_ = conn.Close()
+			return ErrServerClosed
+		}
+		atomic.AddInt64(&srv.stats.connsRejected, 1)
+		srv.rejectConn(conn, errMaxClients)
+		return errMaxClients
 	}
+	atomic.AddInt64(&srv.stats.connsAccepted, 1)
+	srv.serveConn(srv.baseConnContext(context.WithValue(ctx, ServerContextKey, srv), conn), conn)
+	return nil
+}
+
+// baseConnContext derives the context of conn from the context of its listener.
+func (srv *Server) baseConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if srv.ConnContext != nil {
+		ctx = srv.ConnContext(ctx, conn)
+		if ctx == nil {
+			panic("ConnContext returned a nil context")
+		}
+	}
+	return PqWithContext(ctx, srv.Queue)
 }
 
 func (srv *Server) serveConn(ctx context.Context, conn net.Conn) {
-	c := &connContext{conn: conn, ctx: ctx}
-	writer := &responseWriter{conn}
-	defer func() { _ = conn.Close() }()
+	srv.setKeepAlive(conn)
+	if srv.ProxyProtocol {
+		var ok bool
+		if conn, ok = srv.acceptProxy(conn); !ok {
+			if srv.MaxConns > 0 {
+				srv.releaseConnSlot()
+			}
+			return
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	counted := &countingConn{Conn: conn}
+	now := srv.clock().Now()
+	c := &connContext{
+		id:         atomic.AddInt64(&srv.nextClientID, 1),
+		srv:        srv,
+		conn:       counted,
+		counted:    counted,
+		cancel:     cancel,
+		createdAt:  now,
+		lastActive: now,
+	}
+	c.ctx = context.WithValue(ctx, connContextKey, c)
+	c.parser.parser = NewRespProtocolParser(counted)
+	c.parser.parser.MaxBulkLen, c.parser.parser.MaxArrayLen, c.parser.parser.MaxLineLen = srv.MaxBulkLen, srv.MaxArrayLen, srv.MaxLineLen
+	c.parser.tokens = len(srv.TokenSecret) > 0
+	srv.clients.add(c)
+	srv.logger().Debug("khronos: conn opened", "id", c.id, "addr", conn.RemoteAddr().String())
+	c.out = bufio.NewWriter(counted)
+	writer := &responseWriter{c.out}
+	defer func() {
+		srv.clients.remove(c)
+		cancel()
+		_ = c.out.Flush()
+		_ = conn.Close()
+		if srv.MaxConns > 0 {
+			srv.releaseConnSlot()
+		}
+	}()
 	for {
-		// FIXME
 		if err := c.serve(writer); err != nil {
-			if errors.Is(err, ErrQuit) {
-				srv.logf("khronos: conn closed: %v", err)
+			// the client quit, the peer went away or the connection was killed,
+			// there is no one left to reply to.
+			if errors.Is(err, ErrQuit) || errors.Is(err, ErrServerClosed) || c.ctx.Err() != nil || isConnClosed(err) {
+				srv.logger().Info("khronos: conn closed", "id", c.id, "addr", conn.RemoteAddr().String(), "reason", err)
 				return
 			}
+			var protoErr *protocolError
+			if errors.As(err, &protoErr) {
+				c.protocolErrors++
+				// the rest of a frame too large can not be parsed.
+				if c.protocolErrors >= srv.maxProtocolErrors() || tooLarge(err) {
+					_ = writer.WriteError(err)
+					srv.logger().Info("khronos: conn closed", "id", c.id, "addr", conn.RemoteAddr().String(), "reason", err)
+					return
+				}
+			}
+			srv.logger().Warn("khronos: command error", "id", c.id, "cmd", c.command(), "error", err)
 			if err = writer.WriteError(err); err != nil {
-				srv.logf("khronos: conn error: %v", err)
+				srv.logger().Error("khronos: conn error", "id", c.id, "error", err)
 			}
 		}
 	}
 }
 
-func (srv *Server) logf(format string, args ...interface{}) {
-	if srv.Logger != nil {
-		srv.Logger.Printf(format, args...)
+// connState is the lifecycle state of a client connection.
+type connState int
+
+const (
+	// stateIdle means that the connection is waiting for the next command.
+	stateIdle connState = iota
+	// stateActive means that the connection is executing a command.
+	stateActive
+	// stateBlocked means that the connection is executing a command which waits for an item.
+	stateBlocked
+)
+
+// connContext holds the state of a client connection.
+type connContext struct {
+	id        int64
+	srv       *Server
+	conn      net.Conn
+	ctx       context.Context
+	cancel    context.CancelFunc
+	createdAt time.Time
+	counted   *countingConn
+	out       *bufio.Writer // buffers the replies until the client waits for them, see flush.
+
+	mu           sync.Mutex
+	state        connState
+	name         string
+	lastCommand  string
+	lastActive   time.Time
+	commands     int64
+	blockedRoute string
+
+	authenticated bool                      // whether the connection sent the server password.
+	tokenRoute    string                    // the route the connection is restricted to by a token.
+	tokenExpiry   time.Time                 // the expiry of the token of tokenRoute.
+	space         string                    // the queue space selected with "select" or "use", "" for the default one.
+	queue         *PriorityQueueWithRouting // the queue of space, nil for Server.Queue.
+	user          string                    // the user of the access control list the connection authenticated as.
+
+	parser         CommandParser
+	protocolErrors int // consecutive malformed frames.
+}
+
+// kill closes the connection and cancels everything it is blocked on.
+func (c *connContext) kill() {
+	c.cancel()
+	_ = c.conn.Close()
+}
+
+// flush sends the buffered replies of the connection.
+// It must be called by the goroutine serving the connection.
+func (c *connContext) flush() error {
+	if c.out == nil {
+		return nil
 	}
+	return c.out.Flush()
 }
 
-type connContext struct {
-	conn net.Conn
-	ctx  context.Context
+// command returns the name of the last command of the connection.
+func (c *connContext) command() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastCommand
+}
+
+func (c *connContext) setState(state connState) {
+	c.mu.Lock()
+	c.state = state
+	c.mu.Unlock()
 }
 
 func (c *connContext) serve(writer ResponseWriter) error {
-	var parser CommandParser
+	parser := &c.parser
 	for {
+		// the replies of pipelined commands are sent together, once every command read was served.
+		if parser.parser == nil || parser.parser.Buffered() == 0 {
+			if err := c.flush(); err != nil {
+				return err
+			}
+		}
 		select {
 		case <-c.ctx.Done():
 			return c.ctx.Err()
 		default:
 		}
+		if c.srv.shuttingDown() {
+			return ErrServerClosed
+		}
+		c.setState(stateIdle)
 		// read command from connection
 		// it will block until read a complete command
-		if _, err := io.Copy(&parser, c.conn); err != nil {
+		if _, err := io.Copy(parser, c.conn); err != nil {
 			return err
 		}
-		if err := parser.command.Execute(c.ctx, writer); err != nil {
+		c.protocolErrors = 0
+		c.mu.Lock()
+		c.state = stateActive
+		c.lastCommand = parser.command.Name()
+		c.lastActive = c.srv.clock().Now()
+		c.commands++
+		c.mu.Unlock()
+		start := c.srv.clock().Now()
+		err := c.execute(parser.command, writer)
+		c.srv.audit(c, parser.command, start, err)
+		if err != nil {
 			return err
 		}
 
@@ -118,11 +647,52 @@ func (c *connContext) serve(writer ResponseWriter) error {
 	}
 }
 
+// execute runs cmd if the connection is allowed to.
+func (c *connContext) execute(cmd Command, writer ResponseWriter) error {
+	if err := c.authorize(cmd); err != nil {
+		return err
+	}
+	if err := c.srv.redirect(cmd.Name()); err != nil {
+		return err
+	}
+	if err := c.srv.refuseDraining(cmd.Name()); err != nil {
+		return err
+	}
+	if err := c.srv.refuseReplicaWrite(cmd.Name()); err != nil {
+		return err
+	}
+	if limiter := c.srv.RateLimiter; limiter != nil && !limiter.Allow(clientIP(c.conn), cmd.Name()) {
+		return ErrRateLimited
+	}
+	ctx := c.ctx
+	if pq := c.getQueue(); pq != nil {
+		ctx = PqWithContext(ctx, pq)
+	}
+	start := c.srv.clock().Now()
+	err := cmd.Execute(ctx, writer)
+	elapsed := c.srv.clock().Now().Sub(start)
+	c.srv.cmdstats.record(cmd.Name(), elapsed, err)
+	if commandInfos[cmd.Name()].Flags&FlagBlocking == 0 {
+		c.srv.observeLatency(latencyCommand, elapsed)
+	}
+	c.srv.recordSlow(c, cmd, start, elapsed)
+	return err
+}
+
+// isConnClosed reports whether err means that the connection can no longer be used.
+func isConnClosed(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.As(err, &netErr)
+}
+
 func ListenAndServe(addr string) error {
 	server := &Server{
 		Addr:   addr,
 		Queue:  NewPriorityQueueWithRouting(),
-		Logger: log.Default(),
+		Logger: NewStdLogger(log.Default(), slog.LevelInfo),
 	}
 	return server.ListenAndServe()
 }
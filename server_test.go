@@ -0,0 +1,2030 @@
+package khronos
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"khronos/khronostest"
+)
+
+// startServer serves srv on a random local port and returns its address.
+func startServer(t *testing.T, srv *Server) string {
+	t.Helper()
+	if srv.Queue == nil {
+		srv.Queue = NewPriorityQueueWithRouting()
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() { _ = srv.Serve(ln) }()
+	return ln.Addr().String()
+}
+
+type testConn struct {
+	t *testing.T
+	net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *testConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &testConn{t: t, Conn: conn, r: bufio.NewReader(conn)}
+}
+
+// send writes a command without waiting for its reply.
+func (c *testConn) send(args ...string) {
+	c.t.Helper()
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	if _, err := c.Write([]byte(b.String())); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// reply reads one reply and returns it in a compact form:
+// bulk strings and statuses as is, errors with their leading '-',
+// integers with their leading ':' and arrays as space separated elements.
+func (c *testConn) reply() string {
+	c.t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case StringReply:
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatal(err)
+		}
+		return string(buf[:n])
+	case ArrayReply:
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		elems := make([]string, n)
+		for i := range elems {
+			elems[i] = c.reply()
+		}
+		return strings.Join(elems, " ")
+	case StatusReply:
+		return line[1:]
+	}
+	return line
+}
+
+// do sends a command and returns its reply.
+func (c *testConn) do(args ...string) string {
+	c.t.Helper()
+	c.send(args...)
+	return c.reply()
+}
+
+func TestClientKill(t *testing.T) {
+	addr := startServer(t, &Server{})
+
+	admin := dial(t, addr)
+	if got := admin.do("client", "setname", "admin"); got != "OK" {
+		t.Fatalf("client setname: got %q", got)
+	}
+	consumer := dial(t, addr)
+	consumer.send("pop", "jobs")
+
+	var list string
+	for i := 0; i < 100; i++ {
+		list = admin.do("client", "list")
+		if strings.Contains(list, "blocked=jobs") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lines := strings.Split(strings.TrimSpace(list), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("client list: got %q", list)
+	}
+	if !strings.Contains(lines[0], "name=admin") || !strings.Contains(lines[1], "cmd=pop blocked=jobs") {
+		t.Fatalf("client list: got %q", list)
+	}
+
+	id := strings.TrimPrefix(strings.Fields(lines[1])[0], "id=")
+	if got := admin.do("client", "kill", "id", id); got != ":1" {
+		t.Fatalf("client kill: got %q", got)
+	}
+	_ = consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := consumer.r.ReadByte(); err == nil {
+		t.Fatal("expected killed connection to be closed")
+	}
+}
+
+// waitBlocked waits until a connection of srv is blocked on route.
+func waitBlocked(t *testing.T, srv *Server, route string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, c := range srv.clients.list() {
+			c.mu.Lock()
+			blocked := c.blockedRoute
+			c.mu.Unlock()
+			if blocked == route {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("no connection blocked on %s", route)
+}
+
+func TestShutdown(t *testing.T) {
+	srv := &Server{Queue: NewPriorityQueueWithRouting()}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	idle := dial(t, ln.Addr().String())
+	if got := idle.do("ping"); got != "PONG" {
+		t.Fatalf("ping: got %q", got)
+	}
+	idle.do("configure", "mail", "delivery", "atleastonce")
+	idle.do("push", "mail", "a", "1")
+	idle.do("pop", "mail")
+	blocked := dial(t, ln.Addr().String())
+	blocked.send("pop", "jobs")
+	waitBlocked(t, srv, "jobs")
+
+	report, err := srv.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Queue.Length("mail"); n != 1 {
+		t.Errorf("reserved item after shutdown: length %d, want 1", n)
+	}
+	if report.ConnsDrained != 2 || report.ConnsForced != 0 || report.InflightRequeued != 1 {
+		t.Errorf("unexpected report: %s", report)
+	}
+	if err = <-served; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Serve: got %v, want ErrServerClosed", err)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	srv := &Server{Queue: NewPriorityQueueWithRouting()}
+	local, remote := net.Pipe()
+	served := make(chan error, 1)
+	go func() { served <- srv.ServeConn(context.Background(), remote) }()
+
+	conn := &testConn{t: t, Conn: local, r: bufio.NewReader(local)}
+	if got := conn.do("push", "jobs", "a", "1"); !strings.HasPrefix(got, ":") {
+		t.Fatalf("push: got %q", got)
+	}
+	if n := srv.Queue.Length("jobs"); n != 1 {
+		t.Errorf("Expected 1 item, got %d", n)
+	}
+
+	if _, err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("ServeConn: got %v", err)
+	}
+	local, remote = net.Pipe()
+	defer local.Close()
+	if err := srv.ServeConn(context.Background(), remote); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("ServeConn after Shutdown: got %v, want ErrServerClosed", err)
+	}
+}
+
+func TestBlockedPeerGone(t *testing.T) {
+	srv := &Server{KeepAlive: time.Second}
+	addr := startServer(t, srv)
+
+	consumer := dial(t, addr)
+	consumer.send("pop", "jobs")
+	waitBlocked(t, srv, "jobs")
+	_ = consumer.Close()
+	for srv.Queue.Blocked("jobs") != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the item waits for a live consumer instead of being written to the closed connection.
+	producer := dial(t, addr)
+	if got := producer.do("push", "jobs", "a", "1"); got != ":1" {
+		t.Fatalf("push: got %q", got)
+	}
+	if got := producer.do("pop", "jobs"); got != "a" {
+		t.Errorf("pop: got %q", got)
+	}
+}
+
+func TestPipelinedReplies(t *testing.T) {
+	addr := startServer(t, &Server{})
+	conn := dial(t, addr)
+
+	conn.send("ping")
+	conn.send("echo", "a")
+	conn.send("pop", "jobs")
+	// the replies before the blocking pop are sent without waiting for it.
+	if got := conn.reply(); got != "PONG" {
+		t.Errorf("ping: got %q", got)
+	}
+	if got := conn.reply(); got != "a" {
+		t.Errorf("echo: got %q", got)
+	}
+	if got := dial(t, addr).do("push", "jobs", "b", "1"); got != ":1" {
+		t.Fatalf("push: got %q", got)
+	}
+	if got := conn.reply(); got != "b" {
+		t.Errorf("pop: got %q", got)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	srv := &Server{ReplicaOf: "127.0.0.1:1"}
+	addr := startServer(t, srv)
+	conn := dial(t, addr)
+
+	if got := conn.do("health", "live"); got != "OK" {
+		t.Errorf("health live: got %q", got)
+	}
+	if got := conn.do("health", "ready"); got != "-UNREADY not in sync with the leader" {
+		t.Errorf("health ready: got %q", got)
+	}
+	if got := conn.do("health"); got != "live yes ready no accepting yes persistence yes role follower replication_lag 0 link no" {
+		t.Errorf("health: got %q", got)
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	dir := t.TempDir()
+	workers, producers := filepath.Join(dir, "workers.sock"), filepath.Join(dir, "producers.sock")
+	srv := &Server{Queue: NewPriorityQueueWithRouting(), Addrs: []string{"unix://" + workers, "unix://" + producers}}
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe() }()
+
+	dialUnix := func(path string) *testConn {
+		var conn net.Conn
+		eventually(t, func() bool {
+			var err error
+			conn, err = net.Dial("unix", path)
+			return err == nil
+		})
+		t.Cleanup(func() { _ = conn.Close() })
+		return &testConn{t: t, Conn: conn, r: bufio.NewReader(conn)}
+	}
+	// both addresses share the queue.
+	if got := dialUnix(producers).do("push", "jobs", "a", "1"); got != ":1" {
+		t.Errorf("push: got %q", got)
+	}
+	if got := dialUnix(workers).do("pop", "jobs"); got != "a" {
+		t.Errorf("pop: got %q", got)
+	}
+
+	if _, err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("ListenAndServe: got %v, want ErrServerClosed", err)
+	}
+
+	for _, addr := range []string{"tls://127.0.0.1:0", "udp://127.0.0.1:0"} {
+		if err := (&Server{Queue: NewPriorityQueueWithRouting(), Addrs: []string{addr}}).ListenAndServe(); err == nil {
+			t.Errorf("ListenAndServe %s: want an error", addr)
+		}
+	}
+}
+
+func TestDebugCommand(t *testing.T) {
+	srv := &Server{}
+	conn := dial(t, startServer(t, srv))
+
+	start := time.Now()
+	if got := conn.do("debug", "sleep", "20"); got != "OK" {
+		t.Errorf("debug sleep: got %q", got)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("debug sleep replied after %v", elapsed)
+	}
+
+	conn.do("push", "jobs", "a", "1")
+	if got := conn.do("debug", "jmap"); !strings.Contains(got, "route=\"jobs\" heap=1 spilled=0") {
+		t.Errorf("debug jmap: got %q", got)
+	}
+
+	conn.send("debug", "quit")
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.r.ReadByte(); err != io.EOF {
+		t.Errorf("debug quit: got %v, want EOF", err)
+	}
+}
+
+func TestEmbedded(t *testing.T) {
+	e := NewEmbedded()
+	srv := e.NewServer("")
+	conn := dial(t, startServer(t, srv))
+
+	// the in-process users and the network clients share the queue.
+	if id := e.Push("jobs", "a", 1); id != 1 {
+		t.Errorf("push: got id %d", id)
+	}
+	if got := conn.do("pop", "jobs"); got != "a" {
+		t.Errorf("pop over the network: got %q", got)
+	}
+	conn.do("push", "jobs", "b", "1")
+	conn.do("push", "jobs", "c", "2")
+	if item, ok := e.TryPop("jobs"); !ok || item.Value() != "c" {
+		t.Errorf("try pop: got %v, %v", item, ok)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var got []string
+	err := e.Subscribe(ctx, "jobs", func(item *Item) {
+		got = append(got, item.Value())
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) || len(got) != 1 || got[0] != "b" {
+		t.Errorf("subscribe: got %v, %v", got, err)
+	}
+}
+
+func TestRouteToken(t *testing.T) {
+	secret := []byte("secret")
+	addr := startServer(t, &Server{Password: "pass", TokenSecret: secret})
+
+	token := NewRouteToken(secret, "jobs", time.Now().Add(time.Minute))
+	conn := dial(t, addr)
+	if got := conn.do("push", "jobs", "a", "1"); got != "-"+ErrNoAuth.Error() {
+		t.Errorf("push without auth: got %q", got)
+	}
+	if got := conn.do("push", "jobs", "a", "1", "token", token); got != ":1" {
+		t.Errorf("push with token: got %q", got)
+	}
+	if got := conn.do("push", "other", "a", "1", "token", token); got != "-"+errTokenScope.Error() {
+		t.Errorf("push to another route: got %q", got)
+	}
+	if got := conn.do("pop", "jobs", "other", "token", token); got != "-"+errTokenScope.Error() {
+		t.Errorf("pop from another route: got %q", got)
+	}
+	expired := NewRouteToken(secret, "jobs", time.Now().Add(-time.Minute))
+	if got := conn.do("auth", "token", expired); got != "-"+errInvalidToken.Error() {
+		t.Errorf("auth with expired token: got %q", got)
+	}
+	if got := conn.do("auth", "token", token); got != "OK" {
+		t.Errorf("auth token: got %q", got)
+	}
+	if got := conn.do("length", "jobs"); got != ":1" {
+		t.Errorf("length: got %q", got)
+	}
+	if got := conn.do("client", "list"); got != "-"+errTokenScope.Error() {
+		t.Errorf("client list with token: got %q", got)
+	}
+	if got := conn.do("auth", "pass"); got != "OK" {
+		t.Errorf("auth: got %q", got)
+	}
+	if got := conn.do("token", "other", "60"); !strings.HasPrefix(got, "b3RoZXI.") {
+		t.Errorf("token: got %q", got)
+	}
+}
+
+func TestRouteTokenExpiry(t *testing.T) {
+	secret := []byte("secret")
+	clock := khronostest.NewClock(time.Unix(1000, 0))
+	addr := startServer(t, &Server{TokenSecret: secret, Clock: clock})
+
+	conn := dial(t, addr)
+	if got := conn.do("auth", "token", NewRouteToken(secret, "jobs", time.Unix(1060, 0))); got != "OK" {
+		t.Errorf("auth token: got %q", got)
+	}
+	if got := conn.do("length", "jobs"); got != ":0" {
+		t.Errorf("length: got %q", got)
+	}
+	// the connection loses the access of the token once it expires.
+	clock.Advance(time.Minute)
+	if got := conn.do("length", "jobs"); got != "-"+errInvalidToken.Error() {
+		t.Errorf("length after the expiry: got %q", got)
+	}
+}
+
+func TestTokenArgumentsWithoutSecret(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{}))
+
+	if got := conn.do("push", "jobs", "token", "5"); got != ":1" {
+		t.Errorf("push of the value token: got %q", got)
+	}
+	if got := conn.do("pop", "jobs", "withscore"); got != "token :5" {
+		t.Errorf("pop: got %q", got)
+	}
+}
+
+func TestACL(t *testing.T) {
+	srv := &Server{Password: "admin"}
+	if err := srv.SetUser("producer", "on", ">p", "~jobs:*", "+push", "+length"); err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, srv)
+
+	admin := dial(t, addr)
+	admin.do("auth", "admin")
+	if got := admin.do("acl", "setuser", "worker", "on", ">w", "~jobs:*", "+@write", "-push"); got != "OK" {
+		t.Errorf("acl setuser: got %q", got)
+	}
+	if got := admin.do("acl", "setuser", "worker", "+bogus"); got != "-ERR error in ACL SETUSER modifier '+bogus'" {
+		t.Errorf("acl setuser with an unknown command: got %q", got)
+	}
+	if got := admin.do("acl", "users"); got != "producer worker" {
+		t.Errorf("acl users: got %q", got)
+	}
+	if got := admin.do("acl", "whoami"); got != "default" {
+		t.Errorf("acl whoami: got %q", got)
+	}
+
+	producer := dial(t, addr)
+	if got := producer.do("auth", "producer", "wrong"); got != "-"+errInvalidUserPass.Error() {
+		t.Errorf("auth with a wrong password: got %q", got)
+	}
+	producer.do("auth", "producer", "p")
+	if got := producer.do("push", "jobs:eu", "a", "1"); got != ":1" {
+		t.Errorf("push: got %q", got)
+	}
+	if got := producer.do("push", "other", "a", "1"); got != "-"+errRoutePerm.Error() {
+		t.Errorf("push to another namespace: got %q", got)
+	}
+	if got := producer.do("pop", "jobs:eu"); got != "-NOPERM this user has no permissions to run the 'pop' command" {
+		t.Errorf("pop by the producer: got %q", got)
+	}
+
+	worker := dial(t, addr)
+	worker.do("auth", "worker", "w")
+	if got := worker.do("acl", "whoami"); got != "-NOPERM this user has no permissions to run the 'acl' command" {
+		t.Errorf("acl whoami by the worker: got %q", got)
+	}
+	if got := worker.do("push", "jobs:eu", "b", "1"); got != "-NOPERM this user has no permissions to run the 'push' command" {
+		t.Errorf("push by the worker: got %q", got)
+	}
+	if got := worker.do("pop", "jobs:eu", "withheaders"); got != "a" {
+		t.Errorf("pop by the worker: got %q", got)
+	}
+
+	// the changes apply to the authenticated connections.
+	admin.do("acl", "setuser", "worker", "off")
+	if got := worker.do("length", "jobs:eu"); got != "-"+ErrNoAuth.Error() {
+		t.Errorf("length by a disabled user: got %q", got)
+	}
+	if got := admin.do("acl", "deluser", "worker", "nobody"); got != ":1" {
+		t.Errorf("acl deluser: got %q", got)
+	}
+	if got := admin.do("acl", "list"); !strings.HasPrefix(got, "user producer on #") || !strings.HasSuffix(got, " ~jobs:* -@all +length +push") {
+		t.Errorf("acl list: got %q", got)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	addr := startServer(t, &Server{MaxConns: 1})
+
+	first := dial(t, addr)
+	if got := first.do("ping"); got != "PONG" {
+		t.Fatalf("ping: got %q", got)
+	}
+	second := dial(t, addr)
+	if got := second.reply(); got != "-"+errMaxClients.Error() {
+		t.Fatalf("second conn: got %q", got)
+	}
+
+	_ = first.Close()
+	eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		c := &testConn{t: t, Conn: conn, r: bufio.NewReader(conn)}
+		return c.do("ping") == "PONG"
+	})
+}
+
+func TestMaxConnsBlock(t *testing.T) {
+	addr := startServer(t, &Server{MaxConns: 1, MaxConnsBlock: true})
+
+	first := dial(t, addr)
+	if got := first.do("ping"); got != "PONG" {
+		t.Fatalf("ping: got %q", got)
+	}
+	second := dial(t, addr)
+	second.send("ping")
+	_ = second.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := second.r.ReadByte(); err == nil {
+		t.Fatal("second conn served while the limit is reached")
+	}
+
+	_ = first.Close()
+	if got := second.reply(); got != "PONG" {
+		t.Fatalf("second conn after first closed: got %q", got)
+	}
+}
+
+func TestServerClock(t *testing.T) {
+	RegisterListCommands()
+	clock := khronostest.NewClock(time.Unix(0, 0))
+	addr := startServer(t, &Server{Clock: clock})
+
+	conn := dial(t, addr)
+	conn.send("blpop", "jobs", "10")
+	// the timeout of blpop, and the timer of the cron jobs.
+	clock.BlockUntil(2)
+	clock.Advance(5 * time.Second)
+	if got := dial(t, addr).do("client", "list"); !strings.Contains(got, "age=5 cmd=blpop") {
+		t.Errorf("client list: got %q", got)
+	}
+	clock.Advance(5 * time.Second)
+	if got := conn.reply(); got != "(nil)" {
+		t.Errorf("blpop: got %q", got)
+	}
+}
+
+func TestCron(t *testing.T) {
+	clock := khronostest.NewClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	srv := &Server{Clock: clock}
+	addr := startServer(t, srv)
+	clock.BlockUntil(1)
+
+	conn := dial(t, addr)
+	if got := conn.do("cron", "add", "every5", "*/5 * * * *", "jobs", "tick", "1"); got != "OK" {
+		t.Fatalf("cron add: got %q", got)
+	}
+	if got := conn.do("cron", "add", "bad", "*/5 * *", "jobs", "tick", "1"); got != "-ERR invalid cron schedule" {
+		t.Errorf("cron add invalid: got %q", got)
+	}
+	if got := conn.do("cron", "list"); got != `every5 "*/5 * * * *" jobs "tick" 1 next=2026-01-01T00:05:00Z` {
+		t.Errorf("cron list: got %q", got)
+	}
+	for i := 0; i < 5; i++ {
+		clock.Advance(time.Minute)
+		clock.BlockUntil(1)
+	}
+	if n := srv.Queue.Length("jobs"); n != 1 {
+		t.Errorf("Expected 1 item after 5 minutes, got %d", n)
+	}
+	if got := conn.do("cron", "del", "every5"); got != "OK" {
+		t.Errorf("cron del: got %q", got)
+	}
+	if got := conn.do("cron", "del", "every5"); got != "-ERR no such cron job" {
+		t.Errorf("cron del missing: got %q", got)
+	}
+}
+
+func TestAppendOnlyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "khronos.aof")
+	srv := &Server{AppendOnlyFile: path}
+	conn := dial(t, startServer(t, srv))
+	conn.do("push", "jobs", "a", "1")
+	conn.do("push", "jobs", "b", "2")
+	conn.do("push", "jobs", "c", "3")
+	if got := conn.do("pop", "jobs"); got != "c" {
+		t.Fatalf("pop: got %q", got)
+	}
+	conn.do("cron", "add", "hourly", "0 * * * *", "jobs", "tick", "1")
+	report, err := srv.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ItemsPersisted != 2 {
+		t.Errorf("Expected 2 items persisted, got %d", report.ItemsPersisted)
+	}
+
+	// the queue is rebuilt by the next server.
+	srv = &Server{AppendOnlyFile: path}
+	conn = dial(t, startServer(t, srv))
+	defer srv.Shutdown(context.Background())
+	if got := conn.do("length", "jobs"); got != ":2" {
+		t.Errorf("length: got %q", got)
+	}
+	if jobs := srv.Queue.CronJobs(); len(jobs) != 1 {
+		t.Errorf("Expected the cron job to be restored, got %v", jobs)
+	}
+
+	conn.do("push", "jobs", "d", "4")
+	conn.do("pop", "jobs")
+	if got := conn.do("bgrewriteaof"); got != "OK" {
+		t.Fatalf("bgrewriteaof: got %q", got)
+	}
+	eventually(t, func() bool { return strings.Contains(conn.do("info", "persistence"), "aof_rewrites:2\r\n") })
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushes := strings.Count(string(data), "$4\r\npush\r\n"); pushes != 2 || strings.Contains(string(data), "$3\r\ndel\r\n") {
+		t.Errorf("Expected the file to be compacted to 2 pushes, got %q", data)
+	}
+
+	if got := dial(t, startServer(t, &Server{})).do("bgrewriteaof"); got != "-"+errAOFDisabled.Error() {
+		t.Errorf("bgrewriteaof without a file: got %q", got)
+	}
+}
+
+func TestAppendOnlyFileOverflowError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "khronos.aof")
+	srv := &Server{AppendOnlyFile: path, Queue: NewPriorityQueueWithRouting()}
+	srv.Queue.SetOverflowDir(t.TempDir())
+	srv.Queue.SetRouteConfig("jobs", RouteConfig{MaxInMemory: 2})
+	conn := dial(t, startServer(t, srv))
+	defer srv.Shutdown(context.Background())
+	for i := 0; i < 10; i++ {
+		conn.do("push", "jobs", strconv.Itoa(i), strconv.Itoa(i))
+	}
+	// damage the paged items following the heads of the segments.
+	srv.Queue.queueLock.Lock()
+	for _, s := range srv.Queue.routes["jobs"].segments {
+		if err := s.file.Truncate(s.offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv.Queue.queueLock.Unlock()
+
+	if got := conn.do("bgrewriteaof"); got != "OK" {
+		t.Fatalf("bgrewriteaof: got %q", got)
+	}
+	eventually(t, func() bool { return strings.Contains(conn.do("info", "persistence"), "aof_last_write_status:err\r\n") })
+	// the file is not compacted to the snapshot missing the damaged items.
+	eventually(t, func() bool {
+		data, err := os.ReadFile(path)
+		return err == nil && strings.Count(string(data), "$4\r\npush\r\n") == 10
+	})
+}
+
+func TestAppendOnlyFileReservations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "khronos.aof")
+	srv := &Server{AppendOnlyFile: path}
+	conn := dial(t, startServer(t, srv))
+	conn.do("configure", "jobs", "delivery", "atleastonce")
+	conn.do("push", "jobs", "a", "2")
+	conn.do("push", "jobs", "b", "1")
+	conn.do("pop", "jobs")
+	id, _, _ := strings.Cut(conn.do("pop", "jobs"), " ")
+	if got := conn.do("confirm", "jobs", id); got != ":1" {
+		t.Fatalf("confirm: got %q", got)
+	}
+	if _, err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the item reserved and not confirmed is delivered again, after the operations are replayed
+	// and after the compacted file is.
+	for i := 0; i < 2; i++ {
+		srv = &Server{AppendOnlyFile: path}
+		conn = dial(t, startServer(t, srv))
+		if got := conn.do("length", "jobs"); got != ":1" {
+			t.Errorf("restart %d: length: got %q", i, got)
+		}
+		if got := conn.do("pop", "jobs"); !strings.HasSuffix(got, " a") {
+			t.Errorf("restart %d: pop: got %q", i, got)
+		}
+		if _, err := srv.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAppendOnlyFileDedup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "khronos.aof")
+	srv := &Server{AppendOnlyFile: path}
+	conn := dial(t, startServer(t, srv))
+	conn.do("push", "jobs", "a", "1", "dedup", "order-1", "60000")
+	conn.do("pop", "jobs")
+	if _, err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the id is still deduplicated after the operations are replayed and after the compacted file is.
+	for i := 0; i < 2; i++ {
+		srv = &Server{AppendOnlyFile: path}
+		conn = dial(t, startServer(t, srv))
+		if got := conn.do("push", "jobs", "a", "1", "dedup", "order-1", "60000"); got != ":0" {
+			t.Errorf("restart %d: push: got %q", i, got)
+		}
+		if _, err := srv.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAppendOnlyFileGroups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "khronos.aof")
+	srv := &Server{AppendOnlyFile: path}
+	conn := dial(t, startServer(t, srv))
+	conn.do("group", "create", "jobs", "billing")
+	conn.do("group", "create", "jobs", "audit")
+	conn.do("push", "jobs", "a", "1")
+	conn.do("push", "jobs", "b", "2")
+	conn.do("push", "jobs", "c", "3")
+	conn.do("pop", "jobs", "group=billing", "consumer=w1")
+	conn.do("pop", "jobs", "group=billing", "consumer=w1")
+	conn.do("pop", "jobs", "group=audit", "consumer=w2")
+	entries, _ := srv.Queue.Pending("jobs", "billing")
+	conn.do("xack", "jobs", "billing", strconv.FormatUint(entries[0].ID, 10))
+	if got := conn.do("group", "create", "jobs", "gone"); got != "OK" {
+		t.Fatalf("group create: got %q", got)
+	}
+	conn.do("group", "destroy", "jobs", "gone")
+	if _, err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first restart replays the operations, the second one the compacted file.
+	for i := 0; i < 2; i++ {
+		srv = &Server{AppendOnlyFile: path}
+		conn = dial(t, startServer(t, srv))
+		billing, err := srv.Queue.Pending("jobs", "billing")
+		if err != nil || len(billing) != 1 || billing[0].Consumer != "w1" {
+			t.Errorf("restart %d: billing pending entries: got %+v, %v", i, billing, err)
+		}
+		audit, err := srv.Queue.Pending("jobs", "audit")
+		if err != nil || len(audit) != 1+i || audit[0].Consumer != "w2" {
+			t.Errorf("restart %d: audit pending entries: got %+v, %v", i, audit, err)
+		}
+		if _, err = srv.Queue.Pending("jobs", "gone"); err != ErrNoSuchGroup {
+			t.Errorf("restart %d: Expected the destroyed group to stay destroyed, got %v", i, err)
+		}
+		if got := conn.do("pop", "jobs", "group=audit", "consumer=w2"); !strings.HasSuffix(got, " "+[]string{"b", "a"}[i]) {
+			t.Errorf("restart %d: pop audit: got %q", i, got)
+		}
+		if routes := srv.Queue.MemoryStats().Routes; routes != 1 {
+			t.Errorf("restart %d: Expected the routes of the groups to be internal, got %d routes", i, routes)
+		}
+		if err = srv.Queue.Accounting().Check(); err != nil {
+			t.Errorf("restart %d: %v", i, err)
+		}
+		if _, err = srv.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAppendOnlyFileRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "khronos.aof")
+	srv := &Server{AppendOnlyFile: path}
+	conn := dial(t, startServer(t, srv))
+	for _, value := range []string{"a", "b", "c"} {
+		conn.do("push", "jobs", value, "1")
+	}
+	if _, err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check, err := CheckAppendOnlyFile(path)
+	if err != nil || check.Err != nil || check.Version != 1 || check.Operations < 3 || check.ValidSize != check.Size {
+		t.Fatalf("CheckAppendOnlyFile: got %+v, %v", check, err)
+	}
+
+	operations := check.Operations
+	// a crash in the middle of the last write.
+	if err = os.Truncate(path, check.Size-2); err != nil {
+		t.Fatal(err)
+	}
+	check, err = CheckAppendOnlyFile(path)
+	if err != nil || !errors.Is(check.Err, ErrAppendOnlyTruncated) || check.Operations != operations-1 {
+		t.Errorf("CheckAppendOnlyFile of a truncated file: got %+v, %v", check, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[check.ValidSize-1] ^= 0xff
+	if err = os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	check, err = CheckAppendOnlyFile(path)
+	if err != nil || !errors.Is(check.Err, ErrAppendOnlyCorrupt) || check.Operations != operations-2 {
+		t.Errorf("CheckAppendOnlyFile of a corrupt file: got %+v, %v", check, err)
+	}
+
+	// the server recovers the valid operations, and rewrites the file without the damaged ones.
+	srv = &Server{AppendOnlyFile: path}
+	conn = dial(t, startServer(t, srv))
+	if got := conn.do("length", "jobs"); got != ":1" {
+		t.Errorf("length after recovery: got %q", got)
+	}
+	if _, err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if check, err = CheckAppendOnlyFile(path); err != nil || check.Err != nil || check.Operations != operations-2 {
+		t.Errorf("CheckAppendOnlyFile after recovery: got %+v, %v", check, err)
+	}
+
+	// the files written without checksums are still loaded.
+	if err = os.WriteFile(path, []byte("*4\r\n$4\r\npush\r\n$4\r\njobs\r\n$1\r\nx\r\n$1\r\n1\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv = &Server{AppendOnlyFile: path}
+	conn = dial(t, startServer(t, srv))
+	defer srv.Shutdown(context.Background())
+	if got := conn.do("length", "jobs"); got != ":1" {
+		t.Errorf("length of a file without checksums: got %q", got)
+	}
+}
+
+func TestRepairAppendOnlyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "khronos.aof")
+	srv := &Server{AppendOnlyFile: path}
+	conn := dial(t, startServer(t, srv))
+	conn.do("push", "jobs", "a", "1")
+	conn.do("push", "mail", "b", "2")
+	if _, err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(path, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	var pushes []string
+	check, err := ReadAppendOnlyFile(path, func(args []string) {
+		if args[0] == "push" {
+			pushes = append(pushes, strings.Join(args[1:3], " "))
+		}
+	})
+	if err != nil || check.Err == nil || !slices.Equal(pushes, []string{"jobs a"}) {
+		t.Errorf("ReadAppendOnlyFile: got %v, %+v, %v", pushes, check, err)
+	}
+	pq := NewPriorityQueueWithRouting()
+	if _, err = pq.LoadAppendOnlyFile(path); err != nil || pq.Length("jobs") != 1 || pq.Length("mail") != 0 {
+		t.Errorf("LoadAppendOnlyFile: got %d and %d items, %v", pq.Length("jobs"), pq.Length("mail"), err)
+	}
+
+	if _, err = RepairAppendOnlyFile(path); err != nil {
+		t.Fatal(err)
+	}
+	repaired, err := CheckAppendOnlyFile(path)
+	if err != nil || repaired.Err != nil || repaired.Size != check.ValidSize || repaired.Operations != check.Operations {
+		t.Errorf("CheckAppendOnlyFile after the repair: got %+v, %v, want %d valid bytes", repaired, err, check.ValidSize)
+	}
+}
+
+// memStorage is a Storage keeping the operations in memory.
+type memStorage struct {
+	mu          sync.Mutex
+	ops         [][]string
+	compactions int
+}
+
+func (s *memStorage) Load(apply func(op []string)) error {
+	s.mu.Lock()
+	ops := slices.Clone(s.ops)
+	s.mu.Unlock()
+	for _, op := range ops {
+		apply(op)
+	}
+	return nil
+}
+
+func (s *memStorage) Append(ops [][]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = append(s.ops, ops...)
+	return nil
+}
+
+func (s *memStorage) Sync() error { return nil }
+
+func (s *memStorage) Compact(ops [][]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = slices.Clone(ops)
+	s.compactions++
+	return nil
+}
+
+func (s *memStorage) Snapshot(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := io.WriteString(w, aofMagic); err != nil {
+		return err
+	}
+	for _, op := range s.ops {
+		if _, err := writeRecord(w, op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.ops))
+}
+
+func (s *memStorage) Close() error { return nil }
+
+func TestStorage(t *testing.T) {
+	storage := &memStorage{}
+	srv := &Server{Storage: storage}
+	conn := dial(t, startServer(t, srv))
+	conn.do("push", "jobs", "a", "1")
+	conn.do("push", "jobs", "b", "2")
+	conn.do("pop", "jobs")
+	conn.do("bind", "all", "jobs.#")
+	if _, err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if storage.compactions != 1 || len(storage.ops) < 3 {
+		t.Errorf("Expected a compaction and the operations appended, got %d and %q", storage.compactions, storage.ops)
+	}
+
+	srv = &Server{Storage: storage}
+	conn = dial(t, startServer(t, srv))
+	defer srv.Shutdown(context.Background())
+	if got := conn.do("pop", "jobs"); got != "a" {
+		t.Errorf("pop after a restart: got %q", got)
+	}
+	if got := conn.do("bindings"); !strings.Contains(got, "all jobs.#") {
+		t.Errorf("bindings after a restart: got %q", got)
+	}
+	if got := conn.do("info", "persistence"); !strings.Contains(got, "aof_enabled:1\r\n") {
+		t.Errorf("info persistence: got %q", got)
+	}
+}
+
+func TestFileStorageSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewFileStorage(filepath.Join(dir, "khronos.aof"))
+	if err := storage.Compact([][]string{{"push", "jobs", "a", "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Append([][]string{{"push", "jobs", "b", "2"}}); err != nil {
+		t.Fatal(err)
+	}
+	var snapshot bytes.Buffer
+	if err := storage.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if int64(snapshot.Len()) != storage.Size() {
+		t.Errorf("snapshot of %d bytes, want %d", snapshot.Len(), storage.Size())
+	}
+	path := filepath.Join(dir, "backup.aof")
+	if err := os.WriteFile(path, snapshot.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if check, err := CheckAppendOnlyFile(path); err != nil || check.Err != nil || check.Operations != 2 {
+		t.Errorf("CheckAppendOnlyFile of the snapshot: got %+v, %v", check, err)
+	}
+}
+
+// memUploader is an Uploader keeping the snapshots in memory.
+type memUploader struct {
+	mu        sync.Mutex
+	snapshots map[string][]byte
+	err       error
+}
+
+func (u *memUploader) Upload(ctx context.Context, name string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.err != nil {
+		return u.err
+	}
+	if u.snapshots == nil {
+		u.snapshots = make(map[string][]byte)
+	}
+	u.snapshots[name] = data
+	return nil
+}
+
+func TestSnapshotUpload(t *testing.T) {
+	dir := t.TempDir()
+	uploader := &memUploader{}
+	srv := &Server{AppendOnlyFile: filepath.Join(dir, "khronos.aof"), Uploader: uploader, UploadPrefix: "backups/khronos-"}
+	conn := dial(t, startServer(t, srv))
+	conn.do("push", "jobs", "a", "1")
+	conn.do("push", "jobs", "b", "2")
+	if _, err := srv.shutdown(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	uploader.mu.Lock()
+	var last string
+	for name := range uploader.snapshots {
+		if !strings.HasPrefix(name, "backups/khronos-") || !strings.HasSuffix(name, ".aof") {
+			t.Errorf("snapshot name %q", name)
+		}
+		last = max(last, name)
+	}
+	snapshot := uploader.snapshots[last]
+	uploader.err = errors.New("bucket not found")
+	uploader.mu.Unlock()
+	path := filepath.Join(dir, "backup.aof")
+	if err := os.WriteFile(path, snapshot, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pq := NewPriorityQueueWithRouting()
+	if check, err := pq.LoadAppendOnlyFile(path); err != nil || check.Err != nil || pq.Length("jobs") != 2 {
+		t.Errorf("last snapshot %s: got %d items, %+v, %v", last, pq.Length("jobs"), check, err)
+	}
+
+	srv = &Server{AppendOnlyFile: filepath.Join(dir, "khronos.aof"), Uploader: uploader}
+	conn = dial(t, startServer(t, srv))
+	defer srv.Shutdown(context.Background())
+	eventually(t, func() bool {
+		return strings.Contains(conn.do("info", "persistence"), "snapshot_upload_failures:1\r\nsnapshot_last_upload_status:err\r\n")
+	})
+}
+
+func TestClientInfo(t *testing.T) {
+	clock := khronostest.NewClock(time.Unix(0, 0))
+	addr := startServer(t, &Server{Clock: clock})
+
+	conn := dial(t, addr)
+	conn.do("ping")
+	clock.Advance(3 * time.Second)
+	got := conn.do("client", "info")
+	for _, field := range []string{"id=1 ", "age=3 ", "cmd=client ", "idle=0 ", "cmds=2 ", "in=40 ", "out=7 ", "mode=normal ", "resp=2"} {
+		if !strings.Contains(got, field) {
+			t.Errorf("client info: missing %q in %q", field, got)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	clock := khronostest.NewClock(time.Unix(0, 0))
+	limiter := NewTokenBucketLimiter(1, 2, RateLimitByAddrAndCommand)
+	limiter.Clock = clock
+	addr := startServer(t, &Server{RateLimiter: limiter})
+
+	conn := dial(t, addr)
+	conn.do("ping")
+	conn.do("ping")
+	if got := conn.do("ping"); got != "-"+ErrRateLimited.Error() {
+		t.Errorf("ping over the limit: got %q", got)
+	}
+	if got := conn.do("echo", "hello"); got != "hello" {
+		t.Errorf("echo: got %q", got)
+	}
+	clock.Advance(time.Second)
+	if got := conn.do("ping"); got != "PONG" {
+		t.Errorf("ping after refill: got %q", got)
+	}
+}
+
+// recordLogger is a Logger recording the messages it receives.
+type recordLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordLogger) record(level, msg string, args []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, level+" "+msg+" "+fmt.Sprint(args...))
+}
+
+func (l *recordLogger) find(prefix string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, msg := range l.messages {
+		if strings.HasPrefix(msg, prefix) {
+			return msg, true
+		}
+	}
+	return "", false
+}
+
+func (l *recordLogger) Debug(msg string, args ...any) { l.record("DEBUG", msg, args) }
+func (l *recordLogger) Info(msg string, args ...any)  { l.record("INFO", msg, args) }
+func (l *recordLogger) Warn(msg string, args ...any)  { l.record("WARN", msg, args) }
+func (l *recordLogger) Error(msg string, args ...any) { l.record("ERROR", msg, args) }
+
+// slowCommand is a command advancing its clock by one second.
+type slowCommand struct {
+	PingCommand
+	clock *khronostest.Clock
+}
+
+func (c *slowCommand) Name() string {
+	return "slowping"
+}
+
+func (c *slowCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	c.clock.Advance(time.Second)
+	return c.PingCommand.Execute(ctx, writer)
+}
+
+func TestServerLogger(t *testing.T) {
+	clock := khronostest.NewClock(time.Unix(0, 0))
+	RegisterCommand("slowping", func(args []string) (Command, error) {
+		return &slowCommand{clock: clock}, nil
+	})
+	logger := &recordLogger{}
+	addr := startServer(t, &Server{Logger: logger, Clock: clock, SlowLogThreshold: time.Millisecond})
+
+	conn := dial(t, addr)
+	conn.do("push", "jobs")
+	conn.do("slowping")
+	_ = conn.Close()
+
+	eventually(t, func() bool {
+		_, ok := logger.find("INFO khronos: conn closed")
+		return ok
+	})
+	for _, prefix := range []string{"DEBUG khronos: conn opened", "WARN khronos: command error", "WARN khronos: slow command"} {
+		if _, ok := logger.find(prefix); !ok {
+			t.Errorf("missing log %q in %q", prefix, logger.messages)
+		}
+	}
+}
+
+func TestSlowLog(t *testing.T) {
+	clock := khronostest.NewClock(time.Unix(0, 0))
+	RegisterCommand("slowping", func(args []string) (Command, error) {
+		return &slowCommand{clock: clock}, nil
+	})
+	addr := startServer(t, &Server{Clock: clock, SlowLogThreshold: time.Millisecond, SlowLogMaxLen: 2})
+
+	conn := dial(t, addr)
+	conn.do("client", "setname", "worker")
+	for i := 0; i < 3; i++ {
+		conn.do("slowping")
+	}
+	conn.do("ping")
+	if got := conn.do("slowlog", "len"); got != ":2" {
+		t.Fatalf("slowlog len: got %q", got)
+	}
+	got := conn.do("slowlog", "get", "1")
+	if !strings.HasPrefix(got, "id=2 time=2 duration=1000000 ") || !strings.HasSuffix(got, " name=worker cmd=slowping") {
+		t.Errorf("slowlog get: got %q", got)
+	}
+	if got := conn.do("slowlog", "reset"); got != "OK" {
+		t.Errorf("slowlog reset: got %q", got)
+	}
+	if got := conn.do("slowlog", "get"); got != "" {
+		t.Errorf("slowlog get after reset: got %q", got)
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	addr := startServer(t, &Server{AllowCIDRs: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}})
+
+	admin := dial(t, addr)
+	if got := admin.do("config", "get", "allowcidrs"); got != "allowcidrs 127.0.0.0/8" {
+		t.Errorf("config get: got %q", got)
+	}
+	if got := admin.do("config", "set", "denycidrs", "127.0.0.1, 10.0.0.0/8"); got != "OK" {
+		t.Fatalf("config set: got %q", got)
+	}
+	if got := admin.do("config", "get", "denycidrs"); got != "denycidrs 127.0.0.1/32 10.0.0.0/8" {
+		t.Errorf("config get: got %q", got)
+	}
+	if got := admin.do("config", "set", "denycidrs", "nope"); !strings.HasPrefix(got, "-ERR invalid CIDR") {
+		t.Errorf("config set invalid: got %q", got)
+	}
+
+	denied := dial(t, addr)
+	_ = denied.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := denied.r.ReadByte(); err != io.EOF {
+		t.Errorf("denied conn: got %v, want EOF", err)
+	}
+	if got := admin.do("info", "stats"); !strings.Contains(got, "denied_connections:1\r\n") {
+		t.Errorf("info stats: got %q", got)
+	}
+
+	if got := admin.do("config", "set", "denycidrs", ""); got != "OK" {
+		t.Fatalf("config set: got %q", got)
+	}
+	if got := dial(t, addr).do("ping"); got != "PONG" {
+		t.Errorf("ping after clearing denycidrs: got %q", got)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	addr := startServer(t, &Server{ProxyProtocol: true, DenyCIDRs: []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}})
+
+	v1 := dial(t, addr)
+	_, _ = v1.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 4242 7464\r\n"))
+	if got := v1.do("client", "list"); !strings.Contains(got, " addr=203.0.113.7:4242 ") {
+		t.Errorf("client list: got %q", got)
+	}
+
+	v2 := dial(t, addr)
+	header := append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c"), 203, 0, 113, 8, 10, 0, 0, 1, 0x10, 0x92, 0x1d, 0x28)
+	_, _ = v2.Write(header)
+	if got := v2.do("client", "list"); !strings.Contains(got, " addr=203.0.113.8:4242 ") {
+		t.Errorf("client list: got %q", got)
+	}
+
+	// health checks of the proxy keep the address of the connection.
+	local := dial(t, addr)
+	_, _ = local.Write([]byte("PROXY UNKNOWN\r\n"))
+	if got := local.do("ping"); got != "PONG" {
+		t.Errorf("ping: got %q", got)
+	}
+
+	for _, header := range []string{"PING\r\n\r\n\r\n\r\n", "PROXY TCP4 198.51.100.1 10.0.0.1 4242 7464\r\n"} {
+		conn := dial(t, addr)
+		_, _ = conn.Write([]byte(header))
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.r.ReadByte(); err != io.EOF {
+			t.Errorf("%q: got %v, want EOF", header, err)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	events := make(chan AuditEvent, 8)
+	addr := startServer(t, &Server{Password: "secret", Audit: func(event AuditEvent) { events <- event }})
+
+	conn := dial(t, addr)
+	conn.do("client", "setname", "worker")
+	conn.do("auth", "secret")
+	conn.do("push", "jobs", "a", "1")
+
+	for _, want := range []struct {
+		command string
+		args    []string
+		err     error
+	}{
+		{"client", []string{"setname", "worker"}, ErrNoAuth},
+		{"auth", []string{redacted}, nil},
+		{"push", []string{"jobs", "a", "1"}, nil},
+	} {
+		event := <-events
+		if event.Command != want.command || strings.Join(event.Args, " ") != strings.Join(want.args, " ") || !errors.Is(event.Err, want.err) {
+			t.Errorf("got %s %q %v, want %s %q %v", event.Command, event.Args, event.Err, want.command, want.args, want.err)
+		}
+		if event.ClientID == 0 || event.Addr != conn.LocalAddr().String() {
+			t.Errorf("unexpected client %d %s", event.ClientID, event.Addr)
+		}
+	}
+}
+
+// exportCommand is an async command replying once release is closed.
+type exportCommand struct {
+	ArgsCommand
+	release chan struct{}
+}
+
+func (c *exportCommand) Name() string {
+	return "export"
+}
+
+func (c *exportCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	<-c.release
+	return writer.WriteArray(c.Args())
+}
+
+func TestAsyncCommand(t *testing.T) {
+	release := make(chan struct{})
+	RegisterAsyncCommand("export", func(args []string) (Command, error) {
+		cmd := &exportCommand{release: release}
+		cmd.args = args
+		return cmd, nil
+	})
+	addr := startServer(t, &Server{AsyncWorkers: 1})
+
+	conn := dial(t, addr)
+	got := conn.do("export", "jobs")
+	if !strings.HasPrefix(got, "-ASYNC ") {
+		t.Fatalf("export: got %q", got)
+	}
+	token := strings.TrimPrefix(got, "-ASYNC ")
+	// the connection is not blocked by the running command.
+	if got := conn.do("ping"); got != "PONG" {
+		t.Errorf("ping: got %q", got)
+	}
+	if got := conn.do("taskstatus", token); got != "-"+errTaskPending.Error() {
+		t.Errorf("taskstatus while running: got %q", got)
+	}
+	close(release)
+	eventually(t, func() bool {
+		return conn.do("taskstatus", token) == "jobs"
+	})
+	if got := conn.do("taskstatus", token); got != "-"+errNoSuchTask.Error() {
+		t.Errorf("taskstatus after fetch: got %q", got)
+	}
+}
+
+func TestMultiRoutePop(t *testing.T) {
+	srv := &Server{}
+	addr := startServer(t, srv)
+
+	conn := dial(t, addr)
+	conn.do("push", "b", "x", "1")
+	conn.do("push", "c", "y", "1")
+	if got := conn.do("pop", "a", "b", "c"); got != "b x" {
+		t.Errorf("pop: got %q", got)
+	}
+
+	conn.send("pop", "a", "d")
+	waitBlocked(t, srv, "a,d")
+	dial(t, addr).do("push", "d", "z", "1")
+	if got := conn.reply(); got != "d z" {
+		t.Errorf("blocked pop: got %q", got)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	addr := startServer(t, &Server{MaxProtocolErrors: 2})
+
+	conn := dial(t, addr)
+	// the garbage is skipped up to the next command.
+	if _, err := conn.Write([]byte("*1\r\n+oops\r\ngarbage\r\n*1\r\n$4\r\nping\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.reply(); !strings.HasPrefix(got, "-ERR Protocol error") {
+		t.Errorf("malformed frame: got %q", got)
+	}
+	if got := conn.reply(); got != "PONG" {
+		t.Errorf("ping after resync: got %q", got)
+	}
+
+	// consecutive malformed frames close the connection.
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Write([]byte("PING\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.reply(); !strings.HasPrefix(got, "-ERR Protocol error") {
+			t.Errorf("malformed frame %d: got %q", i, got)
+		}
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.r.ReadByte(); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestFrameLimits(t *testing.T) {
+	addr := startServer(t, &Server{MaxBulkLen: 8, MaxArrayLen: 3, MaxLineLen: 16})
+
+	conn := dial(t, addr)
+	if got := conn.do("echo", "12345678"); got != "12345678" {
+		t.Errorf("echo: got %q", got)
+	}
+	for frame, want := range map[string]string{
+		"*2\r\n$4\r\necho\r\n$9999999999\r\n":         "-ERR Protocol error: invalid bulk length",
+		"*4\r\n$4\r\npush\r\n":                        "-ERR Protocol error: invalid multibulk length",
+		"*1\r\n$-5\r\n":                               "-ERR Protocol error: invalid bulk length",
+		"*1\r\n$" + strings.Repeat("0", 32) + "1\r\n": "-ERR Protocol error: too long line",
+	} {
+		conn := dial(t, addr)
+		if _, err := conn.Write([]byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.reply(); got != want {
+			t.Errorf("%q: got %q, want %q", frame, got, want)
+		}
+		// the frame can not be skipped, the connection is closed.
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.r.ReadByte(); err != io.EOF {
+			t.Errorf("%q: expected the connection to be closed, got %v", frame, err)
+		}
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	for input, want := range map[string]string{
+		"+ping\r\n":                  `invalid syntax at offset 0: expected '*', got "+ping"`,
+		"*1\r\n$4\r\nping\r\n*x\r\n": `invalid syntax at offset 15: expected length, got "x"`,
+		"*1\r\n$+4\r\nping\r\n":      `invalid syntax at offset 5: expected length, got "+4"`,
+		"*1\r\n$4\r\npingXY":         `invalid syntax at offset 12: expected "\r\n", got "XY"`,
+		"*0\r\n":                     "invalid syntax at offset 0: expected command, got empty array",
+	} {
+		parser := NewRespProtocolParser(strings.NewReader(input))
+		var err error
+		for err == nil {
+			_, _, err = parser.Parse()
+		}
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) || !errors.Is(err, ErrInvalidSyntax) || err.Error() != want {
+			t.Errorf("%q: got %v, want %s", input, err, want)
+		}
+	}
+	for input, want := range map[string]error{
+		"":                          io.EOF,
+		"*1\r\n$4\r\npi":            io.ErrUnexpectedEOF,
+		"*1\r":                      io.ErrUnexpectedEOF,
+		"*99999999999999999999\r\n": errArrayLength,
+	} {
+		if _, _, err := NewRespProtocolParser(strings.NewReader(input)).Parse(); err != want {
+			t.Errorf("%q: got %v, want %v", input, err, want)
+		}
+	}
+}
+
+// FuzzRespProtocolParser checks that the parser does not panic nor exceed its limits on any input,
+// and that the commands it parses are encoded back to the same commands.
+func FuzzRespProtocolParser(f *testing.F) {
+	for _, seed := range []string{
+		"*1\r\n$4\r\nping\r\n",
+		"*3\r\n$4\r\npush\r\n$4\r\njobs\r\n$1\r\n1\r\n",
+		"*2\r\n$4\r\necho\r\n$-1\r\n",
+		"*1\r\n$3\r\nabcXY",
+		"*-1\r\n",
+		"$4\r\nping\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		parser := NewRespProtocolParser(bytes.NewReader(input))
+		parser.MaxBulkLen, parser.MaxArrayLen, parser.MaxLineLen = 64, 8, 32
+		for {
+			name, args, err := parser.Parse()
+			if err != nil {
+				return
+			}
+			if len(args)+1 > 8 || len(name) > 64 {
+				t.Fatalf("%q: the command exceeds the limits", input)
+			}
+			builder := getprotocolBuilder()
+			builder.WriteArray(append([]string{name}, args...))
+			again, againArgs, err := NewRespProtocolParser(bytes.NewReader(builder.buf)).Parse()
+			putProtocolBuilder(builder)
+			if err != nil || again != name || strings.Join(againArgs, "\x00") != strings.Join(args, "\x00") {
+				t.Fatalf("%q: parsed %q %q, then %q %q, %v", input, name, args, again, againArgs, err)
+			}
+		}
+	})
+}
+
+func TestWriteValue(t *testing.T) {
+	var buf bytes.Buffer
+	writer := &responseWriter{&buf}
+	value := []any{"a", int64(10), uint64(3), true, nil, []any{[]string{"k", "v"}, []int64{1}}, ErrNoSuchItem, OK}
+	if err := WriteValue(writer, value); err != nil {
+		t.Fatal(err)
+	}
+	want := "*8\r\n$1\r\na\r\n:10\r\n:3\r\n:1\r\n$-1\r\n*2\r\n*2\r\n$1\r\nk\r\n$1\r\nv\r\n*1\r\n:1\r\n-ERR no such item\r\n+OK\r\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	buf.Reset()
+	if err := WriteValue(writer, []any{"a", 1.5}); err == nil || buf.Len() != 0 {
+		t.Errorf("Expected an unsupported type to fail without writing, got %v and %q", err, buf.String())
+	}
+}
+
+func TestServerEvents(t *testing.T) {
+	events := make(chan Event, 10)
+	addr := startServer(t, &Server{OnEvent: func(e Event) { events <- e }, Events: EventDequeued})
+
+	conn := dial(t, addr)
+	conn.do("push", "jobs", "a", "1")
+	conn.do("pop", "jobs")
+	select {
+	case e := <-events:
+		if e.Kind != EventDequeued || e.Route != "jobs" || e.Value != "a" || e.ID != 1 {
+			t.Errorf("event: got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %+v", e)
+	default:
+	}
+}
+
+func TestOnDrop(t *testing.T) {
+	type drop struct {
+		route, value string
+		reason       DropReason
+	}
+	drops := make(chan drop, 10)
+	addr := startServer(t, &Server{
+		MaxMemory:       2 * itemMemory("a"),
+		MaxMemoryPolicy: MemoryEvict,
+		OnDrop: func(route string, item Item, reason DropReason) {
+			drops <- drop{route, item.Value(), reason}
+		},
+	})
+
+	conn := dial(t, addr)
+	conn.do("configure", "jobs", "maxlength", "1")
+	conn.do("push", "jobs", "a", "1")
+	conn.do("push", "jobs", "b", "1")
+	conn.do("push", "mail", "c", "1")
+	conn.do("push", "mail", "d", "1")
+	for _, want := range []drop{{"jobs", "b", DropRejected}, {"mail", "c", DropEvicted}} {
+		select {
+		case got := <-drops:
+			if got != want {
+				t.Errorf("drop: got %+v, want %+v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no drop, want %+v", want)
+		}
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	srv := &Server{MaxMemory: 3 * itemMemory("a")}
+	addr := startServer(t, srv)
+
+	conn := dial(t, addr)
+	for _, value := range []string{"a", "b", "c"} {
+		conn.do("push", "jobs", value, "1")
+	}
+	if got := conn.do("memory", "usage", "jobs"); got != ":"+strconv.FormatInt(srv.MaxMemory, 10) {
+		t.Errorf("memory usage: got %q", got)
+	}
+	if got := conn.do("push", "jobs", "d", "1"); got != "-"+ErrOutOfMemory.Error() {
+		t.Errorf("push over maxmemory: got %q", got)
+	}
+
+	if got := conn.do("config", "set", "maxmemorypolicy", "evict"); got != "OK" {
+		t.Fatalf("config set maxmemorypolicy: got %q", got)
+	}
+	if got := conn.do("push", "jobs", "d", "2"); got != ":4" {
+		t.Errorf("push with eviction: got %q", got)
+	}
+	// c is the coldest item, enqueued last among the lowest priorities.
+	if got := conn.do("range", "jobs", "0", "-1"); got != "d a b" {
+		t.Errorf("range after eviction: got %q", got)
+	}
+	if got := conn.do("memory", "stats"); !strings.Contains(got, "evicted 1 rejected 1 maxmemory "+strconv.FormatInt(srv.MaxMemory, 10)+" policy evict") {
+		t.Errorf("memory stats: got %q", got)
+	}
+}
+
+func TestCommandInfo(t *testing.T) {
+	addr := startServer(t, &Server{})
+	c := dial(t, addr)
+
+	if got := c.do("push", "jobs"); got != "-ERR wrong number of arguments for 'push' command" {
+		t.Errorf("push with a missing argument: got %q", got)
+	}
+	if got := c.do("command", "info", "pop", "nosuch"); got != "pop :-2 write blocking :1 :-1 :1 (nil)" {
+		t.Errorf("command info: got %q", got)
+	}
+	if got := c.do("command", "count"); got != ":"+strconv.Itoa(len(commandLibraries)) {
+		t.Errorf("command count: got %q", got)
+	}
+}
+
+func BenchmarkResponseWriterString(b *testing.B) {
+	w := &responseWriter{io.Discard}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = w.WriteString("value")
+	}
+}
+
+func BenchmarkResponseWriterInt64(b *testing.B) {
+	w := &responseWriter{io.Discard}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = w.WriteInt64(int64(i))
+	}
+}
+
+func BenchmarkResponseWriterArray(b *testing.B) {
+	w := &responseWriter{io.Discard}
+	a := []string{"jobs", "1", "value"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = w.WriteArray(a)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	source := dial(t, startServer(t, &Server{}))
+	targetSrv := &Server{Password: "pass"}
+	target := startServer(t, targetSrv)
+	host, port, _ := net.SplitHostPort(target)
+
+	source.do("push", "jobs", "a", "1")
+	source.do("push", "jobs", "b", "2", "header", "k", "v")
+	if got := source.do("migrate", host, port, "jobs"); !strings.HasPrefix(got, "-NOAUTH") {
+		t.Errorf("migrate without auth: got %q", got)
+	}
+	if got := source.do("length", "jobs"); got != ":2" {
+		t.Errorf("length after a failed migrate: got %q, want the items back", got)
+	}
+	if got := source.do("migrate", host, port, "jobs", "copy", "auth", "pass"); got != ":2" {
+		t.Errorf("migrate copy: got %q", got)
+	}
+	if got := source.do("length", "jobs"); got != ":2" {
+		t.Errorf("length after migrate copy: got %q", got)
+	}
+	if got := source.do("migrate", host, port, "jobs", "auth", "pass"); got != "-"+ErrRouteExists.Error() {
+		t.Errorf("migrate to a route with items: got %q", got)
+	}
+	if got := source.do("migrate", host, port, "jobs", "replace", "auth", "pass", "timeout", "1000"); got != ":2" {
+		t.Errorf("migrate replace: got %q", got)
+	}
+	if got := source.do("length", "jobs"); got != ":0" {
+		t.Errorf("length after migrate: got %q", got)
+	}
+	if n := targetSrv.Queue.Length("jobs"); n != 2 {
+		t.Errorf("target length: got %d, want 2", n)
+	}
+	if item := targetSrv.Queue.Dequeue("jobs"); item.Value() != "b" || item.Header("k") != "v" {
+		t.Errorf("migrated item: got %q %v", item.Value(), item.Headers())
+	}
+	if got := source.do("migrate", host, port, "empty"); got != ":0" {
+		t.Errorf("migrate an empty route: got %q", got)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	srv := &Server{}
+	conn := dial(t, startServer(t, srv))
+
+	conn.do("configure", "jobs", "delivery", "atleastonce")
+	conn.do("push", "jobs", "a", "1")
+	if got := conn.do("drain"); got != "OK" {
+		t.Fatalf("drain: got %q", got)
+	}
+	if got := conn.do("push", "jobs", "b", "2"); got != "-"+ErrDraining.Error() {
+		t.Errorf("push while draining: got %q", got)
+	}
+	if got := conn.do("drain", "status"); got != "draining:1\r\npending:1\r\ninflight:0\r\n" {
+		t.Errorf("drain status: got %q", got)
+	}
+
+	drained := make(chan error)
+	go func() { drained <- srv.Drain(context.Background()) }()
+	id, _, _ := strings.Cut(conn.do("pop", "jobs"), " ")
+	if got := conn.do("drain", "status"); got != "draining:1\r\npending:0\r\ninflight:1\r\n" {
+		t.Errorf("drain status with an inflight item: got %q", got)
+	}
+	select {
+	case err := <-drained:
+		t.Fatalf("Drain returned %v with an inflight item", err)
+	case <-time.After(5 * drainPollInterval):
+	}
+	conn.do("confirm", "jobs", id)
+	if err := <-drained; err != nil {
+		t.Errorf("Drain: %v", err)
+	}
+
+	if got := conn.do("drain", "stop"); got != "OK" {
+		t.Errorf("drain stop: got %q", got)
+	}
+	if got := conn.do("push", "jobs", "b", "2"); got != ":2" {
+		t.Errorf("push after drain stop: got %q", got)
+	}
+}
+
+func TestCommandStats(t *testing.T) {
+	clock := khronostest.NewClock(time.Unix(0, 0))
+	conn := dial(t, startServer(t, &Server{Clock: clock}))
+
+	conn.do("push", "jobs", "a", "1")
+	conn.do("push", "jobs", "b", "x")
+	conn.do("length", "jobs")
+	got := conn.do("info", "commandstats")
+	for _, want := range []string{
+		"# Commandstats\r\n",
+		"cmdstat_length:calls=1,usec=0,usec_per_call=0.00,max_usec=0,errors=0\r\n",
+		"cmdstat_push:calls=2,usec=0,usec_per_call=0.00,max_usec=0,errors=1\r\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("info commandstats: got %q, want %q in it", got, want)
+		}
+	}
+
+	if got := conn.do("config", "resetstat"); got != "OK" {
+		t.Errorf("config resetstat: got %q", got)
+	}
+	if got := conn.do("info", "commandstats"); got != "# Commandstats\r\ncmdstat_config:calls=1,usec=0,usec_per_call=0.00,max_usec=0,errors=0\r\n" {
+		t.Errorf("info commandstats after resetstat: got %q", got)
+	}
+}
+
+func TestLockContention(t *testing.T) {
+	srv := &Server{LockProfiling: true}
+	addr := startServer(t, srv)
+	conn := dial(t, addr)
+
+	conn.do("push", "jobs", "a", "1")
+	// a push waits while the lock is held.
+	srv.Queue.queueLock.Lock()
+	done := make(chan string)
+	go func() {
+		done <- dial(t, addr).do("push", "jobs", "b", "2")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	srv.Queue.queueLock.Unlock()
+	<-done
+
+	c := srv.Queue.LockContention()
+	if !c.Profiling || c.Acquisitions < 2 || c.Contended < 1 || c.MaxWait < 10*time.Millisecond || c.Wait < c.MaxWait {
+		t.Fatalf("LockContention = %+v", c)
+	}
+	got := conn.do("info", "contention")
+	for _, want := range []string{"# Contention\r\n", "lock_profiling:1\r\n", "lock_contended:", "lock_wait_usec_per_acquisition:"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("info contention: got %q, want %q in it", got, want)
+		}
+	}
+
+	if got := conn.do("config", "set", "lockprofiling", "no"); got != "OK" {
+		t.Fatalf("config set lockprofiling: got %q", got)
+	}
+	if got := conn.do("config", "get", "lockprofiling"); got != "lockprofiling no" {
+		t.Errorf("config get lockprofiling: got %q", got)
+	}
+	conn.do("config", "resetstat")
+	conn.do("push", "jobs", "c", "3")
+	if c := srv.Queue.LockContention(); c.Profiling || c.Acquisitions != 0 || c.MaxWait != 0 {
+		t.Errorf("LockContention after resetstat = %+v", c)
+	}
+}
+
+func TestQueueSpaces(t *testing.T) {
+	srv := &Server{MaxSpaces: 2}
+	addr := startServer(t, srv)
+	prod, staging := dial(t, addr), dial(t, addr)
+
+	prod.do("push", "jobs", "a", "1")
+	if got := staging.do("use", "staging"); got != "OK" {
+		t.Fatalf("use staging: got %q", got)
+	}
+	if got := staging.do("length", "jobs"); got != ":0" {
+		t.Errorf("length in the staging space: got %q", got)
+	}
+	staging.do("push", "jobs", "b", "1")
+	staging.do("push", "jobs", "c", "1")
+	if got := prod.do("length", "jobs"); got != ":1" {
+		t.Errorf("length in the default space: got %q", got)
+	}
+	if got := staging.do("client", "info"); !strings.Contains(got, " space=staging ") {
+		t.Errorf("client info: got %q, want the space", got)
+	}
+
+	if got := prod.do("select", "1"); got != "OK" {
+		t.Fatalf("select 1: got %q", got)
+	}
+	if got := prod.do("length", "jobs"); got != ":0" {
+		t.Errorf("length in space 1: got %q", got)
+	}
+	if got := prod.do("use", "other"); got != "-"+errTooManySpaces.Error() {
+		t.Errorf("use beyond MaxSpaces: got %q", got)
+	}
+	if got := prod.do("select", "-1"); got != "-"+errSpaceIndex.Error() {
+		t.Errorf("select -1: got %q", got)
+	}
+	if got := prod.do("select", "0"); got != "OK" {
+		t.Fatalf("select 0: got %q", got)
+	}
+	if got := prod.do("length", "jobs"); got != ":1" {
+		t.Errorf("length back in the default space: got %q", got)
+	}
+
+	want := "# Spaces\r\nspace:0:routes=1,items=1\r\nspace:1:routes=0,items=0\r\nspace:staging:routes=1,items=2\r\n"
+	if got := prod.do("info", "spaces"); got != want {
+		t.Errorf("info spaces: got %q, want %q", got, want)
+	}
+
+	disabled := dial(t, startServer(t, &Server{}))
+	if got := disabled.do("select", "1"); got != "-"+errSpacesDisabled.Error() {
+		t.Errorf("select with spaces disabled: got %q", got)
+	}
+	if got := disabled.do("select", "0"); got != "OK" {
+		t.Errorf("select 0 with spaces disabled: got %q", got)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	clock := khronostest.NewClock(time.Unix(1000, 0))
+	srv := &Server{Clock: clock, LatencyMonitorThreshold: time.Millisecond}
+	conn := dial(t, startServer(t, srv))
+
+	srv.observeLatency(latencyAOFFsync, time.Microsecond)
+	srv.observeLatency(latencyAOFFsync, 5*time.Millisecond)
+	srv.observeLatency(latencyAOFFsync, 3*time.Millisecond)
+	clock.Advance(time.Second)
+	srv.observeLatency(latencyAOFFsync, 2*time.Millisecond)
+	for i := 0; i < latencyHistoryLen+10; i++ {
+		clock.Advance(time.Second)
+		srv.observeLatency(latencyLockWait, time.Duration(i+1)*time.Millisecond)
+	}
+
+	if got := conn.do("latency", "history", latencyAOFFsync); got != ":1000 :5 :1001 :2" {
+		t.Errorf("latency history: got %q", got)
+	}
+	history := strings.Fields(conn.do("latency", "history", latencyLockWait))
+	if len(history) != 2*latencyHistoryLen || history[0] != ":1012" || history[1] != ":11" {
+		t.Errorf("latency history of a full ring: got %d fields starting with %v", len(history), history[:2])
+	}
+	if got := conn.do("latency", "latest"); got != "aof-fsync :1001 :2 :5 lock-wait :1171 :170 :170" {
+		t.Errorf("latency latest: got %q", got)
+	}
+	if got := conn.do("latency", "reset", latencyLockWait, "nosuch"); got != ":1" {
+		t.Errorf("latency reset: got %q", got)
+	}
+	if got := conn.do("latency", "history", latencyLockWait); got != "" {
+		t.Errorf("latency history after reset: got %q", got)
+	}
+	if got := conn.do("latency", "reset"); got != ":1" {
+		t.Errorf("latency reset all: got %q", got)
+	}
+}
+
+func TestShutdownCommand(t *testing.T) {
+	if got := dial(t, startServer(t, &Server{})).do("shutdown", "save"); got != "-"+errAOFDisabled.Error() {
+		t.Errorf("shutdown save without a file: got %q", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "khronos.aof")
+	srv := &Server{AppendOnlyFile: path}
+	addr := startServer(t, srv)
+	conn := dial(t, addr)
+	conn.do("push", "jobs", "a", "1")
+	conn.do("push", "jobs", "b", "2")
+	conn.do("pop", "jobs")
+	if got := conn.do("shutdown", "bogus"); got != "-"+errSyntax.Error() {
+		t.Errorf("shutdown with an unknown option: got %q", got)
+	}
+	if got := conn.do("shutdown", "save", "timeout", "5000"); got != "OK" {
+		t.Fatalf("shutdown: got %q", got)
+	}
+	// the connection is closed by the shutdown.
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.r.ReadByte(); err != io.EOF {
+		t.Errorf("read after shutdown: got %v, want EOF", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("the server still accepts connections after shutdown")
+	}
+	// the file was rewritten as a snapshot of the queue.
+	eventually(t, func() bool {
+		data, _ := os.ReadFile(path)
+		return strings.Count(string(data), "$4\r\npush\r\n") == 1 && !strings.Contains(string(data), "$3\r\ndel\r\n")
+	})
+}
+
+func TestConfigSettings(t *testing.T) {
+	var logs bytes.Buffer
+	srv := &Server{SlowLogThreshold: time.Second, Logger: NewStdLogger(log.New(&logs, "", 0), slog.LevelDebug)}
+	conn := dial(t, startServer(t, srv))
+
+	for _, tt := range []struct{ option, initial, value string }{
+		{"slowlogthreshold", "1000", "0"},
+		{"slowlogmaxlen", "0", "10"},
+		{"latencymonitorthreshold", "0", "5"},
+		{"maxmemory", "0", "1000"},
+		{"maxmemorypolicy", "reject", "evict"},
+		{"keepalive", "0", "-1"},
+		{"loglevel", "debug", "warn"},
+		{"maxlength", "0", "2"},
+	} {
+		if got := conn.do("config", "get", tt.option); got != tt.option+" "+tt.initial {
+			t.Errorf("config get %s: got %q", tt.option, got)
+		}
+		if got := conn.do("config", "set", tt.option, tt.value); got != "OK" {
+			t.Errorf("config set %s: got %q", tt.option, got)
+		}
+		if got := conn.do("config", "get", tt.option); got != tt.option+" "+tt.value {
+			t.Errorf("config get %s after set: got %q", tt.option, got)
+		}
+	}
+	if got := conn.do("config", "set", "maxmemorypolicy", "bogus"); got != "-"+errSyntax.Error() {
+		t.Errorf("config set with an invalid value: got %q", got)
+	}
+	if got := conn.do("config", "set", "slowlogthreshold", "x"); got != "-"+errNotInteger.Error() {
+		t.Errorf("config set with an invalid duration: got %q", got)
+	}
+
+	// the settings apply to the running server.
+	conn.do("push", "jobs", "a", "1")
+	conn.do("push", "jobs", "b", "2")
+	if got := conn.do("push", "jobs", "c", "3"); got != "-"+ErrRouteFull.Error() {
+		t.Errorf("push over the default maxlength: got %q", got)
+	}
+	srv.logger().Info("hidden")
+	srv.logger().Warn("shown")
+	if got := logs.String(); strings.Contains(got, "hidden") || !strings.Contains(got, "shown") {
+		t.Errorf("logs with loglevel warn: got %q", got)
+	}
+}
+
+func TestRouteConfigPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "khronos.aof")
+	srv := &Server{AppendOnlyFile: path}
+	addr := startServer(t, srv)
+	conn := dial(t, addr)
+	conn.do("configure", "jobs", "order", "asc")
+	conn.do("configure", "jobs", "delivery", "atleastonce")
+	conn.do("configure", "jobs", "maxlength", "10")
+	conn.do("push", "jobs", "a", "2")
+	conn.do("push", "jobs", "b", "1")
+	conn.do("configure", "other", "retrybackoff", "1s")
+	conn.do("configure", "other", "retrybackoff", "0s")
+	if got := conn.do("configure", "jobs", "get", "order"); got != "asc" {
+		t.Errorf("configure get order: got %q", got)
+	}
+	if got := conn.do("configure", "jobs", "get", "nosuch"); !strings.HasPrefix(got, "-ERR") {
+		t.Errorf("configure get of an unknown option: got %q", got)
+	}
+
+	// a follower receives the settings.
+	follower := &Server{ReplicaOf: addr}
+	startServer(t, follower)
+	eventually(t, func() bool { return follower.Queue.Length("jobs") == 2 })
+	if got, want := follower.Queue.RouteConfig("jobs"), srv.Queue.RouteConfig("jobs"); got != want {
+		t.Errorf("follower settings: got %+v, want %+v", got, want)
+	}
+	follower.replicaOf("")
+
+	if _, err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the settings are restored with the items by the next server.
+	srv = &Server{AppendOnlyFile: path}
+	conn = dial(t, startServer(t, srv))
+	defer srv.Shutdown(context.Background())
+	config := srv.Queue.RouteConfig("jobs")
+	if config.Order != OrderAsc || config.Delivery != DeliveryAtLeastOnce || config.MaxLength != 10 {
+		t.Errorf("restored settings: got %+v", config)
+	}
+	if got := conn.do("pop", "jobs"); !strings.HasSuffix(got, " b") {
+		t.Errorf("pop in ascending order: got %q", got)
+	}
+	if config := srv.Queue.RouteConfig("other"); config != (RouteConfig{}) {
+		t.Errorf("settings set back to the defaults: got %+v", config)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	srv := &Server{MaxSpaces: 1}
+	addr := startServer(t, srv)
+	prod, staging := dial(t, addr), dial(t, addr)
+
+	prod.do("push", "jobs", "a", "1")
+	prod.do("push", "mail", "b", "1")
+	prod.do("configure", "mail", "maxlength", "10")
+	staging.do("use", "staging")
+	staging.do("push", "jobs", "c", "1")
+
+	if got := staging.do("flushspace"); got != "OK" {
+		t.Fatalf("flushspace: got %q", got)
+	}
+	if got := staging.do("length", "jobs"); got != ":0" {
+		t.Errorf("length in the flushed space: got %q", got)
+	}
+	if got := prod.do("length", "jobs"); got != ":1" {
+		t.Errorf("length in the default space: got %q", got)
+	}
+
+	if got := prod.do("flushall", "later"); got != "-"+errSyntax.Error() {
+		t.Errorf("flushall later: got %q", got)
+	}
+	if got := prod.do("flushall", "async"); got != "OK" {
+		t.Fatalf("flushall async: got %q", got)
+	}
+	for _, route := range []string{"jobs", "mail"} {
+		if got := prod.do("length", route); got != ":0" {
+			t.Errorf("length of %s after flushall: got %q", route, got)
+		}
+	}
+	stats := srv.Queue.Accounting()
+	if stats.Pushed != 2 || stats.Dropped != 2 || stats.Pending != 0 {
+		t.Errorf("accounting after flushall: %+v", stats)
+	}
+	if got := srv.Queue.RouteConfig("mail").MaxLength; got != 10 {
+		t.Error("flushall removed the settings of the route")
+	}
+}
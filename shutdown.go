@@ -0,0 +1,270 @@
+package khronos
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// shutdownPollInterval is how often Shutdown checks whether the connections are drained.
+	shutdownPollInterval = 10 * time.Millisecond
+	// defaultShutdownTimeout is how long the "shutdown" command waits for the connections by default.
+	defaultShutdownTimeout = 10 * time.Second
+)
+
+// ShutdownPhase is a step of the shutdown sequence and the time it took.
+type ShutdownPhase struct {
+	Name     string
+	Duration time.Duration
+}
+
+// ShutdownReport describes how a call to Shutdown went,
+// so that operators can verify clean shutdowns and tune their grace periods.
+type ShutdownReport struct {
+	// ConnsDrained is the number of connections closed between two commands.
+	ConnsDrained int
+	// ConnsForced is the number of connections killed in the middle of a command
+	// because the shutdown context expired.
+	ConnsForced int
+	// ItemsPersisted is the number of items written to durable storage during shutdown:
+	// the items left in the queue once its append-only file is flushed and closed,
+	// or 0 if the file could not be written.
+	ItemsPersisted int
+	// InflightRequeued is the number of items reserved by the routes with DeliveryAtLeastOnce
+	// and not confirmed, put back into their routes once the connections are closed.
+	InflightRequeued int
+	// Phases lists the steps of the shutdown in the order they ran.
+	Phases []ShutdownPhase
+	// Duration is the total time spent in Shutdown.
+	Duration time.Duration
+}
+
+// String formats the report on a single line, suitable for logging.
+func (r *ShutdownReport) String() string {
+	var b strings.Builder
+	b.WriteString("drained=" + strconv.Itoa(r.ConnsDrained))
+	b.WriteString(" forced=" + strconv.Itoa(r.ConnsForced))
+	b.WriteString(" persisted=" + strconv.Itoa(r.ItemsPersisted))
+	b.WriteString(" requeued=" + strconv.Itoa(r.InflightRequeued))
+	for _, phase := range r.Phases {
+		b.WriteString(" " + phase.Name + "=" + phase.Duration.String())
+	}
+	b.WriteString(" total=" + r.Duration.String())
+	return b.String()
+}
+
+// phase runs fn and records its duration under name.
+func (r *ShutdownReport) phase(name string, fn func()) {
+	start := time.Now()
+	fn()
+	r.Phases = append(r.Phases, ShutdownPhase{Name: name, Duration: time.Since(start)})
+}
+
+// Shutdown gracefully shuts down the server.
+// It first closes all the listeners, then closes the connections as soon as they are
+// waiting for a command or blocked waiting for an item, and waits for the others to
+// finish the command they are executing.
+// If ctx expires first, the remaining connections are killed and ctx.Err() is returned.
+// The items reserved by the routes with DeliveryAtLeastOnce and not confirmed are then enqueued again.
+//
+// The returned report is also written to the server's logger.
+// Once Shutdown has been called, Serve and ListenAndServe return ErrServerClosed.
+func (srv *Server) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	return srv.shutdown(ctx, false)
+}
+
+// shutdown is Shutdown, rewriting the append-only file before closing it if save.
+func (srv *Server) shutdown(ctx context.Context, save bool) (*ShutdownReport, error) {
+	start := time.Now()
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	srv.closeDoneChan()
+
+	var (
+		report ShutdownReport
+		err    error
+	)
+	report.phase("listeners", srv.closeListeners)
+	srv.replicaOf("")
+	report.phase("connections", func() {
+		report.ConnsDrained, report.ConnsForced, err = srv.drainConns(ctx)
+	})
+	report.phase("inflight", func() {
+		for _, pq := range srv.queues() {
+			report.InflightRequeued += pq.requeueReserved()
+		}
+	})
+	if srv.persisted() {
+		report.phase("persistence", func() {
+			report.ItemsPersisted = srv.closeAppendOnly(save)
+		})
+	}
+	report.Duration = time.Since(start)
+
+	srv.logger().Info("khronos: shutdown",
+		"drained", report.ConnsDrained,
+		"forced", report.ConnsForced,
+		"persisted", report.ItemsPersisted,
+		"requeued", report.InflightRequeued,
+		"duration", report.Duration,
+	)
+	return &report, err
+}
+
+// getDoneChan returns a channel closed when the server shuts down.
+func (srv *Server) getDoneChan() <-chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.done == nil {
+		srv.done = make(chan struct{})
+	}
+	return srv.done
+}
+
+func (srv *Server) closeDoneChan() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.done == nil {
+		srv.done = make(chan struct{})
+	}
+	select {
+	case <-srv.done:
+	default:
+		close(srv.done)
+	}
+}
+
+func (srv *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) != 0
+}
+
+// trackListener adds or removes ln from the listeners closed by Shutdown.
+// It returns false if ln can not be added because the server is shutting down.
+func (srv *Server) trackListener(ln net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
+		if srv.shuttingDown() {
+			return false
+		}
+		if srv.listeners == nil {
+			srv.listeners = make(map[net.Listener]struct{})
+		}
+		srv.listeners[ln] = struct{}{}
+	} else {
+		delete(srv.listeners, ln)
+	}
+	return true
+}
+
+func (srv *Server) closeListeners() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for ln := range srv.listeners {
+		_ = ln.Close()
+		delete(srv.listeners, ln)
+	}
+}
+
+// drainConns closes the connections which are not executing a command until none is left.
+// When ctx expires, it kills the remaining connections regardless of their state.
+func (srv *Server) drainConns(ctx context.Context) (drained, forced int, err error) {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	seen := make(map[int64]bool)
+	for {
+		conns := srv.clients.list()
+		if len(conns) == 0 {
+			return len(seen), 0, nil
+		}
+		for _, c := range conns {
+			seen[c.id] = true
+			c.mu.Lock()
+			state := c.state
+			c.mu.Unlock()
+			if state != stateActive {
+				c.kill()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			for _, c := range srv.clients.list() {
+				c.kill()
+				forced++
+			}
+			return len(seen) - forced, forced, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ShutdownCommand is the command "shutdown".
+// "shutdown [nosave|save] [timeout <ms>]" replies OK and gracefully shuts the server down, see Server.Shutdown,
+// killing the connections still executing a command after the timeout, 10 seconds by default.
+// With save, the append only file is rewritten as a snapshot of the queue before it is closed,
+// with nosave, the default, the operations are only flushed to it.
+// The server no longer accepts connections once the command replied, Serve and ListenAndServe
+// return ErrServerClosed.
+type ShutdownCommand struct {
+	ArgsCommand
+}
+
+func (c *ShutdownCommand) Name() string {
+	return "shutdown"
+}
+
+func (c *ShutdownCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		return errNoServer
+	}
+	args := c.Args()
+	save := false
+	timeout := defaultShutdownTimeout
+	for i := 0; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "save"):
+			save = true
+		case strings.EqualFold(args[i], "nosave"):
+			save = false
+		case strings.EqualFold(args[i], "timeout") && i+1 < len(args):
+			ms, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || ms <= 0 {
+				return errNotInteger
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	if save && !srv.persisted() {
+		return errAOFDisabled
+	}
+	if err := writer.WriteStatus(OK); err != nil {
+		return err
+	}
+	if err := Flush(writer); err != nil {
+		return err
+	}
+	// the connection is closed by the shutdown once the command returns.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_, _ = srv.shutdown(ctx, save)
+	}()
+	return nil
+}
+
+func NewShutdownCommand(args []string) (Command, error) {
+	cmd := &ShutdownCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["shutdown"] = NewShutdownCommand
+}
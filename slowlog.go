@@ -0,0 +1,171 @@
+package khronos
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSlowLogMaxLen is the number of entries kept by the slow log when Server.SlowLogMaxLen is zero.
+const defaultSlowLogMaxLen = 128
+
+// slowLogEntry is a command which took longer than Server.SlowLogThreshold.
+type slowLogEntry struct {
+	id       int64
+	time     time.Time
+	duration time.Duration
+	args     []string
+	addr     string
+	name     string
+}
+
+func (e *slowLogEntry) String() string {
+	var b strings.Builder
+	b.WriteString("id=" + strconv.FormatInt(e.id, 10))
+	b.WriteString(" time=" + strconv.FormatInt(e.time.Unix(), 10))
+	b.WriteString(" duration=" + strconv.FormatInt(e.duration.Microseconds(), 10))
+	b.WriteString(" addr=" + e.addr)
+	b.WriteString(" name=" + e.name)
+	b.WriteString(" cmd=" + strings.Join(e.args, " "))
+	return b.String()
+}
+
+// slowLog is a ring buffer of the last slow commands.
+// The zero value is ready to use.
+type slowLog struct {
+	mu      sync.Mutex
+	entries []*slowLogEntry // ring buffer, next is the position of the oldest entry once full.
+	next    int
+	nextID  int64
+}
+
+func (l *slowLog) add(entry *slowLogEntry, maxLen int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.id = l.nextID
+	l.nextID++
+	if len(l.entries) > maxLen {
+		// the maximum length was lowered, keep the newest entries only.
+		l.entries = append(l.entries[l.next:], l.entries[:l.next]...)
+		l.entries = l.entries[len(l.entries)-maxLen:]
+		l.next = 0
+	}
+	if len(l.entries) < maxLen {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % maxLen
+}
+
+// newest returns at most n entries, the newest first.
+func (l *slowLog) newest(n int) []*slowLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n < 0 || n > len(l.entries) {
+		n = len(l.entries)
+	}
+	entries := make([]*slowLogEntry, 0, n)
+	for i := 0; i < n; i++ {
+		pos := (l.next - 1 - i + 2*len(l.entries)) % len(l.entries)
+		entries = append(entries, l.entries[pos])
+	}
+	return entries
+}
+
+func (l *slowLog) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+func (l *slowLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries, l.next = nil, 0
+}
+
+// recordSlow logs and records cmd in the slow log if it took longer than SlowLogThreshold.
+func (srv *Server) recordSlow(c *connContext, cmd Command, start time.Time, elapsed time.Duration) {
+	settings := srv.getSettings()
+	if settings.slowLogThreshold <= 0 || elapsed <= settings.slowLogThreshold {
+		return
+	}
+	srv.logger().Warn("khronos: slow command", "id", c.id, "cmd", cmd.Name(), "args", len(cmd.Args()), "duration", elapsed)
+	maxLen := settings.slowLogMaxLen
+	if maxLen <= 0 {
+		maxLen = defaultSlowLogMaxLen
+	}
+	c.mu.Lock()
+	name := c.name
+	c.mu.Unlock()
+	srv.slowlog.add(&slowLogEntry{
+		time:     start,
+		duration: elapsed,
+		args:     append([]string{cmd.Name()}, cmd.Args()...),
+		addr:     c.conn.RemoteAddr().String(),
+		name:     name,
+	}, maxLen)
+}
+
+// SlowLogCommand is the command "slowlog".
+// It inspects the commands which took longer than Server.SlowLogThreshold:
+//
+//	slowlog get [n]    the n newest entries (10 by default, -1 for all), one string per entry
+//	slowlog len        the number of entries
+//	slowlog reset      remove every entry
+//
+// An entry has the form "id=<id> time=<unix> duration=<microseconds> addr=<addr> name=<name> cmd=<command and args>".
+type SlowLogCommand struct {
+	ArgsCommand
+}
+
+func (c *SlowLogCommand) Name() string {
+	return "slowlog"
+}
+
+func (c *SlowLogCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	srv := ServerFromContext(ctx)
+	if srv == nil {
+		return errNoServer
+	}
+	switch sub := strings.ToLower(args[0]); {
+	case sub == "get" && len(args) <= 2:
+		n := 10
+		if len(args) == 2 {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil {
+				return errNotInteger
+			}
+		}
+		entries := srv.slowlog.newest(n)
+		reply := make([]string, len(entries))
+		for i, entry := range entries {
+			reply[i] = entry.String()
+		}
+		return writer.WriteArray(reply)
+	case sub == "len" && len(args) == 1:
+		return writer.WriteInt64(int64(srv.slowlog.len()))
+	case sub == "reset" && len(args) == 1:
+		srv.slowlog.reset()
+		return writer.WriteStatus(OK)
+	default:
+		return &wrongCommandError{command: c.Name() + "|" + sub, args: args[1:]}
+	}
+}
+
+func NewSlowLogCommand(args []string) (Command, error) {
+	if len(args) == 0 {
+		return nil, &WrongArityError{"slowlog"}
+	}
+	cmd := &SlowLogCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["slowlog"] = NewSlowLogCommand
+}
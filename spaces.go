@@ -0,0 +1,189 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// defaultSpace is the name of the queue space of Server.Queue.
+const defaultSpace = "0"
+
+var (
+	errSpacesDisabled = errors.New("ERR queue spaces are disabled, see Server.MaxSpaces")
+	errTooManySpaces  = errors.New("ERR too many queue spaces, see Server.MaxSpaces")
+	errSpaceIndex     = errors.New("ERR DB index is out of range")
+)
+
+// queueSpaces holds the queue spaces of a server besides the default one, see Server.MaxSpaces.
+type queueSpaces struct {
+	mu     sync.Mutex
+	queues map[string]*PriorityQueueWithRouting
+}
+
+// space returns the queue of the named space, creating it if needed.
+func (srv *Server) space(name string) (*PriorityQueueWithRouting, error) {
+	if name == defaultSpace {
+		return srv.Queue, nil
+	}
+	limit := srv.MaxSpaces
+	if limit <= 0 {
+		return nil, errSpacesDisabled
+	}
+	s := &srv.spaces
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pq, ok := s.queues[name]; ok {
+		return pq, nil
+	}
+	if len(s.queues) >= limit {
+		return nil, errTooManySpaces
+	}
+	pq := NewPriorityQueueWithRouting()
+	if srv.Clock != nil {
+		pq.useClock(srv.Clock)
+	}
+	pq.SetDefaultRouteConfig(srv.Queue.DefaultRouteConfig())
+	if s.queues == nil {
+		s.queues = make(map[string]*PriorityQueueWithRouting)
+	}
+	s.queues[name] = pq
+	return pq, nil
+}
+
+// queues returns the queues of the spaces by name, including the default one.
+func (srv *Server) queues() map[string]*PriorityQueueWithRouting {
+	s := &srv.spaces
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queues := make(map[string]*PriorityQueueWithRouting, len(s.queues)+1)
+	for name, pq := range s.queues {
+		queues[name] = pq
+	}
+	queues[defaultSpace] = srv.Queue
+	return queues
+}
+
+// spaceFields returns the "info spaces" lines.
+func (srv *Server) spaceFields() []string {
+	queues := srv.queues()
+	names := sortedKeys(queues)
+	// the numbered spaces first, in their order.
+	sort.SliceStable(names, func(i, j int) bool {
+		a, errA := strconv.Atoi(names[i])
+		b, errB := strconv.Atoi(names[j])
+		if errA == nil && errB == nil {
+			return a < b
+		}
+		return errA == nil && errB != nil
+	})
+	fields := make([]string, 0, len(names))
+	for _, name := range names {
+		stats := queues[name].MemoryStats()
+		fields = append(fields, "space:"+name+":routes="+strconv.Itoa(stats.Routes)+",items="+strconv.Itoa(stats.Items))
+	}
+	return fields
+}
+
+// getQueue returns the queue of the space selected by the connection, nil for the default one.
+func (c *connContext) getQueue() *PriorityQueueWithRouting {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.queue
+}
+
+// use switches the connection to the named queue space.
+func (c *connContext) use(name string) error {
+	pq, err := c.srv.space(name)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.space, c.queue = name, pq
+	if pq == c.srv.Queue {
+		c.space, c.queue = "", nil
+	}
+	return nil
+}
+
+// useSpace switches the connection of ctx to the named queue space.
+func useSpace(ctx context.Context, name string) error {
+	c := connFromContext(ctx)
+	if c == nil {
+		return errNoServer
+	}
+	return c.use(name)
+}
+
+// SelectCommand is the command "select".
+// "select <index>" switches the connection to the numbered queue space, like the Redis SELECT,
+// 0 being the default one, see Server.MaxSpaces. It is "use <index>".
+type SelectCommand struct {
+	ArgsCommand
+}
+
+func (c *SelectCommand) Name() string {
+	return "select"
+}
+
+func (c *SelectCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	index, err := strconv.Atoi(c.Args()[0])
+	if err != nil {
+		return errNotInteger
+	}
+	if index < 0 {
+		return errSpaceIndex
+	}
+	if err = useSpace(ctx, strconv.Itoa(index)); err != nil {
+		return err
+	}
+	return writer.WriteStatus(OK)
+}
+
+func NewSelectCommand(args []string) (Command, error) {
+	if len(args) != 1 {
+		return nil, &WrongArityError{"select"}
+	}
+	cmd := &SelectCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+// UseCommand is the command "use".
+// "use <space>" switches the connection to the named queue space, created on first use,
+// with its own routes, see Server.MaxSpaces. The default space is "0".
+type UseCommand struct {
+	ArgsCommand
+}
+
+func (c *UseCommand) Name() string {
+	return "use"
+}
+
+func (c *UseCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	name := c.Args()[0]
+	if name == "" {
+		return errSyntax
+	}
+	if err := useSpace(ctx, name); err != nil {
+		return err
+	}
+	return writer.WriteStatus(OK)
+}
+
+func NewUseCommand(args []string) (Command, error) {
+	if len(args) != 1 {
+		return nil, &WrongArityError{"use"}
+	}
+	cmd := &UseCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["select"] = NewSelectCommand
+	commandLibraries["use"] = NewUseCommand
+}
@@ -0,0 +1,143 @@
+package khronos
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// RouteStats describes the activity of a route.
+type RouteStats struct {
+	Enqueued    uint64        // items enqueued on the route.
+	Dequeued    uint64        // items dequeued from the route.
+	Length      int           // items in the route.
+	OldestAge   time.Duration // time since the oldest item in the route was enqueued, zero if empty.
+	MaxPriority int64         // highest priority in the route, zero if empty.
+	MinPriority int64         // lowest priority in the route, zero if empty.
+	Blocked     int           // consumers waiting for an item.
+	Paused      bool          // whether the delivery of the items is paused, see Pause.
+}
+
+// RouteStats returns the statistics of the route.
+func (pq *PriorityQueueWithRouting) RouteStats(route string) RouteStats {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	r, ok := pq.routes[route]
+	if !ok {
+		return RouteStats{}
+	}
+	stats := RouteStats{
+		Enqueued: r.enqueued,
+		Dequeued: r.dequeued,
+		Length:   r.size(),
+		Blocked:  r.blocked(),
+		Paused:   pq.paused(r),
+	}
+	if stats.Length == 0 {
+		return stats
+	}
+	now := pq.now()
+	spilled, err := r.spilledItems()
+	if err != nil {
+		pq.overflowFailed()
+	}
+	all := append(spilled, r.queue.Items()...)
+	stats.MaxPriority, stats.MinPriority = all[0].priority, all[0].priority
+	for _, item := range all {
+		if age := now.Sub(item.enqueued); age > stats.OldestAge {
+			stats.OldestAge = age
+		}
+		if item.priority < stats.MinPriority {
+			stats.MinPriority = item.priority
+		}
+		if item.priority > stats.MaxPriority {
+			stats.MaxPriority = item.priority
+		}
+	}
+	return stats
+}
+
+// Blocked returns the number of consumers waiting for an item of the route,
+// including the consumers of its groups and the ones waiting on several routes at once.
+// A route with consumers waiting and no items has more workers than it needs.
+func (pq *PriorityQueueWithRouting) Blocked(route string) int {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	if r, ok := pq.routes[route]; ok {
+		return r.blocked()
+	}
+	return 0
+}
+
+// blocked returns the number of consumers waiting on the route and on its groups.
+// It must be called with queueLock held.
+func (r *route) blocked() int {
+	n := r.waiters
+	for _, g := range r.groups {
+		n += g.route.waiters
+	}
+	return n
+}
+
+// blockedRoutes returns the number of consumers waiting on each route with some, see Blocked.
+func (pq *PriorityQueueWithRouting) blockedRoutes() map[string]int {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	blocked := make(map[string]int)
+	for name, r := range pq.routes {
+		if isGroupRoute(name) {
+			continue // the consumers of a group are counted on its route.
+		}
+		if n := r.blocked(); n > 0 {
+			blocked[name] = n
+		}
+	}
+	return blocked
+}
+
+// StatCommand is the command "stat".
+// "stat <route>" replies with the statistics of the route as an array of field, value pairs:
+// enqueued, dequeued, length, oldest_age_ms, max_priority, min_priority, blocked and paused.
+// The priorities are empty when the route is empty.
+type StatCommand struct {
+	ArgsCommand
+}
+
+func (c *StatCommand) Name() string {
+	return "stat"
+}
+
+func (c *StatCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	stats := PqFromContext(ctx).RouteStats(c.Args()[0])
+	var maxPriority, minPriority string
+	if stats.Length > 0 {
+		maxPriority = strconv.FormatInt(stats.MaxPriority, 10)
+		minPriority = strconv.FormatInt(stats.MinPriority, 10)
+	}
+	return writer.WriteArray([]string{
+		"enqueued", strconv.FormatUint(stats.Enqueued, 10),
+		"dequeued", strconv.FormatUint(stats.Dequeued, 10),
+		"length", strconv.Itoa(stats.Length),
+		"oldest_age_ms", strconv.FormatInt(stats.OldestAge.Milliseconds(), 10),
+		"max_priority", maxPriority,
+		"min_priority", minPriority,
+		"blocked", strconv.Itoa(stats.Blocked),
+		"paused", strconv.Itoa(btoi(stats.Paused)),
+	})
+}
+
+func NewStatCommand(args []string) (Command, error) {
+	if len(args) != 1 {
+		return nil, &WrongArityError{"stat"}
+	}
+	cmd := &StatCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["stat"] = NewStatCommand
+}
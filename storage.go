@@ -0,0 +1,219 @@
+package khronos
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage persists the operations applied to the queue of a server, see Server.Storage.
+// An operation is encoded as the arguments of a command, such as ["push", route, value, priority, id],
+// and the queue is rebuilt by applying the stored operations in order.
+//
+// The methods are called by a single goroutine of the server, except Snapshot and Size,
+// which may be called concurrently with the others.
+type Storage interface {
+	// Load calls apply with the stored operations, in order, when the server starts.
+	// It may return an error wrapping ErrAppendOnlyTruncated or ErrAppendOnlyCorrupt after applying
+	// the valid operations of damaged storage, the server then continues with them and calls Compact.
+	Load(apply func(op []string)) error
+
+	// Append stores operations following the stored ones. They may be buffered until Sync.
+	Append(ops [][]string) error
+
+	// Sync makes the appended operations durable. It is called every second.
+	Sync() error
+
+	// Compact replaces the stored operations with ops, the smallest list of operations rebuilding
+	// the state of the queue, and durably, so that a failure leaves the stored operations as they were.
+	// It is called when the server starts, when Size doubled since the last call, and by "bgrewriteaof".
+	Compact(ops [][]string) error
+
+	// Snapshot writes a copy of the stored operations to w, in the format of the append-only files,
+	// see CheckAppendOnlyFile, for instance to back them up.
+	Snapshot(w io.Writer) error
+
+	// Size returns the approximate number of bytes of the stored operations.
+	Size() int64
+
+	// Close syncs and releases the storage.
+	Close() error
+}
+
+// FileStorage is the Storage of an append-only file, the default one, see Server.AppendOnlyFile.
+// The operations are appended to the file as records with a checksum, see CheckAppendOnlyFile,
+// and Compact writes them to a temporary file renamed over the current one, so that a crash
+// in the middle of a compaction leaves the current file in place.
+type FileStorage struct {
+	path string
+
+	mu    sync.Mutex
+	file  *os.File
+	out   *bufio.Writer
+	size  int64
+	dirty bool // whether operations were appended since the last sync.
+}
+
+// NewFileStorage returns the storage of the append-only file at path, created by the first Compact.
+func NewFileStorage(path string) *FileStorage {
+	return &FileStorage{path: path}
+}
+
+func (s *FileStorage) Load(apply func(op []string)) error {
+	check, err := openAppendOnly(s.path, func(op queueOp) { apply(op.args()) })
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return check.Err
+}
+
+func (s *FileStorage) Append(ops [][]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	for _, op := range ops {
+		n, err := writeRecord(s.out, op)
+		s.size += int64(n)
+		s.dirty = true
+		if err != nil {
+			return err
+		}
+	}
+	// the operations are in the file, though not on disk, as soon as they are appended.
+	return s.out.Flush()
+}
+
+func (s *FileStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sync()
+}
+
+// sync flushes the appended operations and syncs the file to disk.
+// It must be called with mu held.
+func (s *FileStorage) sync() error {
+	if s.file == nil || !s.dirty {
+		return nil
+	}
+	if err := s.out.Flush(); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *FileStorage) Compact(ops [][]string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".rewrite-*")
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(tmp)
+	size := int64(len(aofMagic))
+	_, err = out.WriteString(aofMagic)
+	for _, op := range ops {
+		if err != nil {
+			break
+		}
+		var n int
+		n, err = writeRecord(out, op)
+		size += int64(n)
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	// the rename is only durable once the directory is synced. The new file is used
+	// even if it fails, as the old one is no longer in the directory.
+	err = syncDir(filepath.Dir(s.path))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		_ = s.file.Close()
+	}
+	s.file, s.out, s.size, s.dirty = tmp, out, size, false
+	return err
+}
+
+// syncDir syncs the directory to disk, so that the files renamed into it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *FileStorage) Snapshot(w io.Writer) error {
+	s.mu.Lock()
+	if s.file == nil {
+		s.mu.Unlock()
+		return os.ErrClosed
+	}
+	err := s.out.Flush()
+	var f *os.File
+	if err == nil {
+		// a file of its own is not closed by a compaction in the meantime.
+		f, err = os.Open(s.path)
+	}
+	size := s.size
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// the file is only appended to, its first size bytes do not change.
+	_, err = io.Copy(w, io.NewSectionReader(f, 0, size))
+	return err
+}
+
+func (s *FileStorage) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.sync()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	return err
+}
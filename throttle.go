@@ -0,0 +1,93 @@
+package khronos
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrThrottled is returned when a route exceeds its operations quota, see RouteConfig.MaxOps.
+var ErrThrottled = errors.New("THROTTLED route operations quota exceeded")
+
+// tokenBucket is a token bucket rate limiter.
+// It holds at most burst tokens and refills at rate tokens per second.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// refill adds the tokens earned since the last operation, up to burst.
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// take removes a token from the bucket and reports whether there was one.
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// quotas are the tokens needed from the buckets by an operation on several routes.
+type quotas map[*tokenBucket]float64
+
+// add counts a token needed from the bucket, and reports whether the bucket holds enough tokens.
+func (q quotas) add(b *tokenBucket, now time.Time) bool {
+	b.refill(now)
+	if b.tokens < q[b]+1 {
+		return false
+	}
+	q[b]++
+	return true
+}
+
+// Throttle counts an operation against the quotas of the route and of its namespace.
+// It returns ErrThrottled if the route exceeded RouteConfig.MaxOps, or its namespace
+// NamespaceConfig.MaxOps, in the last second.
+// Commands call it before operating on a route, so that a noisy route cannot monopolize the server.
+func (pq *PriorityQueueWithRouting) Throttle(route string) error {
+	return pq.throttle(route)
+}
+
+// throttle counts an operation on each of the routes against their quotas, as Throttle.
+// The tokens are only taken once every quota has enough of them, so that an operation
+// throttled by one route does not consume the quotas of the others.
+func (pq *PriorityQueueWithRouting) throttle(routes ...string) error {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	now := pq.now()
+	need := quotas{}
+	for _, route := range routes {
+		if r, ok := pq.routes[route]; ok && r.config.MaxOps > 0 {
+			maxOps := float64(r.config.MaxOps)
+			if r.bucket == nil || r.bucket.rate != maxOps {
+				r.bucket = newTokenBucket(maxOps, maxOps, now)
+			}
+			if !need.add(r.bucket, now) {
+				return ErrThrottled
+			}
+		}
+		if err := pq.throttleNamespace(route, need, now); err != nil {
+			return err
+		}
+	}
+	for b, n := range need {
+		b.tokens -= n
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	// errBindingPattern is returned for an empty binding pattern.
+	errBindingPattern = errors.New("ERR invalid binding pattern")
+	// ErrNoSuchBinding is returned when a route is not bound to a pattern.
+	ErrNoSuchBinding = errors.New("ERR no such binding")
+)
+
+// Binding binds a route to a topic pattern, see Bind.
+type Binding struct {
+	Route   string
+	Pattern string
+}
+
+// matchTopic reports whether the topic, words separated by dots such as "logs.error.db",
+// matches the pattern, in which "*" matches exactly one word and "#" zero or more words.
+// It tracks the prefixes of the topic matched by the words of the pattern seen so far,
+// so that it takes O(len(pattern) * len(topic)) whichever the number of "#".
+func matchTopic(pattern, topic []string) bool {
+	// matched[i] reports whether the first i words of the topic match the pattern so far.
+	matched := make([]bool, len(topic)+1)
+	matched[0] = true
+	for _, word := range pattern {
+		if word == "#" {
+			for i := 1; i <= len(topic); i++ {
+				matched[i] = matched[i] || matched[i-1]
+			}
+			continue
+		}
+		ok := false
+		for i := len(topic); i > 0; i-- {
+			matched[i] = matched[i-1] && (word == "*" || word == topic[i-1])
+			ok = ok || matched[i]
+		}
+		matched[0] = false
+		if !ok {
+			return false
+		}
+	}
+	return matched[len(topic)]
+}
+
+// Bind binds the route to the topic pattern, as the queues of an AMQP topic exchange: the items pushed
+// to a key matching the pattern, such as "logs.*.db" or "logs.#" for the key "logs.error.db",
+// are pushed to the route instead of to the key, see Publish. The patterns are words separated by dots,
+// "*" matching exactly one word and "#" zero or more words. Binding twice is a no-op.
+// As "#" matches zero words, "jobs.#" also matches the key "jobs" itself: once the pattern is bound,
+// the items pushed to the route "jobs" are pushed to the bound routes instead.
+func (pq *PriorityQueueWithRouting) Bind(route, pattern string) error {
+	if pattern == "" {
+		return errBindingPattern
+	}
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	pq.bind(Binding{Route: route, Pattern: pattern})
+	return nil
+}
+
+// bind adds the binding, if the queue does not have it yet.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) bind(b Binding) {
+	if _, ok := pq.bindings[b]; ok {
+		return
+	}
+	if pq.bindings == nil {
+		pq.bindings = make(map[Binding]struct{})
+	}
+	pq.bindings[b] = struct{}{}
+	pq.emit(queueOp{kind: opBind, route: b.Route, value: b.Pattern})
+}
+
+// Unbind removes the binding of the route to the pattern and reports whether it existed.
+func (pq *PriorityQueueWithRouting) Unbind(route, pattern string) bool {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	b := Binding{Route: route, Pattern: pattern}
+	if _, ok := pq.bindings[b]; !ok {
+		return false
+	}
+	delete(pq.bindings, b)
+	pq.emit(queueOp{kind: opUnbind, route: route, value: pattern})
+	return true
+}
+
+// applyBinding applies a binding operation received from another queue.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) applyBinding(op queueOp) {
+	if op.kind == opUnbind {
+		delete(pq.bindings, Binding{Route: op.route, Pattern: op.value})
+		pq.emit(op)
+		return
+	}
+	pq.bind(Binding{Route: op.route, Pattern: op.value})
+}
+
+// Bindings returns the bindings of the queue, sorted by route and pattern.
+func (pq *PriorityQueueWithRouting) Bindings() []Binding {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	return pq.sortedBindings()
+}
+
+// sortedBindings returns the bindings sorted by route and pattern.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) sortedBindings() []Binding {
+	bindings := make([]Binding, 0, len(pq.bindings))
+	for b := range pq.bindings {
+		bindings = append(bindings, b)
+	}
+	sort.Slice(bindings, func(i, j int) bool {
+		if bindings[i].Route != bindings[j].Route {
+			return bindings[i].Route < bindings[j].Route
+		}
+		return bindings[i].Pattern < bindings[j].Pattern
+	})
+	return bindings
+}
+
+// Publish pushes the item to every route bound to a pattern matching the key, see Bind, and returns
+// the number of routes it was pushed to, once per route whichever the number of its matching patterns.
+// The item is pushed to the first route in the order of the names, and a copy of it to the others.
+// It pushes nothing, and returns 0, if no pattern matches the key.
+// The copies are pushed atomically: if one of the routes holds RouteConfig.MaxLength items,
+// it fails with ErrRouteFull and pushes nothing, without blocking.
+func (pq *PriorityQueueWithRouting) Publish(key string, item *Item) (int, error) {
+	routes := pq.topicRoutes(key)
+	if len(routes) == 0 {
+		return 0, nil
+	}
+	_, err := pq.publish(routes, item)
+	return len(routes), err
+}
+
+// topicRoutes returns the names of the routes bound to a pattern matching the key, in increasing order.
+func (pq *PriorityQueueWithRouting) topicRoutes(key string) []string {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	if len(pq.bindings) == 0 {
+		return nil
+	}
+	topic := strings.Split(key, ".")
+	var routes []string
+	for _, b := range pq.sortedBindings() {
+		if len(routes) > 0 && routes[len(routes)-1] == b.Route {
+			continue
+		}
+		if matchTopic(strings.Split(b.Pattern, "."), topic) {
+			routes = append(routes, b.Route)
+		}
+	}
+	return routes
+}
+
+// publish pushes the item to the first of the routes and a copy of it to the others, see Publish,
+// and returns the identifier of the item.
+func (pq *PriorityQueueWithRouting) publish(routes []string, item *Item) (uint64, error) {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	targets := make([]*route, len(routes))
+	for i, name := range routes {
+		r := pq.route(name)
+		if r.full() {
+			pq.drop(r, item, DropRejected)
+			return 0, ErrRouteFull
+		}
+		targets[i] = r
+	}
+	for _, r := range targets[1:] {
+		pq.push(r, item.Clone())
+	}
+	pq.push(targets[0], item)
+	return item.id, nil
+}
+
+// BindCommand is the command "bind".
+// "bind <route> <pattern>" binds the route to the topic pattern, such as "logs.*.db" or "logs.#",
+// so that it receives the items pushed to the keys matching the pattern, see Bind.
+type BindCommand struct {
+	ArgsCommand
+}
+
+func (c *BindCommand) Name() string {
+	return "bind"
+}
+
+func (c *BindCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	if err := PqFromContext(ctx).Bind(args[0], args[1]); err != nil {
+		return err
+	}
+	return writer.WriteStatus(OK)
+}
+
+func NewBindCommand(args []string) (Command, error) {
+	if len(args) != 2 {
+		return nil, &WrongArityError{"bind"}
+	}
+	cmd := &BindCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+// UnbindCommand is the command "unbind".
+// "unbind <route> <pattern>" removes the binding of the route to the pattern, see Unbind.
+type UnbindCommand struct {
+	ArgsCommand
+}
+
+func (c *UnbindCommand) Name() string {
+	return "unbind"
+}
+
+func (c *UnbindCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	if !PqFromContext(ctx).Unbind(args[0], args[1]) {
+		return ErrNoSuchBinding
+	}
+	return writer.WriteStatus(OK)
+}
+
+func NewUnbindCommand(args []string) (Command, error) {
+	if len(args) != 2 {
+		return nil, &WrongArityError{"unbind"}
+	}
+	cmd := &UnbindCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+// BindingsCommand is the command "bindings".
+// "bindings [<route>]" replies with the bindings of the queue, or of the route, as "<route> <pattern>" lines.
+type BindingsCommand struct {
+	ArgsCommand
+}
+
+func (c *BindingsCommand) Name() string {
+	return "bindings"
+}
+
+func (c *BindingsCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	list := make([]string, 0)
+	for _, b := range PqFromContext(ctx).Bindings() {
+		if len(args) == 1 && b.Route != args[0] {
+			continue
+		}
+		list = append(list, b.Route+" "+b.Pattern)
+	}
+	return writer.WriteArray(list)
+}
+
+func NewBindingsCommand(args []string) (Command, error) {
+	if len(args) > 1 {
+		return nil, &WrongArityError{"bindings"}
+	}
+	cmd := &BindingsCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["bind"] = NewBindCommand
+	commandLibraries["unbind"] = NewUnbindCommand
+	commandLibraries["bindings"] = NewBindingsCommand
+}
@@ -0,0 +1,64 @@
+package khronos
+
+// Tx gives access to the routes of the queue within Atomically.
+// It must not be used after the function passed to Atomically returns.
+type Tx struct {
+	pq *PriorityQueueWithRouting
+}
+
+// Atomically calls fn with the queue locked, so that the operations of fn on the routes
+// are not interleaved with any other operation on the queue, and returns the error of fn.
+// fn must not block nor call the other methods of the queue: it would deadlock.
+// The operations already applied when fn fails are not rolled back.
+func (pq *PriorityQueueWithRouting) Atomically(fn func(tx *Tx) error) error {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	return fn(&Tx{pq: pq})
+}
+
+// Push adds an item to the route, like Enqueue.
+func (tx *Tx) Push(route string, item *Item) {
+	tx.pq.push(tx.pq.route(route), item)
+}
+
+// Pop removes and returns the next item of the route without blocking, like TryDequeue.
+func (tx *Tx) Pop(route string) (*Item, bool) {
+	r, ok := tx.pq.routes[route]
+	if !ok {
+		return nil, false
+	}
+	return tx.pq.pop(r)
+}
+
+// Peek returns a copy of the next item of the route without removing it.
+func (tx *Tx) Peek(route string) (*Item, bool) {
+	r, ok := tx.pq.routes[route]
+	if !ok {
+		return nil, false
+	}
+	var head *Item
+	if r.queue.Len() > 0 {
+		head = r.queue.items[0]
+	}
+	for _, s := range r.segments {
+		if head == nil || r.config.before(s.head, head) {
+			head = s.head
+		}
+	}
+	if head == nil {
+		return nil, false
+	}
+	c := head.Clone()
+	c.id = head.id
+	return c, true
+}
+
+// Length returns the number of items of the route, like Length.
+func (tx *Tx) Length(route string) int {
+	r, ok := tx.pq.routes[route]
+	if !ok {
+		return 0
+	}
+	return r.size()
+}
@@ -0,0 +1,75 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+	"strconv"
+)
+
+// ErrNoSuchItem is returned when an item identifier does not match a queued item.
+var ErrNoSuchItem = errors.New("ERR no such item")
+
+// UpdatePriority changes the priority of the queued item with the given identifier, see Item.ID.
+// It returns ErrNoSuchItem if the item is not queued anymore.
+func (pq *PriorityQueueWithRouting) UpdatePriority(id uint64, priority int64) error {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	item, ok := pq.items[id]
+	if !ok {
+		return ErrNoSuchItem
+	}
+	r := item.route.resolve()
+	if item.priority == priority {
+		return nil
+	}
+	pq.setPriority(r, item, priority)
+	return nil
+}
+
+// setPriority changes the priority of an item queued in memory on the route.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) setPriority(r *route, item *Item, priority int64) {
+	item.priority = priority
+	r.queue.Fix(item.index)
+	pq.emit(updateOp(r.name, item))
+}
+
+// UpdateCommand is the command "update".
+// "update <id> <priority>" changes the priority of the queued item with the identifier returned by push.
+type UpdateCommand struct {
+	ArgsCommand
+}
+
+func (c *UpdateCommand) Name() string {
+	return "update"
+}
+
+func (c *UpdateCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	priority, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	if err = PqFromContext(ctx).UpdatePriority(id, priority); err != nil {
+		return err
+	}
+	return writer.WriteStatus(OK)
+}
+
+func NewUpdateCommand(args []string) (Command, error) {
+	if len(args) != 2 {
+		return nil, &WrongArityError{"update"}
+	}
+	cmd := &UpdateCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+func init() {
+	commandLibraries["update"] = NewUpdateCommand
+}
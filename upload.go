@@ -0,0 +1,124 @@
+package khronos
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// snapshotUploadTimeout is how long the upload of a snapshot may take before it is given up.
+const snapshotUploadTimeout = 10 * time.Minute
+
+// Uploader uploads the snapshots of the queue to an object store, such as S3, see Server.Uploader.
+type Uploader interface {
+	// Upload stores the snapshot read from r under name, and returns once it is stored.
+	// The snapshot is in the format of the append-only files, see CheckAppendOnlyFile.
+	Upload(ctx context.Context, name string, r io.Reader) error
+}
+
+// snapshotUploads is the state of the uploads of the snapshots of a server, see Server.Uploader.
+type snapshotUploads struct {
+	mu       sync.Mutex
+	running  bool       // whether an upload is in progress.
+	pending  bool       // whether a snapshot completed during the upload, it is uploaded next.
+	done     *sync.Cond // signaled when an upload ends without another one pending, see wait.
+	uploads  int        // number of snapshots uploaded.
+	failures int        // number of uploads which failed.
+	lastErr  error      // error of the last upload, nil if it succeeded.
+	lastName string     // name of the last snapshot uploaded.
+}
+
+// uploadSnapshot uploads the snapshot of storage in the background, if Server.Uploader is set.
+// The snapshots completed during an upload are coalesced into a single upload following it.
+func (srv *Server) uploadSnapshot(storage Storage) {
+	if srv.Uploader == nil {
+		return
+	}
+	u := &srv.uploads
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.running {
+		u.pending = true
+		return
+	}
+	u.running = true
+	go srv.runUploads(storage)
+}
+
+// runUploads uploads snapshots of storage until none is pending.
+func (srv *Server) runUploads(storage Storage) {
+	u := &srv.uploads
+	for {
+		name := srv.UploadPrefix + time.Now().UTC().Format("20060102T150405.000Z") + ".aof"
+		err := srv.upload(storage, name)
+		if err != nil {
+			srv.logger().Error("khronos: snapshot upload failed", "name", name, "error", err)
+		} else {
+			srv.logger().Info("khronos: snapshot uploaded", "name", name)
+		}
+
+		u.mu.Lock()
+		u.lastErr = err
+		if err != nil {
+			u.failures++
+		} else {
+			u.uploads++
+			u.lastName = name
+		}
+		if !u.pending {
+			u.running = false
+			if u.done != nil {
+				u.done.Broadcast()
+			}
+			u.mu.Unlock()
+			return
+		}
+		u.pending = false
+		u.mu.Unlock()
+	}
+}
+
+// upload streams a snapshot of storage to Server.Uploader under name.
+func (srv *Server) upload(storage Storage, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotUploadTimeout)
+	defer cancel()
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(storage.Snapshot(w))
+	}()
+	err := srv.Uploader.Upload(ctx, name, r)
+	// unblock the snapshot if the uploader did not read it all.
+	r.CloseWithError(io.ErrClosedPipe)
+	return err
+}
+
+// wait blocks until no upload is in progress.
+func (u *snapshotUploads) wait() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.done == nil {
+		u.done = sync.NewCond(&u.mu)
+	}
+	for u.running {
+		u.done.Wait()
+	}
+}
+
+// fields returns the "info persistence" lines of the uploads.
+func (u *snapshotUploads) fields() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	status := "ok"
+	if u.lastErr != nil {
+		status = "err"
+	}
+	return []string{
+		"snapshot_upload_in_progress:" + strconv.Itoa(btoi(u.running)),
+		"snapshot_uploads:" + strconv.Itoa(u.uploads),
+		"snapshot_upload_failures:" + strconv.Itoa(u.failures),
+		"snapshot_last_upload_status:" + status,
+		"snapshot_last_upload:" + u.lastName,
+	}
+}
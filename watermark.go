@@ -0,0 +1,48 @@
+package khronos
+
+import (
+	"sync/atomic"
+)
+
+// watermark sends EventHighWatermark when the route reaches RouteConfig.HighWatermark items,
+// and EventLowWatermark when it then goes back to RouteConfig.LowWatermark items.
+// It must be called with queueLock held, after the length of the route changed.
+func (pq *PriorityQueueWithRouting) watermark(r *route) {
+	n := r.size()
+	switch {
+	case !r.aboveHigh && r.config.HighWatermark > 0 && n >= r.config.HighWatermark:
+		r.aboveHigh = true
+		pq.notifyLength(EventHighWatermark, r, n)
+	case r.aboveHigh && (n <= r.config.LowWatermark || r.config.HighWatermark <= 0):
+		r.aboveHigh = false
+		pq.notifyLength(EventLowWatermark, r, n)
+	}
+}
+
+// notifyLength sends an event about the length of the route, if events are enabled.
+// It must be called with queueLock held.
+func (pq *PriorityQueueWithRouting) notifyLength(kind EventKind, r *route, n int) {
+	if pq.events == nil {
+		return
+	}
+	select {
+	case pq.events <- Event{Kind: kind, Route: r.name, Length: n, Time: pq.now()}:
+	default:
+		atomic.AddUint64(&pq.eventsDropped, 1)
+	}
+}
+
+// AboveHighWatermark returns the length of the routes which reached their RouteConfig.HighWatermark
+// and did not go back to their RouteConfig.LowWatermark yet.
+func (pq *PriorityQueueWithRouting) AboveHighWatermark() map[string]int {
+	pq.queueLock.Lock()
+	defer pq.queueLock.Unlock()
+
+	above := make(map[string]int)
+	for name, r := range pq.routes {
+		if r.aboveHigh && !isGroupRoute(name) {
+			above[name] = r.size()
+		}
+	}
+	return above
+}
@@ -0,0 +1,286 @@
+package khronos
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	// websocketGUID is the magic string of the WebSocket handshake, see RFC 6455.
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// maxWebSocketMessage bounds the messages sent by the WebSocket consumers, which are only acks.
+	maxWebSocketMessage = 1 << 16
+	// maxWebSocketPrefetch bounds the number of unacknowledged items of a WebSocket consumer.
+	maxWebSocketPrefetch = 1024
+)
+
+// WebSocket opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+var errWebSocketMessageTooLarge = errors.New("websocket message too large")
+
+// wsConn is the server side of a WebSocket connection.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex // serializes the writes.
+}
+
+// upgradeWebSocket performs the WebSocket handshake of r and takes over its connection.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return nil, errors.New("not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection does not support websocket")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	_, err = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeFrame writes a single unmasked frame, as servers do.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return writeWebSocketFrame(c.conn, opcode, payload, nil)
+}
+
+// writeWebSocketFrame writes a final frame, masked with mask if it is not nil.
+func writeWebSocketFrame(w io.Writer, opcode byte, payload []byte, mask []byte) error {
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	if mask != nil {
+		header[1] |= 0x80
+		header = append(header, mask...)
+		masked := make([]byte, len(payload))
+		for i := range payload {
+			masked[i] = payload[i] ^ mask[i%4]
+		}
+		payload = masked
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readWebSocketFrame reads a frame, unmasking its payload.
+func readWebSocketFrame(r *bufio.Reader, limit int) (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode = head[0]&0x80 != 0, head[0]&0x0f
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > uint64(limit) {
+		return false, 0, nil, errWebSocketMessageTooLarge
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(r, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// readMessage returns the next text or binary message, answering the pings on the way.
+// It returns io.EOF when the client closes the connection.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := readWebSocketFrame(c.r, maxWebSocketMessage)
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			if err = c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			_ = c.writeFrame(wsClose, payload)
+			return nil, io.EOF
+		case wsText, wsBinary, wsContinuation:
+			message = append(message, payload...)
+			if len(message) > maxWebSocketMessage {
+				return nil, errWebSocketMessageTooLarge
+			}
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *wsConn) close() {
+	_ = c.conn.Close()
+}
+
+// serveWebSocket streams the items of route to a WebSocket consumer.
+// Each item is sent as a text message {"id": ..., "value": ..., "priority": ...},
+// and must be acknowledged with a message {"ack": <id>}.
+// At most prefetch items are sent without being acknowledged, and the items which are not
+// acknowledged when the connection closes are enqueued again.
+func (srv *Server) serveWebSocket(ctx context.Context, ws *wsConn, route string, prefetch int) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer ws.close()
+
+	var mu sync.Mutex
+	inflight := make(map[uint64]*Item)
+	acked := make(chan struct{}, 1)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, item := range inflight {
+			srv.Queue.Enqueue(route, item.Clone())
+		}
+	}()
+
+	go func() {
+		// the reader ends the consumer when the client goes away.
+		defer cancel()
+		for {
+			message, err := ws.readMessage()
+			if err != nil {
+				return
+			}
+			var ack struct {
+				Ack uint64 `json:"ack"`
+			}
+			if json.Unmarshal(message, &ack) != nil {
+				continue
+			}
+			mu.Lock()
+			_, ok := inflight[ack.Ack]
+			delete(inflight, ack.Ack)
+			mu.Unlock()
+			if ok {
+				select {
+				case acked <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	for {
+		mu.Lock()
+		full := len(inflight) >= prefetch
+		mu.Unlock()
+		if full {
+			select {
+			case <-acked:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		item, err := srv.Queue.DequeueContext(ctx, route)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		inflight[item.id] = item
+		mu.Unlock()
+		delivery := map[string]any{"id": item.id, "value": item.value, "priority": item.priority}
+		if len(item.headers) > 0 {
+			delivery["headers"] = item.headers
+		}
+		message, _ := json.Marshal(delivery)
+		if err = ws.writeFrame(wsText, message); err != nil {
+			return
+		}
+	}
+}
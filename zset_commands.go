@@ -0,0 +1,198 @@
+package khronos
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RegisterSortedSetCommands registers a wire-compatible subset of the Redis sorted set commands
+// used as priority queues: zadd, zpopmax, bzpopmax and zcard.
+//
+// The commands operate on ordinary khronos routes, the score of a member being the priority of an item:
+// zadd pushes, zpopmax and bzpopmax pop in dequeue order, the highest score first unless the route
+// is configured with "order asc", and zcard replies with the length of the route.
+// Unlike in a sorted set, the members are not unique: adding a member twice queues it twice.
+// zpopmax and bzpopmax reply WRONGTYPE on the routes with consumer groups or with DeliveryAtLeastOnce.
+// The scores are integers, such as Unix timestamps.
+// It lets job libraries built on Redis sorted sets point at khronos while they migrate to the native commands.
+// RegisterSortedSetCommands must be called before the server starts serving.
+func RegisterSortedSetCommands() {
+	RegisterCommand("zadd", NewZAddCommand)
+	RegisterCommandInfo("zadd", CommandInfo{Arity: -4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1})
+	RegisterCommand("zpopmax", NewZPopMaxCommand)
+	RegisterCommandInfo("zpopmax", CommandInfo{Arity: -2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1})
+	RegisterCommand("bzpopmax", NewBZPopMaxCommand)
+	RegisterCommandInfo("bzpopmax", CommandInfo{Arity: -3, Flags: FlagWrite | FlagBlocking, FirstKey: 1, LastKey: -2, Step: 1})
+	RegisterCommand("zcard", NewLengthCommand)
+	RegisterCommandInfo("zcard", CommandInfo{Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1})
+}
+
+// parseScore returns the priority of a sorted set score, which must be an integer.
+func parseScore(score string) (int64, error) {
+	if priority, err := strconv.ParseInt(score, 10, 64); err == nil {
+		return priority, nil
+	}
+	// "1.7e9" or "1700000000.0", as sent by clients formatting the scores as floats.
+	f, err := strconv.ParseFloat(score, 64)
+	if err != nil || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, errNotInteger
+	}
+	return int64(f), nil
+}
+
+// checkSortedSet returns ErrWrongType if the sorted set pops do not apply to the route:
+// a route with consumer groups, or with DeliveryAtLeastOnce whose items are confirmed
+// by an identifier the replies do not carry.
+func checkSortedSet(pq *PriorityQueueWithRouting, key string) error {
+	if pq.hasGroups(key) || pq.RouteConfig(key).Delivery == DeliveryAtLeastOnce {
+		return ErrWrongType
+	}
+	return nil
+}
+
+// ZAddCommand is the command "zadd".
+// "zadd <route> <score> <member> [<score> <member>...]" pushes the members with their scores as priorities,
+// and replies with the number of members pushed. The options of the Redis ZADD are not supported.
+type ZAddCommand struct {
+	ArgsCommand
+}
+
+func (c *ZAddCommand) Name() string {
+	return "zadd"
+}
+
+func (c *ZAddCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	key := args[0]
+	items := make([]*Item, 0, (len(args)-1)/2)
+	for i := 1; i < len(args); i += 2 {
+		priority, err := parseScore(args[i])
+		if err != nil {
+			return err
+		}
+		items = append(items, NewItem(args[i+1], priority))
+	}
+	pq := PqFromContext(ctx)
+	if err := pq.Throttle(key); err != nil {
+		return err
+	}
+	if err := ServerFromContext(ctx).reserveMemory(pq, key, items...); err != nil {
+		return err
+	}
+	pq.EnqueueBatch(key, items)
+	return writer.WriteInt64(int64(len(items)))
+}
+
+func NewZAddCommand(args []string) (Command, error) {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return nil, &WrongArityError{"zadd"}
+	}
+	cmd := &ZAddCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+// ZPopMaxCommand is the command "zpopmax".
+// "zpopmax <route> [<count>]" removes up to count items, 1 by default, without blocking,
+// and replies with an array of their values each followed by its priority, empty if the route is empty.
+type ZPopMaxCommand struct {
+	ArgsCommand
+}
+
+func (c *ZPopMaxCommand) Name() string {
+	return "zpopmax"
+}
+
+func (c *ZPopMaxCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	key := args[0]
+	count := 1
+	if len(args) == 2 {
+		var err error
+		if count, err = strconv.Atoi(args[1]); err != nil || count < 0 {
+			return errNotInteger
+		}
+	}
+	pq := PqFromContext(ctx)
+	if err := pq.Throttle(key); err != nil {
+		return err
+	}
+	if err := checkSortedSet(pq, key); err != nil {
+		return err
+	}
+	items := pq.TryDequeueN(key, count)
+	reply := make([]any, 0, 2*len(items))
+	for _, item := range items {
+		reply = append(reply, item.value, strconv.FormatInt(item.priority, 10))
+	}
+	return WriteValue(writer, reply)
+}
+
+func NewZPopMaxCommand(args []string) (Command, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, &WrongArityError{"zpopmax"}
+	}
+	cmd := &ZPopMaxCommand{}
+	cmd.args = args
+	return cmd, nil
+}
+
+// BZPopMaxCommand is the command "bzpopmax".
+// "bzpopmax <route> [<route>...] <timeout>" removes an item from the first non-empty route, waiting for one
+// for up to timeout seconds, zero waiting forever. The server replies with an array of the route, the value
+// and the priority, or with a null array if the timeout expired.
+type BZPopMaxCommand struct {
+	ArgsCommand
+	timeout time.Duration
+}
+
+func (c *BZPopMaxCommand) Name() string {
+	return "bzpopmax"
+}
+
+func (c *BZPopMaxCommand) Execute(ctx context.Context, writer ResponseWriter) error {
+	args := c.Args()
+	keys := args[:len(args)-1]
+	pq := PqFromContext(ctx)
+	for _, key := range keys {
+		if err := pq.Throttle(key); err != nil {
+			return err
+		}
+		if err := checkSortedSet(pq, key); err != nil {
+			return err
+		}
+	}
+	waitCtx := ctx
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = withTimeout(ctx, clockFromContext(ctx), c.timeout)
+		defer cancel()
+	}
+	unblock := markBlocked(ctx, strings.Join(keys, ","))
+	key, item, err := pq.DequeueAny(waitCtx, keys...)
+	unblock()
+	if err != nil {
+		if errors.Is(context.Cause(waitCtx), context.DeadlineExceeded) && ctx.Err() == nil {
+			return writeNilArray(writer)
+		}
+		return err
+	}
+	return writer.WriteArray([]string{key, item.value, strconv.FormatInt(item.priority, 10)})
+}
+
+func NewBZPopMaxCommand(args []string) (Command, error) {
+	if len(args) < 2 {
+		return nil, &WrongArityError{"bzpopmax"}
+	}
+	seconds, err := strconv.ParseFloat(args[len(args)-1], 64)
+	if err != nil || seconds < 0 {
+		return nil, errTimeoutNotValid
+	}
+	cmd := &BZPopMaxCommand{timeout: time.Duration(seconds * float64(time.Second))}
+	cmd.args = args
+	return cmd, nil
+}